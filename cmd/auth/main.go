@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"syscall"
@@ -16,17 +17,26 @@ func main() {
 
 	log := logger.NewLogger(cfg.Env)
 
-	application := app.New(log, cfg.GRPC.Port, cfg.StoragePath, cfg.GRPC.TokenTTL, cfg.GRPC.SecretKey)
+	application := app.New(log, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	go func() {
 		application.GRPCSrv.MustStart()
 	}()
+	go func() {
+		application.HTTPSrv.MustStart()
+	}()
+	go application.Activity.RunRetention(ctx)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	<-sigChan
 
+	cancel()
+	application.HTTPSrv.Stop()
 	application.GRPCSrv.Stop()
 	log.Info("Gracefully stopped")
 
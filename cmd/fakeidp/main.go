@@ -0,0 +1,35 @@
+// fakeidp runs a local OpenID Connect provider for trying the social login without a real one:
+//
+//	go run ./cmd/fakeidp -addr :9000 -users alice@example.com,bob@example.com
+//
+// and configure a social provider with the issuer http://localhost:9000
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"vieo/auth/internal/lib/oidc/fakeidp"
+)
+
+func main() {
+	addr := flag.String("addr", ":9000", "listen address")
+	issuer := flag.String("issuer", "http://localhost:9000", "issuer, the public base URL")
+	users := flag.String("users", "user@example.com", "comma separated emails of the accounts, all verified")
+	flag.Parse()
+
+	accounts := make([]fakeidp.User, 0)
+	for _, email := range strings.Split(*users, ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			accounts = append(accounts, fakeidp.User{Email: email, EmailVerified: true})
+		}
+	}
+	idp, err := fakeidp.New(*issuer, accounts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("fake identity provider %s listening on %s", *issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, idp))
+}
@@ -1,34 +1,526 @@
 package app
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 	grpcapp "vieo/auth/internal/app/grpc"
+	httpapp "vieo/auth/internal/app/http"
+	"vieo/auth/internal/config"
+	"vieo/auth/internal/domain/models"
+	authgrpc "vieo/auth/internal/grpc/auth"
+	oauthhttp "vieo/auth/internal/http/oauth"
+	samlhttp "vieo/auth/internal/http/saml"
+	"vieo/auth/internal/lib/jwt"
 	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/notifier"
+	"vieo/auth/internal/lib/oidc"
+	"vieo/auth/internal/lib/ratelimit"
+	"vieo/auth/internal/lib/samlsp"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/services/access"
+	"vieo/auth/internal/services/activity"
 	"vieo/auth/internal/services/auth"
+	"vieo/auth/internal/services/clients"
+	"vieo/auth/internal/services/directory"
+	"vieo/auth/internal/services/entitlements"
+	"vieo/auth/internal/services/guests"
+	"vieo/auth/internal/services/households"
+	"vieo/auth/internal/services/oauth"
+	"vieo/auth/internal/services/orgs"
+	"vieo/auth/internal/services/pat"
+	"vieo/auth/internal/services/profiles"
+	"vieo/auth/internal/services/qrlogin"
+	"vieo/auth/internal/services/rebac"
+	"vieo/auth/internal/services/risk"
+	"vieo/auth/internal/services/saml"
+	"vieo/auth/internal/services/security"
+	"vieo/auth/internal/services/social"
+	"vieo/auth/internal/services/streams"
 	postgre "vieo/auth/internal/storage/postgres"
 )
 
 type App struct {
-	GRPCSrv *grpcapp.App
+	GRPCSrv  *grpcapp.App
+	HTTPSrv  *httpapp.App
+	Activity *activity.Activity
 }
 
 func New(
 	log *logger.Logger,
-	grpcPort int,
-	storagePath string,
-	tokenTTL time.Duration,
-	secretKey string,
+	cfg *config.Config,
 ) *App {
 
-	storage, err := postgre.New(storagePath)
+	storage, err := postgre.New(cfg.StoragePath)
 	if err != nil {
 		panic(err)
 	}
-	authService := auth.New(log, storage, storage, storage, storage, tokenTTL, secretKey)
+	activityService := activity.New(
+		log,
+		storage,
+		storage,
+		storage,
+		cfg.SecurityEvents.Retention,
+		cfg.SecurityEvents.PruneInterval,
+	)
+	notify := newNotifier(log, cfg.Notifier)
+	securityService := security.New(
+		log,
+		storage,
+		storage,
+		storage,
+		activityService,
+		notify,
+		cfg.GRPC.SecretKey,
+		cfg.Notifier.LinkTTL,
+		cfg.Notifier.ReportDeviceURL,
+		cfg.Notifier.ResetPasswordURL,
+	)
+	lockout := security.NewLockout(
+		log,
+		storage,
+		activityService,
+		notify,
+		security.LockoutPolicy{
+			BackoffAfter: cfg.Lockout.BackoffAfter,
+			BaseDelay:    cfg.Lockout.BaseDelay,
+			MaxDelay:     cfg.Lockout.MaxDelay,
+			LockAfter:    cfg.Lockout.LockAfter,
+			LockDuration: cfg.Lockout.LockDuration,
+			ResetAfter:   cfg.Lockout.ResetAfter,
+		},
+		cfg.GRPC.SecretKey,
+		cfg.Notifier.LinkTTL,
+		cfg.Notifier.UnlockAccountURL,
+	)
+	detector := risk.NewDetector(risk.Thresholds{
+		Window:              cfg.Risk.Window,
+		IPFailures:          cfg.Risk.IPFailures,
+		SubnetFailures:      cfg.Risk.SubnetFailures,
+		IPAccounts:          cfg.Risk.IPAccounts,
+		SubnetAccounts:      cfg.Risk.SubnetAccounts,
+		IPRegistrations:     cfg.Risk.IPRegistrations,
+		SubnetRegistrations: cfg.Risk.SubnetRegistrations,
+		FlagFor:             cfg.Risk.FlagFor,
+	})
+	accessService := access.New(log, storage, storage, activityService)
+	tenants := mustTenants(cfg)
+	// role assignments belong to the users of one tenant, each tenant bootstraps its own admins
+	for _, t := range tenants.All() {
+		accessService.BootstrapAdmins(tenant.NewContext(context.Background(), t), t.Admins)
+	}
+	profilesService := profiles.New(log, storage, cfg.Profiles.MaxProfiles, profiles.PINPolicy{
+		MaxFailures: cfg.Profiles.PINMaxFailures,
+		LockFor:     cfg.Profiles.PINLockFor,
+	})
+	authService := auth.New(
+		log,
+		storage,
+		storage,
+		storage,
+		storage,
+		activityService,
+		securityService,
+		lockout,
+		detector,
+		newChallengeVerifier(log, storage, notify, cfg.Risk, cfg.GRPC.SecretKey),
+		storage,
+		storage,
+		profilesService,
+		storage,
+		newEntitlements(log, cfg.Entitlements),
+		accessService,
+		directories(log, cfg.LDAP),
+		cfg.GRPC.TokenTTL,
+		cfg.GRPC.SecretKey,
+		cfg.EnumerationProtection,
+	)
+	clientsService := clients.New(
+		log,
+		storage,
+		cfg.GRPC.SecretKey,
+		cfg.GRPC.TokenTTL,
+		tokenURL(cfg.HTTP.Issuer),
+	)
+	rebacService := rebac.New(log, storage, storage, mustLoadNamespaces(cfg.Rebac.NamespacesPath))
+	oauthService := oauth.New(
+		log,
+		storage,
+		clientsService,
+		authService,
+		accessService,
+		storage,
+		storage,
+		storage,
+		storage,
+		storage,
+		authService,
+		oauth.OIDC{
+			Issuer: cfg.HTTP.Issuer,
+			Signer: mustSigner(log, cfg.OAuth.SigningKeyPath),
+		},
+		cfg.GRPC.SecretKey,
+		cfg.GRPC.TokenTTL,
+		oauth.Lifetimes{
+			Code:    cfg.OAuth.CodeTTL,
+			Refresh: cfg.OAuth.RefreshTTL,
+			Consent: cfg.OAuth.ConsentTTL,
+		},
+		oauth.DeviceFlow{
+			VerificationURI: verificationURI(cfg),
+			CodeTTL:         cfg.OAuth.DeviceCodeTTL,
+			Interval:        cfg.OAuth.DeviceInterval,
+		},
+	)
+	samlService := saml.New(log, samlConnections(cfg.SAML), storage, storage, authService, cfg.SAML.RequestTTL)
+	// the gRPC methods and the HTTP routes take their tokens from the same buckets backend
+	limiter := newLimiter(storage, cfg.RateLimit)
 	// secret key on two levels transport and service!
-	grpcApp := grpcapp.New(log, authService, grpcPort, secretKey)
+	grpcApp := grpcapp.New(
+		log,
+		authgrpc.Services{
+			Auth:     authService,
+			Activity: activityService,
+			Security: securityService,
+			Lockout:  lockout,
+			Access:   accessService,
+			Orgs:     orgs.New(log, storage, activityService, cfg.Organizations.MaxDevices),
+			Tokens: pat.New(
+				log,
+				storage,
+				storage,
+				activityService,
+				cfg.PersonalTokens.DefaultTTL,
+				cfg.PersonalTokens.MaxTTL,
+			),
+			Clients:  clientsService,
+			Devices:  oauthService,
+			QRLogin:  qrlogin.New(log, storage, authService, cfg.QRLogin.TTL, cfg.QRLogin.PollInterval),
+			Profiles: profilesService,
+			Households: households.New(
+				log,
+				storage,
+				cfg.Households.MaxMembers,
+				cfg.Households.MaxDevices,
+			),
+			Streams: streams.New(log, storage, streamPolicy(cfg.Streams)),
+			Guests: guests.New(log, storage, authService, cfg.GRPC.SecretKey, guests.Policy{
+				Scopes:    cfg.Guests.Scopes,
+				TokenTTL:  cfg.Guests.TokenTTL,
+				RetainFor: cfg.Guests.RetainFor,
+			}),
+			Social: social.New(
+				log,
+				socialProviders(cfg.Social),
+				storage,
+				storage,
+				authService,
+				cfg.Social.StateTTL,
+			),
+			SAML: samlService,
+		},
+		rebacService,
+		cfg.GRPC.Port,
+		cfg.GRPC.SecretKey,
+		cfg.Authorization.Methods,
+		cfg.Authorization.ClientMethods,
+		cfg.Authorization.PersonalTokenMethods,
+		limiter,
+		methodLimits(cfg.RateLimit),
+		tenants,
+	)
+
+	mux := http.NewServeMux()
+	oauthhttp.Register(mux, log, tenants, oauthhttp.Services{
+		Clients: clientsService,
+		OAuth:   oauthService,
+	}, oauthhttp.Limits{
+		Limiter: limiter,
+		Routes:  routeLimits(cfg.RateLimit),
+	})
+	samlhttp.Register(mux, log, samlService)
 
 	return &App{
-		GRPCSrv: grpcApp,
+		GRPCSrv:  grpcApp,
+		HTTPSrv:  httpapp.New(log, cfg.HTTP.Port, mux),
+		Activity: activityService,
+	}
+}
+
+// tokenURL is the token endpoint of the issuer, empty when the issuer is not configured
+func tokenURL(issuer string) string {
+	if issuer == "" {
+		return ""
+	}
+	return strings.TrimSuffix(issuer, "/") + "/token"
+}
+
+// verificationURI is the page where the user enters the code shown on the device
+func verificationURI(cfg *config.Config) string {
+	if cfg.OAuth.VerificationURI != "" {
+		return cfg.OAuth.VerificationURI
+	}
+	return strings.TrimSuffix(cfg.HTTP.Issuer, "/") + "/device"
+}
+
+func mustSigner(log *logger.Logger, path string) *jwt.Signer {
+	if path == "" {
+		log.Warn("no signing key configured, ID tokens will not verify after a restart")
+		signer, err := jwt.GenerateSigner()
+		if err != nil {
+			panic(err)
+		}
+		return signer
+	}
+	signer, err := jwt.LoadSigner(path)
+	if err != nil {
+		panic(err)
+	}
+	return signer
+}
+
+func newNotifier(log *logger.Logger, cfg config.NotifierConfig) notifier.Notifier {
+	switch cfg.Kind {
+	case "smtp":
+		return notifier.NewSMTP(cfg.SMTP.Host, cfg.SMTP.Port, cfg.SMTP.Username, cfg.SMTP.Password, cfg.SMTP.From)
+	case "log":
+		return notifier.NewLog(log)
+	default:
+		panic("unknown notifier kind: " + cfg.Kind)
+	}
+}
+
+func newChallengeVerifier(
+	log *logger.Logger,
+	storage *postgre.Storage,
+	notify notifier.Notifier,
+	cfg config.RiskConfig,
+	secretKey string,
+) risk.ChallengeVerifier {
+	switch cfg.Challenge {
+	case risk.ChallengeProofOfWork:
+		return risk.NewProofOfWork(storage, secretKey, cfg.PoWBits, cfg.PoWTTL)
+	case risk.ChallengeEmailOTP:
+		return risk.NewEmailOTP(log, storage, storage, notify, cfg.OTPTTL)
+	case risk.ChallengeCaptcha:
+		return risk.NewCaptcha(log, cfg.Captcha.VerifyURL, cfg.Captcha.Secret, cfg.Captcha.SiteKey)
+	default:
+		panic("unknown challenge: " + cfg.Challenge)
+	}
+}
+
+func newEntitlements(log *logger.Logger, cfg config.EntitlementsConfig) entitlements.Provider {
+	var provider entitlements.Provider = entitlements.NewStatic(models.Entitlements{}, nil)
+	if cfg.StaticPath != "" {
+		static, err := entitlements.LoadStatic(cfg.StaticPath)
+		if err != nil {
+			panic(err)
+		}
+		provider = static
+	}
+	if cfg.CacheTTL <= 0 {
+		return provider
+	}
+	return entitlements.NewCached(log, provider, cfg.CacheTTL)
+}
+
+// directories are the credential backends Login checks before the local users
+func directories(log *logger.Logger, cfg config.LDAPConfig) []auth.CredentialBackend {
+	if cfg.URL == "" {
+		return nil
+	}
+	// a directory answering for every email would be asked for each customer login
+	if len(cfg.Domains) == 0 {
+		panic("ldap domains are not configured")
+	}
+	return []auth.CredentialBackend{directory.New(log, directory.Config{
+		Domains:         cfg.Domains,
+		URL:             cfg.URL,
+		StartTLS:        cfg.StartTLS,
+		BindDN:          cfg.BindDN,
+		BindPassword:    cfg.BindPassword,
+		BaseDN:          cfg.BaseDN,
+		UserFilter:      cfg.UserFilter,
+		UserDNTemplates: cfg.UserDNTemplates,
+		GroupBaseDN:     cfg.GroupBaseDN,
+		GroupFilter:     cfg.GroupFilter,
+		GroupRoles:      cfg.GroupRoles,
+		Timeout:         cfg.Timeout,
+	})}
+}
+
+func streamPolicy(cfg config.StreamsConfig) streams.Policy {
+	policy := streams.Policy{
+		MaxStreams: cfg.MaxStreams,
+		Timeout:    cfg.HeartbeatTimeout,
+	}
+	switch cfg.OnLimit {
+	case "reject":
+	case "kick_oldest":
+		policy.KickOldest = true
+	default:
+		panic("unknown stream limit action: " + cfg.OnLimit)
+	}
+	return policy
+}
+
+func socialProviders(cfg config.SocialConfig) map[string]social.Provider {
+	client := &http.Client{Timeout: 10 * time.Second}
+	providers := make(map[string]social.Provider, len(cfg.Providers))
+	for name, p := range cfg.Providers {
+		providers[name] = oidc.NewClient(oidc.Config{
+			Issuer:       p.Issuer,
+			ClientID:     p.ClientID,
+			ClientSecret: p.ClientSecret,
+			RedirectURL:  p.RedirectURL,
+			Scopes:       p.Scopes,
+		}, client)
+	}
+	return providers
+}
+
+// samlConnections are the identity providers by connection name, all with the key pair of the service provider
+func samlConnections(cfg config.SAMLConfig) map[string]saml.Connection {
+	connections := make(map[string]saml.Connection, len(cfg.Connections))
+	if len(cfg.Connections) == 0 {
+		return connections
+	}
+	key, cert, err := samlsp.LoadKeyPair(cfg.CertificatePath, cfg.KeyPath)
+	if err != nil {
+		panic(err)
+	}
+	for name, c := range cfg.Connections {
+		idpMetadata, err := os.ReadFile(c.IDPMetadataPath)
+		if err != nil {
+			panic(err)
+		}
+		metadataURL := strings.TrimSuffix(cfg.BaseURL, "/") + "/saml/" + name + "/metadata"
+		sp, err := samlsp.NewClient(samlsp.Config{
+			EntityID:    metadataURL,
+			MetadataURL: metadataURL,
+			ACSURL:      c.ACSURL,
+			IDPMetadata: idpMetadata,
+			Key:         key,
+			Certificate: cert,
+		})
+		if err != nil {
+			panic(fmt.Errorf("saml connection %s: %w", name, err))
+		}
+		connections[name] = saml.Connection{
+			SP:           sp,
+			Attributes:   c.Attributes,
+			Domains:      c.Domains,
+			LinkExisting: c.LinkExisting,
+		}
+	}
+	return connections
+}
+
+func mustLoadNamespaces(path string) rebac.Namespaces {
+	if path == "" {
+		return rebac.Namespaces{}
+	}
+	namespaces, err := rebac.LoadNamespaces(path)
+	if err != nil {
+		panic(err)
+	}
+	return namespaces
+}
+
+func mustTenants(cfg *config.Config) *tenant.Registry {
+	if !cfg.Tenants.Enabled {
+		registry, err := tenant.NewRegistry([]tenant.Tenant{{
+			ID:        tenant.DefaultID,
+			SecretKey: cfg.GRPC.SecretKey,
+			TokenTTL:  cfg.GRPC.TokenTTL,
+			Password:  regexp.MustCompile(tenant.DefaultPasswordPattern),
+			Admins:    cfg.Authorization.Admins,
+		}}, tenant.DefaultID)
+		if err != nil {
+			panic(err)
+		}
+		return registry
+	}
+
+	tenants := make([]tenant.Tenant, 0, len(cfg.Tenants.Tenants))
+	for id, t := range cfg.Tenants.Tenants {
+		ttl := t.TokenTTL
+		if ttl == 0 {
+			ttl = cfg.GRPC.TokenTTL
+		}
+		pattern := t.PasswordPattern
+		if pattern == "" {
+			pattern = tenant.DefaultPasswordPattern
+		}
+		admins := t.Admins
+		if id == tenant.DefaultID {
+			admins = slices.Concat(cfg.Authorization.Admins, t.Admins)
+		}
+		tenants = append(tenants, tenant.Tenant{
+			ID:        id,
+			Hosts:     t.Hosts,
+			SecretKey: t.SecretKey,
+			TokenTTL:  ttl,
+			Password:  regexp.MustCompile(pattern),
+			Admins:    admins,
+		})
 	}
+	registry, err := tenant.NewRegistry(tenants, cfg.Tenants.Default)
+	if err != nil {
+		panic(err)
+	}
+	return registry
+}
+
+func newLimiter(storage *postgre.Storage, cfg config.RateLimitConfig) ratelimit.Limiter {
+	switch cfg.Backend {
+	case "memory":
+		return ratelimit.NewMemory()
+	case "postgres":
+		return ratelimit.NewShared(storage)
+	default:
+		panic("unknown rate limit backend: " + cfg.Backend)
+	}
+}
+
+func methodLimits(cfg config.RateLimitConfig) map[string]authgrpc.MethodLimits {
+	policy := func(p config.RateLimitPolicy) ratelimit.Policy {
+		return ratelimit.Policy{Limit: p.Limit, Per: p.Per, Burst: p.Burst}
+	}
+
+	limits := make(map[string]authgrpc.MethodLimits, len(cfg.Methods))
+	for method, m := range cfg.Methods {
+		limits[method] = authgrpc.MethodLimits{
+			Method: policy(m.Method),
+			IP:     policy(m.IP),
+			Email:  policy(m.Email),
+			Device: policy(m.Device),
+		}
+	}
+
+	return limits
+}
+
+// routeLimits are the policies of the HTTP routes, the config keys them by their mux pattern
+func routeLimits(cfg config.RateLimitConfig) map[string]oauthhttp.RouteLimits {
+	policy := func(p config.RateLimitPolicy) ratelimit.Policy {
+		return ratelimit.Policy{Limit: p.Limit, Per: p.Per, Burst: p.Burst}
+	}
+
+	limits := make(map[string]oauthhttp.RouteLimits, len(cfg.Methods))
+	for route, m := range cfg.Methods {
+		limits[route] = oauthhttp.RouteLimits{
+			Route:  policy(m.Method),
+			IP:     policy(m.IP),
+			Email:  policy(m.Email),
+			Client: policy(m.Client),
+		}
+	}
+
+	return limits
 }
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"net"
 	authgrpc "vieo/auth/internal/grpc/auth"
+	authzgrpc "vieo/auth/internal/grpc/authz"
 	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/ratelimit"
+	"vieo/auth/internal/lib/tenant"
 
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
@@ -19,14 +22,42 @@ type App struct {
 	secretKey  string
 }
 
-func New(log *logger.Logger, auth authgrpc.Auth, port int, secretKey string) *App {
+func New(
+	log *logger.Logger,
+	services authgrpc.Services,
+	rebac authzgrpc.Rebac,
+	port int,
+	secretKey string,
+	protectedMethods map[string][]string,
+	clientMethods []string,
+	personalTokenMethods []string,
+	limiter ratelimit.Limiter,
+	limits map[string]authgrpc.MethodLimits,
+	tenants *tenant.Registry,
+) *App {
 
-	interceptor := authgrpc.NewAuthInterceptor(secretKey, log)
+	interceptor := authgrpc.NewAuthInterceptor(secretKey, log, protectedMethods, clientMethods, personalTokenMethods, services.Tokens)
+	rateLimiter := authgrpc.NewRateLimitInterceptor(limiter, limits, log)
+	tenantResolver := authgrpc.NewTenantInterceptor(tenants, log)
 
 	gRPCServer := grpc.NewServer(
-		grpc.ChainUnaryInterceptor(interceptor.Logger(), interceptor.Authorize()),
+		grpc.ChainUnaryInterceptor(
+			interceptor.ClientInfo(),
+			tenantResolver.Resolve(),
+			interceptor.Logger(),
+			rateLimiter.Limit(),
+			interceptor.Authorize(),
+		),
+		grpc.ChainStreamInterceptor(
+			interceptor.ClientInfoStream(),
+			tenantResolver.ResolveStream(),
+			interceptor.LoggerStream(),
+			rateLimiter.LimitStream(),
+			interceptor.AuthorizeStream(),
+		),
 	)
-	authgrpc.Register(gRPCServer, auth)
+	authgrpc.Register(gRPCServer, services)
+	authzgrpc.Register(gRPCServer, rebac)
 
 	return &App{
 		log:        log,
@@ -0,0 +1,69 @@
+package httpapp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	"vieo/auth/internal/lib/logger"
+
+	"go.uber.org/zap"
+)
+
+const shutdownTime = 10 * time.Second
+
+// the application in which we wrap the http server of the OAuth endpoints
+
+type App struct {
+	log        *logger.Logger
+	httpServer *http.Server
+	port       int
+}
+
+func New(
+	log *logger.Logger,
+	port int,
+	handler http.Handler,
+) *App {
+	return &App{
+		log: log,
+		httpServer: &http.Server{
+			Addr:              fmt.Sprintf(":%d", port),
+			Handler:           handler,
+			ReadHeaderTimeout: 5 * time.Second,
+		},
+		port: port,
+	}
+}
+
+func (a *App) MustStart() {
+	if err := a.Start(); err != nil {
+		panic(err)
+	}
+}
+
+func (a *App) Start() error {
+	const op = "httpapp.Start"
+	log := a.log.With(zap.String("op", op), zap.Int("port", a.port))
+
+	log.Info("http server is running")
+
+	if err := a.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+func (a *App) Stop() {
+	const op = "httpapp.Stop"
+	log := a.log.With(zap.String("op", op))
+	log.Info("stopping http server", zap.Int("port", a.port))
+
+	// stops accepting new requests and finalizes old ones
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTime)
+	defer cancel()
+	if err := a.httpServer.Shutdown(ctx); err != nil {
+		log.Error("failed to stop http server", zap.Error(err))
+	}
+}
@@ -8,9 +8,34 @@ import (
 )
 
 type Config struct {
-	Env         string `yaml:"env" env-default:"prod"`
-	GRPC        GRPCConfig
-	StoragePath string `yaml:"storage_path" env-default:"./storage"`
+	Env            string `yaml:"env" env-default:"prod"`
+	GRPC           GRPCConfig
+	HTTP           HTTPConfig           `yaml:"http"`
+	OAuth          OAuthConfig          `yaml:"oauth"`
+	StoragePath    string               `yaml:"storage_path" env-default:"./storage"`
+	SecurityEvents SecurityEventsConfig `yaml:"security_events"`
+	Notifier       NotifierConfig       `yaml:"notifier"`
+	Lockout        LockoutConfig        `yaml:"lockout"`
+	RateLimit      RateLimitConfig      `yaml:"rate_limit"`
+	Risk           RiskConfig           `yaml:"risk"`
+	Authorization  AuthorizationConfig  `yaml:"authorization"`
+	Rebac          RebacConfig          `yaml:"rebac"`
+	Organizations  OrganizationsConfig  `yaml:"organizations"`
+	Tenants        TenantsConfig        `yaml:"tenants"`
+	PersonalTokens PersonalTokensConfig `yaml:"personal_tokens"`
+	QRLogin        QRLoginConfig        `yaml:"qr_login"`
+	Profiles       ProfilesConfig       `yaml:"profiles"`
+	Households     HouseholdsConfig     `yaml:"households"`
+	Entitlements   EntitlementsConfig   `yaml:"entitlements"`
+	Streams        StreamsConfig        `yaml:"streams"`
+	Guests         GuestsConfig         `yaml:"guests"`
+	Social         SocialConfig         `yaml:"social"`
+	LDAP           LDAPConfig           `yaml:"ldap"`
+	SAML           SAMLConfig           `yaml:"saml"`
+	// EnumerationProtection hides whether an email is registered: Login answers every credentials
+	// failure with the same error in the same time, Register always succeeds with user id 0
+	// and the owner of an existing email is notified instead
+	EnumerationProtection bool `yaml:"enumeration_protection" env-default:"false"`
 }
 
 type GRPCConfig struct {
@@ -20,6 +45,349 @@ type GRPCConfig struct {
 	SecretKey string        `yaml:"secret_key"`
 }
 
+// HTTPConfig is the server of the OAuth endpoints. Issuer is the public base URL of the service,
+// client assertions must be addressed to its token endpoint, Issuer + "/token"
+type HTTPConfig struct {
+	Port   int    `yaml:"port" env-default:"8080"`
+	Issuer string `yaml:"issuer"`
+}
+
+// OAuthConfig holds the lifetimes of the authorization code flow: the code, the refresh token
+// and the consent page after the user signed in. SigningKeyPath is the RSA private key (PEM)
+// of the OpenID Connect ID tokens, without it a key is generated at every start.
+// The device authorization grant shows VerificationURI to the user, the page of the front end
+// that calls VerifyDeviceCode, Issuer + "/device" when empty
+type OAuthConfig struct {
+	CodeTTL         time.Duration `yaml:"code_ttl" env-default:"1m"`
+	RefreshTTL      time.Duration `yaml:"refresh_ttl" env-default:"720h"`
+	ConsentTTL      time.Duration `yaml:"consent_ttl" env-default:"10m"`
+	SigningKeyPath  string        `yaml:"signing_key_path"`
+	DeviceCodeTTL   time.Duration `yaml:"device_code_ttl" env-default:"10m"`
+	DeviceInterval  time.Duration `yaml:"device_interval" env-default:"5s"`
+	VerificationURI string        `yaml:"verification_uri"`
+}
+
+// SecurityEventsConfig controls how long the login history is kept.
+// Zero retention keeps events forever
+type SecurityEventsConfig struct {
+	Retention     time.Duration `yaml:"retention" env-default:"2160h"`
+	PruneInterval time.Duration `yaml:"prune_interval" env-default:"24h"`
+}
+
+// NotifierConfig selects how users are notified: "smtp" sends emails, "log" only writes them to the log.
+// The URLs are frontend pages that receive the one-click link token in the "token" query parameter
+// and the tenant it was issued by in "tenant", to be sent back in the x-tenant-id metadata
+type NotifierConfig struct {
+	Kind             string        `yaml:"kind" env-default:"log"`
+	SMTP             SMTPConfig    `yaml:"smtp"`
+	LinkTTL          time.Duration `yaml:"link_ttl" env-default:"72h"`
+	ReportDeviceURL  string        `yaml:"report_device_url"`
+	ResetPasswordURL string        `yaml:"reset_password_url"`
+	UnlockAccountURL string        `yaml:"unlock_account_url"`
+}
+
+// LockoutConfig is the brute-force protection policy, see security.LockoutPolicy
+type LockoutConfig struct {
+	BackoffAfter int           `yaml:"backoff_after" env-default:"3"`
+	BaseDelay    time.Duration `yaml:"base_delay" env-default:"1s"`
+	MaxDelay     time.Duration `yaml:"max_delay" env-default:"5m"`
+	LockAfter    int           `yaml:"lock_after" env-default:"10"`
+	LockDuration time.Duration `yaml:"lock_duration" env-default:"1h"`
+	ResetAfter   time.Duration `yaml:"reset_after" env-default:"24h"`
+}
+
+// AuthorizationConfig maps full gRPC method names to the permissions the access token must grant.
+// A method listed with no permissions only needs a valid token, methods that are not listed are public.
+// The config defines the whole map, config/local.yaml ships the defaults; a config without
+// methods is refused rather than leaving every method public. ClientMethods are the protected
+// methods tokens issued to OAuth clients and service accounts may call, PersonalTokenMethods the
+// ones personal access tokens may call.
+// Admins get the admin role on the first start of the "default" tenant they are registered by,
+// as long as the tenant has no admin yet. The other tenants list their own in TenantConfig
+type AuthorizationConfig struct {
+	Methods              map[string][]string `yaml:"methods"`
+	ClientMethods        []string            `yaml:"client_methods"`
+	PersonalTokenMethods []string            `yaml:"personal_token_methods"`
+	Admins               []string            `yaml:"admins"`
+}
+
+// RebacConfig points to the namespace config of the relationship based authorization,
+// see rebac.ParseNamespaces. Without it no relation is declared and every check fails
+type RebacConfig struct {
+	NamespacesPath string `yaml:"namespaces_path"`
+}
+
+// OrganizationsConfig holds the device limit given to organizations created without one,
+// 0 is unlimited
+type OrganizationsConfig struct {
+	MaxDevices int `yaml:"max_devices" env-default:"0"`
+}
+
+// TenantsConfig turns on tenant isolation: every request is resolved to one of Tenants and
+// users, tokens and policies are scoped to it. Default is the tenant of requests that name none,
+// empty rejects them. Data created before isolation belongs to the tenant "default".
+// When isolation is off everything runs as "default" with the GRPC secret key and token TTL
+type TenantsConfig struct {
+	Enabled bool                    `yaml:"enabled" env-default:"false"`
+	Default string                  `yaml:"default"`
+	Tenants map[string]TenantConfig `yaml:"tenants"`
+}
+
+// TenantConfig is one tenant. Hosts are matched against the TLS server name and :authority,
+// a zero token TTL falls back to the GRPC one and an empty password pattern to the built-in policy.
+// Admins are bootstrapped in the tenant as Authorization.Admins are in "default"
+type TenantConfig struct {
+	Hosts           []string      `yaml:"hosts"`
+	SecretKey       string        `yaml:"secret_key"`
+	TokenTTL        time.Duration `yaml:"token_ttl"`
+	PasswordPattern string        `yaml:"password_pattern"`
+	Admins          []string      `yaml:"admins"`
+}
+
+// PersonalTokensConfig bounds the lifetime of personal access tokens, DefaultTTL applies
+// when the user does not choose one
+type PersonalTokensConfig struct {
+	DefaultTTL time.Duration `yaml:"default_ttl" env-default:"720h"`
+	MaxTTL     time.Duration `yaml:"max_ttl" env-default:"8760h"`
+}
+
+// QRLoginConfig holds how long a QR code can be scanned and how often the TV watching it is updated
+type QRLoginConfig struct {
+	TTL          time.Duration `yaml:"ttl" env-default:"2m"`
+	PollInterval time.Duration `yaml:"poll_interval" env-default:"1s"`
+}
+
+// ProfilesConfig bounds the viewer profiles of an account, 0 is unlimited, and the PIN guessing:
+// PINMaxFailures wrong PINs in a row lock the PIN of the profile for PINLockFor
+type ProfilesConfig struct {
+	MaxProfiles    int           `yaml:"max_profiles" env-default:"5"`
+	PINMaxFailures int           `yaml:"pin_max_failures" env-default:"5"`
+	PINLockFor     time.Duration `yaml:"pin_lock_for" env-default:"15m"`
+}
+
+// HouseholdsConfig bounds a new household: MaxMembers accounts besides the owner and MaxDevices
+// devices among all of them, on top of the device limit of every account, 0 is unlimited
+type HouseholdsConfig struct {
+	MaxMembers int `yaml:"max_members" env-default:"5"`
+	MaxDevices int `yaml:"max_devices" env-default:"10"`
+}
+
+// EntitlementsConfig selects where the plan claims come from. StaticPath is a JSON file of
+// entitlements per account for local development and tests, without it tokens carry no plan.
+// The entitlements are cached for CacheTTL, 0 disables the cache
+type EntitlementsConfig struct {
+	StaticPath string        `yaml:"static_path"`
+	CacheTTL   time.Duration `yaml:"cache_ttl" env-default:"5m"`
+}
+
+// StreamsConfig bounds the streams playing at once per user or household. MaxStreams applies to
+// accounts without a plan, 0 is unlimited. OnLimit is "reject" to refuse a new stream over the limit
+// or "kick_oldest" to revoke the oldest one. A stream without a heartbeat for HeartbeatTimeout stops counting
+type StreamsConfig struct {
+	MaxStreams       int           `yaml:"max_streams" env-default:"2"`
+	OnLimit          string        `yaml:"on_limit" env-default:"reject"`
+	HeartbeatTimeout time.Duration `yaml:"heartbeat_timeout" env-default:"90s"`
+}
+
+// GuestsConfig holds the guest tokens of AnonymousLogin: the scopes they grant, how long they live
+// and how long a guest not seen is kept for merging into an account
+type GuestsConfig struct {
+	Scopes    []string      `yaml:"scopes" env-default:"catalog:browse"`
+	TokenTTL  time.Duration `yaml:"token_ttl" env-default:"24h"`
+	RetainFor time.Duration `yaml:"retain_for" env-default:"720h"`
+}
+
+// SocialConfig holds the external OpenID Connect providers by the name the apps pass, like "google",
+// and how long a sign in started at a provider may take
+type SocialConfig struct {
+	Providers map[string]SocialProviderConfig `yaml:"providers"`
+	StateTTL  time.Duration                   `yaml:"state_ttl" env-default:"10m"`
+}
+
+// SocialProviderConfig is the client registered at the provider, RedirectURL is where the app
+// receives the code and the state. Scopes default to openid, email and profile
+type SocialProviderConfig struct {
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	RedirectURL  string   `yaml:"redirect_url"`
+	Scopes       []string `yaml:"scopes"`
+}
+
+// LDAPConfig is the directory Login checks before the local users, it is off without a URL.
+// Domains are the email domains it owns, required with a URL: their users sign in through the
+// directory only and cannot register, the other emails never reach it.
+// The user is found by UserFilter as the BindDN account or bound to by UserDNTemplates;
+// {email} and {username} are replaced in both, {dn} of the user in GroupFilter.
+// GroupRoles maps groups by DN or common name to roles, the mapped roles are synced on every login
+type LDAPConfig struct {
+	URL             string            `yaml:"url"`
+	Domains         []string          `yaml:"domains"`
+	StartTLS        bool              `yaml:"start_tls" env-default:"false"`
+	BindDN          string            `yaml:"bind_dn"`
+	BindPassword    string            `yaml:"bind_password"`
+	BaseDN          string            `yaml:"base_dn"`
+	UserFilter      string            `yaml:"user_filter"`
+	UserDNTemplates []string          `yaml:"user_dn_templates"`
+	GroupBaseDN     string            `yaml:"group_base_dn"`
+	GroupFilter     string            `yaml:"group_filter"`
+	GroupRoles      map[string]string `yaml:"group_roles"`
+	Timeout         time.Duration     `yaml:"timeout" env-default:"5s"`
+}
+
+// SAMLConfig holds the service provider: the key and certificate PEM files that sign the
+// AuthnRequests, and the identity providers of enterprise customers by connection name.
+// The metadata of a connection is served at BaseURL + "/saml/{connection}/metadata",
+// which is also its entity ID
+type SAMLConfig struct {
+	BaseURL         string                          `yaml:"base_url"`
+	KeyPath         string                          `yaml:"key_path"`
+	CertificatePath string                          `yaml:"certificate_path"`
+	Connections     map[string]SAMLConnectionConfig `yaml:"connections"`
+	RequestTTL      time.Duration                   `yaml:"request_ttl" env-default:"10m"`
+}
+
+// SAMLConnectionConfig is an identity provider: its metadata XML file and the ACS page of the app
+// it posts the response to. Attributes maps user fields to assertion attributes, the email is
+// the NameID unless mapped. Domains restricts the asserted emails and LinkExisting attaches
+// a new identity to the account of the same email
+type SAMLConnectionConfig struct {
+	IDPMetadataPath string            `yaml:"idp_metadata_path"`
+	ACSURL          string            `yaml:"acs_url"`
+	Attributes      map[string]string `yaml:"attributes"`
+	Domains         []string          `yaml:"domains"`
+	LinkExisting    bool              `yaml:"link_existing"`
+}
+
+// RateLimitConfig selects the limiter backend ("memory" for a single replica, "postgres" to share
+// buckets between replicas) and the policies per full gRPC method name or HTTP route pattern
+type RateLimitConfig struct {
+	Backend string                           `yaml:"backend" env-default:"memory"`
+	Methods map[string]MethodRateLimitConfig `yaml:"methods"`
+}
+
+// MethodRateLimitConfig holds the buckets of one method or route, a policy without limit is not applied.
+// Device applies to the gRPC methods, Client to the client id of the HTTP routes
+type MethodRateLimitConfig struct {
+	Method RateLimitPolicy `yaml:"method"`
+	IP     RateLimitPolicy `yaml:"ip"`
+	Email  RateLimitPolicy `yaml:"email"`
+	Device RateLimitPolicy `yaml:"device"`
+	Client RateLimitPolicy `yaml:"client"`
+}
+
+// RateLimitPolicy allows Limit requests every Per with bursts up to Burst
+type RateLimitPolicy struct {
+	Limit int           `yaml:"limit"`
+	Per   time.Duration `yaml:"per"`
+	Burst int           `yaml:"burst"`
+}
+
+// defaultRateLimits protect the unauthenticated methods when the config has no policies
+var defaultRateLimits = map[string]MethodRateLimitConfig{
+	"/auth_v1.Auth/Login": {
+		Method: RateLimitPolicy{Limit: 500, Per: time.Second, Burst: 1000},
+		IP:     RateLimitPolicy{Limit: 20, Per: time.Minute, Burst: 10},
+		Email:  RateLimitPolicy{Limit: 10, Per: time.Minute, Burst: 5},
+		Device: RateLimitPolicy{Limit: 10, Per: time.Minute, Burst: 5},
+	},
+	"/auth_v1.Auth/Register": {
+		Method: RateLimitPolicy{Limit: 100, Per: time.Second, Burst: 200},
+		IP:     RateLimitPolicy{Limit: 5, Per: time.Hour, Burst: 5},
+		Email:  RateLimitPolicy{Limit: 3, Per: time.Hour, Burst: 3},
+	},
+	"/auth_v1.Auth/RefreshToken": {
+		IP:     RateLimitPolicy{Limit: 60, Per: time.Minute, Burst: 30},
+		Device: RateLimitPolicy{Limit: 10, Per: time.Minute, Burst: 5},
+	},
+	"/auth_v1.Auth/ClientCredentials": {
+		IP: RateLimitPolicy{Limit: 60, Per: time.Minute, Burst: 30},
+	},
+	"/auth_v1.Auth/SelectProfile": {
+		IP: RateLimitPolicy{Limit: 30, Per: time.Minute, Burst: 10},
+	},
+	"/auth_v1.Auth/StartQRLogin": {
+		IP: RateLimitPolicy{Limit: 30, Per: time.Minute, Burst: 10},
+	},
+	// a TV watches its session once, the limit leaves room for reconnects only
+	"/auth_v1.Auth/WatchQRLogin": {
+		IP: RateLimitPolicy{Limit: 30, Per: time.Minute, Burst: 10},
+	},
+	"/auth_v1.Auth/StartSocialLogin": {
+		IP: RateLimitPolicy{Limit: 30, Per: time.Minute, Burst: 10},
+	},
+	"/auth_v1.Auth/CompleteSocialLogin": {
+		IP: RateLimitPolicy{Limit: 30, Per: time.Minute, Burst: 10},
+	},
+	"/auth_v1.Auth/StartSAMLLogin": {
+		IP: RateLimitPolicy{Limit: 30, Per: time.Minute, Burst: 10},
+	},
+	"/auth_v1.Auth/CompleteSAMLLogin": {
+		IP: RateLimitPolicy{Limit: 30, Per: time.Minute, Burst: 10},
+	},
+	// every call without a guest token creates a guest
+	"/auth_v1.Auth/AnonymousLogin": {
+		IP:     RateLimitPolicy{Limit: 30, Per: time.Minute, Burst: 10},
+		Device: RateLimitPolicy{Limit: 10, Per: time.Minute, Burst: 5},
+	},
+	// user codes are short, guessing them must be slow
+	"/auth_v1.Auth/VerifyDeviceCode": {
+		IP: RateLimitPolicy{Limit: 20, Per: time.Minute, Burst: 10},
+	},
+	// the login form of the authorization endpoint checks the password as Login does
+	"POST /authorize": {
+		Method: RateLimitPolicy{Limit: 500, Per: time.Second, Burst: 1000},
+		IP:     RateLimitPolicy{Limit: 20, Per: time.Minute, Burst: 10},
+		Email:  RateLimitPolicy{Limit: 10, Per: time.Minute, Burst: 5},
+	},
+	"POST /authorize/consent": {
+		IP: RateLimitPolicy{Limit: 30, Per: time.Minute, Burst: 10},
+	},
+	// client secrets and refresh tokens are checked here, and every device of a client polls it
+	// every few seconds for its device code, the client bucket is sized for all of them
+	"POST /token": {
+		IP:     RateLimitPolicy{Limit: 60, Per: time.Minute, Burst: 30},
+		Client: RateLimitPolicy{Limit: 50, Per: time.Second, Burst: 100},
+	},
+	// every call mints a device code
+	"POST /device_authorization": {
+		IP:     RateLimitPolicy{Limit: 10, Per: time.Minute, Burst: 5},
+		Client: RateLimitPolicy{Limit: 20, Per: time.Second, Burst: 50},
+	},
+}
+
+// RiskConfig sets the risk detector thresholds, see risk.Thresholds, and the challenge
+// required from flagged sources: "proof_of_work", "email_otp" or "captcha"
+type RiskConfig struct {
+	Window              time.Duration `yaml:"window" env-default:"15m"`
+	IPFailures          int           `yaml:"ip_failures" env-default:"30"`
+	SubnetFailures      int           `yaml:"subnet_failures" env-default:"100"`
+	IPAccounts          int           `yaml:"ip_accounts" env-default:"5"`
+	SubnetAccounts      int           `yaml:"subnet_accounts" env-default:"20"`
+	IPRegistrations     int           `yaml:"ip_registrations" env-default:"3"`
+	SubnetRegistrations int           `yaml:"subnet_registrations" env-default:"20"`
+	FlagFor             time.Duration `yaml:"flag_for" env-default:"1h"`
+	Challenge           string        `yaml:"challenge" env-default:"proof_of_work"`
+	OTPTTL              time.Duration `yaml:"otp_ttl" env-default:"10m"`
+	PoWBits             int           `yaml:"pow_bits" env-default:"20"`
+	PoWTTL              time.Duration `yaml:"pow_ttl" env-default:"5m"`
+	Captcha             CaptchaConfig `yaml:"captcha"`
+}
+
+type CaptchaConfig struct {
+	VerifyURL string `yaml:"verify_url"`
+	Secret    string `yaml:"secret"`
+	SiteKey   string `yaml:"site_key"`
+}
+
+type SMTPConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port" env-default:"587"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
+
 func MustLoad() *Config {
 	path := fetchConfigPath()
 	if path == "" {
@@ -33,6 +401,12 @@ func MustLoad() *Config {
 	if err := cleanenv.ReadConfig(path, &cfg); err != nil {
 		panic("failed to read config: " + err.Error())
 	}
+	if cfg.RateLimit.Methods == nil {
+		cfg.RateLimit.Methods = defaultRateLimits
+	}
+	if cfg.Authorization.Methods == nil {
+		panic("authorization methods are not configured")
+	}
 
 	return &cfg
 }
@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+// the grants a client may be registered for
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+)
+
+// Client is a service account of the client_credentials grant or an application of the authorization
+// code flow. It authenticates either with a secret, of which only the hash is kept, or with a JWT signed
+// by the key in PublicKey (PEM). A client with neither is public and can only use the code flow
+type Client struct {
+	ID         string
+	Name       string
+	SecretHash string
+	PublicKey  string
+	Scopes     []string
+	// RedirectURIs are the exact URIs the authorization code may be sent to
+	RedirectURIs []string
+	// GrantTypes are the grants the client may use: authorization_code for an application acting
+	// for its users, client_credentials for a service account acting on its own
+	GrantTypes []string
+	// TokenTTL is the lifetime of the tokens issued to the client, zero uses the tenant one
+	TokenTTL  time.Duration
+	CreatedAt time.Time
+}
+
+// Public reports whether the client has no credentials
+func (c Client) Public() bool {
+	return c.SecretHash == "" && c.PublicKey == ""
+}
+
+// Allows reports whether the client is registered for the grant
+func (c Client) Allows(grant string) bool {
+	for _, g := range c.GrantTypes {
+		if g == grant {
+			return true
+		}
+	}
+	return false
+}
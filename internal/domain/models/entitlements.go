@@ -0,0 +1,9 @@
+package models
+
+// Entitlements are what the subscription of the account allows: the plan, the features
+// it unlocks and how many streams may play at once, 0 is unlimited
+type Entitlements struct {
+	Plan       string   `json:"plan"`
+	Features   []string `json:"features"`
+	MaxStreams int      `json:"max_streams"`
+}
@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// security event types stored in login_events
+const (
+	EventLoginSuccess    = "login_success"
+	EventLoginFailure    = "login_failure"
+	EventTokenRefresh    = "token_refresh"
+	EventMFAChallenge    = "mfa_challenge" // an OTP, CAPTCHA or proof of work challenge answered
+	EventDeviceAdded     = "device_added"
+	EventDeviceRemoved   = "device_removed"
+	EventPasswordReset   = "password_reset"
+	EventAccountLocked   = "account_locked"
+	EventAccountUnlocked = "account_unlocked"
+	EventLoginChallenge  = "login_challenge" // a challenge issued to a risky source
+	EventRoleAssigned    = "role_assigned"
+	EventRoleRevoked     = "role_revoked"
+	EventOrgJoined       = "org_joined"
+	EventOrgLeft         = "org_left"
+	EventTokenCreated    = "token_created"
+	EventTokenRevoked    = "token_revoked"
+)
+
+type SecurityEvent struct {
+	ID        int64     `db:"id"`
+	Email     string    `db:"email"`
+	Type      string    `db:"event_type"`
+	IP        string    `db:"ip"`
+	Device    string    `db:"device"`
+	UserAgent string    `db:"user_agent"`
+	Reason    string    `db:"reason"`
+	CreatedAt time.Time `db:"created_at"`
+}
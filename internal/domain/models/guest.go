@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// Guest is an anonymous visitor of a device, Metadata is whatever the apps attached to it
+// before the visitor signed up, like the language or the watchlist
+type Guest struct {
+	ID            string
+	DeviceAddress string
+	Metadata      map[string]string
+	CreatedAt     time.Time
+}
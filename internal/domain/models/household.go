@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// roles within a household
+const (
+	HouseholdRoleOwner  = "owner"
+	HouseholdRoleMember = "member"
+)
+
+// Household is a family plan: the owner invites other accounts that share the entitlements
+// of the owner. Members keep their own credentials
+type Household struct {
+	ID         int64  `db:"id"`
+	OwnerEmail string `db:"owner_email"`
+	// MaxMembers is how many accounts may be invited besides the owner, 0 is unlimited
+	MaxMembers int `db:"max_members"`
+	// MaxDevices is how many devices all the members may register together, 0 is unlimited
+	MaxDevices int       `db:"max_devices"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// HouseholdMember is an account of the household or an invitation, Status is one of the membership statuses
+type HouseholdMember struct {
+	HouseholdID int64     `db:"household_id"`
+	Email       string    `db:"email"`
+	Role        string    `db:"role"`
+	Status      string    `db:"status"`
+	CreatedAt   time.Time `db:"created_at"`
+}
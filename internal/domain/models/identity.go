@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// Identity is the account of the user at an external identity provider
+type Identity struct {
+	ID        int64     `db:"id"`
+	Provider  string    `db:"provider"`
+	Subject   string    `db:"subject"`
+	Email     string    `db:"email"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// SocialLogin is a sign in at a provider in progress, LinkEmail is the signed in user
+// linking the identity, empty for a sign in
+type SocialLogin struct {
+	StateHash     string    `db:"state_hash"`
+	Provider      string    `db:"provider"`
+	Nonce         string    `db:"nonce"`
+	CodeVerifier  string    `db:"code_verifier"`
+	DeviceAddress string    `db:"device_address"`
+	LinkEmail     string    `db:"link_email"`
+	ExpiresAt     time.Time `db:"expires_at"`
+}
+
+// SAMLLogin is a sign in at a SAML identity provider in progress, RequestID is the AuthnRequest
+// the response answers
+type SAMLLogin struct {
+	RelayStateHash string    `db:"relay_state_hash"`
+	Connection     string    `db:"connection"`
+	RequestID      string    `db:"request_id"`
+	DeviceAddress  string    `db:"device_address"`
+	ExpiresAt      time.Time `db:"expires_at"`
+}
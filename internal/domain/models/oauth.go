@@ -0,0 +1,69 @@
+package models
+
+import "time"
+
+// OpenID Connect scopes, they select the identity claims rather than permissions
+const (
+	ScopeOpenID  = "openid"
+	ScopeEmail   = "email"
+	ScopeProfile = "profile"
+)
+
+// IsIdentityScope reports whether the scope is an OpenID Connect one
+func IsIdentityScope(scope string) bool {
+	return scope == ScopeOpenID || scope == ScopeEmail || scope == ScopeProfile
+}
+
+// AuthorizationCode is issued by the authorization endpoint and exchanged once for tokens.
+// CodeChallenge is the S256 PKCE challenge the code verifier must match
+type AuthorizationCode struct {
+	Email         string
+	ClientID      string
+	RedirectURI   string
+	Scopes        []string
+	CodeChallenge string
+	// Nonce is the OpenID Connect nonce of the request, echoed in the ID token
+	Nonce string
+	// AuthTime is when the user authenticated and AMR how, both go into the ID token
+	AuthTime  time.Time
+	AMR       []string
+	ExpiresAt time.Time
+}
+
+// RefreshToken is a refresh token of the authorization code flow. Only its hash is stored,
+// FamilyID ties together the tokens rotated from the same authorization
+type RefreshToken struct {
+	ID       int64
+	FamilyID int64
+	Email    string
+	ClientID string
+	Scopes   []string
+	AuthTime time.Time
+	AMR      []string
+	// DeviceAddress is the device the tokens are issued to, empty for the applications
+	// of the authorization code flow
+	DeviceAddress string
+	ExpiresAt     time.Time
+}
+
+// states of a device authorization
+const (
+	DeviceAuthorizationPending  = "pending"
+	DeviceAuthorizationApproved = "approved"
+	DeviceAuthorizationDenied   = "denied"
+)
+
+// DeviceAuthorization is a pending sign in of a device without a keyboard, RFC 8628.
+// The device polls with the device code, of which only the hash is kept, while the user enters
+// UserCode on another device. Email is set once the user decided
+type DeviceAuthorization struct {
+	ClientID      string
+	DeviceAddress string
+	UserCode      string
+	Scopes        []string
+	Status        string
+	Email         string
+	// Interval is the minimum time between two polls, it grows when the device polls too fast
+	Interval  time.Duration
+	ExpiresAt time.Time
+}
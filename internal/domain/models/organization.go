@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// roles of a member within an organization, unrelated to the global roles
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+// membership statuses, an invitation becomes active once the user accepts it
+const (
+	MembershipInvited = "invited"
+	MembershipActive  = "active"
+)
+
+type Organization struct {
+	ID   int64  `db:"id"`
+	Name string `db:"name"`
+	// MaxDevices is how many devices the members may use in the organization, 0 is unlimited
+	MaxDevices int       `db:"max_devices"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+type Membership struct {
+	OrgID     int64     `db:"org_id"`
+	OrgName   string    `db:"org_name"`
+	Email     string    `db:"email"`
+	Role      string    `db:"role"`
+	Status    string    `db:"status"`
+	InvitedBy string    `db:"invited_by"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// IsOrgRole reports whether the role exists within organizations
+func IsOrgRole(role string) bool {
+	return role == OrgRoleOwner || role == OrgRoleAdmin || role == OrgRoleMember
+}
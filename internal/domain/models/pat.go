@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// PersonalAccessToken is a long-lived token a user creates for scripts. Only its hash is stored,
+// Prefix is the beginning of the token shown to tell the tokens apart
+type PersonalAccessToken struct {
+	ID         int64
+	Email      string
+	Name       string
+	Prefix     string
+	Scopes     []string
+	ExpiresAt  time.Time
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
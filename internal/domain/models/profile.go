@@ -0,0 +1,45 @@
+package models
+
+import "time"
+
+// maturity ratings of the profiles from the least to the most mature content,
+// the catalog shows a title when its rating is not above the one of the profile
+const (
+	MaturityAll   = "all"
+	Maturity7     = "7+"
+	Maturity13    = "13+"
+	Maturity16    = "16+"
+	MaturityAdult = "18+"
+)
+
+// MaturityRatings lists the ratings in order
+var MaturityRatings = []string{MaturityAll, Maturity7, Maturity13, Maturity16, MaturityAdult}
+
+// ValidMaturityRating reports whether the rating is one of MaturityRatings
+func ValidMaturityRating(rating string) bool {
+	for _, r := range MaturityRatings {
+		if r == rating {
+			return true
+		}
+	}
+	return false
+}
+
+// Profile is a viewer of the account, the members of a household share one account.
+// PINHash is the bcrypt hash of the optional PIN, empty when the profile is not locked
+type Profile struct {
+	ID             int64
+	Name           string
+	AvatarKey      string
+	MaturityRating string
+	PINHash        string
+	// PINFailures counts the wrong PINs in a row, the PIN is not checked until PINLockedUntil
+	PINFailures    int
+	PINLockedUntil *time.Time
+	CreatedAt      time.Time
+}
+
+// HasPIN reports whether selecting the profile requires the PIN
+func (p Profile) HasPIN() bool {
+	return p.PINHash != ""
+}
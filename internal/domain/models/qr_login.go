@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// states of a QR login
+const (
+	QRLoginPending  = "pending"
+	QRLoginApproved = "approved"
+)
+
+// QRLogin is a sign in started on a TV and approved by scanning its QR code with a phone
+// where the user is signed in. Email is set once approved
+type QRLogin struct {
+	ID            string
+	SecretHash    string
+	DeviceAddress string
+	Status        string
+	Email         string
+	ExpiresAt     time.Time
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrInvalidRelationTuple = errors.New("invalid relation tuple")
+
+// Object is a "namespace:id" reference, e.g. "playlist:42"
+type Object struct {
+	Namespace string
+	ID        string
+}
+
+func (o Object) String() string {
+	return o.Namespace + ":" + o.ID
+}
+
+// Subject is either an object ("user:7") or a userset ("group:eng#member"), the set of
+// subjects that have the relation to the object
+type Subject struct {
+	Object
+	Relation string
+}
+
+func (s Subject) String() string {
+	if s.Relation == "" {
+		return s.Object.String()
+	}
+	return s.Object.String() + "#" + s.Relation
+}
+
+// RelationTuple is "object#relation@subject": the subject has the relation to the object
+type RelationTuple struct {
+	Object   Object
+	Relation string
+	Subject  Subject
+}
+
+func (t RelationTuple) String() string {
+	return t.Object.String() + "#" + t.Relation + "@" + t.Subject.String()
+}
+
+func ParseObject(s string) (Object, error) {
+	ns, id, ok := strings.Cut(s, ":")
+	if !ok || ns == "" || id == "" || strings.ContainsAny(id, "#@") {
+		return Object{}, ErrInvalidRelationTuple
+	}
+	return Object{Namespace: ns, ID: id}, nil
+}
+
+func ParseSubject(s string) (Subject, error) {
+	obj, rel, _ := strings.Cut(s, "#")
+	o, err := ParseObject(obj)
+	if err != nil {
+		return Subject{}, err
+	}
+	if strings.Contains(s, "#") && rel == "" {
+		return Subject{}, ErrInvalidRelationTuple
+	}
+	return Subject{Object: o, Relation: rel}, nil
+}
+
+// TupleRow is the storage form of a relation tuple
+type TupleRow struct {
+	Namespace        string `db:"namespace"`
+	ObjectID         string `db:"object_id"`
+	Relation         string `db:"relation"`
+	SubjectNamespace string `db:"subject_namespace"`
+	SubjectObjectID  string `db:"subject_object_id"`
+	SubjectRelation  string `db:"subject_relation"`
+}
+
+func (r TupleRow) Tuple() RelationTuple {
+	return RelationTuple{
+		Object:   Object{Namespace: r.Namespace, ID: r.ObjectID},
+		Relation: r.Relation,
+		Subject: Subject{
+			Object:   Object{Namespace: r.SubjectNamespace, ID: r.SubjectObjectID},
+			Relation: r.SubjectRelation,
+		},
+	}
+}
@@ -0,0 +1,12 @@
+package models
+
+// built-in role and permissions, seeded by the schema
+const (
+	RoleAdmin = "admin"
+
+	PermissionRolesManage    = "roles:manage"
+	PermissionAccountsUnlock = "accounts:unlock"
+	PermissionRelationsRead  = "relations:read"
+	PermissionRelationsWrite = "relations:write"
+	PermissionClientsManage  = "clients:manage"
+)
@@ -8,6 +8,8 @@ CREATE TABLE IF NOT EXISTS users (
 	registration_time TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_reset_required BOOLEAN NOT NULL DEFAULT FALSE;
+
 CREATE TABLE IF NOT EXISTS devices (
     device_name TEXT NOT NULL,
     email TEXT NOT NULL,
@@ -27,7 +29,7 @@ DROP TRIGGER IF EXISTS email_device_limit ON devices;
 CREATE OR REPLACE FUNCTION check_email_limit() RETURNS TRIGGER AS $$
 BEGIN
     --checking the number of records with the same email
-    IF (SELECT COUNT(*) FROM devices WHERE email = NEW.email) >= 5 THEN
+    IF (SELECT COUNT(*) FROM devices WHERE tenant_id = NEW.tenant_id AND email = NEW.email) >= 5 THEN
         RAISE EXCEPTION 'Exceeded limit of 5 devices for the same email: %', NEW.email;
     END IF;
     RETURN NEW;
@@ -43,4 +45,527 @@ EXECUTE FUNCTION check_email_limit();
 -- DELETE FROM devices WHERE expiry_time < CURRENT_TIMESTAMP;
 -- deletes once a day
 -- SELECT cron.schedule('0 0 * * *', 'DELETE FROM devices WHERE expiry_time < CURRENT_TIMESTAMP');
+
+-- login_events is an append-only security log: successes, failures, refreshes, MFA challenges and device changes.
+-- There is no foreign key on email so that failures for unknown emails are recorded too.
+-- Rows are only removed by the retention job.
+CREATE TABLE IF NOT EXISTS login_events (
+    id BIGSERIAL PRIMARY KEY,
+    email TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    ip TEXT NOT NULL DEFAULT '',
+    device TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS login_events_email_id_idx ON login_events (email, id DESC);
+CREATE INDEX IF NOT EXISTS login_events_created_at_idx ON login_events (created_at);
+
+DROP TRIGGER IF EXISTS login_events_append_only ON login_events;
+
+CREATE OR REPLACE FUNCTION reject_login_events_update() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'login_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER login_events_append_only
+BEFORE UPDATE ON login_events
+FOR EACH ROW
+EXECUTE FUNCTION reject_login_events_update();
+
+-- login_failures holds the consecutive failed logins per account, shared by all replicas.
+-- Rows exist for unknown emails too, so lockout behaves the same for every address
+CREATE TABLE IF NOT EXISTS login_failures (
+    email TEXT PRIMARY KEY,
+    failures INT NOT NULL DEFAULT 0,
+    last_failure TIMESTAMPTZ NOT NULL DEFAULT now(),
+    locked_until TIMESTAMPTZ
+);
+
+-- rate_limit_buckets are the token buckets of the shared rate limiter
+CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+    key TEXT PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS rate_limit_buckets_updated_at_idx ON rate_limit_buckets (updated_at);
+
+-- roles group permissions, users get permissions through their roles.
+-- Both are embedded into access tokens, so a change takes effect on the next login or refresh.
+-- roles and permissions are one catalog shared by every tenant, only user_roles grants them:
+-- a user belongs to one tenant, so a role assigned in one tenant grants nothing in another
+CREATE TABLE IF NOT EXISTS roles (
+    id SERIAL PRIMARY KEY,
+    name TEXT UNIQUE NOT NULL,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS permissions (
+    id SERIAL PRIMARY KEY,
+    name TEXT UNIQUE NOT NULL,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role_id INT NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    permission_id INT NOT NULL REFERENCES permissions(id) ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role_id INT NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+INSERT INTO roles (name, description) VALUES ('admin', 'every permission') ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO permissions (name, description) VALUES
+    ('roles:manage', 'assign and revoke roles'),
+    ('accounts:unlock', 'lift brute-force locks'),
+    ('relations:read', 'check and list relation tuples'),
+    ('relations:write', 'write and delete relation tuples'),
+    ('clients:manage', 'register and delete service account clients')
+ON CONFLICT (name) DO NOTHING;
+
+-- admin always holds every permission, including the ones added later
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT r.id, p.id FROM roles r CROSS JOIN permissions p WHERE r.name = 'admin'
+ON CONFLICT DO NOTHING;
+
+-- login_otps are the one-time codes mailed to the owner when a login comes from a risky source
+CREATE TABLE IF NOT EXISTS login_otps (
+    email TEXT PRIMARY KEY,
+    code_hash TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- relation_tuples are "object#relation@subject" tuples of the relationship based authorization.
+-- Rows are never rewritten: a write creates a row at the new revision and a delete stamps
+-- deleted_rev, so a check can be evaluated at any revision a consistency token points to
+CREATE TABLE IF NOT EXISTS relation_tuples (
+    id BIGSERIAL PRIMARY KEY,
+    namespace TEXT NOT NULL,
+    object_id TEXT NOT NULL,
+    relation TEXT NOT NULL,
+    subject_namespace TEXT NOT NULL,
+    subject_object_id TEXT NOT NULL,
+    subject_relation TEXT NOT NULL DEFAULT '',
+    created_rev BIGINT NOT NULL,
+    deleted_rev BIGINT
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS relation_tuples_live_idx ON relation_tuples
+    (namespace, object_id, relation, subject_namespace, subject_object_id, subject_relation)
+    WHERE deleted_rev IS NULL;
+
+CREATE INDEX IF NOT EXISTS relation_tuples_subject_idx ON relation_tuples
+    (subject_namespace, subject_object_id, subject_relation);
+
+-- relation_tuple_head holds the latest revision of relation_tuples in its single row
+CREATE TABLE IF NOT EXISTS relation_tuple_head (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    rev BIGINT NOT NULL
+);
+
+INSERT INTO relation_tuple_head (rev) VALUES (0) ON CONFLICT DO NOTHING;
+
+-- organizations are team accounts. Users stay global, memberships tie them to organizations
+-- with a per-organization role
+CREATE TABLE IF NOT EXISTS organizations (
+    id SERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    max_devices INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS memberships (
+    org_id INT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role TEXT NOT NULL CHECK (role IN ('owner', 'admin', 'member')),
+    status TEXT NOT NULL CHECK (status IN ('invited', 'active')),
+    invited_by TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (org_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS memberships_user_id_idx ON memberships (user_id);
+
+-- organization_devices are the devices used in the context of an organization, counted against its max_devices
+CREATE TABLE IF NOT EXISTS organization_devices (
+    org_id INT NOT NULL,
+    user_id INT NOT NULL,
+    device_name TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (org_id, user_id, device_name),
+    FOREIGN KEY (org_id, user_id) REFERENCES memberships(org_id, user_id) ON DELETE CASCADE
+);
+
+-- tenant isolation: every user owned row carries the tenant and an email is unique per tenant.
+-- Rows that existed before belong to the 'default' tenant
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE login_events ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE login_failures ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE login_otps ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE organizations ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE relation_tuples ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'users_tenant_email_key') THEN
+        ALTER TABLE devices DROP CONSTRAINT IF EXISTS fk_user_email;
+        ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_key;
+        ALTER TABLE users ADD CONSTRAINT users_tenant_email_key UNIQUE (tenant_id, email);
+
+        ALTER TABLE devices DROP CONSTRAINT IF EXISTS devices_pkey;
+        ALTER TABLE devices ADD PRIMARY KEY (tenant_id, email, device_name);
+        ALTER TABLE devices ADD CONSTRAINT fk_user_tenant_email
+            FOREIGN KEY (tenant_id, email) REFERENCES users(tenant_id, email) ON DELETE CASCADE;
+
+        ALTER TABLE login_failures DROP CONSTRAINT IF EXISTS login_failures_pkey;
+        ALTER TABLE login_failures ADD PRIMARY KEY (tenant_id, email);
+
+        ALTER TABLE login_otps DROP CONSTRAINT IF EXISTS login_otps_pkey;
+        ALTER TABLE login_otps ADD PRIMARY KEY (tenant_id, email);
+    END IF;
+END
+$$;
+
+DROP INDEX IF EXISTS login_events_email_id_idx;
+CREATE INDEX IF NOT EXISTS login_events_tenant_email_id_idx ON login_events (tenant_id, email, id DESC);
+
+CREATE INDEX IF NOT EXISTS organizations_tenant_id_idx ON organizations (tenant_id);
+
+DROP INDEX IF EXISTS relation_tuples_live_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS relation_tuples_tenant_live_idx ON relation_tuples
+    (tenant_id, namespace, object_id, relation, subject_namespace, subject_object_id, subject_relation)
+    WHERE deleted_rev IS NULL;
+
+-- personal_access_tokens are named long-lived tokens for scripts. Only the sha256 of the token is kept,
+-- scopes are permission names, the token grants those the user still holds
+CREATE TABLE IF NOT EXISTS personal_access_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    token_prefix TEXT NOT NULL,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS personal_access_tokens_user_id_idx ON personal_access_tokens (user_id);
+
+-- oauth_clients are the service accounts of the client_credentials grant. A client authenticates
+-- with a secret, of which only the sha256 is kept, or with a JWT signed by the key in public_key
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    client_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    secret_hash TEXT,
+    public_key TEXT,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    token_ttl_ms BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant_id, client_id),
+    CHECK ((secret_hash IS NULL) <> (public_key IS NULL))
+);
+
+-- clients with redirect_uris use the authorization code flow, a client with neither a secret
+-- nor a public key is a public one and relies on PKCE alone
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS redirect_uris TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE oauth_clients DROP CONSTRAINT IF EXISTS oauth_clients_check;
+ALTER TABLE oauth_clients DROP CONSTRAINT IF EXISTS oauth_clients_credentials_check;
+ALTER TABLE oauth_clients ADD CONSTRAINT oauth_clients_credentials_check
+    CHECK (secret_hash IS NULL OR public_key IS NULL);
+
+-- grant_types are the grants a client may use. Clients registered before have the one their
+-- redirect_uris imply: an application of the code flow must not act on its own
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS grant_types TEXT[];
+UPDATE oauth_clients SET grant_types = CASE WHEN cardinality(redirect_uris) > 0
+    THEN '{authorization_code}'::TEXT[] ELSE '{client_credentials}'::TEXT[] END
+WHERE grant_types IS NULL;
+ALTER TABLE oauth_clients ALTER COLUMN grant_types SET NOT NULL;
+
+-- oauth_consents are the scopes a user allowed a client, the consent page is skipped when they cover a request
+CREATE TABLE IF NOT EXISTS oauth_consents (
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    client_id TEXT NOT NULL,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, client_id),
+    FOREIGN KEY (tenant_id, client_id) REFERENCES oauth_clients(tenant_id, client_id) ON DELETE CASCADE
+);
+
+-- oauth_codes are the authorization codes, single use and short-lived. Only the sha256 of the code is kept
+CREATE TABLE IF NOT EXISTS oauth_codes (
+    code_hash TEXT PRIMARY KEY,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    client_id TEXT NOT NULL,
+    redirect_uri TEXT NOT NULL,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    code_challenge TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (tenant_id, client_id) REFERENCES oauth_clients(tenant_id, client_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS oauth_codes_expires_at_idx ON oauth_codes (expires_at);
+
+-- oauth_refresh_tokens rotate on every use. The tokens descending from one authorization share family_id,
+-- presenting a rotated token again revokes the whole family
+CREATE TABLE IF NOT EXISTS oauth_refresh_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    family_id BIGINT NOT NULL,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    client_id TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    revoked_at TIMESTAMPTZ,
+    FOREIGN KEY (tenant_id, client_id) REFERENCES oauth_clients(tenant_id, client_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS oauth_refresh_tokens_family_id_idx ON oauth_refresh_tokens (family_id);
+
+-- OpenID Connect: the nonce, the authentication time and methods travel from the authorization
+-- to the ID tokens, refresh tokens keep the latter two for the ID tokens of refreshed sessions
+ALTER TABLE oauth_codes ADD COLUMN IF NOT EXISTS nonce TEXT NOT NULL DEFAULT '';
+ALTER TABLE oauth_codes ADD COLUMN IF NOT EXISTS auth_time TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE oauth_codes ADD COLUMN IF NOT EXISTS amr TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE oauth_refresh_tokens ADD COLUMN IF NOT EXISTS auth_time TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE oauth_refresh_tokens ADD COLUMN IF NOT EXISTS amr TEXT[] NOT NULL DEFAULT '{}';
+
+ALTER TABLE oauth_refresh_tokens ADD COLUMN IF NOT EXISTS device_address TEXT NOT NULL DEFAULT '';
+
+-- device_authorizations are the pending sign ins of the device authorization grant (RFC 8628).
+-- Only the sha256 of the device code is kept, the user code is short and unique within the tenant
+CREATE TABLE IF NOT EXISTS device_authorizations (
+    device_code_hash TEXT PRIMARY KEY,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    user_code TEXT NOT NULL,
+    client_id TEXT NOT NULL,
+    device_address TEXT NOT NULL,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'denied')),
+    user_id INT REFERENCES users(id) ON DELETE CASCADE,
+    interval_ms BIGINT NOT NULL,
+    last_polled_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (tenant_id, user_code),
+    FOREIGN KEY (tenant_id, client_id) REFERENCES oauth_clients(tenant_id, client_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS device_authorizations_expires_at_idx ON device_authorizations (expires_at);
+
+-- qr_logins are the cross-device sign ins started on a TV: the QR code carries the id,
+-- the TV watches the session with a secret of which only the sha256 is kept
+CREATE TABLE IF NOT EXISTS qr_logins (
+    id TEXT PRIMARY KEY,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    secret_hash TEXT NOT NULL,
+    device_address TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved')),
+    user_id INT REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS qr_logins_expires_at_idx ON qr_logins (expires_at);
+
+-- profiles are the viewers sharing an account, pin_hash is the bcrypt hash of the optional PIN
+CREATE TABLE IF NOT EXISTS profiles (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    avatar_key TEXT NOT NULL DEFAULT '',
+    maturity_rating TEXT NOT NULL DEFAULT '18+' CHECK (maturity_rating IN ('all', '7+', '13+', '16+', '18+')),
+    pin_hash TEXT NOT NULL DEFAULT '',
+    pin_failures INT NOT NULL DEFAULT 0,
+    pin_locked_until TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (user_id, name)
+);
+
+-- households are the family plans: the owner invites other accounts that keep their own credentials
+-- and share the entitlements of the owner. A user is an active member of one household at most
+CREATE TABLE IF NOT EXISTS households (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    owner_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    max_members INT NOT NULL DEFAULT 0,
+    max_devices INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS household_members (
+    household_id BIGINT NOT NULL REFERENCES households(id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role TEXT NOT NULL CHECK (role IN ('owner', 'member')),
+    status TEXT NOT NULL CHECK (status IN ('invited', 'active')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (household_id, user_id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS household_members_active_user_idx ON household_members (user_id)
+    WHERE status = 'active';
+
+-- household_device_limit caps the devices of all the active members of a household at its max_devices,
+-- on top of the limit of every user. The household row is locked so that concurrent logins are counted
+DROP TRIGGER IF EXISTS household_device_limit ON devices;
+
+CREATE OR REPLACE FUNCTION check_household_device_limit() RETURNS TRIGGER AS $$
+DECLARE
+    hid BIGINT;
+    max_devices INT;
+BEGIN
+    -- a known device is not a new one, the unique constraint answers it
+    IF EXISTS (
+        SELECT 1 FROM devices
+        WHERE tenant_id = NEW.tenant_id AND email = NEW.email AND device_name = NEW.device_name
+    ) THEN
+        RETURN NEW;
+    END IF;
+
+    SELECT h.id, h.max_devices INTO hid, max_devices
+    FROM households h
+    JOIN household_members m ON m.household_id = h.id AND m.status = 'active'
+    JOIN users u ON u.id = m.user_id
+    WHERE u.tenant_id = NEW.tenant_id AND u.email = NEW.email
+    FOR UPDATE OF h;
+
+    IF hid IS NOT NULL AND max_devices > 0 AND (
+        SELECT COUNT(*) FROM devices d
+        JOIN users u ON u.tenant_id = d.tenant_id AND u.email = d.email
+        JOIN household_members m ON m.user_id = u.id AND m.status = 'active'
+        WHERE m.household_id = hid
+    ) >= max_devices THEN
+        RAISE EXCEPTION 'Exceeded household device limit';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER household_device_limit
+BEFORE INSERT ON devices
+FOR EACH ROW
+EXECUTE FUNCTION check_household_device_limit();
+
+-- stream_sessions are the playbacks in progress, unlike devices they count what is active at once.
+-- A session is active while it is not revoked and heartbeats arrive within the timeout. Sessions
+-- of the members of a household are counted together under household_id
+CREATE TABLE IF NOT EXISTS stream_sessions (
+    id TEXT PRIMARY KEY,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    household_id BIGINT REFERENCES households(id) ON DELETE SET NULL,
+    device_address TEXT NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    revoked_at TIMESTAMPTZ,
+    revoke_reason TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS stream_sessions_user_idx ON stream_sessions (user_id) WHERE revoked_at IS NULL;
+CREATE INDEX IF NOT EXISTS stream_sessions_household_idx ON stream_sessions (household_id) WHERE revoked_at IS NULL;
+
+-- guests browse the catalog before signing up, a guest is bound to the device it was issued for.
+-- When the guest registers or logs in its metadata is merged into the account and the row is removed
+ALTER TABLE users ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}';
+
+CREATE TABLE IF NOT EXISTS guests (
+    id TEXT PRIMARY KEY,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    device_address TEXT NOT NULL,
+    metadata JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS guests_last_seen_idx ON guests (last_seen_at);
+
+-- user_identities are the accounts at external OpenID Connect providers a user signs in with,
+-- subject is the stable id the provider gives the user. One identity per provider and user
+CREATE TABLE IF NOT EXISTS user_identities (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    email TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (tenant_id, provider, subject),
+    UNIQUE (user_id, provider)
+);
+
+-- social_logins are the sign ins in progress at a provider, keyed by the hash of the state.
+-- link_email is set when a signed in user links the identity instead of signing in with it
+CREATE TABLE IF NOT EXISTS social_logins (
+    state_hash TEXT PRIMARY KEY,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    provider TEXT NOT NULL,
+    nonce TEXT NOT NULL,
+    code_verifier TEXT NOT NULL,
+    device_address TEXT NOT NULL DEFAULT '',
+    link_email TEXT NOT NULL DEFAULT '',
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- saml_logins are the SAML sign ins in progress, keyed by the hash of the relay state.
+-- request_id is the AuthnRequest the response must answer
+CREATE TABLE IF NOT EXISTS saml_logins (
+    relay_state_hash TEXT PRIMARY KEY,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    connection TEXT NOT NULL,
+    request_id TEXT NOT NULL,
+    device_address TEXT NOT NULL DEFAULT '',
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- saml_assertions is the replay cache: an assertion id of an identity provider is accepted once
+-- and kept until the assertion expires
+CREATE TABLE IF NOT EXISTS saml_assertions (
+    connection TEXT NOT NULL,
+    assertion_id TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (connection, assertion_id)
+);
+
+-- pow_stamps are the nonces of the solved proof of work stamps, a stamp is accepted once
+-- and kept until it expires
+CREATE TABLE IF NOT EXISTS pow_stamps (
+    nonce TEXT PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- client_assertions are the jti of the private_key_jwt assertions a client authenticated with,
+-- an assertion is accepted once and kept until it expires
+CREATE TABLE IF NOT EXISTS client_assertions (
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    client_id TEXT NOT NULL,
+    jti TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (tenant_id, client_id, jti)
+);
+
+-- admin_bootstraps marks the tenants whose first administrators were granted from the config,
+-- or that had an admin already. Later starts never grant a role by email
+CREATE TABLE IF NOT EXISTS admin_bootstraps (
+    tenant_id TEXT PRIMARY KEY,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
 `
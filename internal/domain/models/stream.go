@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// reasons a stream session is revoked
+const (
+	// StreamRevokedDisplaced is a session kicked to make room for a newer one over the limit
+	StreamRevokedDisplaced = "displaced"
+	// StreamRevokedTimeout is a session whose heartbeats stopped arriving
+	StreamRevokedTimeout = "timeout"
+)
+
+// StreamSession is a playback in progress, kept alive by heartbeats
+type StreamSession struct {
+	ID            string     `db:"id"`
+	DeviceAddress string     `db:"device_address"`
+	StartedAt     time.Time  `db:"started_at"`
+	LastSeenAt    time.Time  `db:"last_seen_at"`
+	RevokedAt     *time.Time `db:"revoked_at"`
+	RevokeReason  string     `db:"revoke_reason"`
+}
+
+func (s StreamSession) Revoked() bool {
+	return s.RevokedAt != nil
+}
@@ -7,4 +7,8 @@ type User struct {
 	Email            string    `db:"email"`
 	PassHash         []byte    `db:"password"`
 	RegistrationTime time.Time `db:"registration_time"`
+	// set when the owner reported an unrecognized login, Login is refused until the password is reset
+	PasswordResetRequired bool `db:"password_reset_required"`
+	// TenantID is the brand the account belongs to, the email is unique within it
+	TenantID string `db:"tenant_id"`
 }
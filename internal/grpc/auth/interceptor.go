@@ -2,30 +2,70 @@ package authgrpc
 
 import (
 	"context"
+	"errors"
+	"net"
 	"time"
+	"vieo/auth/internal/lib/clientinfo"
 	"vieo/auth/internal/lib/jwt"
 	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/services/pat"
 
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
 type AuthInterceptor struct {
 	secretKey string
 	logger    *logger.Logger
+	// methods maps the protected methods to the permissions the token must grant,
+	// a method with no permissions only needs a valid token
+	methods map[string][]string
+	// clientMethods are the protected methods that accept tokens issued to clients,
+	// the others are only for the tokens of the user
+	clientMethods map[string]bool
+	// personalTokenMethods are the protected methods that accept personal access tokens, the
+	// others mint sessions, link identities or manage tokens and need the user's own login
+	personalTokenMethods map[string]bool
+	tokens               TokenVerifier
+}
+
+// TokenVerifier checks the personal access tokens, JWTs are checked by the interceptor itself
+type TokenVerifier interface {
+	Verify(
+		ctx context.Context,
+		token string,
+	) (jwt.Claims, error)
 }
 
 func NewAuthInterceptor(
 	secretKey string,
 	logger *logger.Logger,
+	methods map[string][]string,
+	clientMethods []string,
+	personalTokenMethods []string,
+	tokens TokenVerifier,
 ) *AuthInterceptor {
 	return &AuthInterceptor{
-		secretKey: secretKey,
-		logger:    logger,
+		secretKey:            secretKey,
+		logger:               logger,
+		methods:              methods,
+		clientMethods:        methodSet(clientMethods),
+		personalTokenMethods: methodSet(personalTokenMethods),
+		tokens:               tokens,
+	}
+}
+
+func methodSet(methods []string) map[string]bool {
+	set := make(map[string]bool, len(methods))
+	for _, method := range methods {
+		set[method] = true
 	}
+	return set
 }
 
 func (interceptor *AuthInterceptor) Authorize() grpc.UnaryServerInterceptor {
@@ -35,32 +75,160 @@ func (interceptor *AuthInterceptor) Authorize() grpc.UnaryServerInterceptor {
 		info *grpc.UnaryServerInfo,
 		handler grpc.UnaryHandler,
 	) (interface{}, error) {
-		protectedMethods := map[string]bool{
-			// here are the methods for which this interceptor is called
-			"/auth_v1.Auth/CheckToken": true,
-		}
-		if protectedMethods[info.FullMethod] {
-			md, ok := metadata.FromIncomingContext(ctx)
-			if !ok {
-				return nil, status.Errorf(codes.Unauthenticated, "metadata is not provided")
-			}
-
-			var accessToken string
-			if val, ok := md["authorization"]; ok && len(val) > 0 {
-				accessToken = val[0]
-			} else {
-				return nil, status.Errorf(codes.Unauthenticated, "token is not provided")
-			}
-			_, _, err := jwt.DecodeToken(interceptor.secretKey, accessToken)
-			if err != nil {
-				return nil, status.Errorf(codes.PermissionDenied, "token is not valid")
-			}
+		ctx, err := interceptor.authorize(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
 		}
 
 		return handler(ctx, req)
 	}
 }
 
+// AuthorizeStream is Authorize for the streaming methods
+func (interceptor *AuthInterceptor) AuthorizeStream() grpc.StreamServerInterceptor {
+	return func(
+		srv any,
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		ctx, err := interceptor.authorize(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// authorize puts the claims of the token into the context of a protected method
+func (interceptor *AuthInterceptor) authorize(ctx context.Context, method string) (context.Context, error) {
+	// here are the methods for which this interceptor is called
+	required, protected := interceptor.methods[method]
+	if !protected {
+		return interceptor.withGuest(ctx), nil
+	}
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "metadata is not provided")
+	}
+
+	var accessToken string
+	if val, ok := md["authorization"]; ok && len(val) > 0 {
+		accessToken = val[0]
+	} else {
+		return nil, status.Errorf(codes.Unauthenticated, "token is not provided")
+	}
+	claims, err := interceptor.verify(ctx, accessToken)
+	if err != nil {
+		if errors.Is(err, pat.ErrInvalidToken) || !pat.IsPersonalToken(accessToken) {
+			return nil, status.Errorf(codes.PermissionDenied, "token is not valid")
+		}
+		interceptor.logger.Error("failed to verify token", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "internal server error")
+	}
+	// guest tokens are for browsing the catalog, not for the account methods
+	if claims.GuestID != "" {
+		return nil, status.Errorf(codes.PermissionDenied, "guest token is not allowed")
+	}
+	// a client acts within its scopes, the account methods are for the user's own tokens
+	if claims.ClientID != "" && !interceptor.clientMethods[method] {
+		return nil, status.Errorf(codes.PermissionDenied, "client token is not allowed")
+	}
+	// a personal token is for scripting within its scopes, not for signing in or widening its own access
+	if claims.PersonalTokenID != 0 && !interceptor.personalTokenMethods[method] {
+		return nil, status.Errorf(codes.PermissionDenied, "personal access token is not allowed")
+	}
+	if !claims.HasPermissions(required...) {
+		return nil, status.Errorf(codes.PermissionDenied, "permission denied")
+	}
+
+	return context.WithValue(ctx, claimsKey{}, claims), nil
+}
+
+// withGuest puts the claims of a guest token, if the request carries one, into the context of
+// a public method, so that signing up or in carries the guest into the account
+func (interceptor *AuthInterceptor) withGuest(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md["authorization"]) == 0 || pat.IsPersonalToken(md["authorization"][0]) {
+		return ctx
+	}
+	claims, err := interceptor.verify(ctx, md["authorization"][0])
+	if err != nil || claims.GuestID == "" {
+		return ctx
+	}
+
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// verify accepts a personal access token or a JWT of the tenant of the request,
+// including the ones issued to clients
+func (interceptor *AuthInterceptor) verify(ctx context.Context, token string) (jwt.Claims, error) {
+	if pat.IsPersonalToken(token) {
+		return interceptor.tokens.Verify(ctx, token)
+	}
+
+	claims, err := jwt.DecodeClientToken(tenant.SecretKey(ctx, interceptor.secretKey), token)
+	if err != nil {
+		return jwt.Claims{}, err
+	}
+	// tokens issued before tenants existed have no audience and belong to the default tenant
+	aud := claims.Tenant
+	if aud == "" {
+		aud = tenant.DefaultID
+	}
+	if aud != tenant.ID(ctx) {
+		return jwt.Claims{}, jwt.ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+// ClientInfo puts the address, user agent and challenge response of the caller into the context
+func (interceptor *AuthInterceptor) ClientInfo() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req any,
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (any, error) {
+		return handler(withClientInfo(ctx), req)
+	}
+}
+
+// ClientInfoStream is ClientInfo for the streaming methods
+func (interceptor *AuthInterceptor) ClientInfoStream() grpc.StreamServerInterceptor {
+	return func(
+		srv any,
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		return handler(srv, &serverStream{ServerStream: ss, ctx: withClientInfo(ss.Context())})
+	}
+}
+
+func withClientInfo(ctx context.Context) context.Context {
+	var ci clientinfo.Info
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		ci.IP = p.Addr.String()
+		if host, _, err := net.SplitHostPort(ci.IP); err == nil {
+			ci.IP = host
+		}
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if val := md.Get("user-agent"); len(val) > 0 {
+			ci.UserAgent = val[0]
+		}
+		if val := md.Get("x-challenge-response"); len(val) > 0 {
+			ci.ChallengeResponse = val[0]
+		}
+	}
+
+	return clientinfo.NewContext(ctx, ci)
+}
+
 func (interceptor *AuthInterceptor) Logger() grpc.UnaryServerInterceptor {
 	return func(ctx context.Context,
 		req any,
@@ -89,3 +257,52 @@ func (interceptor *AuthInterceptor) Logger() grpc.UnaryServerInterceptor {
 		return resp, err
 	}
 }
+
+// LoggerStream is Logger for the streaming methods
+func (interceptor *AuthInterceptor) LoggerStream() grpc.StreamServerInterceptor {
+	return func(
+		srv any,
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		const op = "auth.AuthInterceptor.LoggerStream"
+		log := interceptor.logger.With(
+			zap.String("op", op),
+			zap.String("method", info.FullMethod),
+		)
+		startTime := time.Now()
+
+		err := handler(srv, ss)
+
+		log = log.With(
+			zap.Duration("duration", time.Since(startTime)),
+		)
+
+		if err != nil {
+			log.Error("stream failed", zap.Error(err))
+		} else {
+			log.Info("stream completed successfully")
+		}
+
+		return err
+	}
+}
+
+// serverStream replaces the context of a stream with the one the interceptors filled in
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+type claimsKey struct{}
+
+// claimsFromContext returns the claims of the access token that passed Authorize
+func claimsFromContext(ctx context.Context) (jwt.Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(jwt.Claims)
+	return claims, ok
+}
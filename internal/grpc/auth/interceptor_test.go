@@ -0,0 +1,91 @@
+package authgrpc
+
+import (
+	"context"
+	"testing"
+	"time"
+	"vieo/auth/internal/lib/jwt"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/services/pat"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// staticTokens resolves every personal access token to the same claims
+type staticTokens jwt.Claims
+
+func (s staticTokens) Verify(context.Context, string) (jwt.Claims, error) {
+	return jwt.Claims(s), nil
+}
+
+func TestAuthorize(t *testing.T) {
+	const (
+		secretKey     = "secret"
+		checkToken    = "/auth_v1.Auth/CheckToken"
+		approveQR     = "/auth_v1.Auth/ApproveQRLogin"
+		linkIdentity  = "/auth_v1.Auth/LinkIdentity"
+		createToken   = "/auth_v1.Auth/CreatePersonalAccessToken"
+		write         = "/authz_v1.Authz/Write"
+		personalToken = pat.Prefix + "token"
+	)
+	methods := map[string][]string{
+		checkToken:   {},
+		approveQR:    {},
+		linkIdentity: {},
+		createToken:  {},
+		write:        {"relations:write"},
+	}
+	login, err := jwt.NewToken(jwt.Claims{Email: "user@example.com", Tenant: tenant.DefaultID}, time.Hour, secretKey)
+	if err != nil {
+		t.Fatalf("NewToken: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		token       string
+		method      string
+		permissions []string
+		want        codes.Code
+	}{
+		{"login on a session method", login, approveQR, nil, codes.OK},
+		{"personal token on an open method", personalToken, checkToken, nil, codes.OK},
+		{"personal token with the scope", personalToken, write, []string{"relations:write"}, codes.OK},
+		{"personal token without the scope", personalToken, write, nil, codes.PermissionDenied},
+		{"personal token approving a QR login", personalToken, approveQR, nil, codes.PermissionDenied},
+		{"personal token linking an identity", personalToken, linkIdentity, nil, codes.PermissionDenied},
+		{"personal token creating a token", personalToken, createToken, []string{"relations:write"}, codes.PermissionDenied},
+		{"no token", "", checkToken, nil, codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interceptor := NewAuthInterceptor(
+				secretKey,
+				&logger.Logger{SugaredLogger: zap.NewNop().Sugar()},
+				methods,
+				nil,
+				[]string{checkToken, write},
+				staticTokens{Email: "user@example.com", Permissions: tt.permissions, PersonalTokenID: 1},
+			)
+			md := metadata.MD{}
+			if tt.token != "" {
+				md.Set("authorization", tt.token)
+			}
+			ctx := metadata.NewIncomingContext(context.Background(), md)
+
+			ctx, err := interceptor.authorize(ctx, tt.method)
+			if code := status.Code(err); code != tt.want {
+				t.Fatalf("authorize code = %s, want %s (%v)", code, tt.want, err)
+			}
+			if err != nil {
+				return
+			}
+			if claims, ok := claimsFromContext(ctx); !ok || claims.Email != "user@example.com" {
+				t.Errorf("claims = %+v, want the claims of user@example.com", claims)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package authgrpc
+
+import (
+	"context"
+	"vieo/auth/internal/lib/clientinfo"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/ratelimit"
+	"vieo/auth/internal/lib/tenant"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// MethodLimits are the token bucket policies of one gRPC method.
+// Method is shared by all callers, the others are kept per client ip, per email and per device of the request
+type MethodLimits struct {
+	Method ratelimit.Policy
+	IP     ratelimit.Policy
+	Email  ratelimit.Policy
+	Device ratelimit.Policy
+}
+
+type RateLimitInterceptor struct {
+	limiter ratelimit.Limiter
+	limits  map[string]MethodLimits
+	logger  *logger.Logger
+}
+
+func NewRateLimitInterceptor(
+	limiter ratelimit.Limiter,
+	limits map[string]MethodLimits,
+	logger *logger.Logger,
+) *RateLimitInterceptor {
+	return &RateLimitInterceptor{
+		limiter: limiter,
+		limits:  limits,
+		logger:  logger,
+	}
+}
+
+// limitCheck is one bucket the request has to take a token from
+type limitCheck struct {
+	kind   string
+	key    string
+	policy ratelimit.Policy
+}
+
+// emailRequest and deviceRequest are implemented by the generated requests that carry these fields
+type emailRequest interface {
+	GetEmail() string
+}
+
+type deviceRequest interface {
+	GetDeviceAddress() string
+}
+
+func (interceptor *RateLimitInterceptor) Limit() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req any,
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (any, error) {
+		if err := interceptor.allow(ctx, info.FullMethod, req); err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// LimitStream is Limit for the streaming methods. The buckets are taken for every message the client
+// sends, the request of a server streaming method is its only one
+func (interceptor *RateLimitInterceptor) LimitStream() grpc.StreamServerInterceptor {
+	return func(
+		srv any,
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		if _, ok := interceptor.limits[info.FullMethod]; !ok {
+			return handler(srv, ss)
+		}
+
+		return handler(srv, &limitedStream{ServerStream: ss, interceptor: interceptor, method: info.FullMethod})
+	}
+}
+
+// limitedStream checks the rate limits once a message is received, when its email and device are known
+type limitedStream struct {
+	grpc.ServerStream
+	interceptor *RateLimitInterceptor
+	method      string
+}
+
+func (s *limitedStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	return s.interceptor.allow(s.Context(), s.method, m)
+}
+
+// allow takes a token from every bucket of the method the request falls into
+func (interceptor *RateLimitInterceptor) allow(ctx context.Context, method string, req any) error {
+	limits, ok := interceptor.limits[method]
+	if !ok {
+		return nil
+	}
+
+	checks := []limitCheck{
+		{kind: "method", key: method, policy: limits.Method},
+	}
+	if ip := clientinfo.FromContext(ctx).IP; ip != "" {
+		checks = append(checks, limitCheck{kind: "ip", key: method + ":" + ip, policy: limits.IP})
+	}
+	// the same email or device in two tenants are two different accounts
+	scope := method + ":" + tenant.ID(ctx) + ":"
+	if r, ok := req.(emailRequest); ok && r.GetEmail() != "" {
+		checks = append(checks, limitCheck{kind: "email", key: scope + r.GetEmail(), policy: limits.Email})
+	}
+	if r, ok := req.(deviceRequest); ok && r.GetDeviceAddress() != "" {
+		checks = append(checks, limitCheck{kind: "device", key: scope + r.GetDeviceAddress(), policy: limits.Device})
+	}
+
+	// a request rejected by one bucket gives back the tokens it took from the others,
+	// so retries against a blocked key do not drain the method and ip buckets
+	var taken []limitCheck
+	for _, c := range checks {
+		allowed, retryAfter, err := interceptor.limiter.Allow(ctx, c.kind+":"+c.key, c.policy)
+		if err != nil {
+			// the limiter must not take the service down with it
+			interceptor.logger.Error("rate limiter failed",
+				zap.String("method", method),
+				zap.Error(err),
+			)
+			continue
+		}
+		if !allowed {
+			interceptor.logger.Warn("rate limit exceeded",
+				zap.String("method", method),
+				zap.String("limit", c.kind),
+			)
+			interceptor.refund(ctx, method, taken)
+			return retryError("too many requests", retryAfter)
+		}
+		taken = append(taken, c)
+	}
+
+	return nil
+}
+
+// refund gives back the tokens a rejected request took
+func (interceptor *RateLimitInterceptor) refund(ctx context.Context, method string, taken []limitCheck) {
+	for _, c := range taken {
+		if err := interceptor.limiter.Refund(ctx, c.kind+":"+c.key, c.policy); err != nil {
+			interceptor.logger.Error("failed to refund rate limit",
+				zap.String("method", method),
+				zap.String("limit", c.kind),
+				zap.Error(err),
+			)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package authgrpc
+
+import (
+	"context"
+	"testing"
+	"time"
+	"vieo/auth/internal/lib/clientinfo"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/ratelimit"
+	"vieo/auth/internal/lib/tenant"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// countingLimiter allows a key while it has tokens left and counts the refunds
+type countingLimiter struct {
+	tokens  map[string]int
+	refunds map[string]int
+}
+
+func (l *countingLimiter) Allow(_ context.Context, key string, _ ratelimit.Policy) (bool, time.Duration, error) {
+	if l.tokens[key] <= 0 {
+		return false, time.Second, nil
+	}
+	l.tokens[key]--
+	return true, 0, nil
+}
+
+func (l *countingLimiter) Refund(_ context.Context, key string, _ ratelimit.Policy) error {
+	l.tokens[key]++
+	l.refunds[key]++
+	return nil
+}
+
+type emailReq struct{ email string }
+
+func (r emailReq) GetEmail() string { return r.email }
+
+func TestRateLimitRefundsRejectedRequests(t *testing.T) {
+	const method = "/auth.Auth/Login"
+	var (
+		methodKey = "method:" + method
+		ipKey     = "ip:" + method + ":10.0.0.1"
+		emailKey  = "email:" + method + ":" + tenant.DefaultID + ":user@example.com"
+	)
+	policy := ratelimit.Policy{Limit: 1, Per: time.Minute}
+
+	tests := []struct {
+		name        string
+		tokens      map[string]int
+		wantCode    codes.Code
+		wantTokens  map[string]int
+		wantRefunds map[string]int
+	}{
+		{
+			name:        "all buckets allow",
+			tokens:      map[string]int{methodKey: 5, ipKey: 5, emailKey: 5},
+			wantCode:    codes.OK,
+			wantTokens:  map[string]int{methodKey: 4, ipKey: 4, emailKey: 4},
+			wantRefunds: map[string]int{},
+		},
+		{
+			name:        "last bucket rejects",
+			tokens:      map[string]int{methodKey: 5, ipKey: 5, emailKey: 0},
+			wantCode:    codes.ResourceExhausted,
+			wantTokens:  map[string]int{methodKey: 5, ipKey: 5, emailKey: 0},
+			wantRefunds: map[string]int{methodKey: 1, ipKey: 1},
+		},
+		{
+			name:        "first bucket rejects",
+			tokens:      map[string]int{methodKey: 0, ipKey: 5, emailKey: 5},
+			wantCode:    codes.ResourceExhausted,
+			wantTokens:  map[string]int{methodKey: 0, ipKey: 5, emailKey: 5},
+			wantRefunds: map[string]int{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := &countingLimiter{tokens: tt.tokens, refunds: map[string]int{}}
+			interceptor := NewRateLimitInterceptor(
+				limiter,
+				map[string]MethodLimits{method: {Method: policy, IP: policy, Email: policy}},
+				&logger.Logger{SugaredLogger: zap.NewNop().Sugar()},
+			)
+			ctx := clientinfo.NewContext(context.Background(), clientinfo.Info{IP: "10.0.0.1"})
+			handler := func(context.Context, any) (any, error) { return "ok", nil }
+
+			_, err := interceptor.Limit()(ctx, emailReq{email: "user@example.com"}, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("code = %s, want %s", code, tt.wantCode)
+			}
+			for key, want := range tt.wantTokens {
+				if got := limiter.tokens[key]; got != want {
+					t.Errorf("%s tokens = %d, want %d", key, got, want)
+				}
+			}
+			if len(limiter.refunds) != len(tt.wantRefunds) {
+				t.Errorf("refunds = %v, want %v", limiter.refunds, tt.wantRefunds)
+			}
+			for key, want := range tt.wantRefunds {
+				if got := limiter.refunds[key]; got != want {
+					t.Errorf("%s refunds = %d, want %d", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+// recvStream hands the request to the handler of a streaming method
+type recvStream struct {
+	grpc.ServerStream
+	ctx context.Context
+	req emailReq
+}
+
+func (s *recvStream) Context() context.Context { return s.ctx }
+
+func (s *recvStream) RecvMsg(m any) error {
+	*m.(*emailReq) = s.req
+	return nil
+}
+
+func TestLimitStream(t *testing.T) {
+	const method = "/auth.Auth/Watch"
+	var (
+		ipKey    = "ip:" + method + ":10.0.0.1"
+		emailKey = "email:" + method + ":" + tenant.DefaultID + ":user@example.com"
+	)
+	policy := ratelimit.Policy{Limit: 1, Per: time.Minute}
+	limiter := &countingLimiter{
+		tokens:  map[string]int{"method:" + method: 5, ipKey: 5, emailKey: 1},
+		refunds: map[string]int{},
+	}
+	interceptor := NewRateLimitInterceptor(
+		limiter,
+		map[string]MethodLimits{method: {Method: policy, IP: policy, Email: policy}},
+		&logger.Logger{SugaredLogger: zap.NewNop().Sugar()},
+	)
+	ctx := clientinfo.NewContext(context.Background(), clientinfo.Info{IP: "10.0.0.1"})
+	// the handler of a server streaming method receives its request first
+	handler := func(_ any, ss grpc.ServerStream) error {
+		var req emailReq
+		return ss.RecvMsg(&req)
+	}
+	watch := func(fullMethod string) error {
+		ss := &recvStream{ctx: ctx, req: emailReq{email: "user@example.com"}}
+		return interceptor.LimitStream()(nil, ss, &grpc.StreamServerInfo{FullMethod: fullMethod}, handler)
+	}
+
+	if err := watch(method); err != nil {
+		t.Fatalf("first stream: %v", err)
+	}
+	if err := watch(method); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("second stream code = %s, want %s", status.Code(err), codes.ResourceExhausted)
+	}
+	if limiter.tokens[ipKey] != 4 || limiter.refunds[ipKey] != 1 {
+		t.Errorf("ip tokens = %d, refunds = %d, want the rejected stream refunded", limiter.tokens[ipKey], limiter.refunds[ipKey])
+	}
+	// a method without limits streams untouched
+	if err := watch("/auth.Auth/Other"); err != nil {
+		t.Errorf("stream of a method without limits: %v", err)
+	}
+}
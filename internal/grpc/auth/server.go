@@ -4,14 +4,36 @@ import (
 	"context"
 	"errors"
 	"regexp"
+	"strings"
+	"time"
+	"vieo/auth/internal/domain/models"
 	"vieo/auth/internal/lib/jwt"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/services/activity"
 	"vieo/auth/internal/services/auth"
+	"vieo/auth/internal/services/clients"
+	"vieo/auth/internal/services/guests"
+	"vieo/auth/internal/services/households"
+	"vieo/auth/internal/services/oauth"
+	"vieo/auth/internal/services/orgs"
+	"vieo/auth/internal/services/pat"
+	"vieo/auth/internal/services/profiles"
+	"vieo/auth/internal/services/qrlogin"
+	"vieo/auth/internal/services/risk"
+	"vieo/auth/internal/services/saml"
+	"vieo/auth/internal/services/security"
+	"vieo/auth/internal/services/social"
+	"vieo/auth/internal/services/streams"
 	"vieo/auth/internal/storage"
 
 	desc "github.com/Avalance-rl/contract-vieo/pkg/auth_v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // Auth interface for the service layer
@@ -32,37 +54,420 @@ type Auth interface {
 		deviceAddress string,
 		accessToken string,
 	) (token string, err error)
+	SwitchOrganization(
+		ctx context.Context,
+		email string,
+		deviceAddress string,
+		orgID int64,
+		profileID int64,
+	) (token string, err error)
+	SelectProfile(
+		ctx context.Context,
+		email string,
+		deviceAddress string,
+		orgID int64,
+		profileID int64,
+		pin string,
+	) (token string, err error)
+	VerifyToken(
+		ctx context.Context,
+		accessToken string,
+	) (jwt.Claims, error)
+}
+
+// Activity interface for the security log of the account
+type Activity interface {
+	ListSecurityEvents(
+		ctx context.Context,
+		email string,
+		pageSize int,
+		pageToken string,
+	) (events []models.SecurityEvent, nextPageToken string, err error)
+}
+
+// Security interface for the account recovery flows
+type Security interface {
+	ReportUnrecognizedLogin(
+		ctx context.Context,
+		reportToken string,
+	) error
+	ResetPassword(
+		ctx context.Context,
+		resetToken string,
+		newPassword string,
+	) error
+}
+
+// Lockout interface for lifting brute-force locks
+type Lockout interface {
+	Unlock(
+		ctx context.Context,
+		email string,
+	) error
+	UnlockByLink(
+		ctx context.Context,
+		unlockToken string,
+	) error
+}
+
+// Access interface for the role management
+type Access interface {
+	AssignRole(
+		ctx context.Context,
+		email string,
+		role string,
+	) error
+	RevokeRole(
+		ctx context.Context,
+		email string,
+		role string,
+	) error
+	UserAccess(
+		ctx context.Context,
+		email string,
+	) (roles []string, permissions []string, err error)
+}
+
+// Organizations interface for the team accounts
+type Organizations interface {
+	CreateOrganization(
+		ctx context.Context,
+		ownerEmail string,
+		name string,
+		maxDevices int,
+	) (models.Organization, error)
+	InviteMember(
+		ctx context.Context,
+		actorEmail string,
+		orgID int64,
+		email string,
+		role string,
+	) error
+	AcceptInvitation(
+		ctx context.Context,
+		email string,
+		orgID int64,
+	) error
+	RemoveMember(
+		ctx context.Context,
+		actorEmail string,
+		orgID int64,
+		email string,
+	) error
+	Memberships(
+		ctx context.Context,
+		email string,
+	) ([]models.Membership, error)
+}
+
+// PersonalTokens interface for the personal access tokens
+type PersonalTokens interface {
+	Create(
+		ctx context.Context,
+		email string,
+		name string,
+		scopes []string,
+		ttl time.Duration,
+		granted []string,
+	) (token string, pat models.PersonalAccessToken, err error)
+	List(
+		ctx context.Context,
+		email string,
+	) ([]models.PersonalAccessToken, error)
+	Revoke(
+		ctx context.Context,
+		email string,
+		id int64,
+	) error
+	Verify(
+		ctx context.Context,
+		token string,
+	) (jwt.Claims, error)
+}
+
+// Clients interface for the service accounts and the client_credentials grant
+type Clients interface {
+	CreateClient(
+		ctx context.Context,
+		name string,
+		scopes []string,
+		tokenTTL time.Duration,
+		publicKey string,
+		redirectURIs []string,
+		public bool,
+		granted []string,
+	) (client models.Client, secret string, err error)
+	DeleteClient(
+		ctx context.Context,
+		clientID string,
+	) error
+	ClientCredentials(
+		ctx context.Context,
+		creds clients.Credentials,
+		scopes []string,
+	) (clients.Token, error)
+}
+
+// DeviceVerifier interface for approving a device authorization from a signed in device
+type DeviceVerifier interface {
+	VerifyDeviceCode(
+		ctx context.Context,
+		email string,
+		userCode string,
+		decision string,
+	) (oauth.DevicePrompt, error)
+}
+
+// QRLogin interface for the cross-device sign in of TVs by a QR code
+type QRLogin interface {
+	Start(
+		ctx context.Context,
+		deviceAddress string,
+	) (qrlogin.Session, error)
+	Approve(
+		ctx context.Context,
+		email string,
+		id string,
+	) (deviceAddress string, err error)
+	Watch(
+		ctx context.Context,
+		id string,
+		secret string,
+		send func(qrlogin.Update) error,
+	) error
+}
+
+// Profiles interface for the viewer profiles of an account
+type Profiles interface {
+	Create(
+		ctx context.Context,
+		email string,
+		update profiles.Update,
+	) (models.Profile, error)
+	List(
+		ctx context.Context,
+		email string,
+	) ([]models.Profile, error)
+	Update(
+		ctx context.Context,
+		email string,
+		id int64,
+		update profiles.Update,
+		currentPIN string,
+	) (models.Profile, error)
+	Delete(
+		ctx context.Context,
+		email string,
+		id int64,
+		currentPIN string,
+	) error
+}
+
+type Households interface {
+	Create(
+		ctx context.Context,
+		email string,
+	) (models.Household, error)
+	Get(
+		ctx context.Context,
+		email string,
+	) (models.Household, []models.HouseholdMember, error)
+	Invite(
+		ctx context.Context,
+		ownerEmail string,
+		email string,
+	) error
+	Accept(
+		ctx context.Context,
+		email string,
+		householdID int64,
+	) error
+	Remove(
+		ctx context.Context,
+		email string,
+		memberEmail string,
+	) error
+}
+
+type Streams interface {
+	HeartbeatInterval() time.Duration
+	Start(
+		ctx context.Context,
+		email string,
+		deviceAddress string,
+		entitlements models.Entitlements,
+	) (models.StreamSession, error)
+	Heartbeat(
+		ctx context.Context,
+		email string,
+		id string,
+	) (models.StreamSession, error)
+	Stop(
+		ctx context.Context,
+		email string,
+		id string,
+	) error
+}
+
+type Guests interface {
+	Login(
+		ctx context.Context,
+		guestID string,
+		deviceAddress string,
+		metadata map[string]string,
+	) (string, models.Guest, error)
+	Merge(
+		ctx context.Context,
+		email string,
+		guestID string,
+	) error
+}
+
+type Social interface {
+	Start(
+		ctx context.Context,
+		provider string,
+		deviceAddress string,
+	) (social.Authorization, error)
+	StartLink(
+		ctx context.Context,
+		email string,
+		provider string,
+	) (social.Authorization, error)
+	Complete(
+		ctx context.Context,
+		state string,
+		code string,
+	) (token string, created bool, err error)
+	CompleteLink(
+		ctx context.Context,
+		email string,
+		state string,
+		code string,
+	) (models.Identity, error)
+	Identities(
+		ctx context.Context,
+		email string,
+	) ([]models.Identity, error)
+	Unlink(
+		ctx context.Context,
+		email string,
+		provider string,
+	) error
+}
+
+type SAML interface {
+	Start(
+		ctx context.Context,
+		connection string,
+		deviceAddress string,
+	) (saml.Authorization, error)
+	Complete(
+		ctx context.Context,
+		samlResponse string,
+		relayState string,
+	) (token string, created bool, err error)
 }
 
 // serverAPI handles requests
 type serverAPI struct {
 	desc.UnimplementedAuthServer //
 	auth                         Auth
+	activity                     Activity
+	security                     Security
+	lockout                      Lockout
+	access                       Access
+	orgs                         Organizations
+	tokens                       PersonalTokens
+	clients                      Clients
+	devices                      DeviceVerifier
+	qrLogin                      QRLogin
+	profiles                     Profiles
+	households                   Households
+	streams                      Streams
+	guests                       Guests
+	social                       Social
+	saml                         SAML
+}
+
+// Services are the service layer behind the handlers
+type Services struct {
+	Auth       Auth
+	Activity   Activity
+	Security   Security
+	Lockout    Lockout
+	Access     Access
+	Orgs       Organizations
+	Tokens     PersonalTokens
+	Clients    Clients
+	Devices    DeviceVerifier
+	QRLogin    QRLogin
+	Profiles   Profiles
+	Households Households
+	Streams    Streams
+	Guests     Guests
+	Social     Social
+	SAML       SAML
 }
 
 // Register processes requests that come to the grpc server
-func Register(gRPC *grpc.Server, auth Auth) {
-	desc.RegisterAuthServer(gRPC, &serverAPI{auth: auth}) // регистрация обработчика
+func Register(gRPC *grpc.Server, services Services) {
+	desc.RegisterAuthServer(gRPC, &serverAPI{
+		auth:       services.Auth,
+		activity:   services.Activity,
+		security:   services.Security,
+		lockout:    services.Lockout,
+		access:     services.Access,
+		orgs:       services.Orgs,
+		tokens:     services.Tokens,
+		clients:    services.Clients,
+		devices:    services.Devices,
+		qrLogin:    services.QRLogin,
+		profiles:   services.Profiles,
+		households: services.Households,
+		streams:    services.Streams,
+		guests:     services.Guests,
+		social:     services.Social,
+		saml:       services.SAML,
+	}) // регистрация обработчика
 }
 
 func (s *serverAPI) Login(
 	ctx context.Context,
 	req *desc.LoginRequest,
 ) (*desc.LoginResponse, error) {
-	if !isEmailValid(req.Email) || !isPasswordValid(req.GetPassword()) || req.GetDeviceAddress() == "" {
+	if !isEmailValid(req.Email) || !isPasswordValid(ctx, req.GetPassword()) || req.GetDeviceAddress() == "" {
 		return nil, status.Error(codes.InvalidArgument, "not valid email or password")
 	}
 	token, err := s.auth.Login(ctx, req.GetEmail(), req.GetPassword(), req.GetDeviceAddress())
 	if err != nil {
+		var required *risk.ChallengeRequiredError
+		if errors.As(err, &required) {
+			return nil, challengeError(required)
+		}
+		var locked *security.LockedError
+		if errors.As(err, &locked) {
+			return nil, retryError("too many failed attempts, account is temporarily locked", locked.RetryAfter)
+		}
 		if errors.Is(err, storage.ErrUserNotFound) {
 			return nil, status.Error(codes.NotFound, "user not found")
 		}
 		if errors.Is(err, storage.ErrDeviceLimitExceeded) {
 			return nil, status.Error(codes.ResourceExhausted, "device limit exceeded")
 		}
+		if errors.Is(err, storage.ErrHouseholdDeviceLimitExceeded) {
+			return nil, status.Error(codes.ResourceExhausted, "household device limit exceeded")
+		}
 		if errors.Is(err, auth.ErrWrongPassword) {
 			return nil, status.Error(codes.Unauthenticated, "wrong password")
 		}
+		// the only answer for bad credentials when accounts are hidden
+		if errors.Is(err, auth.ErrInvalidCredentials) {
+			return nil, status.Error(codes.Unauthenticated, "invalid email or password")
+		}
+		if errors.Is(err, auth.ErrPasswordResetRequired) {
+			return nil, status.Error(codes.FailedPrecondition, "password reset required")
+		}
 		// in theory this case should not happen, because either the interceptor will intercept the user without an access token and
 		// throw it to the refresh line or front
 		if errors.Is(err, storage.ErrDeviceAlreadyExists) {
@@ -71,6 +476,7 @@ func (s *serverAPI) Login(
 		return nil, status.Error(codes.Internal, "internal server error")
 
 	}
+	s.mergeGuest(ctx, req.GetEmail(), req.GetDeviceAddress())
 	return &desc.LoginResponse{
 		Token: token,
 	}, nil
@@ -80,21 +486,73 @@ func (s *serverAPI) Register(
 	ctx context.Context,
 	req *desc.RegisterRequest,
 ) (*desc.RegisterResponse, error) {
-	if !isEmailValid(req.Email) || !isPasswordValid(req.GetPassword()) {
+	if !isEmailValid(req.Email) || !isPasswordValid(ctx, req.GetPassword()) {
 		return nil, status.Error(codes.InvalidArgument, "not valid email or password")
 	}
 	uid, err := s.auth.RegisterNewUser(ctx, req.GetEmail(), req.GetPassword())
 	if err != nil {
+		var required *risk.ChallengeRequiredError
+		if errors.As(err, &required) {
+			return nil, challengeError(required)
+		}
 		if errors.Is(err, storage.ErrUserAlreadyExists) {
 			return nil, status.Error(codes.AlreadyExists, "user already exists")
 		}
+		if errors.Is(err, auth.ErrDirectoryUser) {
+			return nil, status.Error(codes.FailedPrecondition, "email is managed by the directory, sign in with it")
+		}
 
 		return nil, status.Error(codes.Internal, "internal server error")
 	}
+	// with hidden accounts a new account cannot be told from an existing one,
+	// the guest is then merged at the first login. The request names no device,
+	// the guest token was issued to the one signing up
+	if claims, ok := claimsFromContext(ctx); ok && uid > 0 {
+		s.mergeGuest(ctx, req.GetEmail(), claims.DeviceAddress)
+	}
 
 	return &desc.RegisterResponse{UserId: uid}, nil
 }
 
+// AnonymousLogin issues a guest token for browsing before signing up. Called with the guest token
+// of the same device it renews it and keeps the guest
+func (s *serverAPI) AnonymousLogin(
+	ctx context.Context,
+	req *desc.AnonymousLoginRequest,
+) (*desc.AnonymousLoginResponse, error) {
+	if req.GetDeviceAddress() == "" {
+		return nil, status.Error(codes.InvalidArgument, "device address is empty")
+	}
+
+	guestID := ""
+	if claims, ok := claimsFromContext(ctx); ok && claims.DeviceAddress == req.GetDeviceAddress() {
+		guestID = claims.GuestID
+	}
+	token, guest, err := s.guests.Login(ctx, guestID, req.GetDeviceAddress(), req.GetMetadata())
+	if err != nil {
+		switch {
+		case errors.Is(err, guests.ErrInvalidMetadata):
+			return nil, status.Error(codes.InvalidArgument, "too much metadata")
+		case errors.Is(err, storage.ErrGuestNotFound):
+			return nil, status.Error(codes.PermissionDenied, "guest token of another device")
+		}
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	return &desc.AnonymousLoginResponse{Token: token, GuestId: guest.ID}, nil
+}
+
+// mergeGuest carries the guest whose token came with the request into the account it signed up
+// or logged in to from the device of the guest, the device joins the devices of the account.
+// A failure does not fail the sign in, only the guest data is lost
+func (s *serverAPI) mergeGuest(ctx context.Context, email string, deviceAddress string) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok || claims.GuestID == "" || claims.DeviceAddress != deviceAddress {
+		return
+	}
+	_ = s.guests.Merge(ctx, email, claims.GuestID)
+}
+
 func (s *serverAPI) RefreshToken(
 	ctx context.Context,
 	req *desc.RefreshTokenRequest,
@@ -126,6 +584,12 @@ func (s *serverAPI) RefreshToken(
 		if errors.Is(err, auth.ErrAddressMismatch) {
 			return nil, status.Error(codes.FailedPrecondition, "address mismatch")
 		}
+		if errors.Is(err, auth.ErrNotMember) {
+			return nil, status.Error(codes.PermissionDenied, "not a member of the organization")
+		}
+		if errors.Is(err, storage.ErrProfileNotFound) {
+			return nil, status.Error(codes.PermissionDenied, "profile was deleted")
+		}
 		return nil, status.Error(codes.Internal, "internal server error")
 	}
 
@@ -139,12 +603,1390 @@ func (s *serverAPI) CheckToken(
 	return &desc.CheckTokenResponse{Message: "OK"}, nil
 }
 
-func isEmailValid(e string) bool {
-	emailRegex := regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,4}$`)
-	return emailRegex.MatchString(e)
+// ListSecurityEvents returns the security log of the token owner
+func (s *serverAPI) ListSecurityEvents(
+	ctx context.Context,
+	req *desc.ListSecurityEventsRequest,
+) (*desc.ListSecurityEventsResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if req.GetPageSize() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "page size is negative")
+	}
+
+	events, next, err := s.activity.ListSecurityEvents(ctx, claims.Email, int(req.GetPageSize()), req.GetPageToken())
+	if err != nil {
+		if errors.Is(err, activity.ErrInvalidPageToken) {
+			return nil, status.Error(codes.InvalidArgument, "invalid page token")
+		}
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	resp := &desc.ListSecurityEventsResponse{
+		Events:        make([]*desc.SecurityEvent, 0, len(events)),
+		NextPageToken: next,
+	}
+	for _, e := range events {
+		resp.Events = append(resp.Events, &desc.SecurityEvent{
+			Id:        e.ID,
+			Type:      e.Type,
+			Ip:        e.IP,
+			Device:    e.Device,
+			UserAgent: e.UserAgent,
+			Reason:    e.Reason,
+			CreatedAt: timestamppb.New(e.CreatedAt),
+		})
+	}
+
+	return resp, nil
+}
+
+// ReportUnrecognizedLogin handles the "this wasn't me" link from the new device notice
+func (s *serverAPI) ReportUnrecognizedLogin(
+	ctx context.Context,
+	req *desc.ReportUnrecognizedLoginRequest,
+) (*desc.ReportUnrecognizedLoginResponse, error) {
+	if req.GetToken() == "" {
+		return nil, status.Error(codes.InvalidArgument, "token is empty")
+	}
+
+	if err := s.security.ReportUnrecognizedLogin(ctx, req.GetToken()); err != nil {
+		if errors.Is(err, security.ErrInvalidLink) {
+			return nil, status.Error(codes.InvalidArgument, "invalid or expired link")
+		}
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	return &desc.ReportUnrecognizedLoginResponse{}, nil
+}
+
+func (s *serverAPI) ResetPassword(
+	ctx context.Context,
+	req *desc.ResetPasswordRequest,
+) (*desc.ResetPasswordResponse, error) {
+	if req.GetToken() == "" || !isPasswordValid(ctx, req.GetNewPassword()) {
+		return nil, status.Error(codes.InvalidArgument, "not valid token or password")
+	}
+
+	if err := s.security.ResetPassword(ctx, req.GetToken(), req.GetNewPassword()); err != nil {
+		if errors.Is(err, security.ErrInvalidLink) {
+			return nil, status.Error(codes.InvalidArgument, "invalid or expired link")
+		}
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	return &desc.ResetPasswordResponse{}, nil
+}
+
+// UnlockAccount lifts a brute-force lock, only for administrators
+func (s *serverAPI) UnlockAccount(
+	ctx context.Context,
+	req *desc.UnlockAccountRequest,
+) (*desc.UnlockAccountResponse, error) {
+	if !isEmailValid(req.GetEmail()) {
+		return nil, status.Error(codes.InvalidArgument, "not valid email")
+	}
+
+	if err := s.lockout.Unlock(ctx, req.GetEmail()); err != nil {
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	return &desc.UnlockAccountResponse{}, nil
+}
+
+// UnlockAccountByLink lifts a brute-force lock with the link from the lockout email
+func (s *serverAPI) UnlockAccountByLink(
+	ctx context.Context,
+	req *desc.UnlockAccountByLinkRequest,
+) (*desc.UnlockAccountByLinkResponse, error) {
+	if req.GetToken() == "" {
+		return nil, status.Error(codes.InvalidArgument, "token is empty")
+	}
+
+	if err := s.lockout.UnlockByLink(ctx, req.GetToken()); err != nil {
+		if errors.Is(err, security.ErrInvalidLink) {
+			return nil, status.Error(codes.InvalidArgument, "invalid or expired link")
+		}
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	return &desc.UnlockAccountByLinkResponse{}, nil
+}
+
+func (s *serverAPI) AssignRole(
+	ctx context.Context,
+	req *desc.AssignRoleRequest,
+) (*desc.AssignRoleResponse, error) {
+	if !isEmailValid(req.GetEmail()) || req.GetRole() == "" {
+		return nil, status.Error(codes.InvalidArgument, "not valid email or role")
+	}
+
+	if err := s.access.AssignRole(ctx, req.GetEmail(), req.GetRole()); err != nil {
+		return nil, roleError(err)
+	}
+
+	return &desc.AssignRoleResponse{}, nil
+}
+
+func (s *serverAPI) RevokeRole(
+	ctx context.Context,
+	req *desc.RevokeRoleRequest,
+) (*desc.RevokeRoleResponse, error) {
+	if !isEmailValid(req.GetEmail()) || req.GetRole() == "" {
+		return nil, status.Error(codes.InvalidArgument, "not valid email or role")
+	}
+
+	if err := s.access.RevokeRole(ctx, req.GetEmail(), req.GetRole()); err != nil {
+		return nil, roleError(err)
+	}
+
+	return &desc.RevokeRoleResponse{}, nil
+}
+
+func (s *serverAPI) ListUserRoles(
+	ctx context.Context,
+	req *desc.ListUserRolesRequest,
+) (*desc.ListUserRolesResponse, error) {
+	if !isEmailValid(req.GetEmail()) {
+		return nil, status.Error(codes.InvalidArgument, "not valid email")
+	}
+
+	roles, permissions, err := s.access.UserAccess(ctx, req.GetEmail())
+	if err != nil {
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	return &desc.ListUserRolesResponse{Roles: roles, Permissions: permissions}, nil
+}
+
+func roleError(err error) error {
+	if errors.Is(err, storage.ErrUserNotFound) {
+		return status.Error(codes.NotFound, "user not found")
+	}
+	if errors.Is(err, storage.ErrRoleNotFound) {
+		return status.Error(codes.NotFound, "role not found")
+	}
+	return status.Error(codes.Internal, "internal server error")
+}
+
+func (s *serverAPI) CreateOrganization(
+	ctx context.Context,
+	req *desc.CreateOrganizationRequest,
+) (*desc.CreateOrganizationResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if req.GetName() == "" || req.GetMaxDevices() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "not valid name or device limit")
+	}
+
+	org, err := s.orgs.CreateOrganization(ctx, claims.Email, req.GetName(), int(req.GetMaxDevices()))
+	if err != nil {
+		return nil, orgError(err)
+	}
+
+	return &desc.CreateOrganizationResponse{OrgId: org.ID}, nil
+}
+
+func (s *serverAPI) InviteMember(
+	ctx context.Context,
+	req *desc.InviteMemberRequest,
+) (*desc.InviteMemberResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if req.GetOrgId() <= 0 || !isEmailValid(req.GetEmail()) {
+		return nil, status.Error(codes.InvalidArgument, "not valid organization or email")
+	}
+
+	if err := s.orgs.InviteMember(ctx, claims.Email, req.GetOrgId(), req.GetEmail(), req.GetRole()); err != nil {
+		return nil, orgError(err)
+	}
+
+	return &desc.InviteMemberResponse{}, nil
+}
+
+func (s *serverAPI) AcceptInvitation(
+	ctx context.Context,
+	req *desc.AcceptInvitationRequest,
+) (*desc.AcceptInvitationResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if req.GetOrgId() <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "not valid organization")
+	}
+
+	if err := s.orgs.AcceptInvitation(ctx, claims.Email, req.GetOrgId()); err != nil {
+		return nil, orgError(err)
+	}
+
+	return &desc.AcceptInvitationResponse{}, nil
 }
 
-func isPasswordValid(p string) bool {
-	passwordRegex := regexp.MustCompile(`^[a-z0-9]{8,14}$`)
+func (s *serverAPI) RemoveMember(
+	ctx context.Context,
+	req *desc.RemoveMemberRequest,
+) (*desc.RemoveMemberResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if req.GetOrgId() <= 0 || !isEmailValid(req.GetEmail()) {
+		return nil, status.Error(codes.InvalidArgument, "not valid organization or email")
+	}
+
+	if err := s.orgs.RemoveMember(ctx, claims.Email, req.GetOrgId(), req.GetEmail()); err != nil {
+		return nil, orgError(err)
+	}
+
+	return &desc.RemoveMemberResponse{}, nil
+}
+
+// ListOrganizations returns the organizations of the token owner and the pending invitations
+func (s *serverAPI) ListOrganizations(
+	ctx context.Context,
+	_ *desc.ListOrganizationsRequest,
+) (*desc.ListOrganizationsResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+
+	memberships, err := s.orgs.Memberships(ctx, claims.Email)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	resp := &desc.ListOrganizationsResponse{
+		Memberships: make([]*desc.Membership, 0, len(memberships)),
+	}
+	for _, m := range memberships {
+		resp.Memberships = append(resp.Memberships, &desc.Membership{
+			OrgId:     m.OrgID,
+			OrgName:   m.OrgName,
+			Role:      m.Role,
+			Status:    m.Status,
+			InvitedBy: m.InvitedBy,
+			CreatedAt: timestamppb.New(m.CreatedAt),
+		})
+	}
+
+	return resp, nil
+}
+
+// SwitchOrganization issues a token for the organization, org id 0 returns to the personal context
+func (s *serverAPI) SwitchOrganization(
+	ctx context.Context,
+	req *desc.SwitchOrganizationRequest,
+) (*desc.SwitchOrganizationResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if req.GetOrgId() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "not valid organization")
+	}
+	// personal access tokens have no device to issue a session for
+	if claims.DeviceAddress == "" {
+		return nil, status.Error(codes.FailedPrecondition, "token is not bound to a device")
+	}
+
+	token, err := s.auth.SwitchOrganization(ctx, claims.Email, claims.DeviceAddress, req.GetOrgId(), claims.ProfileID)
+	if err != nil {
+		if errors.Is(err, auth.ErrNotMember) {
+			return nil, status.Error(codes.PermissionDenied, "not a member of the organization")
+		}
+		if errors.Is(err, storage.ErrProfileNotFound) {
+			return nil, status.Error(codes.NotFound, "profile not found")
+		}
+		if errors.Is(err, storage.ErrOrganizationDeviceLimitExceeded) {
+			return nil, status.Error(codes.ResourceExhausted, "organization device limit exceeded")
+		}
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	return &desc.SwitchOrganizationResponse{Token: token}, nil
+}
+
+// CreatePersonalAccessToken issues a token for scripts, the only response that contains it
+func (s *serverAPI) CreatePersonalAccessToken(
+	ctx context.Context,
+	req *desc.CreatePersonalAccessTokenRequest,
+) (*desc.CreatePersonalAccessTokenResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if restrictedProfile(claims) {
+		return nil, status.Error(codes.PermissionDenied, "not allowed for a restricted profile")
+	}
+	if req.GetName() == "" || req.GetExpiresIn().AsDuration() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "not valid name or lifetime")
+	}
+
+	// the scopes are limited by what the caller holds, so a token cannot mint a stronger one
+	token, created, err := s.tokens.Create(
+		ctx,
+		claims.Email,
+		req.GetName(),
+		req.GetScopes(),
+		req.GetExpiresIn().AsDuration(),
+		claims.Permissions,
+	)
+	if err != nil {
+		if errors.Is(err, pat.ErrScopeNotGranted) {
+			return nil, status.Error(codes.PermissionDenied, "scope is not granted")
+		}
+		if errors.Is(err, pat.ErrInvalidTTL) {
+			return nil, status.Error(codes.InvalidArgument, "not valid lifetime")
+		}
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return nil, status.Error(codes.NotFound, "user not found")
+		}
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	return &desc.CreatePersonalAccessTokenResponse{
+		Token:     token,
+		Id:        created.ID,
+		Prefix:    created.Prefix,
+		ExpiresAt: timestamppb.New(created.ExpiresAt),
+	}, nil
+}
+
+func (s *serverAPI) ListPersonalAccessTokens(
+	ctx context.Context,
+	_ *desc.ListPersonalAccessTokensRequest,
+) (*desc.ListPersonalAccessTokensResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+
+	tokens, err := s.tokens.List(ctx, claims.Email)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	resp := &desc.ListPersonalAccessTokensResponse{
+		Tokens: make([]*desc.PersonalAccessToken, 0, len(tokens)),
+	}
+	for _, t := range tokens {
+		item := &desc.PersonalAccessToken{
+			Id:        t.ID,
+			Name:      t.Name,
+			Prefix:    t.Prefix,
+			Scopes:    t.Scopes,
+			ExpiresAt: timestamppb.New(t.ExpiresAt),
+			CreatedAt: timestamppb.New(t.CreatedAt),
+		}
+		if t.LastUsedAt != nil {
+			item.LastUsedAt = timestamppb.New(*t.LastUsedAt)
+		}
+		resp.Tokens = append(resp.Tokens, item)
+	}
+
+	return resp, nil
+}
+
+func (s *serverAPI) RevokePersonalAccessToken(
+	ctx context.Context,
+	req *desc.RevokePersonalAccessTokenRequest,
+) (*desc.RevokePersonalAccessTokenResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if req.GetId() <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "not valid token id")
+	}
+
+	if err := s.tokens.Revoke(ctx, claims.Email, req.GetId()); err != nil {
+		if errors.Is(err, storage.ErrTokenNotFound) {
+			return nil, status.Error(codes.NotFound, "token not found")
+		}
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	return &desc.RevokePersonalAccessTokenResponse{}, nil
+}
+
+// IntrospectToken tells a resource server whether a JWT or a personal access token is active
+// and what it grants. An inactive token only gets active = false
+func (s *serverAPI) IntrospectToken(
+	ctx context.Context,
+	req *desc.IntrospectTokenRequest,
+) (*desc.IntrospectTokenResponse, error) {
+	if req.GetToken() == "" {
+		return nil, status.Error(codes.InvalidArgument, "token is empty")
+	}
+
+	var (
+		claims    jwt.Claims
+		err       error
+		tokenType = "access_token"
+	)
+	if pat.IsPersonalToken(req.GetToken()) {
+		tokenType = "personal_access_token"
+		claims, err = s.tokens.Verify(ctx, req.GetToken())
+		if err != nil && !errors.Is(err, pat.ErrInvalidToken) {
+			return nil, status.Error(codes.Internal, "internal server error")
+		}
+	} else {
+		claims, err = s.auth.VerifyToken(ctx, req.GetToken())
+	}
+	if err != nil {
+		return &desc.IntrospectTokenResponse{Active: false}, nil
+	}
+
+	return &desc.IntrospectTokenResponse{
+		Active:      true,
+		TokenType:   tokenType,
+		Email:       claims.Email,
+		ClientId:    claims.ClientID,
+		Permissions: claims.Permissions,
+		ExpiresAt:   timestamppb.New(claims.ExpiresAt),
+	}, nil
+}
+
+// CreateClient registers a service account or an application of the authorization code flow.
+// The secret is generated for a confidential client without a public key and returned only here
+func (s *serverAPI) CreateClient(
+	ctx context.Context,
+	req *desc.CreateClientRequest,
+) (*desc.CreateClientResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if req.GetName() == "" || req.GetTokenTtl().AsDuration() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "not valid name or token lifetime")
+	}
+
+	client, secret, err := s.clients.CreateClient(
+		ctx,
+		req.GetName(),
+		req.GetScopes(),
+		req.GetTokenTtl().AsDuration(),
+		req.GetPublicKey(),
+		req.GetRedirectUris(),
+		req.GetPublic(),
+		claims.Permissions,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, clients.ErrScopeNotGranted):
+			return nil, status.Error(codes.PermissionDenied, "scope is not granted")
+		case errors.Is(err, clients.ErrInvalidPublicKey):
+			return nil, status.Error(codes.InvalidArgument, "not valid public key")
+		case errors.Is(err, clients.ErrInvalidTTL):
+			return nil, status.Error(codes.InvalidArgument, "not valid token lifetime")
+		case errors.Is(err, clients.ErrInvalidRedirectURI):
+			return nil, status.Error(codes.InvalidArgument, "not valid redirect uris")
+		}
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	return &desc.CreateClientResponse{
+		ClientId:     client.ID,
+		ClientSecret: secret,
+	}, nil
+}
+
+func (s *serverAPI) DeleteClient(
+	ctx context.Context,
+	req *desc.DeleteClientRequest,
+) (*desc.DeleteClientResponse, error) {
+	if req.GetClientId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "client id is empty")
+	}
+
+	if err := s.clients.DeleteClient(ctx, req.GetClientId()); err != nil {
+		if errors.Is(err, storage.ErrClientNotFound) {
+			return nil, status.Error(codes.NotFound, "client not found")
+		}
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	return &desc.DeleteClientResponse{}, nil
+}
+
+// ClientCredentials is the client_credentials grant. The client authenticates with the request fields
+// or with "authorization: Basic" metadata carrying the client id and secret
+func (s *serverAPI) ClientCredentials(
+	ctx context.Context,
+	req *desc.ClientCredentialsRequest,
+) (*desc.ClientCredentialsResponse, error) {
+	creds := clients.Credentials{
+		ClientID:      req.GetClientId(),
+		ClientSecret:  req.GetClientSecret(),
+		AssertionType: req.GetClientAssertionType(),
+		Assertion:     req.GetClientAssertion(),
+	}
+	if creds.ClientSecret == "" && creds.Assertion == "" {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if val := md.Get("authorization"); len(val) > 0 {
+				if id, secret, ok := clients.ParseBasicAuth(val[0]); ok {
+					creds.ClientID, creds.ClientSecret = id, secret
+				}
+			}
+		}
+	}
+
+	token, err := s.clients.ClientCredentials(ctx, creds, clients.ParseScope(req.GetScope()))
+	if err != nil {
+		switch {
+		case errors.Is(err, clients.ErrInvalidClient):
+			return nil, status.Error(codes.Unauthenticated, "client authentication failed")
+		case errors.Is(err, clients.ErrInvalidScope):
+			return nil, status.Error(codes.InvalidArgument, "scope is not allowed")
+		case errors.Is(err, clients.ErrUnauthorizedClient):
+			return nil, status.Error(codes.PermissionDenied, "client may not use the grant")
+		}
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	return &desc.ClientCredentialsResponse{
+		AccessToken: token.AccessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(token.ExpiresIn.Seconds()),
+		Scope:       strings.Join(token.Scopes, " "),
+	}, nil
+}
+
+// VerifyDeviceCode answers a device authorization with the user code shown on the TV: without
+// a decision it tells what the device asks for, "approve" or "deny" answer it
+func (s *serverAPI) VerifyDeviceCode(
+	ctx context.Context,
+	req *desc.VerifyDeviceCodeRequest,
+) (*desc.VerifyDeviceCodeResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if restrictedProfile(claims) {
+		return nil, status.Error(codes.PermissionDenied, "not allowed for a restricted profile")
+	}
+	// a token without a user can not approve, applications are refused by the interceptor
+	if claims.Email == "" {
+		return nil, status.Error(codes.PermissionDenied, "user token required")
+	}
+	if req.GetUserCode() == "" {
+		return nil, status.Error(codes.InvalidArgument, "user code is empty")
+	}
+
+	prompt, err := s.devices.VerifyDeviceCode(ctx, claims.Email, req.GetUserCode(), req.GetDecision())
+	if err != nil {
+		switch {
+		case errors.Is(err, oauth.ErrInvalidDecision):
+			return nil, status.Error(codes.InvalidArgument, "decision must be approve or deny")
+		case errors.Is(err, oauth.ErrInvalidUserCode):
+			return nil, status.Error(codes.NotFound, "user code not found or expired")
+		}
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	return &desc.VerifyDeviceCodeResponse{
+		ClientId:   prompt.Client.ID,
+		ClientName: prompt.Client.Name,
+		Scopes:     prompt.Scopes,
+	}, nil
+}
+
+// StartQRLogin opens a QR login for the TV: the session id is rendered as a QR code,
+// the secret stays on the TV to watch the session with
+func (s *serverAPI) StartQRLogin(
+	ctx context.Context,
+	req *desc.StartQRLoginRequest,
+) (*desc.StartQRLoginResponse, error) {
+	if req.GetDeviceAddress() == "" {
+		return nil, status.Error(codes.InvalidArgument, "device address is empty")
+	}
+
+	session, err := s.qrLogin.Start(ctx, req.GetDeviceAddress())
+	if err != nil {
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	return &desc.StartQRLoginResponse{
+		SessionId: session.ID,
+		Secret:    session.Secret,
+		ExpiresIn: durationpb.New(session.ExpiresIn),
+	}, nil
+}
+
+// ApproveQRLogin is called by the phone that scanned the QR code, the TV becomes a device of the user
+func (s *serverAPI) ApproveQRLogin(
+	ctx context.Context,
+	req *desc.ApproveQRLoginRequest,
+) (*desc.ApproveQRLoginResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if restrictedProfile(claims) {
+		return nil, status.Error(codes.PermissionDenied, "not allowed for a restricted profile")
+	}
+	// a token without a user can not approve, applications are refused by the interceptor
+	if claims.Email == "" {
+		return nil, status.Error(codes.PermissionDenied, "user token required")
+	}
+	if req.GetSessionId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "session id is empty")
+	}
+
+	device, err := s.qrLogin.Approve(ctx, claims.Email, req.GetSessionId())
+	if err != nil {
+		switch {
+		case errors.Is(err, qrlogin.ErrSessionNotFound):
+			return nil, status.Error(codes.NotFound, "session not found or expired")
+		case errors.Is(err, storage.ErrDeviceLimitExceeded):
+			return nil, status.Error(codes.ResourceExhausted, "device limit exceeded")
+		case errors.Is(err, storage.ErrHouseholdDeviceLimitExceeded):
+			return nil, status.Error(codes.ResourceExhausted, "household device limit exceeded")
+		case errors.Is(err, auth.ErrPasswordResetRequired):
+			return nil, status.Error(codes.FailedPrecondition, "password reset required")
+		}
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	return &desc.ApproveQRLoginResponse{DeviceAddress: device}, nil
+}
+
+// WatchQRLogin streams the state of the QR login to the TV, the last message carries the token
+func (s *serverAPI) WatchQRLogin(
+	req *desc.WatchQRLoginRequest,
+	stream grpc.ServerStreamingServer[desc.WatchQRLoginResponse],
+) error {
+	if req.GetSessionId() == "" || req.GetSecret() == "" {
+		return status.Error(codes.InvalidArgument, "session id or secret is empty")
+	}
+
+	err := s.qrLogin.Watch(stream.Context(), req.GetSessionId(), req.GetSecret(), func(u qrlogin.Update) error {
+		return stream.Send(&desc.WatchQRLoginResponse{Status: u.Status, Token: u.Token})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, qrlogin.ErrSessionNotFound):
+			return status.Error(codes.NotFound, "session not found")
+		case errors.Is(err, qrlogin.ErrSessionExpired):
+			return status.Error(codes.DeadlineExceeded, "session expired")
+		case errors.Is(err, storage.ErrDeviceLimitExceeded):
+			return status.Error(codes.ResourceExhausted, "device limit exceeded")
+		case errors.Is(err, storage.ErrHouseholdDeviceLimitExceeded):
+			return status.Error(codes.ResourceExhausted, "household device limit exceeded")
+		case errors.Is(err, auth.ErrPasswordResetRequired):
+			return status.Error(codes.FailedPrecondition, "password reset required")
+		case errors.Is(err, context.Canceled):
+			return status.Error(codes.Canceled, "watch canceled")
+		}
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Error(codes.Internal, "internal server error")
+	}
+
+	return nil
+}
+
+func (s *serverAPI) CreateProfile(
+	ctx context.Context,
+	req *desc.CreateProfileRequest,
+) (*desc.CreateProfileResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if restrictedProfile(claims) {
+		return nil, status.Error(codes.PermissionDenied, "not allowed for a restricted profile")
+	}
+
+	profile, err := s.profiles.Create(ctx, claims.Email, profiles.Update{
+		Name:           req.GetName(),
+		AvatarKey:      req.GetAvatarKey(),
+		MaturityRating: req.GetMaturityRating(),
+		PIN:            req.GetPin(),
+	})
+	if err != nil {
+		return nil, profileError(err)
+	}
+
+	return &desc.CreateProfileResponse{Profile: profileToDesc(profile)}, nil
+}
+
+func (s *serverAPI) ListProfiles(
+	ctx context.Context,
+	_ *desc.ListProfilesRequest,
+) (*desc.ListProfilesResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+
+	list, err := s.profiles.List(ctx, claims.Email)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	resp := &desc.ListProfilesResponse{Profiles: make([]*desc.Profile, 0, len(list))}
+	for _, p := range list {
+		resp.Profiles = append(resp.Profiles, profileToDesc(p))
+	}
+
+	return resp, nil
+}
+
+// UpdateProfile replaces the profile, the PIN is kept unless a new one is set or clear_pin is true.
+// A profile with a PIN is only changed with current_pin
+func (s *serverAPI) UpdateProfile(
+	ctx context.Context,
+	req *desc.UpdateProfileRequest,
+) (*desc.UpdateProfileResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if restrictedProfile(claims) {
+		return nil, status.Error(codes.PermissionDenied, "not allowed for a restricted profile")
+	}
+
+	profile, err := s.profiles.Update(ctx, claims.Email, req.GetProfileId(), profiles.Update{
+		Name:           req.GetName(),
+		AvatarKey:      req.GetAvatarKey(),
+		MaturityRating: req.GetMaturityRating(),
+		PIN:            req.GetPin(),
+		ClearPIN:       req.GetClearPin(),
+	}, req.GetCurrentPin())
+	if err != nil {
+		return nil, profileError(err)
+	}
+
+	return &desc.UpdateProfileResponse{Profile: profileToDesc(profile)}, nil
+}
+
+func (s *serverAPI) DeleteProfile(
+	ctx context.Context,
+	req *desc.DeleteProfileRequest,
+) (*desc.DeleteProfileResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if restrictedProfile(claims) {
+		return nil, status.Error(codes.PermissionDenied, "not allowed for a restricted profile")
+	}
+
+	if err := s.profiles.Delete(ctx, claims.Email, req.GetProfileId(), req.GetCurrentPin()); err != nil {
+		return nil, profileError(err)
+	}
+
+	return &desc.DeleteProfileResponse{}, nil
+}
+
+// SelectProfile issues a token for the profile, downstream services enforce its maturity rating
+func (s *serverAPI) SelectProfile(
+	ctx context.Context,
+	req *desc.SelectProfileRequest,
+) (*desc.SelectProfileResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	// personal access tokens have no device to issue a session for
+	if claims.DeviceAddress == "" {
+		return nil, status.Error(codes.FailedPrecondition, "token is not bound to a device")
+	}
+	if req.GetProfileId() <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "not valid profile")
+	}
+
+	token, err := s.auth.SelectProfile(
+		ctx,
+		claims.Email,
+		claims.DeviceAddress,
+		claims.OrgID,
+		req.GetProfileId(),
+		req.GetPin(),
+	)
+	if err != nil {
+		if errors.Is(err, auth.ErrNotMember) {
+			return nil, status.Error(codes.PermissionDenied, "not a member of the organization")
+		}
+		return nil, profileError(err)
+	}
+
+	return &desc.SelectProfileResponse{Token: token}, nil
+}
+
+// CreateHousehold makes the user the owner of a new household, the household claim
+// appears in the tokens issued from now on
+func (s *serverAPI) CreateHousehold(
+	ctx context.Context,
+	_ *desc.CreateHouseholdRequest,
+) (*desc.CreateHouseholdResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if claims.Email == "" {
+		return nil, status.Error(codes.PermissionDenied, "user token required")
+	}
+	if restrictedProfile(claims) {
+		return nil, status.Error(codes.PermissionDenied, "not allowed for a restricted profile")
+	}
+
+	household, err := s.households.Create(ctx, claims.Email)
+	if err != nil {
+		return nil, householdError(err)
+	}
+
+	return &desc.CreateHouseholdResponse{Household: householdToDesc(household, nil)}, nil
+}
+
+func (s *serverAPI) GetHousehold(
+	ctx context.Context,
+	_ *desc.GetHouseholdRequest,
+) (*desc.GetHouseholdResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+
+	household, members, err := s.households.Get(ctx, claims.Email)
+	if err != nil {
+		return nil, householdError(err)
+	}
+
+	return &desc.GetHouseholdResponse{Household: householdToDesc(household, members)}, nil
+}
+
+func (s *serverAPI) InviteHouseholdMember(
+	ctx context.Context,
+	req *desc.InviteHouseholdMemberRequest,
+) (*desc.InviteHouseholdMemberResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if restrictedProfile(claims) {
+		return nil, status.Error(codes.PermissionDenied, "not allowed for a restricted profile")
+	}
+	if !isEmailValid(req.GetEmail()) {
+		return nil, status.Error(codes.InvalidArgument, "not valid email")
+	}
+
+	if err := s.households.Invite(ctx, claims.Email, req.GetEmail()); err != nil {
+		return nil, householdError(err)
+	}
+
+	return &desc.InviteHouseholdMemberResponse{}, nil
+}
+
+func (s *serverAPI) AcceptHouseholdInvitation(
+	ctx context.Context,
+	req *desc.AcceptHouseholdInvitationRequest,
+) (*desc.AcceptHouseholdInvitationResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if restrictedProfile(claims) {
+		return nil, status.Error(codes.PermissionDenied, "not allowed for a restricted profile")
+	}
+	if req.GetHouseholdId() <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "not valid household")
+	}
+
+	if err := s.households.Accept(ctx, claims.Email, req.GetHouseholdId()); err != nil {
+		return nil, householdError(err)
+	}
+
+	return &desc.AcceptHouseholdInvitationResponse{}, nil
+}
+
+// RemoveHouseholdMember removes a member, or the caller itself to leave the household
+func (s *serverAPI) RemoveHouseholdMember(
+	ctx context.Context,
+	req *desc.RemoveHouseholdMemberRequest,
+) (*desc.RemoveHouseholdMemberResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if restrictedProfile(claims) {
+		return nil, status.Error(codes.PermissionDenied, "not allowed for a restricted profile")
+	}
+	if !isEmailValid(req.GetEmail()) {
+		return nil, status.Error(codes.InvalidArgument, "not valid email")
+	}
+
+	if err := s.households.Remove(ctx, claims.Email, req.GetEmail()); err != nil {
+		return nil, householdError(err)
+	}
+
+	return &desc.RemoveHouseholdMemberResponse{}, nil
+}
+
+func profileError(err error) error {
+	var locked *profiles.PINLockedError
+	if errors.As(err, &locked) {
+		return retryError("too many wrong pins, profile is temporarily locked", locked.RetryAfter)
+	}
+	switch {
+	case errors.Is(err, profiles.ErrInvalidProfile):
+		return status.Error(codes.InvalidArgument, "not valid name or maturity rating")
+	case errors.Is(err, profiles.ErrInvalidPIN):
+		return status.Error(codes.InvalidArgument, "pin must be 4 to 6 digits")
+	case errors.Is(err, profiles.ErrWrongPIN):
+		return status.Error(codes.PermissionDenied, "wrong pin")
+	case errors.Is(err, storage.ErrProfileNotFound):
+		return status.Error(codes.NotFound, "profile not found")
+	case errors.Is(err, storage.ErrProfileAlreadyExists):
+		return status.Error(codes.AlreadyExists, "profile with this name already exists")
+	case errors.Is(err, storage.ErrProfileLimitExceeded):
+		return status.Error(codes.ResourceExhausted, "profile limit exceeded")
+	}
+	return status.Error(codes.Internal, "internal server error")
+}
+
+func profileToDesc(p models.Profile) *desc.Profile {
+	return &desc.Profile{
+		Id:             p.ID,
+		Name:           p.Name,
+		AvatarKey:      p.AvatarKey,
+		MaturityRating: p.MaturityRating,
+		HasPin:         p.HasPIN(),
+		CreatedAt:      timestamppb.New(p.CreatedAt),
+	}
+}
+
+// StartStream opens a playback session counted against the concurrent stream limit of the plan
+func (s *serverAPI) StartStream(
+	ctx context.Context,
+	_ *desc.StartStreamRequest,
+) (*desc.StartStreamResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if claims.Email == "" || claims.DeviceAddress == "" {
+		return nil, status.Error(codes.FailedPrecondition, "token is not bound to a device")
+	}
+
+	session, err := s.streams.Start(ctx, claims.Email, claims.DeviceAddress, models.Entitlements{
+		Plan:       claims.Plan,
+		Features:   claims.Features,
+		MaxStreams: claims.MaxStreams,
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrStreamLimitExceeded) {
+			return nil, status.Error(codes.ResourceExhausted, "concurrent stream limit exceeded")
+		}
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return nil, status.Error(codes.NotFound, "user not found")
+		}
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	return &desc.StartStreamResponse{
+		SessionId:         session.ID,
+		HeartbeatInterval: durationpb.New(s.streams.HeartbeatInterval()),
+	}, nil
+}
+
+// Heartbeat keeps the stream session alive. A revoked session is answered with active false
+// and the reason, the player must stop
+func (s *serverAPI) Heartbeat(
+	ctx context.Context,
+	req *desc.HeartbeatRequest,
+) (*desc.HeartbeatResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if req.GetSessionId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "session id is empty")
+	}
+
+	session, err := s.streams.Heartbeat(ctx, claims.Email, req.GetSessionId())
+	if err != nil {
+		switch {
+		case errors.Is(err, streams.ErrRevoked):
+			return &desc.HeartbeatResponse{Active: false, RevokeReason: session.RevokeReason}, nil
+		case errors.Is(err, storage.ErrStreamNotFound):
+			return nil, status.Error(codes.NotFound, "stream session not found")
+		}
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	return &desc.HeartbeatResponse{Active: true}, nil
+}
+
+func (s *serverAPI) StopStream(
+	ctx context.Context,
+	req *desc.StopStreamRequest,
+) (*desc.StopStreamResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if req.GetSessionId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "session id is empty")
+	}
+
+	if err := s.streams.Stop(ctx, claims.Email, req.GetSessionId()); err != nil {
+		if errors.Is(err, storage.ErrStreamNotFound) {
+			return nil, status.Error(codes.NotFound, "stream session not found")
+		}
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	return &desc.StopStreamResponse{}, nil
+}
+
+// StartSocialLogin returns the URL of the provider to sign in at, the app opens it and gets
+// the code and the state back on its redirect URI
+func (s *serverAPI) StartSocialLogin(
+	ctx context.Context,
+	req *desc.StartSocialLoginRequest,
+) (*desc.StartSocialLoginResponse, error) {
+	if req.GetProvider() == "" || req.GetDeviceAddress() == "" {
+		return nil, status.Error(codes.InvalidArgument, "provider or device address is empty")
+	}
+
+	authorization, err := s.social.Start(ctx, req.GetProvider(), req.GetDeviceAddress())
+	if err != nil {
+		return nil, socialError(err)
+	}
+
+	return &desc.StartSocialLoginResponse{
+		AuthorizationUrl: authorization.URL,
+		State:            authorization.State,
+	}, nil
+}
+
+func (s *serverAPI) CompleteSocialLogin(
+	ctx context.Context,
+	req *desc.CompleteSocialLoginRequest,
+) (*desc.CompleteSocialLoginResponse, error) {
+	if req.GetState() == "" || req.GetCode() == "" {
+		return nil, status.Error(codes.InvalidArgument, "state or code is empty")
+	}
+
+	token, created, err := s.social.Complete(ctx, req.GetState(), req.GetCode())
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrDeviceLimitExceeded):
+			return nil, status.Error(codes.ResourceExhausted, "device limit exceeded")
+		case errors.Is(err, storage.ErrHouseholdDeviceLimitExceeded):
+			return nil, status.Error(codes.ResourceExhausted, "household device limit exceeded")
+		case errors.Is(err, auth.ErrPasswordResetRequired):
+			return nil, status.Error(codes.FailedPrecondition, "password reset required")
+		}
+		return nil, socialError(err)
+	}
+
+	return &desc.CompleteSocialLoginResponse{Token: token, Created: created}, nil
+}
+
+// StartSAMLLogin returns the URL of the identity provider of the connection to sign in at,
+// it posts the response and the relay state back to the ACS of the app
+func (s *serverAPI) StartSAMLLogin(
+	ctx context.Context,
+	req *desc.StartSAMLLoginRequest,
+) (*desc.StartSAMLLoginResponse, error) {
+	if req.GetConnection() == "" || req.GetDeviceAddress() == "" {
+		return nil, status.Error(codes.InvalidArgument, "connection or device address is empty")
+	}
+
+	authorization, err := s.saml.Start(ctx, req.GetConnection(), req.GetDeviceAddress())
+	if err != nil {
+		return nil, samlError(err)
+	}
+
+	return &desc.StartSAMLLoginResponse{
+		RedirectUrl: authorization.URL,
+		RelayState:  authorization.RelayState,
+	}, nil
+}
+
+// CompleteSAMLLogin signs in with the SAMLResponse the ACS of the app received
+func (s *serverAPI) CompleteSAMLLogin(
+	ctx context.Context,
+	req *desc.CompleteSAMLLoginRequest,
+) (*desc.CompleteSAMLLoginResponse, error) {
+	if req.GetSamlResponse() == "" || req.GetRelayState() == "" {
+		return nil, status.Error(codes.InvalidArgument, "saml response or relay state is empty")
+	}
+
+	token, created, err := s.saml.Complete(ctx, req.GetSamlResponse(), req.GetRelayState())
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrDeviceLimitExceeded):
+			return nil, status.Error(codes.ResourceExhausted, "device limit exceeded")
+		case errors.Is(err, storage.ErrHouseholdDeviceLimitExceeded):
+			return nil, status.Error(codes.ResourceExhausted, "household device limit exceeded")
+		case errors.Is(err, auth.ErrPasswordResetRequired):
+			return nil, status.Error(codes.FailedPrecondition, "password reset required")
+		}
+		return nil, samlError(err)
+	}
+
+	return &desc.CompleteSAMLLoginResponse{Token: token, Created: created}, nil
+}
+
+// LinkIdentity starts linking an identity of the provider to the account, completed by CompleteIdentityLink
+func (s *serverAPI) LinkIdentity(
+	ctx context.Context,
+	req *desc.LinkIdentityRequest,
+) (*desc.LinkIdentityResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if claims.Email == "" || restrictedProfile(claims) {
+		return nil, status.Error(codes.PermissionDenied, "user token required")
+	}
+	if req.GetProvider() == "" {
+		return nil, status.Error(codes.InvalidArgument, "provider is empty")
+	}
+
+	authorization, err := s.social.StartLink(ctx, claims.Email, req.GetProvider())
+	if err != nil {
+		return nil, socialError(err)
+	}
+
+	return &desc.LinkIdentityResponse{
+		AuthorizationUrl: authorization.URL,
+		State:            authorization.State,
+	}, nil
+}
+
+func (s *serverAPI) CompleteIdentityLink(
+	ctx context.Context,
+	req *desc.CompleteIdentityLinkRequest,
+) (*desc.CompleteIdentityLinkResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if claims.Email == "" || restrictedProfile(claims) {
+		return nil, status.Error(codes.PermissionDenied, "user token required")
+	}
+	if req.GetState() == "" || req.GetCode() == "" {
+		return nil, status.Error(codes.InvalidArgument, "state or code is empty")
+	}
+
+	identity, err := s.social.CompleteLink(ctx, claims.Email, req.GetState(), req.GetCode())
+	if err != nil {
+		return nil, socialError(err)
+	}
+
+	return &desc.CompleteIdentityLinkResponse{Identity: identityToDesc(identity)}, nil
+}
+
+func (s *serverAPI) ListIdentities(
+	ctx context.Context,
+	_ *desc.ListIdentitiesRequest,
+) (*desc.ListIdentitiesResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+
+	identities, err := s.social.Identities(ctx, claims.Email)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	resp := &desc.ListIdentitiesResponse{Identities: make([]*desc.Identity, 0, len(identities))}
+	for _, i := range identities {
+		resp.Identities = append(resp.Identities, identityToDesc(i))
+	}
+	return resp, nil
+}
+
+func (s *serverAPI) UnlinkIdentity(
+	ctx context.Context,
+	req *desc.UnlinkIdentityRequest,
+) (*desc.UnlinkIdentityResponse, error) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "token is not provided")
+	}
+	if claims.Email == "" || restrictedProfile(claims) {
+		return nil, status.Error(codes.PermissionDenied, "user token required")
+	}
+	if req.GetProvider() == "" {
+		return nil, status.Error(codes.InvalidArgument, "provider is empty")
+	}
+
+	if err := s.social.Unlink(ctx, claims.Email, req.GetProvider()); err != nil {
+		return nil, socialError(err)
+	}
+
+	return &desc.UnlinkIdentityResponse{}, nil
+}
+
+func householdError(err error) error {
+	switch {
+	case errors.Is(err, households.ErrNotOwner):
+		return status.Error(codes.PermissionDenied, "only the owner manages the household")
+	case errors.Is(err, households.ErrOwnerCannotLeave):
+		return status.Error(codes.FailedPrecondition, "owner cannot leave the household")
+	case errors.Is(err, storage.ErrUserNotFound):
+		return status.Error(codes.NotFound, "user not found")
+	case errors.Is(err, storage.ErrHouseholdNotFound):
+		return status.Error(codes.NotFound, "household not found")
+	case errors.Is(err, storage.ErrHouseholdMemberNotFound):
+		return status.Error(codes.NotFound, "member or invitation not found")
+	case errors.Is(err, storage.ErrHouseholdAlreadyExists):
+		return status.Error(codes.AlreadyExists, "already in a household")
+	case errors.Is(err, storage.ErrHouseholdMemberAlreadyExists):
+		return status.Error(codes.AlreadyExists, "already a member or invited")
+	case errors.Is(err, storage.ErrHouseholdFull):
+		return status.Error(codes.ResourceExhausted, "household member limit exceeded")
+	}
+	return status.Error(codes.Internal, "internal server error")
+}
+
+func householdToDesc(h models.Household, members []models.HouseholdMember) *desc.Household {
+	res := &desc.Household{
+		Id:         h.ID,
+		OwnerEmail: h.OwnerEmail,
+		MaxMembers: int32(h.MaxMembers),
+		MaxDevices: int32(h.MaxDevices),
+		CreatedAt:  timestamppb.New(h.CreatedAt),
+		Members:    make([]*desc.HouseholdMember, 0, len(members)),
+	}
+	for _, m := range members {
+		res.Members = append(res.Members, &desc.HouseholdMember{
+			Email:     m.Email,
+			Role:      m.Role,
+			Status:    m.Status,
+			CreatedAt: timestamppb.New(m.CreatedAt),
+		})
+	}
+	return res
+}
+
+func socialError(err error) error {
+	switch {
+	case errors.Is(err, social.ErrUnknownProvider):
+		return status.Error(codes.InvalidArgument, "unknown identity provider")
+	case errors.Is(err, social.ErrInvalidState):
+		return status.Error(codes.InvalidArgument, "invalid or expired state")
+	case errors.Is(err, social.ErrAccountExists):
+		return status.Error(codes.FailedPrecondition, "account with this email exists, sign in and link the identity")
+	case errors.Is(err, social.ErrEmailNotVerified):
+		return status.Error(codes.FailedPrecondition, "identity has no verified email")
+	case errors.Is(err, social.ErrProviderFailed):
+		return status.Error(codes.Unauthenticated, "identity provider did not vouch for the user")
+	case errors.Is(err, storage.ErrIdentityAlreadyLinked):
+		return status.Error(codes.AlreadyExists, "identity already linked")
+	case errors.Is(err, storage.ErrIdentityNotFound):
+		return status.Error(codes.NotFound, "identity not found")
+	}
+	return status.Error(codes.Internal, "internal server error")
+}
+
+func samlError(err error) error {
+	switch {
+	case errors.Is(err, saml.ErrUnknownConnection):
+		return status.Error(codes.InvalidArgument, "unknown saml connection")
+	case errors.Is(err, saml.ErrInvalidState):
+		return status.Error(codes.InvalidArgument, "invalid or expired relay state")
+	case errors.Is(err, saml.ErrInvalidAssertion), errors.Is(err, saml.ErrReplayed):
+		return status.Error(codes.Unauthenticated, "identity provider did not vouch for the user")
+	case errors.Is(err, saml.ErrNoEmail):
+		return status.Error(codes.FailedPrecondition, "assertion has no acceptable email")
+	case errors.Is(err, saml.ErrAccountExists):
+		return status.Error(codes.FailedPrecondition, "account with this email exists and the connection does not link accounts")
+	}
+	return status.Error(codes.Internal, "internal server error")
+}
+
+func identityToDesc(i models.Identity) *desc.Identity {
+	return &desc.Identity{
+		Provider:  i.Provider,
+		Subject:   i.Subject,
+		Email:     i.Email,
+		CreatedAt: timestamppb.New(i.CreatedAt),
+	}
+}
+
+// restrictedProfile reports whether the token was selected for a profile that may not see
+// everything. Such a token must not manage the account or hand out unrestricted tokens
+func restrictedProfile(claims jwt.Claims) bool {
+	return claims.ProfileID != 0 && claims.MaturityRating != models.MaturityAdult
+}
+
+func orgError(err error) error {
+	switch {
+	case errors.Is(err, orgs.ErrNotAllowed):
+		return status.Error(codes.PermissionDenied, "not allowed in the organization")
+	case errors.Is(err, orgs.ErrInvalidOrgRole):
+		return status.Error(codes.InvalidArgument, "not valid organization role")
+	case errors.Is(err, storage.ErrUserNotFound):
+		return status.Error(codes.NotFound, "user not found")
+	case errors.Is(err, storage.ErrOrganizationNotFound):
+		return status.Error(codes.NotFound, "organization not found")
+	case errors.Is(err, storage.ErrMembershipNotFound):
+		return status.Error(codes.NotFound, "membership not found")
+	case errors.Is(err, storage.ErrMembershipAlreadyExists):
+		return status.Error(codes.AlreadyExists, "already a member or invited")
+	case errors.Is(err, storage.ErrLastOwner):
+		return status.Error(codes.FailedPrecondition, "organization must keep an owner")
+	}
+	return status.Error(codes.Internal, "internal server error")
+}
+
+// retryError builds a ResourceExhausted status carrying a RetryInfo detail, so clients know when to come back
+func retryError(msg string, retryAfter time.Duration) error {
+	st := status.New(codes.ResourceExhausted, msg)
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// challengeError builds a FailedPrecondition status whose ErrorInfo detail describes the challenge,
+// the client solves it and retries with the solution in the x-challenge-response metadata
+func challengeError(challenge *risk.ChallengeRequiredError) error {
+	metadata := map[string]string{"type": challenge.Type}
+	for k, v := range challenge.Params {
+		metadata[k] = v
+	}
+
+	st := status.New(codes.FailedPrecondition, "challenge required")
+	detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   "CHALLENGE_REQUIRED",
+		Domain:   "auth.vieo",
+		Metadata: metadata,
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+func isEmailValid(e string) bool {
+	emailRegex := regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,4}$`)
+	return emailRegex.MatchString(e)
+}
+
+// isPasswordValid checks the password against the policy of the tenant of the request
+func isPasswordValid(ctx context.Context, p string) bool {
+	if t, ok := tenant.FromContext(ctx); ok {
+		return t.ValidPassword(p)
+	}
+	passwordRegex := regexp.MustCompile(tenant.DefaultPasswordPattern)
 	return passwordRegex.MatchString(p)
 }
@@ -0,0 +1,117 @@
+package authgrpc
+
+import (
+	"context"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/tenant"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// TenantInterceptor scopes every request to a tenant. The tenant is taken from, in order:
+// the "x-tenant-id" metadata, the TLS server name (SNI), the :authority host,
+// the audience of the bearer token and finally the default tenant
+type TenantInterceptor struct {
+	tenants *tenant.Registry
+	logger  *logger.Logger
+}
+
+func NewTenantInterceptor(tenants *tenant.Registry, logger *logger.Logger) *TenantInterceptor {
+	return &TenantInterceptor{
+		tenants: tenants,
+		logger:  logger,
+	}
+}
+
+func (interceptor *TenantInterceptor) Resolve() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req any,
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (any, error) {
+		t, err := interceptor.resolve(ctx)
+		if err != nil {
+			interceptor.logger.Warn("tenant not resolved",
+				zap.String("method", info.FullMethod),
+				zap.Error(err),
+			)
+			return nil, status.Error(codes.InvalidArgument, "unknown tenant")
+		}
+
+		return handler(tenant.NewContext(ctx, t), req)
+	}
+}
+
+// ResolveStream is Resolve for the streaming methods
+func (interceptor *TenantInterceptor) ResolveStream() grpc.StreamServerInterceptor {
+	return func(
+		srv any,
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		t, err := interceptor.resolve(ss.Context())
+		if err != nil {
+			interceptor.logger.Warn("tenant not resolved",
+				zap.String("method", info.FullMethod),
+				zap.Error(err),
+			)
+			return status.Error(codes.InvalidArgument, "unknown tenant")
+		}
+
+		return handler(srv, &serverStream{ServerStream: ss, ctx: tenant.NewContext(ss.Context(), t)})
+	}
+}
+
+func (interceptor *TenantInterceptor) resolve(ctx context.Context) (tenant.Tenant, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	// an explicit tenant that does not exist is an error, not a reason to fall back
+	if val := md.Get("x-tenant-id"); len(val) > 0 && val[0] != "" {
+		return interceptor.tenants.Tenant(val[0])
+	}
+
+	if p, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && tlsInfo.State.ServerName != "" {
+			if t, ok := interceptor.tenants.ByHost(tlsInfo.State.ServerName); ok {
+				return t, nil
+			}
+		}
+	}
+
+	if val := md.Get(":authority"); len(val) > 0 {
+		if t, ok := interceptor.tenants.ByHost(val[0]); ok {
+			return t, nil
+		}
+	}
+
+	// the audience only picks the key, Authorize still verifies the token with it
+	if val := md.Get("authorization"); len(val) > 0 {
+		if aud := tokenAudience(val[0]); aud != "" {
+			return interceptor.tenants.Tenant(aud)
+		}
+	}
+
+	return interceptor.tenants.Fallback()
+}
+
+// tokenAudience reads the audience of the token without verifying it
+func tokenAudience(token string) string {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		return ""
+	}
+	aud, err := claims.GetAudience()
+	if err != nil || len(aud) == 0 {
+		return ""
+	}
+	return aud[0]
+}
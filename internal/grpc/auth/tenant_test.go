@@ -0,0 +1,73 @@
+package authgrpc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"testing"
+	"time"
+	"vieo/auth/internal/lib/jwt"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/tenant"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func TestTenantResolve(t *testing.T) {
+	registry, err := tenant.NewRegistry([]tenant.Tenant{
+		{ID: "acme", Hosts: []string{"auth.acme.com"}, SecretKey: "acme-secret"},
+		{ID: "globex", Hosts: []string{"auth.globex.com"}, SecretKey: "globex-secret"},
+		{ID: "initech", SecretKey: "initech-secret"},
+	}, "initech")
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	globexToken, err := jwt.NewToken(jwt.Claims{Email: "user@example.com", Tenant: "globex"}, time.Hour, "globex-secret")
+	if err != nil {
+		t.Fatalf("NewToken: %v", err)
+	}
+	unknownToken, err := jwt.NewToken(jwt.Claims{Email: "user@example.com", Tenant: "umbrella"}, time.Hour, "secret")
+	if err != nil {
+		t.Fatalf("NewToken: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		md         metadata.MD
+		serverName string
+		want       string
+		wantErr    error
+	}{
+		{"metadata", metadata.Pairs("x-tenant-id", "globex", ":authority", "auth.acme.com"), "auth.acme.com", "globex", nil},
+		{"unknown metadata does not fall back", metadata.Pairs("x-tenant-id", "umbrella"), "", "", tenant.ErrUnknownTenant},
+		{"server name", metadata.Pairs(":authority", "auth.globex.com"), "auth.acme.com", "acme", nil},
+		{"unknown server name", metadata.Pairs(":authority", "auth.globex.com"), "auth.example.com", "globex", nil},
+		{"authority", metadata.Pairs(":authority", "auth.acme.com:443", "authorization", globexToken), "", "acme", nil},
+		{"token audience", metadata.Pairs("authorization", globexToken), "", "globex", nil},
+		{"unknown token audience", metadata.Pairs("authorization", unknownToken), "", "", tenant.ErrUnknownTenant},
+		{"malformed token", metadata.Pairs("authorization", "not.a.token"), "", "initech", nil},
+		{"fallback", metadata.MD{}, "", "initech", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interceptor := NewTenantInterceptor(registry, &logger.Logger{SugaredLogger: zap.NewNop().Sugar()})
+			ctx := metadata.NewIncomingContext(context.Background(), tt.md)
+			if tt.serverName != "" {
+				ctx = peer.NewContext(ctx, &peer.Peer{
+					AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{ServerName: tt.serverName}},
+				})
+			}
+
+			got, err := interceptor.resolve(ctx)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("resolve error = %v, want %v", err, tt.wantErr)
+			}
+			if got.ID != tt.want {
+				t.Errorf("resolve = %q, want %q", got.ID, tt.want)
+			}
+		})
+	}
+}
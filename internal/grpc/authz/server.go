@@ -0,0 +1,192 @@
+package authzgrpc
+
+import (
+	"context"
+	"errors"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/services/rebac"
+
+	desc "github.com/Avalance-rl/contract-vieo/pkg/authz_v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Rebac interface for the relationship based authorization
+type Rebac interface {
+	Check(
+		ctx context.Context,
+		object models.Object,
+		relation string,
+		subject models.Subject,
+		consistencyToken string,
+	) (allowed bool, token string, err error)
+	Expand(
+		ctx context.Context,
+		object models.Object,
+		relation string,
+		consistencyToken string,
+	) (tree *rebac.Node, token string, err error)
+	Write(
+		ctx context.Context,
+		writes []models.RelationTuple,
+		deletes []models.RelationTuple,
+	) (token string, err error)
+	ListObjects(
+		ctx context.Context,
+		namespace string,
+		relation string,
+		subject models.Subject,
+		consistencyToken string,
+	) (objectIDs []string, token string, err error)
+}
+
+// serverAPI handles requests
+type serverAPI struct {
+	desc.UnimplementedAuthzServer //
+	rebac                         Rebac
+}
+
+// Register processes requests that come to the grpc server
+func Register(gRPC *grpc.Server, rebac Rebac) {
+	desc.RegisterAuthzServer(gRPC, &serverAPI{rebac: rebac})
+}
+
+func (s *serverAPI) Check(
+	ctx context.Context,
+	req *desc.CheckRequest,
+) (*desc.CheckResponse, error) {
+	object, err := models.ParseObject(req.GetObject())
+	if err != nil || req.GetRelation() == "" {
+		return nil, status.Error(codes.InvalidArgument, "not valid object or relation")
+	}
+	subject, err := models.ParseSubject(req.GetSubject())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "not valid subject")
+	}
+
+	allowed, token, err := s.rebac.Check(ctx, object, req.GetRelation(), subject, req.GetConsistencyToken())
+	if err != nil {
+		return nil, rebacError(err)
+	}
+
+	return &desc.CheckResponse{
+		Allowed:          allowed,
+		ConsistencyToken: token,
+	}, nil
+}
+
+func (s *serverAPI) Expand(
+	ctx context.Context,
+	req *desc.ExpandRequest,
+) (*desc.ExpandResponse, error) {
+	object, err := models.ParseObject(req.GetObject())
+	if err != nil || req.GetRelation() == "" {
+		return nil, status.Error(codes.InvalidArgument, "not valid object or relation")
+	}
+
+	tree, token, err := s.rebac.Expand(ctx, object, req.GetRelation(), req.GetConsistencyToken())
+	if err != nil {
+		return nil, rebacError(err)
+	}
+
+	return &desc.ExpandResponse{
+		Tree:             usersetNode(tree),
+		ConsistencyToken: token,
+	}, nil
+}
+
+func (s *serverAPI) Write(
+	ctx context.Context,
+	req *desc.WriteRequest,
+) (*desc.WriteResponse, error) {
+	if len(req.GetWrites()) == 0 && len(req.GetDeletes()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "nothing to write")
+	}
+
+	writes, err := relationTuples(req.GetWrites())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "not valid relation tuple")
+	}
+	deletes, err := relationTuples(req.GetDeletes())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "not valid relation tuple")
+	}
+
+	token, err := s.rebac.Write(ctx, writes, deletes)
+	if err != nil {
+		return nil, rebacError(err)
+	}
+
+	return &desc.WriteResponse{ConsistencyToken: token}, nil
+}
+
+func (s *serverAPI) ListObjects(
+	ctx context.Context,
+	req *desc.ListObjectsRequest,
+) (*desc.ListObjectsResponse, error) {
+	if req.GetNamespace() == "" || req.GetRelation() == "" {
+		return nil, status.Error(codes.InvalidArgument, "not valid namespace or relation")
+	}
+	subject, err := models.ParseSubject(req.GetSubject())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "not valid subject")
+	}
+
+	ids, token, err := s.rebac.ListObjects(ctx, req.GetNamespace(), req.GetRelation(), subject, req.GetConsistencyToken())
+	if err != nil {
+		return nil, rebacError(err)
+	}
+
+	return &desc.ListObjectsResponse{
+		ObjectIds:        ids,
+		ConsistencyToken: token,
+	}, nil
+}
+
+func relationTuples(in []*desc.RelationTuple) ([]models.RelationTuple, error) {
+	tuples := make([]models.RelationTuple, 0, len(in))
+	for _, t := range in {
+		object, err := models.ParseObject(t.GetObject())
+		if err != nil {
+			return nil, err
+		}
+		subject, err := models.ParseSubject(t.GetSubject())
+		if err != nil {
+			return nil, err
+		}
+		if t.GetRelation() == "" {
+			return nil, models.ErrInvalidRelationTuple
+		}
+		tuples = append(tuples, models.RelationTuple{Object: object, Relation: t.GetRelation(), Subject: subject})
+	}
+	return tuples, nil
+}
+
+func usersetNode(n *rebac.Node) *desc.UsersetNode {
+	node := &desc.UsersetNode{
+		Type:    n.Type,
+		Userset: n.Userset.String(),
+	}
+	for _, s := range n.Subjects {
+		node.Subjects = append(node.Subjects, s.String())
+	}
+	for _, c := range n.Children {
+		node.Children = append(node.Children, usersetNode(c))
+	}
+	return node
+}
+
+func rebacError(err error) error {
+	switch {
+	case errors.Is(err, rebac.ErrUnknownRelation):
+		return status.Error(codes.InvalidArgument, "relation is not declared")
+	case errors.Is(err, models.ErrInvalidRelationTuple):
+		return status.Error(codes.InvalidArgument, "not valid relation tuple")
+	case errors.Is(err, rebac.ErrInvalidConsistencyToken):
+		return status.Error(codes.FailedPrecondition, "not valid consistency token")
+	case errors.Is(err, rebac.ErrMaxDepthExceeded):
+		return status.Error(codes.FailedPrecondition, "userset nesting is too deep")
+	}
+	return status.Error(codes.Internal, "internal server error")
+}
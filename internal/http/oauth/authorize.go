@@ -0,0 +1,234 @@
+package oauthhttp
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/services/auth"
+	"vieo/auth/internal/services/clients"
+	"vieo/auth/internal/services/oauth"
+	"vieo/auth/internal/services/risk"
+	"vieo/auth/internal/services/security"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+// pageData is what the login and consent pages render, Request is carried in hidden fields
+type pageData struct {
+	Request oauth.AuthorizationRequest
+	Scope   string
+	Client  string
+	Error   string
+	Ticket  string
+	Email   string
+}
+
+var pages = template.Must(template.New("pages").Parse(`
+{{define "head"}}<!doctype html><html><head><meta charset="utf-8"><title>Sign in</title></head><body>{{end}}
+{{define "request"}}
+<input type="hidden" name="response_type" value="{{.Request.ResponseType}}">
+<input type="hidden" name="client_id" value="{{.Request.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.Request.RedirectURI}}">
+<input type="hidden" name="scope" value="{{.Scope}}">
+<input type="hidden" name="state" value="{{.Request.State}}">
+<input type="hidden" name="code_challenge" value="{{.Request.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.Request.CodeChallengeMethod}}">
+<input type="hidden" name="nonce" value="{{.Request.Nonce}}">
+{{end}}
+{{define "login"}}{{template "head"}}
+<h1>Sign in to continue to {{.Client}}</h1>
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<form method="post" action="/authorize">
+{{template "request" .}}
+<label>Email <input type="email" name="email" autocomplete="username" required></label>
+<label>Password <input type="password" name="password" autocomplete="current-password" required></label>
+<button type="submit">Sign in</button>
+</form></body></html>{{end}}
+{{define "consent"}}{{template "head"}}
+<h1>{{.Client}} wants to access your account</h1>
+<p>Signed in as {{.Email}}. {{.Client}} asks for:</p>
+<ul>{{range .Request.Scopes}}<li>{{.}}</li>{{end}}</ul>
+<form method="post" action="/authorize/consent">
+{{template "request" .}}
+<input type="hidden" name="ticket" value="{{.Ticket}}">
+<button type="submit" name="decision" value="allow">Allow</button>
+<button type="submit" name="decision" value="deny">Deny</button>
+</form></body></html>{{end}}
+{{define "error"}}{{template "head"}}<h1>Authorization failed</h1><p>{{.Error}}</p></body></html>{{end}}
+`))
+
+// authorize starts the authorization code flow with the login page
+func (h *handler) authorize(w http.ResponseWriter, r *http.Request) {
+	req, client, err := h.oauth.Validate(r.Context(), authorizationRequest(r.URL.Query()))
+	if err != nil {
+		h.authorizationFailed(w, r, req, err)
+		return
+	}
+
+	h.render(w, http.StatusOK, "login", page(req, client, ""))
+}
+
+// login authenticates the user and either sends the code back or asks for consent
+func (h *handler) login(w http.ResponseWriter, r *http.Request) {
+	const op = "oauthhttp.login"
+	log := h.log.With(zap.String("op", op))
+
+	if err := r.ParseForm(); err != nil {
+		h.render(w, http.StatusBadRequest, "error", pageData{Error: "malformed form"})
+		return
+	}
+	req, client, err := h.oauth.Validate(r.Context(), authorizationRequest(r.PostForm))
+	if err != nil {
+		h.authorizationFailed(w, r, req, err)
+		return
+	}
+	decision, err := h.oauth.Login(r.Context(), req, r.PostForm.Get("email"), r.PostForm.Get("password"))
+	if err != nil {
+		var locked *security.LockedError
+		switch {
+		// a risky source would get the challenge from the gRPC login, the page has none to offer
+		case errors.Is(err, risk.ErrChallengeRequired):
+			h.render(w, http.StatusTooManyRequests, "login", page(req, client, "Too many attempts from your network, try again later"))
+		case errors.As(err, &locked):
+			h.render(w, http.StatusTooManyRequests, "login", page(req, client, "The account is temporarily locked, try again later"))
+		case errors.Is(err, storage.ErrDeviceLimitExceeded):
+			h.render(w, http.StatusForbidden, "login", page(req, client, "The device limit of the account is reached"))
+		case errors.Is(err, storage.ErrHouseholdDeviceLimitExceeded):
+			h.render(w, http.StatusForbidden, "login", page(req, client, "The device limit of the household is reached"))
+		case errors.Is(err, oauth.ErrInvalidCredentials),
+			errors.Is(err, storage.ErrUserNotFound),
+			errors.Is(err, auth.ErrWrongPassword),
+			errors.Is(err, auth.ErrInvalidCredentials):
+			h.render(w, http.StatusUnauthorized, "login", page(req, client, "Invalid email or password"))
+		case errors.Is(err, auth.ErrPasswordResetRequired):
+			h.render(w, http.StatusForbidden, "login", page(req, client, "Reset your password to sign in"))
+		default:
+			log.Error("failed to log in", zap.Error(err))
+			h.render(w, http.StatusInternalServerError, "error", pageData{Error: "internal server error"})
+		}
+		return
+	}
+
+	if decision.Code != "" {
+		redirect(w, r, req, url.Values{"code": {decision.Code}})
+		return
+	}
+	data := page(req, client, "")
+	data.Ticket = decision.ConsentTicket
+	data.Email = decision.Email
+	h.render(w, http.StatusOK, "consent", data)
+}
+
+// consent takes the decision of the user on the consent page
+func (h *handler) consent(w http.ResponseWriter, r *http.Request) {
+	const op = "oauthhttp.consent"
+	log := h.log.With(zap.String("op", op))
+
+	if err := r.ParseForm(); err != nil {
+		h.render(w, http.StatusBadRequest, "error", pageData{Error: "malformed form"})
+		return
+	}
+	req, client, err := h.oauth.Validate(r.Context(), authorizationRequest(r.PostForm))
+	if err != nil {
+		h.authorizationFailed(w, r, req, err)
+		return
+	}
+	approved := r.PostForm.Get("decision") == "allow"
+
+	code, err := h.oauth.Consent(r.Context(), req, r.PostForm.Get("ticket"), approved)
+	if err != nil {
+		switch {
+		case errors.Is(err, oauth.ErrInvalidConsentTicket):
+			h.render(w, http.StatusBadRequest, "login", page(req, client, "The sign in expired, sign in again"))
+		case errors.Is(err, oauth.ErrAccessDenied):
+			redirect(w, r, req, url.Values{"error": {"access_denied"}})
+		default:
+			log.Error("failed to record consent", zap.Error(err))
+			h.render(w, http.StatusInternalServerError, "error", pageData{Error: "internal server error"})
+		}
+		return
+	}
+
+	redirect(w, r, req, url.Values{"code": {code}})
+}
+
+// authorizationFailed reports an invalid authorization request. Until the client and the redirect URI
+// are known to be valid the error is shown to the user, afterwards it is sent back to the client
+func (h *handler) authorizationFailed(w http.ResponseWriter, r *http.Request, req oauth.AuthorizationRequest, err error) {
+	switch {
+	case errors.Is(err, clients.ErrInvalidClient):
+		h.render(w, http.StatusBadRequest, "error", pageData{Error: "unknown client"})
+	case errors.Is(err, oauth.ErrInvalidRedirectURI):
+		h.render(w, http.StatusBadRequest, "error", pageData{Error: "the redirect uri is not registered for the client"})
+	case errors.Is(err, oauth.ErrUnsupportedResponseType):
+		redirect(w, r, req, url.Values{"error": {"unsupported_response_type"}})
+	case errors.Is(err, oauth.ErrInvalidScope):
+		redirect(w, r, req, url.Values{"error": {"invalid_scope"}})
+	case errors.Is(err, oauth.ErrInvalidRequest), errors.Is(err, oauth.ErrUnsupportedChallengeType):
+		redirect(w, r, req, url.Values{
+			"error":             {"invalid_request"},
+			"error_description": {"code_challenge with the S256 method is required"},
+		})
+	default:
+		h.log.Error("failed to validate authorization request", zap.Error(err))
+		redirect(w, r, req, url.Values{"error": {"server_error"}})
+	}
+}
+
+func (h *handler) render(w http.ResponseWriter, code int, name string, data pageData) {
+	// the pages take credentials, they must not be framed or cached
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+	w.WriteHeader(code)
+	if err := pages.ExecuteTemplate(w, name, data); err != nil {
+		h.log.Error("failed to render page", zap.String("page", name), zap.Error(err))
+	}
+}
+
+// redirect sends the result to the redirect URI of the client with the state of the request
+func redirect(w http.ResponseWriter, r *http.Request, req oauth.AuthorizationRequest, params url.Values) {
+	u, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		http.Error(w, "invalid redirect uri", http.StatusBadRequest)
+		return
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	if req.State != "" {
+		q.Set("state", req.State)
+	}
+	u.RawQuery = q.Encode()
+
+	// 303 makes the browser follow a form post with GET
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+func authorizationRequest(v url.Values) oauth.AuthorizationRequest {
+	return oauth.AuthorizationRequest{
+		ClientID:            v.Get("client_id"),
+		RedirectURI:         v.Get("redirect_uri"),
+		ResponseType:        v.Get("response_type"),
+		Scopes:              clients.ParseScope(v.Get("scope")),
+		State:               v.Get("state"),
+		CodeChallenge:       v.Get("code_challenge"),
+		CodeChallengeMethod: v.Get("code_challenge_method"),
+		Nonce:               v.Get("nonce"),
+	}
+}
+
+func page(req oauth.AuthorizationRequest, client models.Client, errMsg string) pageData {
+	return pageData{
+		Request: req,
+		Scope:   strings.Join(req.Scopes, " "),
+		Client:  client.Name,
+		Error:   errMsg,
+	}
+}
@@ -0,0 +1,413 @@
+package oauthhttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/clientinfo"
+	"vieo/auth/internal/lib/jwt"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/services/auth"
+	"vieo/auth/internal/services/clients"
+	"vieo/auth/internal/services/oauth"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+// Clients interface for the client_credentials grant
+type Clients interface {
+	ClientCredentials(
+		ctx context.Context,
+		creds clients.Credentials,
+		scopes []string,
+	) (clients.Token, error)
+}
+
+// OAuth interface for the authorization code flow
+type OAuth interface {
+	Validate(
+		ctx context.Context,
+		req oauth.AuthorizationRequest,
+	) (oauth.AuthorizationRequest, models.Client, error)
+	Login(
+		ctx context.Context,
+		req oauth.AuthorizationRequest,
+		email string,
+		password string,
+	) (oauth.Decision, error)
+	Consent(
+		ctx context.Context,
+		req oauth.AuthorizationRequest,
+		ticket string,
+		approved bool,
+	) (code string, err error)
+	ExchangeCode(
+		ctx context.Context,
+		creds clients.Credentials,
+		code string,
+		redirectURI string,
+		codeVerifier string,
+	) (oauth.TokenSet, error)
+	Refresh(
+		ctx context.Context,
+		creds clients.Credentials,
+		refreshToken string,
+		scopes []string,
+	) (oauth.TokenSet, error)
+	UserInfo(
+		ctx context.Context,
+		accessToken string,
+	) (map[string]any, error)
+	DeviceAuthorization(
+		ctx context.Context,
+		creds clients.Credentials,
+		scopes []string,
+		deviceAddress string,
+	) (oauth.DeviceCode, error)
+	ExchangeDeviceCode(
+		ctx context.Context,
+		creds clients.Credentials,
+		deviceCode string,
+	) (oauth.TokenSet, error)
+	Discovery() oauth.Metadata
+	JWKS() []jwt.JWK
+}
+
+// Services are the service layer behind the handlers
+type Services struct {
+	Clients Clients
+	OAuth   OAuth
+}
+
+// handler serves the OAuth endpoints over HTTP
+type handler struct {
+	log     *logger.Logger
+	tenants *tenant.Registry
+	clients Clients
+	oauth   OAuth
+	limits  Limits
+}
+
+// Register adds the OAuth endpoints to the mux, the routes found in limits are rate limited
+func Register(
+	mux *http.ServeMux,
+	log *logger.Logger,
+	tenants *tenant.Registry,
+	services Services,
+	limits Limits,
+) {
+	h := &handler{
+		log:     log,
+		tenants: tenants,
+		clients: services.Clients,
+		oauth:   services.OAuth,
+		limits:  limits,
+	}
+	route := func(pattern string, f http.HandlerFunc) {
+		mux.Handle(pattern, h.withTenant(h.withLimit(pattern, f)))
+	}
+	route("POST /token", h.token)
+	route("POST /device_authorization", h.deviceAuthorization)
+	route("GET /authorize", h.authorize)
+	route("POST /authorize", h.login)
+	route("POST /authorize/consent", h.consent)
+	route("GET /userinfo", h.userInfo)
+	route("POST /userinfo", h.userInfo)
+	mux.HandleFunc("GET /.well-known/openid-configuration", h.discovery)
+	mux.HandleFunc("GET /.well-known/jwks.json", h.jwks)
+}
+
+// tokenResponse is the successful response of RFC 6749 section 5.1
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// errorResponse is the error response of RFC 6749 section 5.2
+type errorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// token is the token endpoint of the client_credentials, authorization_code, refresh_token
+// and device_code grants
+func (h *handler) token(w http.ResponseWriter, r *http.Request) {
+	const op = "oauthhttp.token"
+	log := h.log.With(zap.String("op", op))
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "malformed form")
+		return
+	}
+	creds, basic, ok := clientCredentials(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid_request", "use one client authentication method")
+		return
+	}
+	scopes := clients.ParseScope(r.PostForm.Get("scope"))
+
+	var (
+		resp tokenResponse
+		err  error
+	)
+	switch r.PostForm.Get("grant_type") {
+	case "client_credentials":
+		var token clients.Token
+		token, err = h.clients.ClientCredentials(r.Context(), creds, scopes)
+		resp = tokenResponse{
+			AccessToken: token.AccessToken,
+			ExpiresIn:   int64(token.ExpiresIn.Seconds()),
+			Scope:       strings.Join(token.Scopes, " "),
+		}
+	case "authorization_code":
+		var tokens oauth.TokenSet
+		tokens, err = h.oauth.ExchangeCode(
+			r.Context(),
+			creds,
+			r.PostForm.Get("code"),
+			r.PostForm.Get("redirect_uri"),
+			r.PostForm.Get("code_verifier"),
+		)
+		resp = tokenSetResponse(tokens)
+	case "refresh_token":
+		var tokens oauth.TokenSet
+		tokens, err = h.oauth.Refresh(r.Context(), creds, r.PostForm.Get("refresh_token"), scopes)
+		resp = tokenSetResponse(tokens)
+	case oauth.DeviceCodeGrantType:
+		var tokens oauth.TokenSet
+		tokens, err = h.oauth.ExchangeDeviceCode(r.Context(), creds, r.PostForm.Get("device_code"))
+		resp = tokenSetResponse(tokens)
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, clients.ErrInvalidClient):
+			if basic {
+				w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+			}
+			writeError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		case errors.Is(err, clients.ErrUnauthorizedClient):
+			writeError(w, http.StatusBadRequest, "unauthorized_client", "")
+		case errors.Is(err, clients.ErrInvalidScope), errors.Is(err, oauth.ErrInvalidScope):
+			writeError(w, http.StatusBadRequest, "invalid_scope", "")
+		case errors.Is(err, oauth.ErrInvalidGrant):
+			writeError(w, http.StatusBadRequest, "invalid_grant", "")
+		case errors.Is(err, oauth.ErrAuthorizationPending):
+			writeError(w, http.StatusBadRequest, "authorization_pending", "")
+		case errors.Is(err, oauth.ErrSlowDown):
+			writeError(w, http.StatusBadRequest, "slow_down", "")
+		case errors.Is(err, oauth.ErrExpiredToken):
+			writeError(w, http.StatusBadRequest, "expired_token", "")
+		case errors.Is(err, oauth.ErrAccessDenied):
+			writeError(w, http.StatusBadRequest, "access_denied", "")
+		case errors.Is(err, storage.ErrDeviceLimitExceeded):
+			writeError(w, http.StatusBadRequest, "access_denied", "device limit exceeded")
+		case errors.Is(err, storage.ErrHouseholdDeviceLimitExceeded):
+			writeError(w, http.StatusBadRequest, "access_denied", "household device limit exceeded")
+		case errors.Is(err, auth.ErrPasswordResetRequired):
+			writeError(w, http.StatusBadRequest, "access_denied", "password reset required")
+		default:
+			log.Error("failed to issue token", zap.Error(err))
+			writeError(w, http.StatusInternalServerError, "server_error", "")
+		}
+		return
+	}
+
+	resp.TokenType = "Bearer"
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// deviceAuthorizationResponse is the response of RFC 8628 section 3.2
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// deviceAuthorization is the device authorization endpoint of RFC 8628. The device also sends
+// device_address, the address it is registered under among the devices of the user
+func (h *handler) deviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	const op = "oauthhttp.deviceAuthorization"
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "malformed form")
+		return
+	}
+	creds, basic, ok := clientCredentials(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid_request", "use one client authentication method")
+		return
+	}
+
+	code, err := h.oauth.DeviceAuthorization(
+		r.Context(),
+		creds,
+		clients.ParseScope(r.PostForm.Get("scope")),
+		r.PostForm.Get("device_address"),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, clients.ErrInvalidClient):
+			if basic {
+				w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+			}
+			writeError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		case errors.Is(err, oauth.ErrInvalidRequest):
+			writeError(w, http.StatusBadRequest, "invalid_request", "device_address is required")
+		case errors.Is(err, oauth.ErrInvalidScope):
+			writeError(w, http.StatusBadRequest, "invalid_scope", "")
+		default:
+			h.log.Error("failed to start device authorization", zap.String("op", op), zap.Error(err))
+			writeError(w, http.StatusInternalServerError, "server_error", "")
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, deviceAuthorizationResponse{
+		DeviceCode:              code.DeviceCode,
+		UserCode:                code.UserCode,
+		VerificationURI:         code.VerificationURI,
+		VerificationURIComplete: code.VerificationURIComplete,
+		ExpiresIn:               int64(code.ExpiresIn.Seconds()),
+		Interval:                int64(code.Interval.Seconds()),
+	})
+}
+
+// clientCredentials reads the client authentication of a token request: "Authorization: Basic",
+// client_secret or client_assertion in the form, or only client_id for a public client.
+// ok is false when more than one method is used
+func clientCredentials(r *http.Request) (creds clients.Credentials, basic bool, ok bool) {
+	creds = clients.Credentials{
+		ClientID:      r.PostForm.Get("client_id"),
+		ClientSecret:  r.PostForm.Get("client_secret"),
+		AssertionType: r.PostForm.Get("client_assertion_type"),
+		Assertion:     r.PostForm.Get("client_assertion"),
+	}
+	if creds.ClientSecret != "" && creds.Assertion != "" {
+		return creds, false, false
+	}
+	if header := r.Header.Get("Authorization"); header != "" {
+		id, secret, ok := clients.ParseBasicAuth(header)
+		if !ok || creds.ClientSecret != "" || creds.Assertion != "" {
+			return creds, false, false
+		}
+		creds.ClientID, creds.ClientSecret = id, secret
+		return creds, true, true
+	}
+	return creds, false, true
+}
+
+func tokenSetResponse(tokens oauth.TokenSet) tokenResponse {
+	return tokenResponse{
+		AccessToken:  tokens.AccessToken,
+		ExpiresIn:    int64(tokens.ExpiresIn.Seconds()),
+		RefreshToken: tokens.RefreshToken,
+		IDToken:      tokens.IDToken,
+		Scope:        strings.Join(tokens.Scopes, " "),
+	}
+}
+
+// userInfo is the OpenID Connect UserInfo endpoint, the bearer token errors follow RFC 6750
+func (h *handler) userInfo(w http.ResponseWriter, r *http.Request) {
+	const op = "oauthhttp.userInfo"
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer`)
+		writeError(w, http.StatusUnauthorized, "invalid_request", "bearer token is not provided")
+		return
+	}
+
+	claims, err := h.oauth.UserInfo(r.Context(), token)
+	if err != nil {
+		switch {
+		case errors.Is(err, oauth.ErrInvalidToken):
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, "invalid_token", "")
+		case errors.Is(err, oauth.ErrInsufficientScope):
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+			writeError(w, http.StatusForbidden, "insufficient_scope", "")
+		default:
+			h.log.Error("failed to get user info", zap.String("op", op), zap.Error(err))
+			writeError(w, http.StatusInternalServerError, "server_error", "")
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, claims)
+}
+
+func (h *handler) discovery(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(h.oauth.Discovery())
+}
+
+func (h *handler) jwks(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Keys []jwt.JWK `json:"keys"`
+	}{Keys: h.oauth.JWKS()})
+}
+
+// withTenant scopes the request to a tenant like the gRPC TenantInterceptor: the "X-Tenant-ID" header,
+// the TLS server name, the Host and finally the default tenant. It also puts the client info into the context
+func (h *handler) withTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, err := h.resolve(r)
+		if err != nil {
+			h.log.Warn("tenant not resolved", zap.String("path", r.URL.Path), zap.Error(err))
+			writeError(w, http.StatusBadRequest, "invalid_request", "unknown tenant")
+			return
+		}
+
+		ci := clientinfo.Info{IP: r.RemoteAddr, UserAgent: r.UserAgent()}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			ci.IP = host
+		}
+		ctx := clientinfo.NewContext(tenant.NewContext(r.Context(), t), ci)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (h *handler) resolve(r *http.Request) (tenant.Tenant, error) {
+	if id := r.Header.Get("X-Tenant-ID"); id != "" {
+		return h.tenants.Tenant(id)
+	}
+	if r.TLS != nil && r.TLS.ServerName != "" {
+		if t, ok := h.tenants.ByHost(r.TLS.ServerName); ok {
+			return t, nil
+		}
+	}
+	if t, ok := h.tenants.ByHost(r.Host); ok {
+		return t, nil
+	}
+	return h.tenants.Fallback()
+}
+
+func writeError(w http.ResponseWriter, code int, errCode string, description string) {
+	writeJSON(w, code, errorResponse{Error: errCode, ErrorDescription: description})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	// token responses must not be cached, RFC 6749 section 5.1
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
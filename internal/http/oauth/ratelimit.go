@@ -0,0 +1,107 @@
+package oauthhttp
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+	"vieo/auth/internal/lib/clientinfo"
+	"vieo/auth/internal/lib/ratelimit"
+	"vieo/auth/internal/lib/tenant"
+
+	"go.uber.org/zap"
+)
+
+// RouteLimits are the token bucket policies of one route, keyed by its mux pattern such as "POST /token".
+// Route is shared by all callers, the others are kept per client ip, per email of the login form
+// and per client id of the request
+type RouteLimits struct {
+	Route  ratelimit.Policy
+	IP     ratelimit.Policy
+	Email  ratelimit.Policy
+	Client ratelimit.Policy
+}
+
+// Limits are the rate limits of the OAuth endpoints, the same limiter as the gRPC methods
+type Limits struct {
+	Limiter ratelimit.Limiter
+	Routes  map[string]RouteLimits
+}
+
+// limitCheck is one bucket the request has to take a token from
+type limitCheck struct {
+	kind   string
+	key    string
+	policy ratelimit.Policy
+}
+
+// withLimit rejects the request with 429 once one of the buckets of the route is empty.
+// It runs after withTenant, which resolves the tenant and the client ip
+func (h *handler) withLimit(route string, next http.Handler) http.Handler {
+	limits, ok := h.limits.Routes[route]
+	if !ok || h.limits.Limiter == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		checks := []limitCheck{
+			{kind: "route", key: route, policy: limits.Route},
+		}
+		if ip := clientinfo.FromContext(ctx).IP; ip != "" {
+			checks = append(checks, limitCheck{kind: "ip", key: route + ":" + ip, policy: limits.IP})
+		}
+		// a malformed form is refused by the handler, only the route and ip buckets apply to it
+		if err := r.ParseForm(); err == nil {
+			// the same email or client in two tenants are two different accounts
+			scope := route + ":" + tenant.ID(ctx) + ":"
+			if email := r.PostForm.Get("email"); email != "" {
+				checks = append(checks, limitCheck{kind: "email", key: scope + email, policy: limits.Email})
+			}
+			if creds, _, ok := clientCredentials(r); ok && creds.ClientID != "" {
+				checks = append(checks, limitCheck{kind: "client", key: scope + creds.ClientID, policy: limits.Client})
+			}
+		}
+
+		// a request rejected by one bucket gives back the tokens it took from the others,
+		// so retries against a blocked key do not drain the route and ip buckets
+		var taken []limitCheck
+		for _, c := range checks {
+			allowed, retryAfter, err := h.limits.Limiter.Allow(ctx, c.kind+":"+c.key, c.policy)
+			if err != nil {
+				// the limiter must not take the service down with it
+				h.log.Error("rate limiter failed", zap.String("route", route), zap.Error(err))
+				continue
+			}
+			if !allowed {
+				h.log.Warn("rate limit exceeded", zap.String("route", route), zap.String("limit", c.kind))
+				h.refund(ctx, route, taken)
+				w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+				writeError(w, http.StatusTooManyRequests, "temporarily_unavailable", "too many requests")
+				return
+			}
+			taken = append(taken, c)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// refund gives back the tokens a rejected request took
+func (h *handler) refund(ctx context.Context, route string, taken []limitCheck) {
+	for _, c := range taken {
+		if err := h.limits.Limiter.Refund(ctx, c.kind+":"+c.key, c.policy); err != nil {
+			h.log.Error("failed to refund rate limit",
+				zap.String("route", route),
+				zap.String("limit", c.kind),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// retryAfterSeconds formats the wait as the delay-seconds of Retry-After, rounded up to at least a second
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(max(1, int(math.Ceil(d.Seconds()))))
+}
@@ -0,0 +1,169 @@
+package oauthhttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"vieo/auth/internal/lib/clientinfo"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/ratelimit"
+	"vieo/auth/internal/lib/tenant"
+
+	"go.uber.org/zap"
+)
+
+// countingLimiter allows a key while it has tokens left and counts the refunds
+type countingLimiter struct {
+	tokens  map[string]int
+	refunds map[string]int
+}
+
+func (l *countingLimiter) Allow(_ context.Context, key string, _ ratelimit.Policy) (bool, time.Duration, error) {
+	if l.tokens[key] <= 0 {
+		return false, 1500 * time.Millisecond, nil
+	}
+	l.tokens[key]--
+	return true, 0, nil
+}
+
+func (l *countingLimiter) Refund(_ context.Context, key string, _ ratelimit.Policy) error {
+	l.tokens[key]++
+	l.refunds[key]++
+	return nil
+}
+
+func TestRateLimitedRoutes(t *testing.T) {
+	const route = "POST /authorize"
+	var (
+		routeKey  = "route:" + route
+		ipKey     = "ip:" + route + ":10.0.0.1"
+		emailKey  = "email:" + route + ":" + tenant.DefaultID + ":user@example.com"
+		clientKey = "client:" + route + ":" + tenant.DefaultID + ":tv-app"
+	)
+	policy := ratelimit.Policy{Limit: 1, Per: time.Minute}
+
+	tests := []struct {
+		name        string
+		tokens      map[string]int
+		wantStatus  int
+		wantTokens  map[string]int
+		wantRefunds map[string]int
+	}{
+		{
+			name:        "all buckets allow",
+			tokens:      map[string]int{routeKey: 5, ipKey: 5, emailKey: 5, clientKey: 5},
+			wantStatus:  http.StatusOK,
+			wantTokens:  map[string]int{routeKey: 4, ipKey: 4, emailKey: 4, clientKey: 4},
+			wantRefunds: map[string]int{},
+		},
+		{
+			name:        "email bucket rejects",
+			tokens:      map[string]int{routeKey: 5, ipKey: 5, emailKey: 0, clientKey: 5},
+			wantStatus:  http.StatusTooManyRequests,
+			wantTokens:  map[string]int{routeKey: 5, ipKey: 5, emailKey: 0, clientKey: 5},
+			wantRefunds: map[string]int{routeKey: 1, ipKey: 1},
+		},
+		{
+			name:        "ip bucket rejects",
+			tokens:      map[string]int{routeKey: 5, ipKey: 0, emailKey: 5, clientKey: 5},
+			wantStatus:  http.StatusTooManyRequests,
+			wantTokens:  map[string]int{routeKey: 5, ipKey: 0, emailKey: 5, clientKey: 5},
+			wantRefunds: map[string]int{routeKey: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := &countingLimiter{tokens: tt.tokens, refunds: map[string]int{}}
+			tenants, err := tenant.NewRegistry([]tenant.Tenant{{ID: tenant.DefaultID, SecretKey: "secret"}}, tenant.DefaultID)
+			if err != nil {
+				t.Fatalf("NewRegistry: %v", err)
+			}
+			mux := http.NewServeMux()
+			called := false
+			h := &handler{
+				log:     &logger.Logger{SugaredLogger: zap.NewNop().Sugar()},
+				tenants: tenants,
+				limits: Limits{
+					Limiter: limiter,
+					Routes: map[string]RouteLimits{
+						route: {Route: policy, IP: policy, Email: policy, Client: policy},
+					},
+				},
+			}
+			mux.Handle(route, h.withTenant(h.withLimit(route, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			}))))
+
+			form := url.Values{"email": {"user@example.com"}, "password": {"secret"}, "client_id": {"tv-app"}}
+			req := httptest.NewRequest(http.MethodPost, "/authorize", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.RemoteAddr = "10.0.0.1:5555"
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if called != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("handler called = %v", called)
+			}
+			if tt.wantStatus == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "2" {
+				t.Errorf("Retry-After = %q, want 2", rec.Header().Get("Retry-After"))
+			}
+			for key, want := range tt.wantTokens {
+				if got := limiter.tokens[key]; got != want {
+					t.Errorf("tokens[%s] = %d, want %d", key, got, want)
+				}
+			}
+			for key, got := range limiter.refunds {
+				if want := tt.wantRefunds[key]; got != want {
+					t.Errorf("refunds[%s] = %d, want %d", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUnlimitedRoute(t *testing.T) {
+	// a limiter without tokens rejects every key it is asked about
+	h := &handler{limits: Limits{Limiter: &countingLimiter{tokens: map[string]int{}, refunds: map[string]int{}}}}
+	next := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+
+	rec := httptest.NewRecorder()
+	h.withLimit("GET /userinfo", next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/userinfo", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status of a route without limits = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestDeviceAuthorizationLimitedByClient(t *testing.T) {
+	const route = "POST /device_authorization"
+	clientKey := "client:" + route + ":" + tenant.DefaultID + ":tv-app"
+	limiter := &countingLimiter{
+		tokens:  map[string]int{"route:" + route: 5, "ip:" + route + ":10.0.0.1": 5, clientKey: 1},
+		refunds: map[string]int{},
+	}
+	h := &handler{
+		log:    &logger.Logger{SugaredLogger: zap.NewNop().Sugar()},
+		limits: Limits{Limiter: limiter, Routes: map[string]RouteLimits{route: {}}},
+	}
+	minted := 0
+	next := h.withLimit(route, http.HandlerFunc(func(http.ResponseWriter, *http.Request) { minted++ }))
+
+	for range 2 {
+		req := httptest.NewRequest(http.MethodPost, "/device_authorization", strings.NewReader("scope=openid"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		// the client id of the basic authentication is the one limited
+		req.SetBasicAuth("tv-app", "secret")
+		req = req.WithContext(clientinfo.NewContext(req.Context(), clientinfo.Info{IP: "10.0.0.1"}))
+		next.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if minted != 1 {
+		t.Errorf("minted %d device codes, want 1", minted)
+	}
+}
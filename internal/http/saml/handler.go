@@ -0,0 +1,50 @@
+package samlhttp
+
+import (
+	"errors"
+	"net/http"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/services/saml"
+
+	"go.uber.org/zap"
+)
+
+// Metadata interface for the service provider metadata of the connections
+type Metadata interface {
+	Metadata(connection string) ([]byte, error)
+}
+
+// handler serves the SAML service provider metadata the identity providers are configured with
+type handler struct {
+	log      *logger.Logger
+	metadata Metadata
+}
+
+// Register adds the SAML endpoints to the mux. The ACS is the page of the app, it hands
+// the posted response to CompleteSAMLLogin
+func Register(
+	mux *http.ServeMux,
+	log *logger.Logger,
+	metadata Metadata,
+) {
+	h := &handler{
+		log:      log,
+		metadata: metadata,
+	}
+	mux.HandleFunc("GET /saml/{connection}/metadata", h.serveMetadata)
+}
+
+func (h *handler) serveMetadata(w http.ResponseWriter, r *http.Request) {
+	metadata, err := h.metadata.Metadata(r.PathValue("connection"))
+	if err != nil {
+		if errors.Is(err, saml.ErrUnknownConnection) {
+			http.NotFound(w, r)
+			return
+		}
+		h.log.Error("failed to serve saml metadata", zap.Error(err))
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	_, _ = w.Write(metadata)
+}
@@ -0,0 +1,24 @@
+package clientinfo
+
+import "context"
+
+// Info describes the client that made the current request
+type Info struct {
+	IP        string
+	UserAgent string
+	// ChallengeResponse is the solution of a CAPTCHA or a one-time code sent along with the request
+	ChallengeResponse string
+}
+
+type ctxKey struct{}
+
+// NewContext returns a copy of ctx carrying the client info
+func NewContext(ctx context.Context, info Info) context.Context {
+	return context.WithValue(ctx, ctxKey{}, info)
+}
+
+// FromContext returns the client info stored in ctx, empty if there is none
+func FromContext(ctx context.Context) Info {
+	info, _ := ctx.Value(ctxKey{}).(Info)
+	return info
+}
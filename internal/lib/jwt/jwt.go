@@ -2,6 +2,8 @@ package jwt
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -13,24 +15,122 @@ var (
 	ErrIncorrectExpiration = errors.New("incorrect token expiration time value")
 	ErrInvalidToken        = errors.New("invalid token")
 	ErrInvalidSignMethod   = errors.New("invalid signature method")
+	// ErrClientToken is returned by DecodeToken for a token issued to a client, a service account
+	// or a third-party application must not pass for the user
+	ErrClientToken = fmt.Errorf("%w: issued to a client", ErrInvalidToken)
 )
 
+// Claims is the content of an access token
+type Claims struct {
+	Email         string
+	DeviceAddress string
+	Roles         []string
+	Permissions   []string
+	// OrgID is the organization the token acts for and OrgRole the role in it,
+	// zero for the personal context
+	OrgID   int64
+	OrgRole string
+	// Tenant is the audience of the token, a token is only accepted by its own tenant
+	Tenant string
+	// ClientID is the client the token was issued to: the service account of the client_credentials
+	// grant, such tokens have no email, or the application of the authorization code flow
+	ClientID string
+	// Scopes are the OAuth scopes granted to the client, empty for first-party tokens
+	Scopes []string
+	// ProfileID is the viewer profile the token was selected for and MaturityRating its content
+	// restriction the catalog enforces, zero for the whole account
+	ProfileID      int64
+	MaturityRating string
+	// HouseholdID is the household the user belongs to and HouseholdRole the role in it,
+	// zero outside of a household
+	HouseholdID   int64
+	HouseholdRole string
+	// Plan, Features and MaxStreams are the entitlements of the subscription, catalog services
+	// check them instead of asking the billing service, empty without a plan
+	Plan       string
+	Features   []string
+	MaxStreams int
+	// GuestID is the anonymous visitor of a guest token, such tokens have no email and are
+	// limited to the guest scopes
+	GuestID string
+	// PersonalTokenID is the personal access token the claims were resolved from, such claims
+	// are never encoded into a JWT and are limited to the methods open to personal tokens
+	PersonalTokenID int64
+	// ExpiresAt is filled on decoding, NewToken takes the lifetime instead
+	ExpiresAt time.Time
+}
+
+// HasPermissions reports whether the token grants all of the permissions
+func (c Claims) HasPermissions(permissions ...string) bool {
+	for _, p := range permissions {
+		found := false
+		for _, granted := range c.Permissions {
+			if granted == p {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
 // NewToken generate new access token for client,
-// he consists of "email", "deviceAddress", "expiration", "iat"
+// he consists of "email", "deviceAddress", "roles", "permissions", "expiration", "iat"
+// and "org_id", "org_role" when issued for an organization, "aud" is the tenant,
+// "client_id" and "scope" are the client and the scopes of an OAuth token, "sub" is the client
+// of a service account token, "profile_id" and "maturity_rating" the selected viewer profile,
+// "household_id" and "household_role" the household of the user, "plan", "features" and "max_streams"
+// the entitlements of the subscription, "guest_id" the visitor of a guest token
 func NewToken(
-	user string,
+	claims Claims,
 	duration time.Duration,
 	secretKey string,
-	deviceAddress string,
 ) (string, error) {
 	jwtSecretKey := []byte(secretKey)
 	expirationTime := time.Now().Add(duration).Unix()
 	accessPayload := jwt.MapClaims{
-		"email":         user,
-		"deviceAddress": deviceAddress,
+		"email":         claims.Email,
+		"deviceAddress": claims.DeviceAddress,
+		"roles":         nonNil(claims.Roles),
+		"permissions":   nonNil(claims.Permissions),
 		"exp":           expirationTime, // interceptor will check access token's expiration time
 		"iat":           time.Now().Unix(),
 	}
+	if claims.Tenant != "" {
+		accessPayload["aud"] = claims.Tenant
+	}
+	if claims.ClientID != "" {
+		accessPayload["client_id"] = claims.ClientID
+		if claims.Email == "" {
+			accessPayload["sub"] = claims.ClientID
+		}
+	}
+	if len(claims.Scopes) > 0 {
+		accessPayload["scope"] = strings.Join(claims.Scopes, " ")
+	}
+	if claims.OrgID != 0 {
+		accessPayload["org_id"] = claims.OrgID
+		accessPayload["org_role"] = claims.OrgRole
+	}
+	if claims.ProfileID != 0 {
+		accessPayload["profile_id"] = claims.ProfileID
+		accessPayload["maturity_rating"] = claims.MaturityRating
+	}
+	if claims.HouseholdID != 0 {
+		accessPayload["household_id"] = claims.HouseholdID
+		accessPayload["household_role"] = claims.HouseholdRole
+	}
+	if claims.GuestID != "" {
+		accessPayload["guest_id"] = claims.GuestID
+	}
+	if claims.Plan != "" {
+		accessPayload["plan"] = claims.Plan
+		accessPayload["features"] = nonNil(claims.Features)
+		accessPayload["max_streams"] = claims.MaxStreams
+	}
 
 	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessPayload)
 	signedAccessToken, err := accessToken.SignedString(jwtSecretKey)
@@ -41,11 +141,29 @@ func NewToken(
 	return signedAccessToken, nil
 }
 
-// DecodeToken is decoding access token, checking his valid
+// DecodeToken is decoding first-party access token, checking his valid.
+// Tokens issued to clients are ErrClientToken, see DecodeClientToken
 func DecodeToken(
 	secretKey string,
 	accessToken string,
-) (string, string, error) {
+) (Claims, error) {
+	claims, err := DecodeClientToken(secretKey, accessToken)
+	if err != nil {
+		return Claims{}, err
+	}
+	if claims.ClientID != "" {
+		return Claims{}, ErrClientToken
+	}
+
+	return claims, nil
+}
+
+// DecodeClientToken is DecodeToken that also accepts the tokens issued to clients,
+// the caller must check ClientID before trusting the token as the user's own
+func DecodeClientToken(
+	secretKey string,
+	accessToken string,
+) (Claims, error) {
 	jwtSecretKey := []byte(secretKey)
 
 	token, err := jwt.Parse(accessToken, func(token *jwt.Token) (interface{}, error) {
@@ -57,27 +175,167 @@ func DecodeToken(
 	})
 
 	if err != nil {
-		return "", "", ErrInvalidSignMethod
+		return Claims{}, ErrInvalidSignMethod
 	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
 		email, okEmail := claims["email"].(string)
 		deviceAddress, okDevice := claims["deviceAddress"].(string)
 		if !okEmail || !okDevice {
-			return "", "", ErrFailedToExtractData
+			return Claims{}, ErrFailedToExtractData
 		}
 
 		expiration, ok := claims["exp"].(float64)
 		if !ok {
-			return "", "", ErrIncorrectExpiration
+			return Claims{}, ErrIncorrectExpiration
 		}
 
 		if time.Now().Unix() > int64(expiration) {
-			return "", "", ErrTokenExpiration
+			return Claims{}, ErrTokenExpiration
 		}
 
-		return email, deviceAddress, nil
+		// tokens issued before roles existed have no such claims and grant nothing
+		res := Claims{
+			Email:         email,
+			DeviceAddress: deviceAddress,
+			Roles:         stringSlice(claims["roles"]),
+			Permissions:   stringSlice(claims["permissions"]),
+			ExpiresAt:     time.Unix(int64(expiration), 0),
+		}
+		if aud, err := claims.GetAudience(); err == nil && len(aud) > 0 {
+			res.Tenant = aud[0]
+		}
+		res.ClientID, _ = claims["client_id"].(string)
+		if scope, ok := claims["scope"].(string); ok {
+			res.Scopes = strings.Fields(scope)
+		}
+		if orgID, ok := claims["org_id"].(float64); ok {
+			res.OrgID = int64(orgID)
+			res.OrgRole, _ = claims["org_role"].(string)
+		}
+		if profileID, ok := claims["profile_id"].(float64); ok {
+			res.ProfileID = int64(profileID)
+			res.MaturityRating, _ = claims["maturity_rating"].(string)
+		}
+		if householdID, ok := claims["household_id"].(float64); ok {
+			res.HouseholdID = int64(householdID)
+			res.HouseholdRole, _ = claims["household_role"].(string)
+		}
+		res.GuestID, _ = claims["guest_id"].(string)
+		if plan, ok := claims["plan"].(string); ok {
+			res.Plan = plan
+			res.Features = stringSlice(claims["features"])
+			if maxStreams, ok := claims["max_streams"].(float64); ok {
+				res.MaxStreams = int(maxStreams)
+			}
+		}
+		return res, nil
 	}
 
-	return "", "", ErrInvalidToken
+	return Claims{}, ErrInvalidToken
+}
+
+// stringSlice converts a decoded JSON array to strings, skipping anything else
+func stringSlice(v any) []string {
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	res := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// nonNil makes empty lists encode as [] rather than null
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// NewActionToken generate a short-lived token for a one-click link sent to the user,
+// it consists of "sub", "purpose", "deviceAddress", "fingerprint", "expiration", "iat".
+// The token has no "email" claim, so DecodeToken never accepts it as an access token
+func NewActionToken(
+	secretKey string,
+	purpose string,
+	user string,
+	deviceAddress string,
+	fingerprint string,
+	duration time.Duration,
+) (string, error) {
+	payload := jwt.MapClaims{
+		"sub":           user,
+		"purpose":       purpose,
+		"deviceAddress": deviceAddress,
+		"fingerprint":   fingerprint,
+		"exp":           time.Now().Add(duration).Unix(),
+		"iat":           time.Now().Unix(),
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, payload)
+	signed, err := token.SignedString([]byte(secretKey))
+	if err != nil {
+		return "", err
+	}
+
+	return signed, nil
+}
+
+// ActionClaims is the content of a token made by NewActionToken
+type ActionClaims struct {
+	User          string
+	DeviceAddress string
+	Fingerprint   string
+	IssuedAt      time.Time
+}
+
+// DecodeActionToken is decoding action token, checking it is valid and has the purpose
+func DecodeActionToken(
+	secretKey string,
+	purpose string,
+	actionToken string,
+) (ActionClaims, error) {
+	token, err := jwt.Parse(actionToken, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, ErrInvalidSignMethod
+		}
+		return []byte(secretKey), nil
+	})
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return ActionClaims{}, ErrTokenExpiration
+		}
+		return ActionClaims{}, ErrInvalidToken
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return ActionClaims{}, ErrInvalidToken
+	}
+	if p, _ := claims["purpose"].(string); p != purpose {
+		return ActionClaims{}, ErrInvalidToken
+	}
+
+	user, okUser := claims["sub"].(string)
+	deviceAddress, okDevice := claims["deviceAddress"].(string)
+	fingerprint, okFingerprint := claims["fingerprint"].(string)
+	if !okUser || !okDevice || !okFingerprint {
+		return ActionClaims{}, ErrFailedToExtractData
+	}
+
+	res := ActionClaims{
+		User:          user,
+		DeviceAddress: deviceAddress,
+		Fingerprint:   fingerprint,
+	}
+	if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+		res.IssuedAt = iat.Time
+	}
+	return res, nil
 }
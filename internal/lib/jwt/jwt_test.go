@@ -0,0 +1,283 @@
+package jwt
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testSecret = "secret"
+
+func TestTokenRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims Claims
+	}{
+		{
+			name:   "user",
+			claims: Claims{Email: "user@example.com", DeviceAddress: "device", Roles: []string{"admin"}, Permissions: []string{"users:read"}},
+		},
+		{
+			name:   "no roles",
+			claims: Claims{Email: "user@example.com", DeviceAddress: "device", Roles: []string{}, Permissions: []string{}},
+		},
+		{
+			name: "organization and tenant",
+			claims: Claims{
+				Email: "user@example.com", DeviceAddress: "device", Roles: []string{}, Permissions: []string{},
+				OrgID: 7, OrgRole: "owner", Tenant: "acme",
+			},
+		},
+		{
+			name: "profile, household and plan",
+			claims: Claims{
+				Email: "user@example.com", DeviceAddress: "device", Roles: []string{}, Permissions: []string{},
+				ProfileID: 3, MaturityRating: "teen", HouseholdID: 9, HouseholdRole: "member",
+				Plan: "premium", Features: []string{"4k", "downloads"}, MaxStreams: 4,
+			},
+		},
+		{
+			name: "guest",
+			claims: Claims{
+				DeviceAddress: "device", Roles: []string{}, Permissions: []string{"catalog:read"},
+				GuestID: "guest-1", Scopes: []string{"catalog"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := NewToken(tt.claims, time.Hour, testSecret)
+			if err != nil {
+				t.Fatalf("NewToken: %v", err)
+			}
+			got, err := DecodeToken(testSecret, token)
+			if err != nil {
+				t.Fatalf("DecodeToken: %v", err)
+			}
+			if d := time.Until(got.ExpiresAt); d <= 0 || d > time.Hour {
+				t.Errorf("ExpiresAt in %s, want within an hour", d)
+			}
+			got.ExpiresAt = time.Time{}
+			if !reflect.DeepEqual(got, tt.claims) {
+				t.Errorf("DecodeToken = %+v, want %+v", got, tt.claims)
+			}
+		})
+	}
+}
+
+func TestDecodeClientTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims Claims
+	}{
+		{"service account", Claims{ClientID: "svc", Scopes: []string{"users:read"}}},
+		{"application acting for a user", Claims{Email: "user@example.com", DeviceAddress: "device", ClientID: "app", Scopes: []string{"openid"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := NewToken(tt.claims, time.Hour, testSecret)
+			if err != nil {
+				t.Fatalf("NewToken: %v", err)
+			}
+
+			if _, err := DecodeToken(testSecret, token); !errors.Is(err, ErrClientToken) {
+				t.Errorf("DecodeToken error = %v, want %v", err, ErrClientToken)
+			}
+			if !errors.Is(ErrClientToken, ErrInvalidToken) {
+				t.Errorf("ErrClientToken is not ErrInvalidToken")
+			}
+
+			got, err := DecodeClientToken(testSecret, token)
+			if err != nil {
+				t.Fatalf("DecodeClientToken: %v", err)
+			}
+			if got.ClientID != tt.claims.ClientID || !reflect.DeepEqual(got.Scopes, tt.claims.Scopes) {
+				t.Errorf("DecodeClientToken = %q %v, want %q %v", got.ClientID, got.Scopes, tt.claims.ClientID, tt.claims.Scopes)
+			}
+		})
+	}
+}
+
+func TestDecodeTokenRejects(t *testing.T) {
+	valid := Claims{Email: "user@example.com", DeviceAddress: "device"}
+
+	tests := []struct {
+		name  string
+		token func(t *testing.T) string
+	}{
+		{
+			name: "another secret",
+			token: func(t *testing.T) string {
+				return newToken(t, valid, time.Hour, "other")
+			},
+		},
+		{
+			name: "expired",
+			token: func(t *testing.T) string {
+				return newToken(t, valid, -time.Minute, testSecret)
+			},
+		},
+		{
+			name: "action token",
+			token: func(t *testing.T) string {
+				token, err := NewActionToken(testSecret, "reset_password", "user@example.com", "device", "", time.Hour)
+				if err != nil {
+					t.Fatalf("NewActionToken: %v", err)
+				}
+				return token
+			},
+		},
+		{
+			name: "rsa signed",
+			token: func(t *testing.T) string {
+				signer, err := GenerateSigner()
+				if err != nil {
+					t.Fatalf("GenerateSigner: %v", err)
+				}
+				token, err := signer.Sign(map[string]any{"email": "user@example.com", "deviceAddress": "device"}, time.Hour)
+				if err != nil {
+					t.Fatalf("Sign: %v", err)
+				}
+				return token
+			},
+		},
+		{
+			name: "unsigned",
+			token: func(t *testing.T) string {
+				token, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{
+					"email": "user@example.com", "deviceAddress": "device", "exp": time.Now().Add(time.Hour).Unix(),
+				}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+				if err != nil {
+					t.Fatalf("SignedString: %v", err)
+				}
+				return token
+			},
+		},
+		{
+			name: "malformed",
+			token: func(*testing.T) string {
+				return "not.a.token"
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeToken(testSecret, tt.token(t)); err == nil {
+				t.Errorf("DecodeToken accepted the token")
+			}
+		})
+	}
+}
+
+func TestActionTokenRoundTrip(t *testing.T) {
+	token, err := NewActionToken(testSecret, "unlock_account", "user@example.com", "device", "fp", time.Hour)
+	if err != nil {
+		t.Fatalf("NewActionToken: %v", err)
+	}
+
+	got, err := DecodeActionToken(testSecret, "unlock_account", token)
+	if err != nil {
+		t.Fatalf("DecodeActionToken: %v", err)
+	}
+	if got.User != "user@example.com" || got.DeviceAddress != "device" || got.Fingerprint != "fp" {
+		t.Errorf("DecodeActionToken = %+v", got)
+	}
+	if time.Since(got.IssuedAt) > time.Minute {
+		t.Errorf("IssuedAt = %s, want now", got.IssuedAt)
+	}
+}
+
+func TestDecodeActionTokenRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   func(t *testing.T) string
+		purpose string
+		want    error
+	}{
+		{
+			name: "another purpose",
+			token: func(t *testing.T) string {
+				return newActionToken(t, testSecret, "reset_password", time.Hour)
+			},
+			purpose: "unlock_account",
+			want:    ErrInvalidToken,
+		},
+		{
+			name: "another secret",
+			token: func(t *testing.T) string {
+				return newActionToken(t, "other", "unlock_account", time.Hour)
+			},
+			purpose: "unlock_account",
+			want:    ErrInvalidToken,
+		},
+		{
+			name: "expired",
+			token: func(t *testing.T) string {
+				return newActionToken(t, testSecret, "unlock_account", -time.Minute)
+			},
+			purpose: "unlock_account",
+			want:    ErrTokenExpiration,
+		},
+		{
+			name: "access token",
+			token: func(t *testing.T) string {
+				return newToken(t, Claims{Email: "user@example.com", DeviceAddress: "device"}, time.Hour, testSecret)
+			},
+			purpose: "",
+			want:    ErrFailedToExtractData,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeActionToken(testSecret, tt.purpose, tt.token(t))
+			if !errors.Is(err, tt.want) {
+				t.Errorf("DecodeActionToken error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasPermissions(t *testing.T) {
+	claims := Claims{Permissions: []string{"users:read", "users:write"}}
+
+	tests := []struct {
+		name        string
+		permissions []string
+		want        bool
+	}{
+		{"none", nil, true},
+		{"one granted", []string{"users:read"}, true},
+		{"all granted", []string{"users:read", "users:write"}, true},
+		{"one missing", []string{"users:read", "roles:write"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := claims.HasPermissions(tt.permissions...); got != tt.want {
+				t.Errorf("HasPermissions(%v) = %v, want %v", tt.permissions, got, tt.want)
+			}
+		})
+	}
+}
+
+func newToken(t *testing.T, claims Claims, duration time.Duration, secretKey string) string {
+	t.Helper()
+
+	token, err := NewToken(claims, duration, secretKey)
+	if err != nil {
+		t.Fatalf("NewToken: %v", err)
+	}
+	return token
+}
+
+func newActionToken(t *testing.T, secretKey, purpose string, duration time.Duration) string {
+	t.Helper()
+
+	token, err := NewActionToken(secretKey, purpose, "user@example.com", "device", "", duration)
+	if err != nil {
+		t.Fatalf("NewActionToken: %v", err)
+	}
+	return token
+}
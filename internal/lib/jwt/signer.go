@@ -0,0 +1,108 @@
+package jwt
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// rsaKeyBits is the size of the key generated when none is configured
+const rsaKeyBits = 2048
+
+var ErrInvalidSigningKey = errors.New("invalid signing key")
+
+// Signer signs the tokens verified by other parties, ID tokens, with an RSA key they get from the JWKS
+type Signer struct {
+	key *rsa.PrivateKey
+	kid string
+}
+
+// LoadSigner reads an RSA private key in PEM, PKCS #1 or PKCS #8
+func LoadSigner(path string) (*Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+	if err != nil {
+		return nil, ErrInvalidSigningKey
+	}
+	return NewSigner(key), nil
+}
+
+// GenerateSigner makes a signer with a fresh key, the tokens it signs are not verifiable after a restart
+func GenerateSigner() (*Signer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	return NewSigner(key), nil
+}
+
+func NewSigner(key *rsa.PrivateKey) *Signer {
+	return &Signer{
+		key: key,
+		kid: thumbprint(&key.PublicKey),
+	}
+}
+
+// Sign makes an RS256 token of the claims, "iat" and "exp" are set from the lifetime
+func (s *Signer) Sign(claims map[string]any, duration time.Duration) (string, error) {
+	payload := jwt.MapClaims{}
+	for k, v := range claims {
+		payload[k] = v
+	}
+	now := time.Now()
+	payload["iat"] = now.Unix()
+	payload["exp"] = now.Add(duration).Unix()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, payload)
+	token.Header["kid"] = s.kid
+	return token.SignedString(s.key)
+}
+
+// JWK is a public key of the JWKS, RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKS returns the public key set the signatures are verified with
+func (s *Signer) JWKS() []JWK {
+	return []JWK{{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: "RS256",
+		Kid: s.kid,
+		N:   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+	}}
+}
+
+// thumbprint is the JWK thumbprint of the key, RFC 7638, used as the key id
+func thumbprint(key *rsa.PublicKey) string {
+	// the members in lexicographic order, as the RFC requires
+	data, _ := json.Marshal(struct {
+		E   string `json:"e"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+	}{
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		Kty: "RSA",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+	})
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,26 @@
+package notifier
+
+import (
+	"context"
+	"vieo/auth/internal/lib/logger"
+
+	"go.uber.org/zap"
+)
+
+// Log writes messages to the log instead of delivering them, for local runs and tests
+type Log struct {
+	log *logger.Logger
+}
+
+func NewLog(log *logger.Logger) *Log {
+	return &Log{log: log}
+}
+
+func (l *Log) Notify(_ context.Context, msg Message) error {
+	l.log.Info("notification",
+		zap.String("to", msg.To),
+		zap.String("subject", msg.Subject),
+		zap.String("body", msg.Body),
+	)
+	return nil
+}
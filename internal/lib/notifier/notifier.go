@@ -0,0 +1,15 @@
+package notifier
+
+import "context"
+
+// Message is a notification addressed to a user
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Notifier delivers messages to users out-of-band
+type Notifier interface {
+	Notify(ctx context.Context, msg Message) error
+}
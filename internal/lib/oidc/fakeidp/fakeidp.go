@@ -0,0 +1,197 @@
+// Package fakeidp is a local OpenID Connect provider standing in for Google, Apple and the others
+// in development and tests. It signs in whoever is asked for, without a login page
+package fakeidp
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"vieo/auth/internal/lib/jwt"
+	"vieo/auth/internal/lib/oidc"
+)
+
+const (
+	codeTTL    = time.Minute
+	idTokenTTL = 5 * time.Minute
+)
+
+// User is an account of the provider, Subject defaults to the email
+type User struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// IdP serves the discovery document, the keys, the authorization and the token endpoints under Issuer
+type IdP struct {
+	issuer string
+	signer *jwt.Signer
+
+	mu    sync.Mutex
+	users map[string]User
+	codes map[string]grant
+}
+
+type grant struct {
+	clientID    string
+	redirectURI string
+	nonce       string
+	challenge   string
+	user        User
+	expiresAt   time.Time
+}
+
+func New(issuer string, users ...User) (*IdP, error) {
+	signer, err := jwt.GenerateSigner()
+	if err != nil {
+		return nil, err
+	}
+	idp := &IdP{
+		issuer: strings.TrimSuffix(issuer, "/"),
+		signer: signer,
+		users:  make(map[string]User),
+		codes:  make(map[string]grant),
+	}
+	for _, u := range users {
+		idp.AddUser(u)
+	}
+	return idp, nil
+}
+
+// AddUser adds or replaces the account of the email
+func (p *IdP) AddUser(u User) {
+	if u.Subject == "" {
+		u.Subject = u.Email
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.users[strings.ToLower(u.Email)] = u
+}
+
+func (p *IdP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		writeJSON(w, http.StatusOK, map[string]any{
+			"issuer":                                p.issuer,
+			"authorization_endpoint":                p.issuer + "/authorize",
+			"token_endpoint":                        p.issuer + "/token",
+			"jwks_uri":                              p.issuer + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"code_challenge_methods_supported":      []string{"S256"},
+		})
+	case "/jwks":
+		writeJSON(w, http.StatusOK, map[string]any{"keys": p.signer.JWKS()})
+	case "/authorize":
+		p.authorize(w, r)
+	case "/token":
+		p.token(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorize signs in the user of login_hint, or the only user, and redirects back with a code
+func (p *IdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirect.Scheme == "" || q.Get("client_id") == "" {
+		http.Error(w, "invalid redirect_uri or client_id", http.StatusBadRequest)
+		return
+	}
+	if q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "only the code flow with S256 PKCE is supported", http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	user, ok := p.users[strings.ToLower(q.Get("login_hint"))]
+	if !ok && len(p.users) == 1 {
+		for _, u := range p.users {
+			user, ok = u, true
+		}
+	}
+	if !ok {
+		p.mu.Unlock()
+		http.Error(w, "unknown user, pass login_hint", http.StatusBadRequest)
+		return
+	}
+	code := randomString()
+	p.codes[code] = grant{
+		clientID:    q.Get("client_id"),
+		redirectURI: q.Get("redirect_uri"),
+		nonce:       q.Get("nonce"),
+		challenge:   q.Get("code_challenge"),
+		user:        user,
+		expiresAt:   time.Now().Add(codeTTL),
+	}
+	p.mu.Unlock()
+
+	back := redirect.Query()
+	back.Set("code", code)
+	back.Set("state", q.Get("state"))
+	redirect.RawQuery = back.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// token redeems a code once, checking the client, the redirect URI and the PKCE verifier
+func (p *IdP) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	p.mu.Lock()
+	g, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+	challenge := oidc.CodeChallenge(r.PostForm.Get("code_verifier"))
+	if !ok || time.Now().After(g.expiresAt) ||
+		g.clientID != r.PostForm.Get("client_id") ||
+		g.redirectURI != r.PostForm.Get("redirect_uri") ||
+		subtle.ConstantTimeCompare([]byte(challenge), []byte(g.challenge)) != 1 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	idToken, err := p.signer.Sign(map[string]any{
+		"iss":            p.issuer,
+		"sub":            g.user.Subject,
+		"aud":            g.clientID,
+		"nonce":          g.nonce,
+		"email":          g.user.Email,
+		"email_verified": g.user.EmailVerified,
+		"name":           g.user.Name,
+	}, idTokenTTL)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   int(idTokenTTL.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
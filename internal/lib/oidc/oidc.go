@@ -0,0 +1,298 @@
+// Package oidc is the relying party side of OpenID Connect: it signs users in with external
+// identity providers by the authorization code flow with PKCE
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// discoveryTTL is how long the discovery document and the keys are kept before they are fetched again
+const discoveryTTL = time.Hour
+
+var (
+	ErrDiscovery         = errors.New("oidc discovery failed")
+	ErrExchange          = errors.New("oidc code exchange failed")
+	ErrInvalidIDToken    = errors.New("invalid id token")
+	ErrNonceMismatch     = errors.New("id token nonce mismatch")
+	ErrUnknownSigningKey = errors.New("unknown id token signing key")
+)
+
+// Config of a provider, the client is registered at Issuer with RedirectURL
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Identity is what the verified ID token says about the user
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// Client talks to one provider, the discovery document and the keys are cached
+type Client struct {
+	cfg  Config
+	http *http.Client
+
+	mu        sync.Mutex
+	discovery discovery
+	keys      map[string]any
+	fetchedAt time.Time
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func NewClient(cfg Config, httpClient *http.Client) *Client {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &Client{
+		cfg:  cfg,
+		http: httpClient,
+	}
+}
+
+// CodeChallenge is the S256 PKCE challenge of the verifier
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL is where the user is sent to sign in at the provider
+func (c *Client) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	d, err := c.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.cfg.ClientID},
+		"redirect_uri":          {c.cfg.RedirectURL},
+		"scope":                 {strings.Join(c.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {CodeChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange trades the code for the tokens and returns the verified identity of the ID token,
+// which must carry the nonce of the authorization request
+func (c *Client) Exchange(ctx context.Context, code, verifier, nonce string) (Identity, error) {
+	d, err := c.metadata(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.cfg.RedirectURL},
+		"client_id":     {c.cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	if c.cfg.ClientSecret != "" {
+		form.Set("client_secret", c.cfg.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %w", ErrExchange, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %w", ErrExchange, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Identity{}, fmt.Errorf("%w: status %d: %s", ErrExchange, resp.StatusCode, body)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil || tokens.IDToken == "" {
+		return Identity{}, fmt.Errorf("%w: no id token", ErrExchange)
+	}
+
+	return c.Verify(ctx, tokens.IDToken, nonce)
+}
+
+// Verify checks the signature of the ID token against the keys of the provider, the issuer,
+// the audience, the lifetime and the nonce
+func (c *Client) Verify(ctx context.Context, idToken, nonce string) (Identity, error) {
+	d, err := c.metadata(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(
+		idToken,
+		claims,
+		func(t *jwt.Token) (any, error) {
+			kid, _ := t.Header["kid"].(string)
+			return c.key(ctx, kid)
+		},
+		jwt.WithValidMethods([]string{"RS256", "ES256"}),
+		jwt.WithIssuer(d.Issuer),
+		jwt.WithAudience(c.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %w", ErrInvalidIDToken, err)
+	}
+	// with several audiences the token must have been issued to us
+	if aud, _ := claims.GetAudience(); len(aud) > 1 {
+		if azp, _ := claims["azp"].(string); azp != c.cfg.ClientID {
+			return Identity{}, fmt.Errorf("%w: authorized party mismatch", ErrInvalidIDToken)
+		}
+	}
+	if got, _ := claims["nonce"].(string); nonce == "" || got != nonce {
+		return Identity{}, ErrNonceMismatch
+	}
+
+	identity := Identity{}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.Name, _ = claims["name"].(string)
+	// some providers send the flag as a string
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = v
+	case string:
+		identity.EmailVerified = v == "true"
+	}
+	if identity.Subject == "" {
+		return Identity{}, fmt.Errorf("%w: no subject", ErrInvalidIDToken)
+	}
+
+	return identity, nil
+}
+
+// metadata returns the discovery document, fetching it when it is missing or old
+func (c *Client) metadata(ctx context.Context) (discovery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.discovery.Issuer != "" && time.Since(c.fetchedAt) < discoveryTTL {
+		return c.discovery, nil
+	}
+	if err := c.refresh(ctx); err != nil {
+		return discovery{}, err
+	}
+	return c.discovery, nil
+}
+
+// key returns the verification key of the kid, the keys are fetched again once for an unknown kid
+// since providers rotate them
+func (c *Client) key(ctx context.Context, kid string) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.lookup(kid); ok {
+		return key, nil
+	}
+	if err := c.refresh(ctx); err != nil {
+		return nil, err
+	}
+	if key, ok := c.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, ErrUnknownSigningKey
+}
+
+// lookup finds the key, without a kid the provider must have a single key
+func (c *Client) lookup(kid string) (any, bool) {
+	if kid == "" && len(c.keys) == 1 {
+		for _, key := range c.keys {
+			return key, true
+		}
+	}
+	key, ok := c.keys[kid]
+	return key, ok
+}
+
+// refresh fetches the discovery document and the keys, the caller holds the lock
+func (c *Client) refresh(ctx context.Context) error {
+	var d discovery
+	if err := c.getJSON(ctx, strings.TrimSuffix(c.cfg.Issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return err
+	}
+	// the issuer of the document must be the configured one, RFC 8414 section 3.3
+	if strings.TrimSuffix(d.Issuer, "/") != strings.TrimSuffix(c.cfg.Issuer, "/") ||
+		d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return fmt.Errorf("%w: unexpected discovery document of %s", ErrDiscovery, c.cfg.Issuer)
+	}
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := c.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return err
+	}
+	keys := make(map[string]any, len(set.Keys))
+	for _, raw := range set.Keys {
+		kid, key, err := parseJWK(raw)
+		if err != nil {
+			// keys of other types are of no use to us
+			continue
+		}
+		keys[kid] = key
+	}
+
+	c.discovery = d
+	c.keys = keys
+	c.fetchedAt = time.Now()
+	return nil
+}
+
+func (c *Client) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDiscovery, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s: status %d", ErrDiscovery, url, resp.StatusCode)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v); err != nil {
+		return fmt.Errorf("%w: %w", ErrDiscovery, err)
+	}
+	return nil
+}
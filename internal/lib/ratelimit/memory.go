@@ -0,0 +1,100 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const sweepInterval = time.Minute
+
+// Memory keeps buckets in the process, suitable for a single replica
+type Memory struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// how long the bucket needs to refill completely, after that it can be forgotten
+	fillTime time.Duration
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (m *Memory) Allow(
+	_ context.Context,
+	key string,
+	policy Policy,
+) (bool, time.Duration, error) {
+	if !policy.Enabled() {
+		return true, 0, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.sweep(now)
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{
+			tokens:   policy.capacity(),
+			updated:  now,
+			fillTime: time.Duration(policy.capacity() / policy.rate() * float64(time.Second)),
+		}
+		m.buckets[key] = b
+	}
+
+	left, allowed, retryAfter := take(b.tokens, now.Sub(b.updated), policy)
+	b.tokens = left
+	b.updated = now
+
+	return allowed, retryAfter, nil
+}
+
+func (m *Memory) Refund(
+	_ context.Context,
+	key string,
+	policy Policy,
+) error {
+	if !policy.Enabled() {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// a swept bucket is full already
+	b, ok := m.buckets[key]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	b.tokens = refund(b.tokens, now.Sub(b.updated), policy)
+	b.updated = now
+
+	return nil
+}
+
+// sweep drops the buckets that are full again, they are indistinguishable from new ones
+func (m *Memory) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < sweepInterval {
+		return
+	}
+	m.lastSweep = now
+
+	for key, b := range m.buckets {
+		if now.Sub(b.updated) >= b.fillTime {
+			delete(m.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Policy is a token bucket: it holds up to Burst tokens and refills Limit tokens every Per.
+// A zero policy does not limit anything
+type Policy struct {
+	Limit int
+	Per   time.Duration
+	Burst int
+}
+
+func (p Policy) Enabled() bool {
+	return p.Limit > 0 && p.Per > 0
+}
+
+// rate returns the refill speed in tokens per second
+func (p Policy) rate() float64 {
+	return float64(p.Limit) / p.Per.Seconds()
+}
+
+// capacity returns the bucket size, at least one token
+func (p Policy) capacity() float64 {
+	if p.Burst > 0 {
+		return float64(p.Burst)
+	}
+	return float64(p.Limit)
+}
+
+// Limiter takes one token from the bucket identified by key.
+// If the bucket is empty, allowed is false and retryAfter tells when a token will be available.
+// Refund returns a token taken by Allow, for a request another bucket rejected
+type Limiter interface {
+	Allow(
+		ctx context.Context,
+		key string,
+		policy Policy,
+	) (allowed bool, retryAfter time.Duration, err error)
+	Refund(
+		ctx context.Context,
+		key string,
+		policy Policy,
+	) error
+}
+
+// take applies one request to a bucket that had tokens at the given elapsed time since its last update
+func take(tokens float64, elapsed time.Duration, policy Policy) (left float64, allowed bool, retryAfter time.Duration) {
+	tokens += elapsed.Seconds() * policy.rate()
+	if c := policy.capacity(); tokens > c {
+		tokens = c
+	}
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+
+	wait := time.Duration((1 - tokens) / policy.rate() * float64(time.Second))
+	return tokens, false, wait
+}
+
+// refund gives one token back to a bucket that had tokens at the given elapsed time since its last update
+func refund(tokens float64, elapsed time.Duration, policy Policy) float64 {
+	return min(tokens+elapsed.Seconds()*policy.rate()+1, policy.capacity())
+}
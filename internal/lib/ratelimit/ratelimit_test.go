@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTake(t *testing.T) {
+	// 2 tokens per second, up to 4
+	policy := Policy{Limit: 2, Per: time.Second, Burst: 4}
+
+	tests := []struct {
+		name        string
+		tokens      float64
+		elapsed     time.Duration
+		wantLeft    float64
+		wantAllowed bool
+		wantRetry   time.Duration
+	}{
+		{"full bucket", 4, 0, 3, true, 0},
+		{"last token", 1, 0, 0, true, 0},
+		{"empty bucket", 0, 0, 0, false, 500 * time.Millisecond},
+		{"half a token", 0.5, 0, 0.5, false, 250 * time.Millisecond},
+		{"refilled", 0, 500 * time.Millisecond, 0, true, 0},
+		{"partly refilled", 0, 250 * time.Millisecond, 0.5, false, 250 * time.Millisecond},
+		{"refill capped at burst", 0, time.Hour, 3, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			left, allowed, retryAfter := take(tt.tokens, tt.elapsed, policy)
+			if left != tt.wantLeft || allowed != tt.wantAllowed || retryAfter != tt.wantRetry {
+				t.Errorf("take(%v, %s) = %v, %v, %s, want %v, %v, %s",
+					tt.tokens, tt.elapsed, left, allowed, retryAfter, tt.wantLeft, tt.wantAllowed, tt.wantRetry)
+			}
+		})
+	}
+}
+
+func TestRefund(t *testing.T) {
+	policy := Policy{Limit: 2, Per: time.Second, Burst: 4}
+
+	tests := []struct {
+		name    string
+		tokens  float64
+		elapsed time.Duration
+		want    float64
+	}{
+		{"empty bucket", 0, 0, 1},
+		{"refilled meanwhile", 0, 500 * time.Millisecond, 2},
+		{"capped at burst", 3.5, 0, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := refund(tt.tokens, tt.elapsed, policy); got != tt.want {
+				t.Errorf("refund(%v, %s) = %v, want %v", tt.tokens, tt.elapsed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyCapacity(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		want   float64
+	}{
+		{"burst", Policy{Limit: 5, Per: time.Minute, Burst: 10}, 10},
+		{"limit without burst", Policy{Limit: 5, Per: time.Minute}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.capacity(); got != tt.want {
+				t.Errorf("capacity() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	policy := Policy{Limit: 1, Per: time.Hour, Burst: 2}
+	m := NewMemory()
+
+	for i, want := range []bool{true, true, false} {
+		allowed, _, err := m.Allow(ctx, "a", policy)
+		if err != nil {
+			t.Fatalf("Allow: %v", err)
+		}
+		if allowed != want {
+			t.Fatalf("request %d allowed = %v, want %v", i, allowed, want)
+		}
+	}
+	if allowed, _, _ := m.Allow(ctx, "b", policy); !allowed {
+		t.Errorf("another key is limited by the first one")
+	}
+
+	if err := m.Refund(ctx, "a", policy); err != nil {
+		t.Fatalf("Refund: %v", err)
+	}
+	if allowed, _, _ := m.Allow(ctx, "a", policy); !allowed {
+		t.Errorf("refunded token was not available")
+	}
+	if allowed, _, _ := m.Allow(ctx, "a", policy); allowed {
+		t.Errorf("refund gave back more than one token")
+	}
+
+	if allowed, _, _ := m.Allow(ctx, "a", Policy{}); !allowed {
+		t.Errorf("zero policy limited a request")
+	}
+}
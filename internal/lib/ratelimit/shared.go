@@ -0,0 +1,112 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	pruneInterval = 10 * time.Minute
+	idleTTL       = time.Hour
+	pruneTime     = 10 * time.Second
+)
+
+// BucketStore updates a bucket atomically for all replicas. The function receives the stored tokens
+// and the time passed since the last update (both measured by the store) and returns the tokens to save
+type BucketStore interface {
+	UpdateRateLimitBucket(
+		ctx context.Context,
+		key string,
+		initial float64,
+		update func(tokens float64, elapsed time.Duration) float64,
+	) error
+	DeleteIdleRateLimitBuckets(
+		ctx context.Context,
+		idle time.Duration,
+	) (int64, error)
+}
+
+// Shared keeps buckets in a store, so the limits hold across replicas.
+// Buckets idle for longer than idleTTL are removed, policies should refill faster than that
+type Shared struct {
+	store BucketStore
+
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+func NewShared(store BucketStore) *Shared {
+	return &Shared{
+		store:     store,
+		lastPrune: time.Now(),
+	}
+}
+
+func (s *Shared) Allow(
+	ctx context.Context,
+	key string,
+	policy Policy,
+) (bool, time.Duration, error) {
+	const op = "ratelimit.Shared.Allow"
+
+	if !policy.Enabled() {
+		return true, 0, nil
+	}
+	s.maybePrune(ctx)
+
+	var (
+		allowed    bool
+		retryAfter time.Duration
+	)
+	err := s.store.UpdateRateLimitBucket(ctx, key, policy.capacity(), func(tokens float64, elapsed time.Duration) float64 {
+		var left float64
+		left, allowed, retryAfter = take(tokens, elapsed, policy)
+		return left
+	})
+	if err != nil {
+		return false, 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return allowed, retryAfter, nil
+}
+
+func (s *Shared) Refund(
+	ctx context.Context,
+	key string,
+	policy Policy,
+) error {
+	const op = "ratelimit.Shared.Refund"
+
+	if !policy.Enabled() {
+		return nil
+	}
+
+	err := s.store.UpdateRateLimitBucket(ctx, key, policy.capacity(), func(tokens float64, elapsed time.Duration) float64 {
+		return refund(tokens, elapsed, policy)
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// maybePrune removes idle buckets in the background at most once per pruneInterval
+func (s *Shared) maybePrune(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.lastPrune) < pruneInterval {
+		return
+	}
+	s.lastPrune = time.Now()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), pruneTime)
+		defer cancel()
+		// a failed prune is retried on the next interval
+		_, _ = s.store.DeleteIdleRateLimitBuckets(ctx, idleTTL)
+	}()
+}
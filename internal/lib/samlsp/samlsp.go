@@ -0,0 +1,180 @@
+// Package samlsp is the service provider side of SAML 2.0: it publishes the metadata, sends
+// AuthnRequests by the redirect binding and validates the signed responses posted back
+package samlsp
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/crewjam/saml"
+)
+
+var (
+	ErrInvalidMetadata = errors.New("invalid identity provider metadata")
+	ErrInvalidResponse = errors.New("invalid saml response")
+	// ErrNoAudience is returned for an assertion not restricted to an audience, it could be
+	// replayed at any service provider trusting the identity provider
+	ErrNoAudience = errors.New("saml assertion has no audience restriction")
+)
+
+// Config of the service provider registered at one identity provider. IDPMetadata is the XML
+// the identity provider publishes, Key and Certificate sign the requests and decrypt the assertions
+type Config struct {
+	EntityID    string
+	MetadataURL string
+	ACSURL      string
+	IDPMetadata []byte
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+}
+
+// Assertion is what the validated response says about the user. The ID is kept in the replay
+// cache until NotOnOrAfter, the last moment the assertion could be accepted
+type Assertion struct {
+	ID           string
+	NameID       string
+	Attributes   map[string][]string
+	NotOnOrAfter time.Time
+}
+
+// Client is the service provider of one identity provider
+type Client struct {
+	sp *saml.ServiceProvider
+}
+
+func NewClient(cfg Config) (*Client, error) {
+	var idp saml.EntityDescriptor
+	if err := xml.Unmarshal(cfg.IDPMetadata, &idp); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMetadata, err)
+	}
+	if len(idp.IDPSSODescriptors) == 0 {
+		return nil, fmt.Errorf("%w: no IDPSSODescriptor", ErrInvalidMetadata)
+	}
+	metadataURL, err := url.Parse(cfg.MetadataURL)
+	if err != nil {
+		return nil, err
+	}
+	acsURL, err := url.Parse(cfg.ACSURL)
+	if err != nil {
+		return nil, err
+	}
+
+	sp := &saml.ServiceProvider{
+		EntityID:          cfg.EntityID,
+		Key:               cfg.Key,
+		Certificate:       cfg.Certificate,
+		MetadataURL:       *metadataURL,
+		AcsURL:            *acsURL,
+		IDPMetadata:       &idp,
+		AuthnNameIDFormat: saml.EmailAddressNameIDFormat,
+	}
+	if cfg.Key != nil {
+		sp.SignatureMethod = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	}
+	return &Client{sp: sp}, nil
+}
+
+// LoadKeyPair reads the PEM files of the RSA key and the certificate of the service provider
+func LoadKeyPair(certPath, keyPath string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("saml key is not an RSA key")
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, cert, nil
+}
+
+// Metadata returns the XML of the service provider the identity provider is configured with
+func (c *Client) Metadata() ([]byte, error) {
+	metadata, err := xml.MarshalIndent(c.sp.Metadata(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), metadata...), nil
+}
+
+// AuthnRequest returns the URL sending the user to the identity provider and the ID of the
+// request the response must answer. The relay state comes back with the response
+func (c *Client) AuthnRequest(relayState string) (string, string, error) {
+	location := c.sp.GetSSOBindingLocation(saml.HTTPRedirectBinding)
+	if location == "" {
+		return "", "", fmt.Errorf("%w: no redirect binding", ErrInvalidMetadata)
+	}
+	req, err := c.sp.MakeAuthenticationRequest(location, saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return "", "", err
+	}
+	redirect, err := req.Redirect(relayState, c.sp)
+	if err != nil {
+		return "", "", err
+	}
+	return redirect.String(), req.ID, nil
+}
+
+// Verify validates the base64 SAMLResponse posted to the ACS: the signature by a key of the
+// identity provider, the destination, the issuer, InResponseTo the request, the conditions
+// and the audience. An assertion must be restricted to the entity ID of the service provider
+func (c *Client) Verify(samlResponse string, requestID string) (assertion Assertion, err error) {
+	decoded, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		return Assertion{}, fmt.Errorf("%w: %w", ErrInvalidResponse, err)
+	}
+	// the library dereferences Subject and Conditions without checking they are present
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrInvalidResponse, r)
+		}
+	}()
+	parsed, err := c.sp.ParseXMLResponse(decoded, []string{requestID})
+	if err != nil {
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) {
+			return Assertion{}, fmt.Errorf("%w: %w", ErrInvalidResponse, invalid.PrivateErr)
+		}
+		return Assertion{}, fmt.Errorf("%w: %w", ErrInvalidResponse, err)
+	}
+	if parsed.Conditions == nil || len(parsed.Conditions.AudienceRestrictions) == 0 {
+		return Assertion{}, ErrNoAudience
+	}
+	if parsed.Subject == nil || parsed.Subject.NameID == nil || parsed.ID == "" {
+		return Assertion{}, fmt.Errorf("%w: no subject", ErrInvalidResponse)
+	}
+
+	assertion = Assertion{
+		ID:           parsed.ID,
+		NameID:       parsed.Subject.NameID.Value,
+		Attributes:   make(map[string][]string),
+		NotOnOrAfter: parsed.Conditions.NotOnOrAfter,
+	}
+	for _, statement := range parsed.AttributeStatements {
+		for _, attr := range statement.Attributes {
+			for _, value := range attr.Values {
+				assertion.Attributes[attr.Name] = append(assertion.Attributes[attr.Name], value.Value)
+				if attr.FriendlyName != "" && attr.FriendlyName != attr.Name {
+					assertion.Attributes[attr.FriendlyName] = append(assertion.Attributes[attr.FriendlyName], value.Value)
+				}
+			}
+		}
+	}
+	if assertion.NotOnOrAfter.IsZero() {
+		// without a condition the assertion is accepted as long as its issue is recent enough
+		assertion.NotOnOrAfter = parsed.IssueInstant.Add(saml.MaxIssueDelay)
+	}
+	assertion.NotOnOrAfter = assertion.NotOnOrAfter.Add(saml.MaxClockSkew)
+
+	return assertion, nil
+}
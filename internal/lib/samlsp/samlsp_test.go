@@ -0,0 +1,278 @@
+package samlsp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+)
+
+const (
+	testEntityID  = "https://auth.example.com/saml/acme/metadata"
+	testACSURL    = "https://app.example.com/saml/acs"
+	testRequestID = "id-request"
+)
+
+// testIDP is an identity provider that answers the requests of the client
+type testIDP struct {
+	idp    *saml.IdentityProvider
+	spMeta *saml.EntityDescriptor
+}
+
+func newTestIDP(t *testing.T) *saml.IdentityProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	metadataURL, _ := url.Parse("https://idp.example.com/metadata")
+	ssoURL, _ := url.Parse("https://idp.example.com/sso")
+
+	return &saml.IdentityProvider{
+		Key:             key,
+		Certificate:     cert,
+		MetadataURL:     *metadataURL,
+		SSOURL:          *ssoURL,
+		SignatureMethod: "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256",
+	}
+}
+
+// newTestClient returns the client trusting idp and the identity provider answering it
+func newTestClient(t *testing.T, idp *saml.IdentityProvider) (*Client, testIDP) {
+	t.Helper()
+
+	idpMeta, err := xml.Marshal(idp.Metadata())
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	client, err := NewClient(Config{
+		EntityID:    testEntityID,
+		MetadataURL: testEntityID,
+		ACSURL:      testACSURL,
+		IDPMetadata: idpMeta,
+	})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	spMetaXML, err := client.Metadata()
+	if err != nil {
+		t.Fatalf("Metadata: %v", err)
+	}
+	var spMeta saml.EntityDescriptor
+	if err := xml.Unmarshal(spMetaXML, &spMeta); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	return client, testIDP{idp: idp, spMeta: &spMeta}
+}
+
+// respond signs a response to the request, mutate changes the assertion before it is signed
+func (i testIDP) respond(t *testing.T, signer *saml.IdentityProvider, mutate func(req *saml.IdpAuthnRequest)) string {
+	t.Helper()
+
+	sp := &i.spMeta.SPSSODescriptors[0]
+	var acs *saml.IndexedEndpoint
+	for j := range sp.AssertionConsumerServices {
+		if sp.AssertionConsumerServices[j].Binding == saml.HTTPPostBinding {
+			acs = &sp.AssertionConsumerServices[j]
+		}
+	}
+	req := &saml.IdpAuthnRequest{
+		IDP:                     signer,
+		HTTPRequest:             &http.Request{RemoteAddr: "10.0.0.1"},
+		Request:                 saml.AuthnRequest{ID: testRequestID, IssueInstant: saml.TimeNow()},
+		ServiceProviderMetadata: i.spMeta,
+		SPSSODescriptor:         sp,
+		ACSEndpoint:             acs,
+		Now:                     saml.TimeNow(),
+	}
+	session := &saml.Session{
+		NameID:    "user@acme.com",
+		UserEmail: "user@acme.com",
+		CustomAttributes: []saml.Attribute{{
+			FriendlyName: "department",
+			Name:         "urn:oid:2.5.4.11",
+			Values:       []saml.AttributeValue{{Type: "xs:string", Value: "sales"}},
+		}},
+	}
+	if err := (saml.DefaultAssertionMaker{}).MakeAssertion(req, session); err != nil {
+		t.Fatalf("MakeAssertion: %v", err)
+	}
+	if mutate != nil {
+		mutate(req)
+	}
+	if err := req.MakeResponse(); err != nil {
+		t.Fatalf("MakeResponse: %v", err)
+	}
+	doc := etree.NewDocument()
+	doc.SetRoot(req.ResponseEl)
+	b, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatalf("WriteToBytes: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func TestVerify(t *testing.T) {
+	idp := newTestIDP(t)
+	client, i := newTestClient(t, idp)
+
+	assertion, err := client.Verify(i.respond(t, idp, nil), testRequestID)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if assertion.ID == "" || assertion.NameID != "user@acme.com" {
+		t.Errorf("Verify = %+v, want the assertion of user@acme.com", assertion)
+	}
+	if got := assertion.Attributes["department"]; len(got) != 1 || got[0] != "sales" {
+		t.Errorf("department = %v, want [sales]", got)
+	}
+	if got := assertion.Attributes["urn:oid:2.5.4.11"]; len(got) != 1 || got[0] != "sales" {
+		t.Errorf("urn:oid:2.5.4.11 = %v, want [sales]", got)
+	}
+	if !assertion.NotOnOrAfter.After(time.Now()) {
+		t.Errorf("NotOnOrAfter = %s, want in the future", assertion.NotOnOrAfter)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	idp := newTestIDP(t)
+	otherIDP := newTestIDP(t)
+	client, i := newTestClient(t, idp)
+
+	tests := []struct {
+		name      string
+		response  func(t *testing.T) string
+		requestID string
+		want      error
+	}{
+		{
+			name:     "not base64",
+			response: func(*testing.T) string { return "%%%" },
+			want:     ErrInvalidResponse,
+		},
+		{
+			name:     "not xml",
+			response: func(*testing.T) string { return base64.StdEncoding.EncodeToString([]byte("not xml")) },
+			want:     ErrInvalidResponse,
+		},
+		{
+			name:      "another request",
+			response:  func(t *testing.T) string { return i.respond(t, idp, nil) },
+			requestID: "id-other",
+			want:      ErrInvalidResponse,
+		},
+		{
+			name:     "signed by another identity provider",
+			response: func(t *testing.T) string { return i.respond(t, otherIDP, nil) },
+			want:     ErrInvalidResponse,
+		},
+		{
+			name: "changed after signing",
+			response: func(t *testing.T) string {
+				signed, _ := base64.StdEncoding.DecodeString(i.respond(t, idp, nil))
+				changed := bytes.ReplaceAll(signed, []byte("user@acme.com"), []byte("admin@acme.com"))
+				return base64.StdEncoding.EncodeToString(changed)
+			},
+			want: ErrInvalidResponse,
+		},
+		{
+			name: "expired",
+			response: func(t *testing.T) string {
+				return i.respond(t, idp, func(req *saml.IdpAuthnRequest) {
+					past := time.Now().Add(-time.Hour)
+					req.Assertion.Conditions.NotBefore = past.Add(-time.Minute)
+					req.Assertion.Conditions.NotOnOrAfter = past
+					req.Assertion.Subject.SubjectConfirmations[0].SubjectConfirmationData.NotOnOrAfter = past
+				})
+			},
+			want: ErrInvalidResponse,
+		},
+		{
+			name: "another audience",
+			response: func(t *testing.T) string {
+				return i.respond(t, idp, func(req *saml.IdpAuthnRequest) {
+					req.Assertion.Conditions.AudienceRestrictions[0].Audience.Value = "https://other.example.com/metadata"
+				})
+			},
+			want: ErrInvalidResponse,
+		},
+		{
+			name: "no audience",
+			response: func(t *testing.T) string {
+				return i.respond(t, idp, func(req *saml.IdpAuthnRequest) {
+					req.Assertion.Conditions.AudienceRestrictions = nil
+				})
+			},
+			want: ErrNoAudience,
+		},
+		{
+			name: "no conditions",
+			response: func(t *testing.T) string {
+				return i.respond(t, idp, func(req *saml.IdpAuthnRequest) {
+					req.Assertion.Conditions = nil
+				})
+			},
+			want: ErrInvalidResponse,
+		},
+		{
+			name: "no subject",
+			response: func(t *testing.T) string {
+				return i.respond(t, idp, func(req *saml.IdpAuthnRequest) {
+					req.Assertion.Subject = nil
+				})
+			},
+			want: ErrInvalidResponse,
+		},
+		{
+			name: "another destination",
+			response: func(t *testing.T) string {
+				return i.respond(t, idp, func(req *saml.IdpAuthnRequest) {
+					acs := *req.ACSEndpoint
+					acs.Location = "https://other.example.com/saml/acs"
+					req.ACSEndpoint = &acs
+				})
+			},
+			want: ErrInvalidResponse,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestID := tt.requestID
+			if requestID == "" {
+				requestID = testRequestID
+			}
+			_, err := client.Verify(tt.response(t), requestID)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Verify error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultID is the tenant of the data created before tenant isolation and of
+// everything done outside of a request
+const DefaultID = "default"
+
+// DefaultPasswordPattern is the password policy of tenants that do not set their own
+const DefaultPasswordPattern = `^[a-z0-9]{8,14}$`
+
+var ErrUnknownTenant = errors.New("unknown tenant")
+
+// Tenant is a brand hosted by the service with its own users, signing key and policies
+type Tenant struct {
+	ID string
+	// Hosts are the server names (SNI or :authority) the tenant is served under
+	Hosts     []string
+	SecretKey string
+	TokenTTL  time.Duration
+	// Password is the pattern every password of the tenant must match
+	Password *regexp.Regexp
+	// Admins get the admin role on the first start while the tenant has no admin
+	Admins []string
+}
+
+// ValidPassword reports whether the password satisfies the policy of the tenant
+func (t Tenant) ValidPassword(p string) bool {
+	return t.Password != nil && t.Password.MatchString(p)
+}
+
+// Registry resolves requests to tenants
+type Registry struct {
+	tenants map[string]Tenant
+	hosts   map[string]string
+	// fallback is the tenant of requests that name none, empty rejects them
+	fallback string
+}
+
+func NewRegistry(tenants []Tenant, fallback string) (*Registry, error) {
+	const op = "tenant.NewRegistry"
+
+	r := &Registry{
+		tenants:  make(map[string]Tenant, len(tenants)),
+		hosts:    make(map[string]string),
+		fallback: fallback,
+	}
+	for _, t := range tenants {
+		if t.ID == "" || t.SecretKey == "" {
+			return nil, fmt.Errorf("%s: tenant %q needs an id and a secret key", op, t.ID)
+		}
+		if _, ok := r.tenants[t.ID]; ok {
+			return nil, fmt.Errorf("%s: tenant %q declared twice", op, t.ID)
+		}
+		r.tenants[t.ID] = t
+		for _, h := range t.Hosts {
+			h = strings.ToLower(h)
+			if other, ok := r.hosts[h]; ok {
+				return nil, fmt.Errorf("%s: host %q belongs to %q and %q", op, h, other, t.ID)
+			}
+			r.hosts[h] = t.ID
+		}
+	}
+	if _, ok := r.tenants[fallback]; fallback != "" && !ok {
+		return nil, fmt.Errorf("%s: default tenant %q: %w", op, fallback, ErrUnknownTenant)
+	}
+
+	return r, nil
+}
+
+// Tenant returns the tenant by id
+func (r *Registry) Tenant(id string) (Tenant, error) {
+	t, ok := r.tenants[id]
+	if !ok {
+		return Tenant{}, ErrUnknownTenant
+	}
+	return t, nil
+}
+
+// ByHost returns the tenant served under the host, the port is ignored
+func (r *Registry) ByHost(host string) (Tenant, bool) {
+	if h, _, ok := strings.Cut(host, ":"); ok {
+		host = h
+	}
+	id, ok := r.hosts[strings.ToLower(host)]
+	if !ok {
+		return Tenant{}, false
+	}
+	return r.tenants[id], true
+}
+
+// All returns every tenant ordered by id
+func (r *Registry) All() []Tenant {
+	tenants := make([]Tenant, 0, len(r.tenants))
+	for _, t := range r.tenants {
+		tenants = append(tenants, t)
+	}
+	slices.SortFunc(tenants, func(a, b Tenant) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return tenants
+}
+
+// Fallback returns the tenant of requests that name none
+func (r *Registry) Fallback() (Tenant, error) {
+	if r.fallback == "" {
+		return Tenant{}, ErrUnknownTenant
+	}
+	return r.tenants[r.fallback], nil
+}
+
+type ctxKey struct{}
+
+// NewContext returns a copy of ctx scoped to the tenant
+func NewContext(ctx context.Context, t Tenant) context.Context {
+	return context.WithValue(ctx, ctxKey{}, t)
+}
+
+// FromContext returns the tenant of the request, ok is false outside of a request
+func FromContext(ctx context.Context) (Tenant, bool) {
+	t, ok := ctx.Value(ctxKey{}).(Tenant)
+	return t, ok
+}
+
+// ID returns the id of the tenant in ctx, DefaultID if there is none. Storage scopes every query by it
+func ID(ctx context.Context) string {
+	if t, ok := FromContext(ctx); ok {
+		return t.ID
+	}
+	return DefaultID
+}
+
+// SecretKey returns the signing key of the tenant in ctx, fallback if there is none
+func SecretKey(ctx context.Context, fallback string) string {
+	if t, ok := FromContext(ctx); ok {
+		return t.SecretKey
+	}
+	return fallback
+}
+
+// TokenTTL returns the access token lifetime of the tenant in ctx, fallback if there is none
+func TokenTTL(ctx context.Context, fallback time.Duration) time.Duration {
+	if t, ok := FromContext(ctx); ok && t.TokenTTL > 0 {
+		return t.TokenTTL
+	}
+	return fallback
+}
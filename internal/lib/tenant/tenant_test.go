@@ -0,0 +1,150 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func testRegistry(t *testing.T, fallback string) *Registry {
+	t.Helper()
+
+	r, err := NewRegistry([]Tenant{
+		{ID: "acme", Hosts: []string{"auth.acme.com", "Login.Acme.com"}, SecretKey: "acme-secret"},
+		{ID: "globex", Hosts: []string{"auth.globex.com"}, SecretKey: "globex-secret"},
+	}, fallback)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	return r
+}
+
+func TestNewRegistryRejects(t *testing.T) {
+	tests := []struct {
+		name     string
+		tenants  []Tenant
+		fallback string
+	}{
+		{"no id", []Tenant{{SecretKey: "s"}}, ""},
+		{"no secret key", []Tenant{{ID: "acme"}}, ""},
+		{"duplicate id", []Tenant{{ID: "acme", SecretKey: "s"}, {ID: "acme", SecretKey: "t"}}, ""},
+		{
+			"shared host",
+			[]Tenant{{ID: "acme", Hosts: []string{"auth.example.com"}, SecretKey: "s"}, {ID: "globex", Hosts: []string{"AUTH.example.com"}, SecretKey: "t"}},
+			"",
+		},
+		{"unknown fallback", []Tenant{{ID: "acme", SecretKey: "s"}}, "globex"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRegistry(tt.tenants, tt.fallback); err == nil {
+				t.Errorf("NewRegistry accepted the tenants")
+			}
+		})
+	}
+}
+
+func TestRegistryTenant(t *testing.T) {
+	r := testRegistry(t, "")
+
+	if got, err := r.Tenant("globex"); err != nil || got.SecretKey != "globex-secret" {
+		t.Errorf("Tenant(globex) = %+v, %v", got, err)
+	}
+	if _, err := r.Tenant("initech"); !errors.Is(err, ErrUnknownTenant) {
+		t.Errorf("Tenant(initech) error = %v, want %v", err, ErrUnknownTenant)
+	}
+}
+
+func TestRegistryAll(t *testing.T) {
+	r := testRegistry(t, "")
+
+	all := r.All()
+	if len(all) != 2 || all[0].ID != "acme" || all[1].ID != "globex" {
+		t.Errorf("All() = %+v, want acme and globex in order", all)
+	}
+}
+
+func TestRegistryByHost(t *testing.T) {
+	r := testRegistry(t, "")
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"auth.acme.com", "acme"},
+		{"AUTH.ACME.COM", "acme"},
+		{"login.acme.com", "acme"},
+		{"auth.acme.com:443", "acme"},
+		{"auth.globex.com", "globex"},
+		{"acme.com", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			got, ok := r.ByHost(tt.host)
+			if ok != (tt.want != "") || got.ID != tt.want {
+				t.Errorf("ByHost(%q) = %q, %v, want %q", tt.host, got.ID, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryFallback(t *testing.T) {
+	if got, err := testRegistry(t, "acme").Fallback(); err != nil || got.ID != "acme" {
+		t.Errorf("Fallback() = %q, %v, want acme", got.ID, err)
+	}
+	if _, err := testRegistry(t, "").Fallback(); !errors.Is(err, ErrUnknownTenant) {
+		t.Errorf("Fallback() error = %v, want %v", err, ErrUnknownTenant)
+	}
+}
+
+func TestContext(t *testing.T) {
+	acme := Tenant{ID: "acme", SecretKey: "acme-secret", TokenTTL: time.Minute}
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		wantID     string
+		wantSecret string
+		wantTTL    time.Duration
+	}{
+		{"no tenant", context.Background(), DefaultID, "fallback", time.Hour},
+		{"tenant", NewContext(context.Background(), acme), "acme", "acme-secret", time.Minute},
+		{"tenant without ttl", NewContext(context.Background(), Tenant{ID: "globex", SecretKey: "s"}), "globex", "s", time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ID(tt.ctx); got != tt.wantID {
+				t.Errorf("ID = %q, want %q", got, tt.wantID)
+			}
+			if got := SecretKey(tt.ctx, "fallback"); got != tt.wantSecret {
+				t.Errorf("SecretKey = %q, want %q", got, tt.wantSecret)
+			}
+			if got := TokenTTL(tt.ctx, time.Hour); got != tt.wantTTL {
+				t.Errorf("TokenTTL = %s, want %s", got, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestValidPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		tenant   Tenant
+		password string
+		want     bool
+	}{
+		{"matches", Tenant{Password: regexp.MustCompile(DefaultPasswordPattern)}, "abcd1234", true},
+		{"does not match", Tenant{Password: regexp.MustCompile(DefaultPasswordPattern)}, "short", false},
+		{"no policy", Tenant{}, "abcd1234", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.tenant.ValidPassword(tt.password); got != tt.want {
+				t.Errorf("ValidPassword(%q) = %v, want %v", tt.password, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+const (
+	queryTime = 3 * time.Second
+)
+
+// Access manages the roles of the users
+type Access struct {
+	log     *logger.Logger
+	roles   RoleManager
+	granted GrantProvider
+	events  EventRecorder
+}
+
+type RoleManager interface {
+	AssignRole(
+		ctx context.Context,
+		email string,
+		role string,
+	) error
+	RevokeRole(
+		ctx context.Context,
+		email string,
+		role string,
+	) error
+	BootstrapAdmins(
+		ctx context.Context,
+		emails []string,
+	) ([]string, error)
+}
+
+type GrantProvider interface {
+	UserAccess(
+		ctx context.Context,
+		email string,
+	) (roles []string, permissions []string, err error)
+}
+
+type EventRecorder interface {
+	Record(
+		ctx context.Context,
+		event models.SecurityEvent,
+	)
+}
+
+func New(
+	log *logger.Logger,
+	roles RoleManager,
+	granted GrantProvider,
+	events EventRecorder,
+) *Access {
+	return &Access{
+		log:     log,
+		roles:   roles,
+		granted: granted,
+		events:  events,
+	}
+}
+
+func (a *Access) AssignRole(
+	ctx context.Context,
+	email string,
+	role string,
+) error {
+	const op = "Access.AssignRole"
+	log := a.log.With(zap.String("op", op), zap.String("role", role))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	if err := a.roles.AssignRole(ctx, email, role); err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) || errors.Is(err, storage.ErrRoleNotFound) {
+			log.Warn("failed to assign role", zap.Error(err))
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("failed to assign role", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	a.events.Record(ctx, models.SecurityEvent{
+		Email:  email,
+		Type:   models.EventRoleAssigned,
+		Reason: role,
+	})
+
+	return nil
+}
+
+func (a *Access) RevokeRole(
+	ctx context.Context,
+	email string,
+	role string,
+) error {
+	const op = "Access.RevokeRole"
+	log := a.log.With(zap.String("op", op), zap.String("role", role))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	if err := a.roles.RevokeRole(ctx, email, role); err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) || errors.Is(err, storage.ErrRoleNotFound) {
+			log.Warn("failed to revoke role", zap.Error(err))
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("failed to revoke role", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	a.events.Record(ctx, models.SecurityEvent{
+		Email:  email,
+		Type:   models.EventRoleRevoked,
+		Reason: role,
+	})
+
+	return nil
+}
+
+func (a *Access) UserAccess(
+	ctx context.Context,
+	email string,
+) ([]string, []string, error) {
+	const op = "Access.UserAccess"
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	roles, permissions, err := a.granted.UserAccess(ctx, email)
+	if err != nil {
+		a.log.Error("failed to get user access", zap.String("op", op), zap.Error(err))
+		return nil, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return roles, permissions, nil
+}
+
+// BootstrapAdmins gives the admin role to the listed users of the tenant in ctx, so the first
+// administrator does not need an administrator. It runs on every start until one of them got the role
+// or the tenant has an admin, an admin registering after the first start gets the role on the next one.
+// Once the tenant has an admin, emails registered later never get the role, whoever registers them
+func (a *Access) BootstrapAdmins(
+	ctx context.Context,
+	emails []string,
+) {
+	const op = "Access.BootstrapAdmins"
+	log := a.log.With(zap.String("op", op), zap.String("tenant", tenant.ID(ctx)))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	granted, err := a.roles.BootstrapAdmins(ctx, emails)
+	if err != nil {
+		log.Error("failed to bootstrap admins", zap.Error(err))
+		return
+	}
+	for _, email := range granted {
+		log.Info("bootstrapped admin", zap.String("email", email))
+		a.events.Record(ctx, models.SecurityEvent{
+			Email:  email,
+			Type:   models.EventRoleAssigned,
+			Reason: models.RoleAdmin,
+		})
+	}
+}
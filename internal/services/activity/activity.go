@@ -0,0 +1,182 @@
+package activity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/clientinfo"
+	"vieo/auth/internal/lib/logger"
+
+	"go.uber.org/zap"
+)
+
+const (
+	queryTime = 3 * time.Second
+
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+var (
+	ErrInvalidPageToken = errors.New("invalid page token")
+)
+
+// Activity keeps the security log of the accounts: records events, serves the feed and prunes old rows
+type Activity struct {
+	log           *logger.Logger
+	eventSaver    EventSaver
+	eventProvider EventProvider
+	eventRemover  EventRemover
+	retention     time.Duration
+	pruneInterval time.Duration
+}
+
+type EventSaver interface {
+	SaveSecurityEvent(
+		ctx context.Context,
+		event models.SecurityEvent,
+	) error
+}
+
+type EventProvider interface {
+	SecurityEvents(
+		ctx context.Context,
+		email string,
+		beforeID int64,
+		limit int,
+	) ([]models.SecurityEvent, error)
+}
+
+type EventRemover interface {
+	DeleteSecurityEvents(
+		ctx context.Context,
+		before time.Time,
+	) (int64, error)
+}
+
+func New(
+	log *logger.Logger,
+	eventSaver EventSaver,
+	eventProvider EventProvider,
+	eventRemover EventRemover,
+	retention time.Duration,
+	pruneInterval time.Duration,
+) *Activity {
+	return &Activity{
+		log:           log,
+		eventSaver:    eventSaver,
+		eventProvider: eventProvider,
+		eventRemover:  eventRemover,
+		retention:     retention,
+		pruneInterval: pruneInterval,
+	}
+}
+
+// Record appends an event to the security log. The client ip and user agent are taken from ctx.
+// Recording is best effort: a failure is logged and never breaks the calling flow
+func (a *Activity) Record(
+	ctx context.Context,
+	event models.SecurityEvent,
+) {
+	const op = "Activity.Record"
+
+	info := clientinfo.FromContext(ctx)
+	if event.IP == "" {
+		event.IP = info.IP
+	}
+	if event.UserAgent == "" {
+		event.UserAgent = info.UserAgent
+	}
+
+	// the event must be written even if the request itself was cancelled
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queryTime)
+	defer cancel()
+	if err := a.eventSaver.SaveSecurityEvent(ctx, event); err != nil {
+		a.log.With(
+			zap.String("op", op),
+			zap.String("type", event.Type),
+		).Error("failed to save security event", zap.Error(err))
+	}
+}
+
+// ListSecurityEvents returns a page of the user's events, newest first, and the token of the next page.
+// The next page token is empty when there are no more events
+func (a *Activity) ListSecurityEvents(
+	ctx context.Context,
+	email string,
+	pageSize int,
+	pageToken string,
+) ([]models.SecurityEvent, string, error) {
+	const op = "Activity.ListSecurityEvents"
+
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	var beforeID int64
+	if pageToken != "" {
+		id, err := strconv.ParseInt(pageToken, 10, 64)
+		if err != nil || id <= 0 {
+			return nil, "", fmt.Errorf("%s: %w", op, ErrInvalidPageToken)
+		}
+		beforeID = id
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	// one extra row tells whether there is a next page
+	events, err := a.eventProvider.SecurityEvents(ctx, email, beforeID, pageSize+1)
+	if err != nil {
+		a.log.Error("failed to get security events", zap.String("op", op), zap.Error(err))
+		return nil, "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	var nextPageToken string
+	if len(events) > pageSize {
+		events = events[:pageSize]
+		nextPageToken = strconv.FormatInt(events[pageSize-1].ID, 10)
+	}
+
+	return events, nextPageToken, nil
+}
+
+// RunRetention periodically removes events older than the retention period until ctx is done.
+// A zero retention keeps events forever
+func (a *Activity) RunRetention(ctx context.Context) {
+	if a.retention <= 0 || a.pruneInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(a.pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		a.prune(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *Activity) prune(ctx context.Context) {
+	const op = "Activity.prune"
+	log := a.log.With(zap.String("op", op))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	n, err := a.eventRemover.DeleteSecurityEvents(ctx, time.Now().Add(-a.retention))
+	if err != nil {
+		log.Error("failed to prune security events", zap.Error(err))
+		return
+	}
+	log.Info("security events pruned", zap.Int64("count", n))
+}
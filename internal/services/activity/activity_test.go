@@ -0,0 +1,192 @@
+package activity
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/clientinfo"
+	"vieo/auth/internal/lib/logger"
+
+	"go.uber.org/zap"
+)
+
+// memoryEvents keeps the events in order of their ids, the newest last
+type memoryEvents struct {
+	events  []models.SecurityEvent
+	saveErr error
+	// ctxErr is the error of the context SaveSecurityEvent was called with
+	ctxErr  error
+	limits  []int
+	removed []time.Time
+}
+
+func (m *memoryEvents) SaveSecurityEvent(ctx context.Context, event models.SecurityEvent) error {
+	m.ctxErr = ctx.Err()
+	if m.saveErr != nil {
+		return m.saveErr
+	}
+	event.ID = int64(len(m.events) + 1)
+	m.events = append(m.events, event)
+	return nil
+}
+
+func (m *memoryEvents) SecurityEvents(_ context.Context, email string, beforeID int64, limit int) ([]models.SecurityEvent, error) {
+	m.limits = append(m.limits, limit)
+	page := []models.SecurityEvent{}
+	for i := len(m.events) - 1; i >= 0 && len(page) < limit; i-- {
+		e := m.events[i]
+		if e.Email == email && (beforeID == 0 || e.ID < beforeID) {
+			page = append(page, e)
+		}
+	}
+	return page, nil
+}
+
+func (m *memoryEvents) DeleteSecurityEvents(_ context.Context, before time.Time) (int64, error) {
+	m.removed = append(m.removed, before)
+	return 0, nil
+}
+
+func newActivity(events *memoryEvents, retention time.Duration) *Activity {
+	log := &logger.Logger{SugaredLogger: zap.NewNop().Sugar()}
+	return New(log, events, events, events, retention, time.Hour)
+}
+
+func TestRecordFillsTheClient(t *testing.T) {
+	events := &memoryEvents{}
+	a := newActivity(events, 0)
+	ctx := clientinfo.NewContext(context.Background(), clientinfo.Info{IP: "10.0.0.1", UserAgent: "tv"})
+
+	a.Record(ctx, models.SecurityEvent{Email: "user@example.com", Type: models.EventLoginSuccess})
+	a.Record(ctx, models.SecurityEvent{Email: "user@example.com", Type: models.EventLoginFailure, IP: "10.0.0.2"})
+
+	if len(events.events) != 2 {
+		t.Fatalf("recorded %d events, want 2", len(events.events))
+	}
+	if got := events.events[0]; got.IP != "10.0.0.1" || got.UserAgent != "tv" {
+		t.Errorf("first event client = %q %q, want the one of the request", got.IP, got.UserAgent)
+	}
+	if got := events.events[1]; got.IP != "10.0.0.2" {
+		t.Errorf("second event ip = %q, want the one of the event", got.IP)
+	}
+}
+
+func TestRecordOutlivesTheRequest(t *testing.T) {
+	events := &memoryEvents{}
+	a := newActivity(events, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	a.Record(ctx, models.SecurityEvent{Email: "user@example.com", Type: models.EventLoginSuccess})
+
+	if events.ctxErr != nil || len(events.events) != 1 {
+		t.Errorf("event of a cancelled request not saved: %v", events.ctxErr)
+	}
+}
+
+func TestRecordIgnoresFailures(t *testing.T) {
+	events := &memoryEvents{saveErr: errors.New("database is down")}
+	a := newActivity(events, 0)
+
+	// the calling flow goes on, the failure is only logged
+	a.Record(context.Background(), models.SecurityEvent{Email: "user@example.com", Type: models.EventLoginSuccess})
+}
+
+func TestListSecurityEventsPages(t *testing.T) {
+	events := &memoryEvents{}
+	a := newActivity(events, 0)
+	for i := 0; i < 5; i++ {
+		a.Record(context.Background(), models.SecurityEvent{Email: "user@example.com", Type: models.EventLoginSuccess})
+	}
+	a.Record(context.Background(), models.SecurityEvent{Email: "other@example.com", Type: models.EventLoginSuccess})
+
+	var (
+		ids   []int64
+		token string
+		pages int
+	)
+	for {
+		page, next, err := a.ListSecurityEvents(context.Background(), "user@example.com", 2, token)
+		if err != nil {
+			t.Fatalf("ListSecurityEvents: %v", err)
+		}
+		for _, e := range page {
+			ids = append(ids, e.ID)
+		}
+		pages++
+		if next == "" {
+			break
+		}
+		token = next
+	}
+
+	if want := []int64{5, 4, 3, 2, 1}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("event ids = %v, want %v", ids, want)
+	}
+	if pages != 3 {
+		t.Errorf("pages = %d, want 3", pages)
+	}
+}
+
+func TestListSecurityEventsPageSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		pageSize  int
+		wantLimit int
+	}{
+		{name: "default", pageSize: 0, wantLimit: defaultPageSize + 1},
+		{name: "negative", pageSize: -1, wantLimit: defaultPageSize + 1},
+		{name: "requested", pageSize: 10, wantLimit: 11},
+		{name: "capped", pageSize: 10_000, wantLimit: maxPageSize + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := &memoryEvents{}
+			a := newActivity(events, 0)
+
+			if _, _, err := a.ListSecurityEvents(context.Background(), "user@example.com", tt.pageSize, ""); err != nil {
+				t.Fatalf("ListSecurityEvents: %v", err)
+			}
+			if events.limits[0] != tt.wantLimit {
+				t.Errorf("limit = %d, want %d", events.limits[0], tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestListSecurityEventsRejectsPageTokens(t *testing.T) {
+	for _, token := range []string{"abc", "0", "-5"} {
+		a := newActivity(&memoryEvents{}, 0)
+		if _, _, err := a.ListSecurityEvents(context.Background(), "user@example.com", 10, token); !errors.Is(err, ErrInvalidPageToken) {
+			t.Errorf("ListSecurityEvents(%q) error = %v, want %v", token, err, ErrInvalidPageToken)
+		}
+	}
+}
+
+func TestRunRetention(t *testing.T) {
+	t.Run("zero retention keeps events", func(t *testing.T) {
+		events := &memoryEvents{}
+		newActivity(events, 0).RunRetention(context.Background())
+		if len(events.removed) != 0 {
+			t.Errorf("pruned %d times, want none", len(events.removed))
+		}
+	})
+
+	t.Run("prunes older than the retention", func(t *testing.T) {
+		events := &memoryEvents{}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		newActivity(events, 24*time.Hour).RunRetention(ctx)
+
+		if len(events.removed) != 1 {
+			t.Fatalf("pruned %d times, want once before stopping", len(events.removed))
+		}
+		if age := time.Since(events.removed[0]); age < 24*time.Hour-time.Minute || age > 24*time.Hour+time.Minute {
+			t.Errorf("pruned before %s ago, want 24h", age)
+		}
+	})
+}
@@ -4,10 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"time"
 	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/clientinfo"
 	"vieo/auth/internal/lib/jwt"
 	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/services/risk"
+	"vieo/auth/internal/services/security"
 	"vieo/auth/internal/storage"
 
 	"go.uber.org/zap"
@@ -20,18 +25,40 @@ type Auth struct {
 	usrProvider    UserProvider
 	deviceSaver    DeviceSaver
 	deviceProvider DeviceProvider
-	tokenTTL       time.Duration
-	secretKey      string
+	events         EventRecorder
+	alerts         Alerter
+	lockout        LoginGuard
+	risk           RiskDetector
+	challenges     ChallengeVerifier
+	grants         GrantProvider
+	members        MembershipProvider
+	profiles       ProfileProvider
+	households     HouseholdProvider
+	entitlements   EntitlementProvider
+	roles          RoleManager
+	// backends check the password of Login in order, the local users are the last one
+	backends  []CredentialBackend
+	tokenTTL  time.Duration
+	secretKey string
+	// hideAccounts makes Login and Register answer the same whether the email is registered or not
+	hideAccounts bool
 }
 
 const (
 	queryTime = 3 * time.Second
+	// dummyHash is compared against when the user does not exist, so Login takes as long
+	// as for a wrong password. Its cost must stay equal to bcrypt.DefaultCost
+	dummyHash = "$2a$10$1ETaYbhIptzJDh4QTlLL4O9tb5.wOBRSMJ9uYAQrSfF/zcRuV03IO"
 )
 
 var (
 	ErrInvalidCredentials = errors.New("invalid credentials")
 	ErrWrongPassword      = errors.New("wrong password")
 	ErrAddressMismatch    = errors.New("address mismatch")
+	// ErrPasswordResetRequired is returned after the owner reported an unrecognized login
+	ErrPasswordResetRequired = errors.New("password reset required")
+	// ErrNotMember is returned for an organization the user is not an active member of
+	ErrNotMember = errors.New("not a member of the organization")
 )
 
 type UserSaver interface {
@@ -54,7 +81,7 @@ type DeviceSaver interface {
 		ctx context.Context,
 		email string,
 		device string,
-	) error
+	) (created bool, err error)
 }
 
 type DeviceProvider interface {
@@ -65,23 +92,162 @@ type DeviceProvider interface {
 	) error
 }
 
+// EventRecorder writes to the security log of the account
+type EventRecorder interface {
+	Record(
+		ctx context.Context,
+		event models.SecurityEvent,
+	)
+}
+
+// LoginGuard throttles password guessing per account
+type LoginGuard interface {
+	Check(
+		ctx context.Context,
+		email string,
+	) error
+	Fail(
+		ctx context.Context,
+		email string,
+		registered bool,
+	)
+	Succeed(
+		ctx context.Context,
+		email string,
+	)
+}
+
+// RiskDetector collects the statistics that flag credential stuffing, password spraying and mass signups
+type RiskDetector interface {
+	RecordFailure(ip string, email string)
+	RecordRegistration(ip string)
+	Risky(ip string) bool
+}
+
+// ChallengeVerifier makes requests from risky sources prove themselves, see risk.ChallengeVerifier
+type ChallengeVerifier interface {
+	Verify(
+		ctx context.Context,
+		action string,
+		email string,
+		response string,
+	) error
+}
+
+// GrantProvider returns the roles and permissions embedded into access tokens
+type GrantProvider interface {
+	UserAccess(
+		ctx context.Context,
+		email string,
+	) (roles []string, permissions []string, err error)
+}
+
+// MembershipProvider checks the organization a token is issued for
+type MembershipProvider interface {
+	Membership(
+		ctx context.Context,
+		orgID int64,
+		email string,
+	) (models.Membership, error)
+	// SaveOrganizationDevice counts the device against the device limit of the organization
+	SaveOrganizationDevice(
+		ctx context.Context,
+		orgID int64,
+		email string,
+		device string,
+	) error
+}
+
+// Alerter notifies the owner of the account out-of-band
+type Alerter interface {
+	// NewDevice reports a login from a device the account has not seen before
+	NewDevice(
+		ctx context.Context,
+		user models.User,
+		deviceAddress string,
+	)
+	// RegistrationAttempt reports an attempt to register an already registered email
+	RegistrationAttempt(
+		ctx context.Context,
+		user models.User,
+	)
+}
+
+// ProfileProvider returns the viewer profile a token is issued for
+type ProfileProvider interface {
+	Profile(
+		ctx context.Context,
+		email string,
+		id int64,
+	) (models.Profile, error)
+	// Unlock returns the profile once its PIN, if any, matches
+	Unlock(
+		ctx context.Context,
+		email string,
+		id int64,
+		pin string,
+	) (models.Profile, error)
+}
+
+// HouseholdProvider returns the household the user is an active member of
+type HouseholdProvider interface {
+	HouseholdOf(
+		ctx context.Context,
+		email string,
+	) (models.Household, error)
+}
+
+// EntitlementProvider returns the entitlements of the subscription of the account
+type EntitlementProvider interface {
+	Entitlements(
+		ctx context.Context,
+		email string,
+	) (models.Entitlements, error)
+}
+
 func New(
 	log *logger.Logger,
 	userSaver UserSaver,
 	userProvider UserProvider,
 	deviceSaver DeviceSaver,
 	deviceProvider DeviceProvider,
+	events EventRecorder,
+	alerts Alerter,
+	lockout LoginGuard,
+	risk RiskDetector,
+	challenges ChallengeVerifier,
+	grants GrantProvider,
+	members MembershipProvider,
+	profiles ProfileProvider,
+	households HouseholdProvider,
+	entitlements EntitlementProvider,
+	roles RoleManager,
+	directories []CredentialBackend,
 	tokenTTL time.Duration,
 	secretKey string,
+	hideAccounts bool,
 ) *Auth {
 	return &Auth{
 		usrSaver:       userSaver,
 		usrProvider:    userProvider,
 		deviceSaver:    deviceSaver,
 		deviceProvider: deviceProvider,
+		events:         events,
+		alerts:         alerts,
+		lockout:        lockout,
+		risk:           risk,
+		challenges:     challenges,
+		grants:         grants,
+		members:        members,
+		profiles:       profiles,
+		households:     households,
+		entitlements:   entitlements,
+		roles:          roles,
+		backends:       append(slices.Clip(directories), localBackend{users: userProvider}),
 		log:            log,
 		tokenTTL:       tokenTTL,
 		secretKey:      secretKey,
+		hideAccounts:   hideAccounts,
 	}
 }
 
@@ -96,6 +262,15 @@ func (a *Auth) RegisterNewUser(
 		zap.String("email", "****"+email[4:]),
 	)
 	log.Info("registering user")
+	// the account of a directory user is created at the first directory login, a local one
+	// registered before would receive the roles of the directory
+	if a.directoryOwns(email) {
+		log.Warn("email is managed by a directory")
+		return 0, fmt.Errorf("%s: %w", op, ErrDirectoryUser)
+	}
+	if err := a.challenge(ctx, risk.ActionRegister, email, ""); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
 
 	passHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -109,12 +284,24 @@ func (a *Auth) RegisterNewUser(
 	if err != nil {
 		if errors.Is(err, storage.ErrUserAlreadyExists) {
 			a.log.Warn("user already exists", zap.Error(err))
+			// probing for registered emails counts like signing up
+			a.risk.RecordRegistration(clientinfo.FromContext(ctx).IP)
+			if a.hideAccounts {
+				// the owner learns about the attempt by email, the caller gets the usual answer
+				a.notifyRegistrationAttempt(ctx, email)
+				return 0, nil
+			}
 			return -1, fmt.Errorf("%s: %w", op, err)
 		}
 		log.Error("failed to save user", zap.Error(err))
 
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
+	a.risk.RecordRegistration(clientinfo.FromContext(ctx).IP)
+	// the id would tell a new account from an existing one
+	if a.hideAccounts {
+		return 0, nil
+	}
 
 	return id, nil
 }
@@ -132,47 +319,248 @@ func (a *Auth) Login(
 		zap.String("email", "****"+email[4:]),
 	)
 	log.Info("attempting to login user")
+	user, err := a.checkPassword(ctx, email, password, deviceAddress)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	log.Info("successfully logged in")
+	if err := a.registerDevice(ctx, user, deviceAddress); err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	token, err := a.newToken(ctx, user.Email, deviceAddress, 0, 0)
+	if err != nil {
+		a.log.Error("failed to generate token", zap.Error(err))
+
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	a.events.Record(ctx, models.SecurityEvent{
+		Email:  user.Email,
+		Type:   models.EventLoginSuccess,
+		Device: deviceAddress,
+	})
+
+	return token, nil
+}
+
+// VerifyPassword authenticates the user as Login does, with the challenge and the lockout,
+// but neither registers the device nor issues a token. It is the login of the authorization
+// server, an application the user authorizes is not one of their devices
+func (a *Auth) VerifyPassword(
+	ctx context.Context,
+	email string,
+	password string,
+	deviceAddress string,
+) (models.User, error) {
+	const op = "Auth.VerifyPassword"
+
+	log := a.log.With(
+		zap.String("op", op),
+		zap.String("email", "****"+email[4:]),
+	)
+	log.Info("attempting to verify password")
+	user, err := a.checkPassword(ctx, email, password, deviceAddress)
+	if err != nil {
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	a.events.Record(ctx, models.SecurityEvent{
+		Email:  user.Email,
+		Type:   models.EventLoginSuccess,
+		Device: deviceAddress,
+	})
+	log.Info("password verified")
+
+	return user, nil
+}
+
+// checkPassword is the part of the login up to the device: the challenge of a risky source,
+// the lockout, the credentials and the password reset
+func (a *Auth) checkPassword(
+	ctx context.Context,
+	email string,
+	password string,
+	deviceAddress string,
+) (models.User, error) {
+	// a risky source has to pass the challenge before learning anything about the account
+	if err := a.challenge(ctx, risk.ActionLogin, email, deviceAddress); err != nil {
+		return models.User{}, err
+	}
+	// a locked account is refused before the password is looked at
+	if err := a.lockout.Check(ctx, email); err != nil {
+		if errors.Is(err, security.ErrAccountLocked) {
+			a.log.Warn("account locked", zap.Error(err))
+			a.recordLoginFailure(ctx, email, deviceAddress, "account locked")
+			return models.User{}, err
+		}
+		a.log.Error("failed to check lockout", zap.Error(err))
+		return models.User{}, err
+	}
+	principal, err := a.authenticate(ctx, email, password)
+	if err != nil {
+		if errors.Is(err, ErrUnknownUser) {
+			a.log.Warn("user not found", zap.Error(err))
+			a.loginFailed(ctx, email, deviceAddress, false, "user not found")
+			if a.hideAccounts {
+				// spend the same time as a wrong password would
+				_ = bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
+				return models.User{}, ErrInvalidCredentials
+			}
+			return models.User{}, storage.ErrUserNotFound
+		}
+		if errors.Is(err, ErrWrongPassword) {
+			a.log.Info("invalid credentials", zap.Error(err))
+			a.loginFailed(ctx, email, deviceAddress, true, "wrong password")
+			if a.hideAccounts {
+				return models.User{}, ErrInvalidCredentials
+			}
+			return models.User{}, ErrWrongPassword
+		}
+		a.log.Error("failed to authenticate", zap.Error(err))
+
+		return models.User{}, err
+	}
+	user := principal.User
+	if principal.External {
+		if user, err = a.provision(ctx, email, principal); err != nil {
+			return models.User{}, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	a.lockout.Succeed(ctx, email)
+	// the directory owns the password of an external user, a local reset would not change it
+	if user.PasswordResetRequired && !principal.External {
+		a.log.Warn("password reset required")
+		a.recordLoginFailure(ctx, email, deviceAddress, "password reset required")
+		return models.User{}, ErrPasswordResetRequired
+	}
+
+	return user, nil
+}
+
+// RegisterDevice adds a device the user signed in on from another one, such as a TV approved
+// from the phone. The device limit applies and the owner is alerted about a new device.
+// A user who must reset the password gets ErrPasswordResetRequired, as Login does
+func (a *Auth) RegisterDevice(
+	ctx context.Context,
+	email string,
+	deviceAddress string,
+) error {
+	const op = "Auth.RegisterDevice"
+
 	ctx, cancel := context.WithTimeout(ctx, queryTime)
 	defer cancel()
 	user, err := a.usrProvider.User(ctx, email)
 	if err != nil {
 		if errors.Is(err, storage.ErrUserNotFound) {
-			a.log.Warn("user not found", zap.Error(err))
-			return "", fmt.Errorf("%s: %w", op, ErrInvalidCredentials)
+			a.log.Warn("user not found", zap.String("op", op), zap.Error(err))
+			return fmt.Errorf("%s: %w", op, err)
 		}
+		a.log.Error("failed to get user", zap.String("op", op), zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	// the owner reported a login they did not make, no device signs in until the password is reset
+	if user.PasswordResetRequired {
+		a.log.Warn("password reset required", zap.String("op", op))
+		a.recordLoginFailure(ctx, email, deviceAddress, "password reset required")
+		return fmt.Errorf("%s: %w", op, ErrPasswordResetRequired)
+	}
+
+	if err := a.registerDevice(ctx, user, deviceAddress); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
 
-		a.log.Error("failed to get user", zap.Error(err))
+// LoginDevice signs the user in on a device without a password: a device approved from another device
+// the user is signed in on, the QR login of a TV, or an external identity provider vouched for the user.
+// Like Login after the password check, the device is registered and gets a token
+func (a *Auth) LoginDevice(
+	ctx context.Context,
+	email string,
+	deviceAddress string,
+) (string, error) {
+	const op = "Auth.LoginDevice"
+	log := a.log.With(zap.String("op", op), zap.String("device", deviceAddress))
 
+	if err := a.RegisterDevice(ctx, email, deviceAddress); err != nil {
 		return "", fmt.Errorf("%s: %w", op, err)
 	}
-	if err := bcrypt.CompareHashAndPassword(user.PassHash, []byte(password)); err != nil {
-		a.log.Info("invalid credentials", zap.Error(err))
-		return "", fmt.Errorf("%s: %w", op, ErrWrongPassword)
+	token, err := a.newToken(ctx, email, deviceAddress, 0, 0)
+	if err != nil {
+		log.Error("failed to generate token", zap.Error(err))
+		return "", fmt.Errorf("%s: %w", op, err)
 	}
-	log.Info("successfully logged in")
-	ctx, cancel = context.WithTimeout(ctx, queryTime)
+	a.events.Record(ctx, models.SecurityEvent{
+		Email:  email,
+		Type:   models.EventLoginSuccess,
+		Device: deviceAddress,
+	})
+	log.Info("device signed in")
+
+	return token, nil
+}
+
+// registerDevice saves the device of a successful login
+func (a *Auth) registerDevice(ctx context.Context, user models.User, deviceAddress string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
 	defer cancel()
-	err = a.deviceSaver.SaveDevice(ctx, email, deviceAddress)
+	created, err := a.deviceSaver.SaveDevice(ctx, user.Email, deviceAddress)
 	if err != nil {
 		if errors.Is(err, storage.ErrDeviceLimitExceeded) {
 			a.log.Warn("device limit exceeded", zap.Error(err))
-			return "", fmt.Errorf("%s: %w", op, err)
+			a.recordLoginFailure(ctx, user.Email, deviceAddress, "device limit exceeded")
+			return err
+		}
+		if errors.Is(err, storage.ErrHouseholdDeviceLimitExceeded) {
+			a.log.Warn("household device limit exceeded", zap.Error(err))
+			a.recordLoginFailure(ctx, user.Email, deviceAddress, "household device limit exceeded")
+			return err
 		}
 		if errors.Is(err, storage.ErrUserNotFound) {
 			a.log.Warn("user not found", zap.Error(err))
-			return "", fmt.Errorf("%s: %w", op, ErrInvalidCredentials)
+			return ErrInvalidCredentials
 		}
 		a.log.Error("failed to save device", zap.Error(err))
-		return "", fmt.Errorf("%s: %w", op, err)
+		return err
+	}
+	if created {
+		a.deviceAdded(ctx, user, deviceAddress)
 	}
-	token, err := jwt.NewToken(user.Email, a.tokenTTL, a.secretKey, deviceAddress)
-	if err != nil {
-		a.log.Error("failed to generate token", zap.Error(err))
 
-		return "", fmt.Errorf("%s: %w", op, err)
+	return nil
+}
+
+// DeviceAdded records a device added to the account outside of a sign in, such as the device
+// of a guest merged into it, and alerts the owner
+func (a *Auth) DeviceAdded(
+	ctx context.Context,
+	email string,
+	deviceAddress string,
+) {
+	const op = "Auth.DeviceAdded"
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	user, err := a.usrProvider.User(ctx, email)
+	if err != nil {
+		a.log.Error("failed to get user", zap.String("op", op), zap.Error(err))
+		return
 	}
+	a.deviceAdded(ctx, user, deviceAddress)
+}
 
-	return token, nil
+func (a *Auth) deviceAdded(ctx context.Context, user models.User, deviceAddress string) {
+	a.events.Record(ctx, models.SecurityEvent{
+		Email:  user.Email,
+		Type:   models.EventDeviceAdded,
+		Device: deviceAddress,
+	})
+	a.alerts.NewDevice(ctx, user, deviceAddress)
 }
 
 func (a *Auth) RefreshToken(
@@ -192,7 +580,7 @@ func (a *Auth) RefreshToken(
 	ctx, cancel := context.WithTimeout(ctx, queryTime)
 	defer cancel()
 
-	email, addressInToken, err := jwt.DecodeToken(a.secretKey, accessToken)
+	claims, err := jwt.DecodeToken(tenant.SecretKey(ctx, a.secretKey), accessToken)
 	if err != nil {
 		if errors.Is(err, jwt.ErrTokenExpiration) {
 			a.log.Warn("token expired", zap.Error(err))
@@ -210,6 +598,11 @@ func (a *Auth) RefreshToken(
 			a.log.Warn("incorrect expiration", zap.Error(err))
 			return "", fmt.Errorf("%s: %w", op, err)
 		}
+		// a token of a client is refreshed by the client at the token endpoint, here it would become the user's own
+		if errors.Is(err, jwt.ErrClientToken) {
+			a.log.Warn("token issued to a client", zap.Error(err))
+			return "", fmt.Errorf("%s: %w", op, err)
+		}
 		if errors.Is(err, jwt.ErrInvalidToken) {
 			a.log.Warn("invalid token", zap.Error(err))
 			return "", fmt.Errorf("%s: %w", op, err)
@@ -218,9 +611,16 @@ func (a *Auth) RefreshToken(
 		return "", fmt.Errorf("%s: %w", op, err)
 	}
 
+	// a token of another tenant is never refreshed here, even if the keys happen to match
+	if !sameTenant(ctx, claims) {
+		a.log.Warn("token of another tenant")
+		return "", fmt.Errorf("%s: %w", op, jwt.ErrInvalidToken)
+	}
+
 	// check is needed so that there is no possibility
 	// use someone else's token. Explicitly checking devices
-	if addressInToken != deviceAddress {
+	email := claims.Email
+	if claims.DeviceAddress != deviceAddress {
 		a.log.Warn("address is mismatch")
 		return "", ErrAddressMismatch
 	}
@@ -237,11 +637,265 @@ func (a *Auth) RefreshToken(
 		return "", fmt.Errorf("%s: %w", op, err)
 	}
 
-	token, err := jwt.NewToken(email, a.tokenTTL, a.secretKey, deviceAddress)
+	// roles are read again, so the refreshed token reflects the current grants
+	// and a member removed from the organization loses its context. The profile stays selected,
+	// with its current rating
+	token, err := a.newToken(ctx, email, deviceAddress, claims.OrgID, claims.ProfileID)
 	if err != nil {
+		if errors.Is(err, ErrNotMember) {
+			a.log.Warn("no longer a member", zap.Error(err))
+			return "", fmt.Errorf("%s: %w", op, err)
+		}
+		if errors.Is(err, storage.ErrProfileNotFound) {
+			a.log.Warn("profile deleted", zap.Error(err))
+			return "", fmt.Errorf("%s: %w", op, err)
+		}
 		a.log.Error("failed to generate token", zap.Error(err))
 		return "", fmt.Errorf("%s: %w", op, err)
 	}
+	a.events.Record(ctx, models.SecurityEvent{
+		Email:  email,
+		Type:   models.EventTokenRefresh,
+		Device: deviceAddress,
+	})
 
 	return token, nil
 }
+
+// VerifyToken checks an access token of the tenant of the request and returns its claims.
+// Tokens issued to clients are accepted, ClientID tells them apart
+func (a *Auth) VerifyToken(
+	ctx context.Context,
+	accessToken string,
+) (jwt.Claims, error) {
+	const op = "Auth.VerifyToken"
+
+	claims, err := jwt.DecodeClientToken(tenant.SecretKey(ctx, a.secretKey), accessToken)
+	if err != nil {
+		return jwt.Claims{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if !sameTenant(ctx, claims) {
+		return jwt.Claims{}, fmt.Errorf("%s: %w", op, jwt.ErrInvalidToken)
+	}
+
+	return claims, nil
+}
+
+// sameTenant reports whether the token was issued for the tenant of the request.
+// Tokens without an audience predate tenants and belong to the default one
+func sameTenant(ctx context.Context, claims jwt.Claims) bool {
+	aud := claims.Tenant
+	if aud == "" {
+		aud = tenant.DefaultID
+	}
+	return aud == tenant.ID(ctx)
+}
+
+// notifyRegistrationAttempt alerts the owner in the background, looking the account up
+// would make the answer for an existing email slower than for a new one
+func (a *Auth) notifyRegistrationAttempt(ctx context.Context, email string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queryTime)
+		defer cancel()
+		user, err := a.usrProvider.User(ctx, email)
+		if err != nil {
+			a.log.Error("failed to get user", zap.Error(err))
+			return
+		}
+		a.alerts.RegistrationAttempt(ctx, user)
+	}()
+}
+
+// SwitchOrganization issues a token for the organization context, orgID 0 switches back
+// to the personal one. The device is counted against the device limit of the organization.
+// The selected profile, if any, stays selected
+func (a *Auth) SwitchOrganization(
+	ctx context.Context,
+	email string,
+	deviceAddress string,
+	orgID int64,
+	profileID int64,
+) (string, error) {
+	const op = "Auth.SwitchOrganization"
+	log := a.log.With(zap.String("op", op), zap.Int64("org_id", orgID))
+
+	if orgID != 0 {
+		ctx, cancel := context.WithTimeout(ctx, queryTime)
+		defer cancel()
+		err := a.members.SaveOrganizationDevice(ctx, orgID, email, deviceAddress)
+		if err != nil {
+			if errors.Is(err, storage.ErrOrganizationDeviceLimitExceeded) {
+				log.Warn("organization device limit exceeded", zap.Error(err))
+				return "", fmt.Errorf("%s: %w", op, err)
+			}
+			if errors.Is(err, storage.ErrMembershipNotFound) || errors.Is(err, storage.ErrOrganizationNotFound) {
+				log.Warn("not a member", zap.Error(err))
+				return "", fmt.Errorf("%s: %w", op, ErrNotMember)
+			}
+			log.Error("failed to save organization device", zap.Error(err))
+			return "", fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	token, err := a.newToken(ctx, email, deviceAddress, orgID, profileID)
+	if err != nil {
+		if errors.Is(err, ErrNotMember) || errors.Is(err, storage.ErrProfileNotFound) {
+			log.Warn("token context no longer valid", zap.Error(err))
+			return "", fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("failed to generate token", zap.Error(err))
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return token, nil
+}
+
+// SelectProfile issues a token for the viewer profile, with its PIN if the profile has one.
+// The token carries the profile and its maturity rating, the organization context is kept
+func (a *Auth) SelectProfile(
+	ctx context.Context,
+	email string,
+	deviceAddress string,
+	orgID int64,
+	profileID int64,
+	pin string,
+) (string, error) {
+	const op = "Auth.SelectProfile"
+	log := a.log.With(zap.String("op", op), zap.Int64("profile_id", profileID))
+
+	if _, err := a.profiles.Unlock(ctx, email, profileID, pin); err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	token, err := a.newToken(ctx, email, deviceAddress, orgID, profileID)
+	if err != nil {
+		if errors.Is(err, ErrNotMember) || errors.Is(err, storage.ErrProfileNotFound) {
+			log.Warn("token context no longer valid", zap.Error(err))
+			return "", fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("failed to generate token", zap.Error(err))
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	log.Info("profile selected")
+
+	return token, nil
+}
+
+// newToken issues an access token carrying the current roles and permissions of the user,
+// for orgID other than 0 the role in the organization and for profileID other than 0 the profile,
+// the household of the user when there is one and the entitlements of the subscription
+func (a *Auth) newToken(
+	ctx context.Context,
+	email string,
+	deviceAddress string,
+	orgID int64,
+	profileID int64,
+) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	roles, permissions, err := a.grants.UserAccess(ctx, email)
+	if err != nil {
+		return "", err
+	}
+
+	claims := jwt.Claims{
+		Email:         email,
+		DeviceAddress: deviceAddress,
+		Roles:         roles,
+		Permissions:   permissions,
+		Tenant:        tenant.ID(ctx),
+	}
+	if orgID != 0 {
+		m, err := a.members.Membership(ctx, orgID, email)
+		if err != nil {
+			if errors.Is(err, storage.ErrMembershipNotFound) {
+				return "", ErrNotMember
+			}
+			return "", err
+		}
+		// an invitation is not a membership yet
+		if m.Status != models.MembershipActive {
+			return "", ErrNotMember
+		}
+		claims.OrgID = orgID
+		claims.OrgRole = m.Role
+	}
+	if profileID != 0 {
+		profile, err := a.profiles.Profile(ctx, email, profileID)
+		if err != nil {
+			return "", err
+		}
+		claims.ProfileID = profile.ID
+		claims.MaturityRating = profile.MaturityRating
+	}
+	// the members of a household share the subscription of the owner
+	subscriber := email
+	household, err := a.households.HouseholdOf(ctx, email)
+	switch {
+	case err == nil:
+		claims.HouseholdID = household.ID
+		claims.HouseholdRole = models.HouseholdRoleMember
+		if household.OwnerEmail == email {
+			claims.HouseholdRole = models.HouseholdRoleOwner
+		}
+		subscriber = household.OwnerEmail
+	case !errors.Is(err, storage.ErrHouseholdNotFound):
+		return "", err
+	}
+	entitlements, err := a.entitlements.Entitlements(ctx, subscriber)
+	if err != nil {
+		return "", err
+	}
+	claims.Plan = entitlements.Plan
+	claims.Features = entitlements.Features
+	claims.MaxStreams = entitlements.MaxStreams
+
+	return jwt.NewToken(claims, tenant.TokenTTL(ctx, a.tokenTTL), tenant.SecretKey(ctx, a.secretKey))
+}
+
+// challenge asks for a challenge response when the client comes from a source flagged by the risk detector
+func (a *Auth) challenge(ctx context.Context, action, email, deviceAddress string) error {
+	info := clientinfo.FromContext(ctx)
+	if !a.risk.Risky(info.IP) {
+		return nil
+	}
+
+	err := a.challenges.Verify(ctx, action, email, info.ChallengeResponse)
+	var required *risk.ChallengeRequiredError
+	if errors.As(err, &required) {
+		a.log.Warn("challenge required", zap.String("action", action), zap.String("type", required.Type))
+		a.events.Record(ctx, models.SecurityEvent{
+			Email:  email,
+			Type:   models.EventLoginChallenge,
+			Device: deviceAddress,
+			Reason: action + ": " + required.Type,
+		})
+	} else if err != nil {
+		a.log.Error("failed to verify challenge", zap.Error(err))
+	} else {
+		a.events.Record(ctx, models.SecurityEvent{
+			Email:  email,
+			Type:   models.EventMFAChallenge,
+			Device: deviceAddress,
+			Reason: action + ": passed",
+		})
+	}
+
+	return err
+}
+
+// loginFailed feeds a failed credentials check to the lockout and the risk detector
+func (a *Auth) loginFailed(ctx context.Context, email, deviceAddress string, registered bool, reason string) {
+	a.lockout.Fail(ctx, email, registered)
+	a.risk.RecordFailure(clientinfo.FromContext(ctx).IP, email)
+	a.recordLoginFailure(ctx, email, deviceAddress, reason)
+}
+
+func (a *Auth) recordLoginFailure(ctx context.Context, email, deviceAddress, reason string) {
+	a.events.Record(ctx, models.SecurityEvent{
+		Email:  email,
+		Type:   models.EventLoginFailure,
+		Device: deviceAddress,
+		Reason: reason,
+	})
+}
@@ -0,0 +1,318 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/services/security"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// userBackend knows one user with the password "password"
+type userBackend struct {
+	user models.User
+}
+
+func (b userBackend) Owns(string) bool {
+	return true
+}
+
+func (b userBackend) Authenticate(_ context.Context, email, password string) (Principal, error) {
+	if email != b.user.Email {
+		return Principal{}, ErrUnknownUser
+	}
+	if password != "password" {
+		return Principal{}, ErrWrongPassword
+	}
+	return Principal{User: b.user}, nil
+}
+
+type fakeGuard struct {
+	locked   bool
+	fails    int
+	succeeds int
+}
+
+func (g *fakeGuard) Check(context.Context, string) error {
+	if g.locked {
+		return security.ErrAccountLocked
+	}
+	return nil
+}
+
+func (g *fakeGuard) Fail(context.Context, string, bool) { g.fails++ }
+
+func (g *fakeGuard) Succeed(context.Context, string) { g.succeeds++ }
+
+type quietRisk struct{}
+
+func (quietRisk) RecordFailure(string, string) {}
+func (quietRisk) RecordRegistration(string)    {}
+func (quietRisk) Risky(string) bool            { return false }
+
+type eventLog struct {
+	events []models.SecurityEvent
+}
+
+func (l *eventLog) Record(_ context.Context, event models.SecurityEvent) {
+	l.events = append(l.events, event)
+}
+
+// countingDevices counts the devices saved, the limit is reached from the start
+type countingDevices struct {
+	saved int
+}
+
+func (d *countingDevices) SaveDevice(context.Context, string, string) (bool, error) {
+	d.saved++
+	return false, errors.New("device limit exceeded")
+}
+
+func TestVerifyPassword(t *testing.T) {
+	tests := []struct {
+		name      string
+		email     string
+		password  string
+		locked    bool
+		resetReq  bool
+		wantErr   error
+		wantFails int
+		wantEvent string
+	}{
+		{name: "valid password", email: "alice@example.com", password: "password", wantEvent: models.EventLoginSuccess},
+		{name: "wrong password", email: "alice@example.com", password: "guess", wantErr: ErrWrongPassword, wantFails: 1, wantEvent: models.EventLoginFailure},
+		{name: "locked account", email: "alice@example.com", password: "password", locked: true, wantErr: security.ErrAccountLocked, wantEvent: models.EventLoginFailure},
+		{name: "password reset required", email: "alice@example.com", password: "password", resetReq: true, wantErr: ErrPasswordResetRequired, wantEvent: models.EventLoginFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guard := &fakeGuard{locked: tt.locked}
+			events := &eventLog{}
+			devices := &countingDevices{}
+			a := &Auth{
+				log:         &logger.Logger{SugaredLogger: zap.NewNop().Sugar()},
+				deviceSaver: devices,
+				events:      events,
+				lockout:     guard,
+				risk:        quietRisk{},
+				backends: []CredentialBackend{userBackend{user: models.User{
+					Email:                 "alice@example.com",
+					PasswordResetRequired: tt.resetReq,
+				}}},
+			}
+
+			user, err := a.VerifyPassword(context.Background(), tt.email, tt.password, "oauth:app")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("VerifyPassword error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && user.Email != tt.email {
+				t.Errorf("user = %q, want %q", user.Email, tt.email)
+			}
+			// the application is not a device, the device limit does not apply to it
+			if devices.saved != 0 {
+				t.Errorf("saved %d devices, want none", devices.saved)
+			}
+			if guard.fails != tt.wantFails {
+				t.Errorf("lockout failures = %d, want %d", guard.fails, tt.wantFails)
+			}
+			if len(events.events) != 1 || events.events[0].Type != tt.wantEvent {
+				t.Errorf("events = %+v, want one %s", events.events, tt.wantEvent)
+			}
+		})
+	}
+}
+
+// hashBackend knows alice with a bcrypt hash of "password", it compares like the local users do
+type hashBackend struct {
+	hash []byte
+	err  error
+}
+
+func (b hashBackend) Owns(string) bool {
+	return true
+}
+
+func (b hashBackend) Authenticate(_ context.Context, email, password string) (Principal, error) {
+	if b.err != nil {
+		return Principal{}, b.err
+	}
+	if email != "alice@example.com" {
+		return Principal{}, ErrUnknownUser
+	}
+	if bcrypt.CompareHashAndPassword(b.hash, []byte(password)) != nil {
+		return Principal{}, ErrWrongPassword
+	}
+	return Principal{User: models.User{Email: email}}, nil
+}
+
+// countingGuard counts the failures by whether the account exists
+type countingGuard struct {
+	fakeGuard
+	registered   int
+	unregistered int
+}
+
+func (g *countingGuard) Fail(_ context.Context, _ string, registered bool) {
+	if registered {
+		g.registered++
+	} else {
+		g.unregistered++
+	}
+}
+
+func newHidingAuth(t *testing.T, hideAccounts bool, backend hashBackend) (*Auth, *countingGuard) {
+	t.Helper()
+
+	if backend.hash == nil {
+		hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.DefaultCost)
+		if err != nil {
+			t.Fatalf("GenerateFromPassword: %v", err)
+		}
+		backend.hash = hash
+	}
+	guard := &countingGuard{}
+	return &Auth{
+		log:          &logger.Logger{SugaredLogger: zap.NewNop().Sugar()},
+		events:       &eventLog{},
+		lockout:      guard,
+		risk:         quietRisk{},
+		backends:     []CredentialBackend{backend},
+		hideAccounts: hideAccounts,
+	}, guard
+}
+
+func TestHideAccountsLogin(t *testing.T) {
+	tests := []struct {
+		name             string
+		hideAccounts     bool
+		email            string
+		wantErr          error
+		wantRegistered   int
+		wantUnregistered int
+	}{
+		{name: "unknown email", email: "bob@example.com", wantErr: storage.ErrUserNotFound, wantUnregistered: 1},
+		{name: "wrong password", email: "alice@example.com", wantErr: ErrWrongPassword, wantRegistered: 1},
+		{name: "hidden unknown email", hideAccounts: true, email: "bob@example.com", wantErr: ErrInvalidCredentials, wantUnregistered: 1},
+		{name: "hidden wrong password", hideAccounts: true, email: "alice@example.com", wantErr: ErrInvalidCredentials, wantRegistered: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, guard := newHidingAuth(t, tt.hideAccounts, hashBackend{})
+
+			_, err := a.Login(context.Background(), tt.email, "guess", "phone")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Login error = %v, want %v", err, tt.wantErr)
+			}
+			// the caller cannot tell the two apart, the lockout still can
+			if tt.hideAccounts && (errors.Is(err, storage.ErrUserNotFound) || errors.Is(err, ErrWrongPassword)) {
+				t.Errorf("hidden Login error %v tells whether the account exists", err)
+			}
+			if guard.registered != tt.wantRegistered || guard.unregistered != tt.wantUnregistered {
+				t.Errorf("lockout failures = %d registered, %d unregistered, want %d, %d",
+					guard.registered, guard.unregistered, tt.wantRegistered, tt.wantUnregistered)
+			}
+		})
+	}
+}
+
+func TestHideAccountsLoginTiming(t *testing.T) {
+	a, _ := newHidingAuth(t, true, hashBackend{})
+	// the fastest of a few logins, so a slow scheduler does not decide
+	fastest := func(email string) time.Duration {
+		best := time.Duration(math.MaxInt64)
+		for range 3 {
+			start := time.Now()
+			_, _ = a.Login(context.Background(), email, "guess", "phone")
+			best = min(best, time.Since(start))
+		}
+		return best
+	}
+
+	wrongPassword := fastest("alice@example.com")
+	unknownEmail := fastest("bob@example.com")
+	// both compare a bcrypt hash of the default cost, an unknown email must not answer at once
+	if unknownEmail < wrongPassword/2 {
+		t.Errorf("unknown email answered in %s, a wrong password in %s", unknownEmail, wrongPassword)
+	}
+	if cost, err := bcrypt.Cost([]byte(dummyHash)); err != nil || cost != bcrypt.DefaultCost {
+		t.Errorf("dummy hash cost = %d, %v, want %d", cost, err, bcrypt.DefaultCost)
+	}
+}
+
+func TestLoginBackendFailure(t *testing.T) {
+	errDirectory := errors.New("directory unavailable")
+	for _, hideAccounts := range []bool{false, true} {
+		a, guard := newHidingAuth(t, hideAccounts, hashBackend{err: errDirectory})
+
+		// an outage is not a wrong password: it is neither masked nor counted against the account
+		_, err := a.Login(context.Background(), "alice@example.com", "password", "phone")
+		if !errors.Is(err, errDirectory) || errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("Login with hideAccounts %v error = %v, want %v", hideAccounts, err, errDirectory)
+		}
+		if guard.registered != 0 || guard.unregistered != 0 {
+			t.Errorf("lockout failures = %d, %d, want none", guard.registered, guard.unregistered)
+		}
+	}
+}
+
+// accounts saves alice once and tells the registration attempts
+type accounts struct {
+	saved    map[string]bool
+	attempts chan string
+}
+
+func (u *accounts) SaveUser(_ context.Context, email string, _ []byte) (int64, error) {
+	if u.saved[email] {
+		return 0, storage.ErrUserAlreadyExists
+	}
+	u.saved[email] = true
+	return int64(len(u.saved)), nil
+}
+
+func (u *accounts) User(_ context.Context, email string) (models.User, error) {
+	return models.User{Email: email}, nil
+}
+
+func (u *accounts) NewDevice(context.Context, models.User, string) {}
+
+func (u *accounts) RegistrationAttempt(_ context.Context, user models.User) {
+	u.attempts <- user.Email
+}
+
+func TestHideAccountsRegister(t *testing.T) {
+	users := &accounts{saved: map[string]bool{"alice@example.com": true}, attempts: make(chan string, 1)}
+	a := &Auth{
+		log:          &logger.Logger{SugaredLogger: zap.NewNop().Sugar()},
+		usrSaver:     users,
+		usrProvider:  users,
+		alerts:       users,
+		risk:         quietRisk{},
+		hideAccounts: true,
+	}
+
+	// a new and a registered email get the same answer
+	for _, email := range []string{"bob@example.com", "alice@example.com"} {
+		if id, err := a.RegisterNewUser(context.Background(), email, "password"); id != 0 || err != nil {
+			t.Errorf("RegisterNewUser(%s) = %d, %v, want 0, nil", email, id, err)
+		}
+	}
+	// only the owner of the registered one is told
+	select {
+	case email := <-users.attempts:
+		if email != "alice@example.com" {
+			t.Errorf("registration attempt reported to %s", email)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("registration attempt not reported")
+	}
+	if !users.saved["bob@example.com"] {
+		t.Errorf("new user not saved")
+	}
+}
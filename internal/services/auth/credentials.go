@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrUnknownUser is returned by a credential backend that does not know the email
+	ErrUnknownUser = errors.New("unknown user")
+	// ErrDirectoryUser is returned by Register for an email a directory owns, its users
+	// sign in with the directory password only
+	ErrDirectoryUser = errors.New("email is managed by a directory")
+)
+
+// CredentialBackend checks the password of a login for the emails it owns. The first backend
+// owning the email decides: ErrUnknownUser or an error of the backend fail the login rather than
+// passing it on, so a local account can never stand in for a directory one. ErrWrongPassword
+// is returned for a user it knows with another password
+type CredentialBackend interface {
+	Owns(email string) bool
+	Authenticate(
+		ctx context.Context,
+		email string,
+		password string,
+	) (Principal, error)
+}
+
+// Principal is the user a credential backend vouched for
+type Principal struct {
+	// User is set by the backend of the local users
+	User models.User
+	// External is set by a directory outside of users: the user is saved on its first login
+	// and the roles the directory manages are synced on every login
+	External bool
+	// Roles the directory grants the user
+	Roles []string
+	// Managed are all the roles the directory maps to, a managed role the user is not granted is revoked
+	Managed []string
+}
+
+// RoleManager assigns and revokes the roles of a user synced from a directory
+type RoleManager interface {
+	AssignRole(
+		ctx context.Context,
+		email string,
+		role string,
+	) error
+	RevokeRole(
+		ctx context.Context,
+		email string,
+		role string,
+	) error
+}
+
+// localBackend checks the password against the hash in users, it is the last backend of the chain
+// and owns the emails no directory does
+type localBackend struct {
+	users UserProvider
+}
+
+func (localBackend) Owns(string) bool {
+	return true
+}
+
+func (b localBackend) Authenticate(
+	ctx context.Context,
+	email string,
+	password string,
+) (Principal, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	user, err := b.users.User(ctx, email)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return Principal{}, ErrUnknownUser
+		}
+		return Principal{}, err
+	}
+	if err := bcrypt.CompareHashAndPassword(user.PassHash, []byte(password)); err != nil {
+		return Principal{}, ErrWrongPassword
+	}
+
+	return Principal{User: user}, nil
+}
+
+// authenticate asks the first backend that owns the email, the others are not contacted
+func (a *Auth) authenticate(
+	ctx context.Context,
+	email string,
+	password string,
+) (Principal, error) {
+	for _, backend := range a.backends {
+		if backend.Owns(email) {
+			return backend.Authenticate(ctx, email, password)
+		}
+	}
+
+	return Principal{}, ErrUnknownUser
+}
+
+// directoryOwns reports whether a directory rather than the local users owns the email
+func (a *Auth) directoryOwns(email string) bool {
+	for _, backend := range a.backends {
+		if _, local := backend.(localBackend); !local && backend.Owns(email) {
+			return true
+		}
+	}
+	return false
+}
+
+// provision returns the user a directory vouched for, saving it on its first login,
+// and syncs the roles the directory manages
+func (a *Auth) provision(ctx context.Context, email string, principal Principal) (models.User, error) {
+	const op = "Auth.provision"
+	log := a.log.With(zap.String("op", op))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	user, err := a.usrProvider.User(ctx, email)
+	if errors.Is(err, storage.ErrUserNotFound) {
+		log.Info("provisioning directory user")
+		if err := a.saveDirectoryUser(ctx, email); err != nil {
+			log.Error("failed to save user", zap.Error(err))
+			return models.User{}, fmt.Errorf("%s: %w", op, err)
+		}
+		user, err = a.usrProvider.User(ctx, email)
+	}
+	if err != nil {
+		log.Error("failed to get user", zap.Error(err))
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if err := a.syncRoles(ctx, email, principal); err != nil {
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return user, nil
+}
+
+// saveDirectoryUser saves a user whose password lives in the directory. Nobody knows the local
+// password, a concurrent first login of the same user is not an error
+func (a *Auth) saveDirectoryUser(ctx context.Context, email string) error {
+	password := make([]byte, 32)
+	if _, err := rand.Read(password); err != nil {
+		return err
+	}
+	passHash, err := bcrypt.GenerateFromPassword(
+		[]byte(base64.RawURLEncoding.EncodeToString(password)),
+		bcrypt.DefaultCost,
+	)
+	if err != nil {
+		return err
+	}
+	if _, err := a.usrSaver.SaveUser(ctx, email, passHash); err != nil && !errors.Is(err, storage.ErrUserAlreadyExists) {
+		return err
+	}
+
+	return nil
+}
+
+// syncRoles assigns the roles the directory grants and revokes the managed ones it no longer does.
+// Roles outside of the mapping are left to the administrators
+func (a *Auth) syncRoles(ctx context.Context, email string, principal Principal) error {
+	current, _, err := a.grants.UserAccess(ctx, email)
+	if err != nil {
+		a.log.Error("failed to get roles", zap.Error(err))
+		return err
+	}
+	for _, role := range principal.Roles {
+		if slices.Contains(current, role) {
+			continue
+		}
+		if err := a.roles.AssignRole(ctx, email, role); err != nil {
+			if errors.Is(err, storage.ErrRoleNotFound) {
+				continue
+			}
+			return err
+		}
+	}
+	for _, role := range principal.Managed {
+		if !slices.Contains(current, role) || slices.Contains(principal.Roles, role) {
+			continue
+		}
+		if err := a.roles.RevokeRole(ctx, email, role); err != nil {
+			if errors.Is(err, storage.ErrRoleNotFound) {
+				continue
+			}
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"vieo/auth/internal/lib/logger"
+
+	"go.uber.org/zap"
+)
+
+// domainBackend owns the emails of a domain and answers every login with err
+type domainBackend struct {
+	domain string
+	err    error
+	calls  int
+}
+
+func (b *domainBackend) Owns(email string) bool {
+	return strings.HasSuffix(email, "@"+b.domain)
+}
+
+func (b *domainBackend) Authenticate(context.Context, string, string) (Principal, error) {
+	b.calls++
+	if b.err != nil {
+		return Principal{}, b.err
+	}
+	return Principal{External: true}, nil
+}
+
+// everyBackend stands in for the local users, it owns every email
+type everyBackend struct {
+	calls int
+}
+
+func (b *everyBackend) Owns(string) bool {
+	return true
+}
+
+func (b *everyBackend) Authenticate(context.Context, string, string) (Principal, error) {
+	b.calls++
+	return Principal{}, nil
+}
+
+func TestAuthenticateBackends(t *testing.T) {
+	errDown := errors.New("directory is down")
+
+	tests := []struct {
+		name          string
+		email         string
+		directoryErr  error
+		wantErr       error
+		wantDirectory int
+		wantLocal     int
+	}{
+		{name: "directory user", email: "alice@corp.example.com", wantDirectory: 1},
+		{name: "directory does not know the user", email: "alice@corp.example.com", directoryErr: ErrUnknownUser, wantErr: ErrUnknownUser, wantDirectory: 1},
+		{name: "wrong directory password", email: "alice@corp.example.com", directoryErr: ErrWrongPassword, wantErr: ErrWrongPassword, wantDirectory: 1},
+		{name: "directory down", email: "alice@corp.example.com", directoryErr: errDown, wantErr: errDown, wantDirectory: 1},
+		{name: "local user", email: "bob@example.com", wantLocal: 1},
+		{name: "local user while the directory is down", email: "bob@example.com", directoryErr: errDown, wantLocal: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			directory := &domainBackend{domain: "corp.example.com", err: tt.directoryErr}
+			local := &everyBackend{}
+			a := &Auth{backends: []CredentialBackend{directory, local}}
+
+			principal, err := a.authenticate(context.Background(), tt.email, "password")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("authenticate error = %v, want %v", err, tt.wantErr)
+			}
+			if directory.calls != tt.wantDirectory || local.calls != tt.wantLocal {
+				t.Errorf("directory calls = %d, local calls = %d, want %d and %d",
+					directory.calls, local.calls, tt.wantDirectory, tt.wantLocal)
+			}
+			if err == nil && principal.External != (tt.wantDirectory == 1) {
+				t.Errorf("External = %v, want %v", principal.External, tt.wantDirectory == 1)
+			}
+		})
+	}
+}
+
+func TestRegisterDirectoryUser(t *testing.T) {
+	a := &Auth{
+		log: &logger.Logger{SugaredLogger: zap.NewNop().Sugar()},
+		backends: []CredentialBackend{
+			&domainBackend{domain: "corp.example.com"},
+			localBackend{},
+		},
+	}
+
+	if !a.directoryOwns("alice@corp.example.com") {
+		t.Errorf("directoryOwns of a directory email = false")
+	}
+	if a.directoryOwns("bob@example.com") {
+		t.Errorf("directoryOwns of a local email = true")
+	}
+	if _, err := a.RegisterNewUser(context.Background(), "alice@corp.example.com", "password"); !errors.Is(err, ErrDirectoryUser) {
+		t.Errorf("RegisterNewUser error = %v, want %v", err, ErrDirectoryUser)
+	}
+}
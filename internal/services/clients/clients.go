@@ -0,0 +1,471 @@
+package clients
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/jwt"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+
+	jwtv5 "github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	queryTime = 3 * time.Second
+	// AssertionType is the only client_assertion_type accepted, RFC 7523
+	AssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	// maxAssertionTTL bounds how far ahead an assertion may expire, so used ones are not kept for long
+	maxAssertionTTL = 10 * time.Minute
+	assertionLeeway = 30 * time.Second
+)
+
+var (
+	// ErrInvalidClient is returned for every client authentication failure,
+	// the caller does not learn which part was wrong
+	ErrInvalidClient    = errors.New("invalid client")
+	ErrInvalidScope     = errors.New("invalid scope")
+	ErrInvalidPublicKey = errors.New("invalid public key")
+	ErrInvalidTTL       = errors.New("invalid token lifetime")
+	// ErrUnauthorizedClient is returned for a grant the client may not use
+	ErrUnauthorizedClient = errors.New("client is not authorized for the grant")
+	// ErrInvalidRedirectURI is returned for a redirect URI that is not absolute, has a fragment
+	// or uses plain http for a host other than localhost, and for a public client without any
+	ErrInvalidRedirectURI = errors.New("invalid redirect uri")
+	// ErrScopeNotGranted is returned for a scope the caller does not hold itself
+	ErrScopeNotGranted = errors.New("scope is not granted to the caller")
+)
+
+// assertionMethods are the signature algorithms of private_key_jwt, the key type must match
+var assertionMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// Clients registers the service accounts and issues them tokens by the client_credentials grant
+type Clients struct {
+	log       *logger.Logger
+	clients   ClientStore
+	secretKey string
+	tokenTTL  time.Duration
+	// audience is the token endpoint URL the assertions must be addressed to,
+	// private_key_jwt is refused without it
+	audience string
+}
+
+type ClientStore interface {
+	SaveClient(
+		ctx context.Context,
+		client models.Client,
+	) (models.Client, error)
+	Client(
+		ctx context.Context,
+		clientID string,
+	) (models.Client, error)
+	DeleteClient(
+		ctx context.Context,
+		clientID string,
+	) error
+	// SaveClientAssertion returns storage.ErrClientAssertionReplayed for a jti of the client saved before
+	SaveClientAssertion(
+		ctx context.Context,
+		clientID string,
+		jti string,
+		expiresAt time.Time,
+	) error
+}
+
+// Credentials is how a client authenticates: a secret or a signed assertion.
+// ClientID may be left empty with an assertion, it is then taken from the assertion
+type Credentials struct {
+	ClientID      string
+	ClientSecret  string
+	AssertionType string
+	Assertion     string
+}
+
+// Token is the result of the client_credentials grant
+type Token struct {
+	AccessToken string
+	ExpiresIn   time.Duration
+	Scopes      []string
+}
+
+func New(
+	log *logger.Logger,
+	clients ClientStore,
+	secretKey string,
+	tokenTTL time.Duration,
+	audience string,
+) *Clients {
+	return &Clients{
+		log:       log,
+		clients:   clients,
+		secretKey: secretKey,
+		tokenTTL:  tokenTTL,
+		audience:  audience,
+	}
+}
+
+// CreateClient registers a client allowed the scopes, each of them but the OpenID Connect ones
+// must be among granted, the permissions of the caller. Clients with redirect URIs are registered for
+// the authorization code flow only, a public one has no credentials and must have them. The others are
+// service accounts of the client_credentials grant. A client authenticates with
+// the public key or, without it, with a generated secret that is returned only here
+func (c *Clients) CreateClient(
+	ctx context.Context,
+	name string,
+	scopes []string,
+	tokenTTL time.Duration,
+	publicKey string,
+	redirectURIs []string,
+	public bool,
+	granted []string,
+) (models.Client, string, error) {
+	const op = "Clients.CreateClient"
+	log := c.log.With(zap.String("op", op))
+
+	for _, s := range scopes {
+		// the identity scopes grant no permission, any client may ask for them
+		if !contains(granted, s) && !models.IsIdentityScope(s) {
+			log.Warn("scope not granted", zap.String("scope", s))
+			return models.Client{}, "", fmt.Errorf("%s: %w", op, ErrScopeNotGranted)
+		}
+	}
+	if tokenTTL < 0 {
+		return models.Client{}, "", fmt.Errorf("%s: %w", op, ErrInvalidTTL)
+	}
+	for _, uri := range redirectURIs {
+		if !validRedirectURI(uri) {
+			log.Warn("invalid redirect uri", zap.String("redirect_uri", uri))
+			return models.Client{}, "", fmt.Errorf("%s: %w", op, ErrInvalidRedirectURI)
+		}
+	}
+	if public && (publicKey != "" || len(redirectURIs) == 0) {
+		return models.Client{}, "", fmt.Errorf("%s: %w", op, ErrInvalidRedirectURI)
+	}
+
+	id, err := randomString(16)
+	if err != nil {
+		log.Error("failed to generate client id", zap.Error(err))
+		return models.Client{}, "", fmt.Errorf("%s: %w", op, err)
+	}
+	client := models.Client{
+		ID:           id,
+		Name:         name,
+		Scopes:       scopes,
+		RedirectURIs: redirectURIs,
+		GrantTypes:   []string{models.GrantClientCredentials},
+		TokenTTL:     tokenTTL,
+	}
+	if len(redirectURIs) > 0 {
+		client.GrantTypes = []string{models.GrantAuthorizationCode}
+	}
+
+	var secret string
+	if public {
+		// PKCE alone protects the code of a client that cannot keep a secret
+	} else if publicKey != "" {
+		if _, err := parsePublicKey(publicKey); err != nil {
+			log.Warn("invalid public key", zap.Error(err))
+			return models.Client{}, "", fmt.Errorf("%s: %w", op, ErrInvalidPublicKey)
+		}
+		client.PublicKey = publicKey
+	} else {
+		secret, err = randomString(32)
+		if err != nil {
+			log.Error("failed to generate client secret", zap.Error(err))
+			return models.Client{}, "", fmt.Errorf("%s: %w", op, err)
+		}
+		client.SecretHash = hash(secret)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	saved, err := c.clients.SaveClient(ctx, client)
+	if err != nil {
+		log.Error("failed to save client", zap.Error(err))
+		return models.Client{}, "", fmt.Errorf("%s: %w", op, err)
+	}
+	log.Info("client created", zap.String("client_id", saved.ID))
+
+	return saved, secret, nil
+}
+
+func (c *Clients) DeleteClient(
+	ctx context.Context,
+	clientID string,
+) error {
+	const op = "Clients.DeleteClient"
+	log := c.log.With(zap.String("op", op), zap.String("client_id", clientID))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	if err := c.clients.DeleteClient(ctx, clientID); err != nil {
+		if errors.Is(err, storage.ErrClientNotFound) {
+			log.Warn("client not found", zap.Error(err))
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("failed to delete client", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	log.Info("client deleted")
+
+	return nil
+}
+
+// ClientCredentials authenticates the client and issues an access token with "sub" set to it.
+// The token grants the requested scopes, all of the allowed ones when none is requested
+func (c *Clients) ClientCredentials(
+	ctx context.Context,
+	creds Credentials,
+	scopes []string,
+) (Token, error) {
+	const op = "Clients.ClientCredentials"
+
+	client, err := c.Authenticate(ctx, creds)
+	if err != nil {
+		return Token{}, fmt.Errorf("%s: %w", op, err)
+	}
+	log := c.log.With(zap.String("op", op), zap.String("client_id", client.ID))
+	// an application of the code flow acts for its users, never with its scopes on its own
+	if client.Public() || !client.Allows(models.GrantClientCredentials) {
+		log.Warn("client is not registered for the grant")
+		return Token{}, fmt.Errorf("%s: %w", op, ErrUnauthorizedClient)
+	}
+
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	for _, s := range scopes {
+		if !contains(client.Scopes, s) {
+			log.Warn("scope not allowed", zap.String("scope", s))
+			return Token{}, fmt.Errorf("%s: %w", op, ErrInvalidScope)
+		}
+	}
+
+	ttl := client.TokenTTL
+	if ttl == 0 {
+		ttl = tenant.TokenTTL(ctx, c.tokenTTL)
+	}
+	token, err := jwt.NewToken(
+		jwt.Claims{
+			ClientID:    client.ID,
+			Permissions: scopes,
+			Scopes:      scopes,
+			Tenant:      tenant.ID(ctx),
+		},
+		ttl,
+		tenant.SecretKey(ctx, c.secretKey),
+	)
+	if err != nil {
+		log.Error("failed to generate token", zap.Error(err))
+		return Token{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return Token{
+		AccessToken: token,
+		ExpiresIn:   ttl,
+		Scopes:      scopes,
+	}, nil
+}
+
+// Authenticate returns the client the credentials belong to. A public client is identified
+// by its id alone, it must not send credentials
+func (c *Clients) Authenticate(
+	ctx context.Context,
+	creds Credentials,
+) (models.Client, error) {
+	const op = "Clients.Authenticate"
+	log := c.log.With(zap.String("op", op))
+
+	clientID := creds.ClientID
+	if clientID == "" && creds.Assertion != "" {
+		clientID = assertionSubject(creds.Assertion)
+	}
+	if clientID == "" {
+		return models.Client{}, fmt.Errorf("%s: %w", op, ErrInvalidClient)
+	}
+	log = log.With(zap.String("client_id", clientID))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	client, err := c.clients.Client(ctx, clientID)
+	if err != nil {
+		if errors.Is(err, storage.ErrClientNotFound) {
+			log.Warn("client not found")
+			return models.Client{}, fmt.Errorf("%s: %w", op, ErrInvalidClient)
+		}
+		log.Error("failed to get client", zap.Error(err))
+		return models.Client{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := c.authenticate(ctx, client, creds); err != nil {
+		log.Warn("client authentication failed", zap.Error(err))
+		return models.Client{}, fmt.Errorf("%s: %w", op, ErrInvalidClient)
+	}
+
+	return client, nil
+}
+
+// authenticate checks the credentials against the method the client was registered with
+func (c *Clients) authenticate(ctx context.Context, client models.Client, creds Credentials) error {
+	if client.Public() {
+		if creds.ClientSecret != "" || creds.Assertion != "" {
+			return errors.New("public client sent credentials")
+		}
+		return nil
+	}
+	if client.PublicKey == "" {
+		if creds.Assertion != "" || creds.ClientSecret == "" {
+			return errors.New("client_secret required")
+		}
+		if subtle.ConstantTimeCompare([]byte(hash(creds.ClientSecret)), []byte(client.SecretHash)) != 1 {
+			return errors.New("wrong client secret")
+		}
+		return nil
+	}
+
+	if creds.ClientSecret != "" || creds.Assertion == "" {
+		return errors.New("private_key_jwt required")
+	}
+	if creds.AssertionType != AssertionType {
+		return fmt.Errorf("unsupported assertion type %q", creds.AssertionType)
+	}
+	if c.audience == "" {
+		return errors.New("token endpoint URL is not configured")
+	}
+	key, err := parsePublicKey(client.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	claims := jwtv5.RegisteredClaims{}
+	_, err = jwtv5.ParseWithClaims(
+		creds.Assertion,
+		&claims,
+		func(*jwtv5.Token) (interface{}, error) { return key, nil },
+		jwtv5.WithValidMethods(assertionMethods),
+		jwtv5.WithAudience(c.audience),
+		jwtv5.WithIssuer(client.ID),
+		jwtv5.WithSubject(client.ID),
+		jwtv5.WithExpirationRequired(),
+		jwtv5.WithLeeway(assertionLeeway),
+	)
+	if err != nil {
+		return err
+	}
+	if claims.ID == "" {
+		return errors.New("assertion has no jti")
+	}
+	expires := claims.ExpiresAt.Time
+	if time.Until(expires) > maxAssertionTTL {
+		return errors.New("assertion expires too late")
+	}
+	// the jti is kept until the assertion can no longer be accepted
+	if err := c.clients.SaveClientAssertion(ctx, client.ID, claims.ID, expires.Add(assertionLeeway)); err != nil {
+		if errors.Is(err, storage.ErrClientAssertionReplayed) {
+			return errors.New("assertion replayed")
+		}
+		return err
+	}
+
+	return nil
+}
+
+// assertionSubject reads the client of the assertion without verifying it
+func assertionSubject(assertion string) string {
+	claims := jwtv5.RegisteredClaims{}
+	if _, _, err := jwtv5.NewParser().ParseUnverified(assertion, &claims); err != nil {
+		return ""
+	}
+	return claims.Subject
+}
+
+// parsePublicKey accepts RSA, ECDSA and Ed25519 public keys in PEM
+func parsePublicKey(pem string) (crypto.PublicKey, error) {
+	if key, err := jwtv5.ParseRSAPublicKeyFromPEM([]byte(pem)); err == nil {
+		return key, nil
+	}
+	if key, err := jwtv5.ParseECPublicKeyFromPEM([]byte(pem)); err == nil {
+		return key, nil
+	}
+	if key, err := jwtv5.ParseEdPublicKeyFromPEM([]byte(pem)); err == nil {
+		return key, nil
+	}
+	return nil, ErrInvalidPublicKey
+}
+
+// ParseBasicAuth reads the client id and secret of an "Authorization: Basic" value,
+// both are form-encoded before base64 as RFC 6749 section 2.3.1 requires
+func ParseBasicAuth(header string) (clientID string, secret string, ok bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	id, secret, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", false
+	}
+	if id, err = url.QueryUnescape(id); err != nil {
+		return "", "", false
+	}
+	if secret, err = url.QueryUnescape(secret); err != nil {
+		return "", "", false
+	}
+	return id, secret, true
+}
+
+// validRedirectURI follows OAuth 2.1: an absolute URI without a fragment, plain http only for loopback.
+// Custom schemes of native apps are allowed
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || strings.Contains(uri, "#") {
+		return false
+	}
+	if u.Scheme == "http" {
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	}
+	return u.Scheme != "javascript" && u.Scheme != "data"
+}
+
+// ParseScope splits an OAuth scope parameter, scopes are separated by spaces
+func ParseScope(scope string) []string {
+	return strings.Fields(scope)
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,399 @@
+package clients
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/jwt"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/storage"
+
+	jwtv5 "github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+const testAudience = "https://auth.example.com/oauth/token"
+
+func TestParseBasicAuth(t *testing.T) {
+	basic := func(s string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	tests := []struct {
+		name       string
+		header     string
+		wantID     string
+		wantSecret string
+		wantOK     bool
+	}{
+		{"id and secret", basic("client:secret"), "client", "secret", true},
+		{"lowercase scheme", "basic " + base64.StdEncoding.EncodeToString([]byte("client:secret")), "client", "secret", true},
+		{"form encoded", basic("my%3Aclient:p%40ss+word"), "my:client", "p@ss word", true},
+		{"colon in the secret", basic("client:a:b"), "client", "a:b", true},
+		{"empty secret", basic("client:"), "client", "", true},
+		{"no colon", basic("client"), "", "", false},
+		{"bad encoding of the id", basic("%zz:secret"), "", "", false},
+		{"bad encoding of the secret", basic("client:%zz"), "", "", false},
+		{"not base64", "Basic !!!", "", "", false},
+		{"bearer", "Bearer token", "", "", false},
+		{"too short", "Basic", "", "", false},
+		{"empty", "", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, secret, ok := ParseBasicAuth(tt.header)
+			if id != tt.wantID || secret != tt.wantSecret || ok != tt.wantOK {
+				t.Errorf("ParseBasicAuth(%q) = %q, %q, %v, want %q, %q, %v",
+					tt.header, id, secret, ok, tt.wantID, tt.wantSecret, tt.wantOK)
+			}
+		})
+	}
+}
+
+// memoryClients is a ClientStore in maps
+type memoryClients struct {
+	clients    map[string]models.Client
+	assertions map[string]bool
+}
+
+func (m *memoryClients) SaveClient(_ context.Context, client models.Client) (models.Client, error) {
+	m.clients[client.ID] = client
+	return client, nil
+}
+
+func (m *memoryClients) Client(_ context.Context, clientID string) (models.Client, error) {
+	client, ok := m.clients[clientID]
+	if !ok {
+		return models.Client{}, storage.ErrClientNotFound
+	}
+	return client, nil
+}
+
+func (m *memoryClients) DeleteClient(_ context.Context, clientID string) error {
+	delete(m.clients, clientID)
+	return nil
+}
+
+func (m *memoryClients) SaveClientAssertion(_ context.Context, clientID string, jti string, _ time.Time) error {
+	if m.assertions[clientID+":"+jti] {
+		return storage.ErrClientAssertionReplayed
+	}
+	m.assertions[clientID+":"+jti] = true
+	return nil
+}
+
+func TestAuthenticate(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey: %v", err)
+	}
+	publicPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	assertion := func(t *testing.T, key ed25519.PrivateKey, claims jwtv5.RegisteredClaims) string {
+		t.Helper()
+		signed, err := jwtv5.NewWithClaims(jwtv5.SigningMethodEdDSA, claims).SignedString(key)
+		if err != nil {
+			t.Fatalf("SignedString: %v", err)
+		}
+		return signed
+	}
+	claims := func(jti string, ttl time.Duration) jwtv5.RegisteredClaims {
+		return jwtv5.RegisteredClaims{
+			Issuer:    "keyed",
+			Subject:   "keyed",
+			Audience:  jwtv5.ClaimStrings{testAudience},
+			ExpiresAt: jwtv5.NewNumericDate(time.Now().Add(ttl)),
+			ID:        jti,
+		}
+	}
+	withAudience := func(c jwtv5.RegisteredClaims, aud string) jwtv5.RegisteredClaims {
+		c.Audience = jwtv5.ClaimStrings{aud}
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		creds  func(t *testing.T) Credentials
+		wantID string
+	}{
+		{
+			name: "secret",
+			creds: func(*testing.T) Credentials {
+				return Credentials{ClientID: "secret", ClientSecret: "s3cret"}
+			},
+			wantID: "secret",
+		},
+		{
+			name: "wrong secret",
+			creds: func(*testing.T) Credentials {
+				return Credentials{ClientID: "secret", ClientSecret: "wrong"}
+			},
+		},
+		{
+			name: "no secret",
+			creds: func(*testing.T) Credentials {
+				return Credentials{ClientID: "secret"}
+			},
+		},
+		{
+			name: "unknown client",
+			creds: func(*testing.T) Credentials {
+				return Credentials{ClientID: "unknown", ClientSecret: "s3cret"}
+			},
+		},
+		{
+			name: "public client",
+			creds: func(*testing.T) Credentials {
+				return Credentials{ClientID: "public"}
+			},
+			wantID: "public",
+		},
+		{
+			name: "public client with a secret",
+			creds: func(*testing.T) Credentials {
+				return Credentials{ClientID: "public", ClientSecret: "s3cret"}
+			},
+		},
+		{
+			name: "assertion",
+			creds: func(t *testing.T) Credentials {
+				return Credentials{AssertionType: AssertionType, Assertion: assertion(t, privateKey, claims("a", time.Minute))}
+			},
+			wantID: "keyed",
+		},
+		{
+			name: "assertion signed by another key",
+			creds: func(t *testing.T) Credentials {
+				return Credentials{AssertionType: AssertionType, Assertion: assertion(t, otherKey, claims("a", time.Minute))}
+			},
+		},
+		{
+			name: "assertion for another audience",
+			creds: func(t *testing.T) Credentials {
+				return Credentials{AssertionType: AssertionType, Assertion: assertion(t, privateKey, withAudience(claims("a", time.Minute), "https://other.example.com"))}
+			},
+		},
+		{
+			name: "assertion without jti",
+			creds: func(t *testing.T) Credentials {
+				return Credentials{AssertionType: AssertionType, Assertion: assertion(t, privateKey, claims("", time.Minute))}
+			},
+		},
+		{
+			name: "assertion expiring too late",
+			creds: func(t *testing.T) Credentials {
+				return Credentials{AssertionType: AssertionType, Assertion: assertion(t, privateKey, claims("a", time.Hour))}
+			},
+		},
+		{
+			name: "expired assertion",
+			creds: func(t *testing.T) Credentials {
+				return Credentials{AssertionType: AssertionType, Assertion: assertion(t, privateKey, claims("a", -time.Hour))}
+			},
+		},
+		{
+			name: "assertion of another type",
+			creds: func(t *testing.T) Credentials {
+				return Credentials{AssertionType: "saml", Assertion: assertion(t, privateKey, claims("a", time.Minute))}
+			},
+		},
+		{
+			name: "secret of a keyed client",
+			creds: func(*testing.T) Credentials {
+				return Credentials{ClientID: "keyed", ClientSecret: "s3cret"}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClients(publicPEM)
+
+			client, err := c.Authenticate(context.Background(), tt.creds(t))
+			if tt.wantID == "" {
+				if !errors.Is(err, ErrInvalidClient) {
+					t.Errorf("Authenticate error = %v, want %v", err, ErrInvalidClient)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Authenticate: %v", err)
+			}
+			if client.ID != tt.wantID {
+				t.Errorf("client = %q, want %q", client.ID, tt.wantID)
+			}
+		})
+	}
+
+	t.Run("replayed assertion", func(t *testing.T) {
+		c := newTestClients(publicPEM)
+		creds := Credentials{AssertionType: AssertionType, Assertion: assertion(t, privateKey, claims("once", time.Minute))}
+
+		if _, err := c.Authenticate(context.Background(), creds); err != nil {
+			t.Fatalf("Authenticate: %v", err)
+		}
+		if _, err := c.Authenticate(context.Background(), creds); !errors.Is(err, ErrInvalidClient) {
+			t.Errorf("replayed Authenticate error = %v, want %v", err, ErrInvalidClient)
+		}
+	})
+}
+
+func newTestClients(publicPEM string) *Clients {
+	store := &memoryClients{
+		clients: map[string]models.Client{
+			"secret": {
+				ID:         "secret",
+				SecretHash: hash("s3cret"),
+				Scopes:     []string{"relations:read", "relations:write"},
+				GrantTypes: []string{models.GrantClientCredentials},
+			},
+			"keyed": {ID: "keyed", PublicKey: publicPEM, GrantTypes: []string{models.GrantClientCredentials}},
+			"app": {
+				ID:           "app",
+				SecretHash:   hash("s3cret"),
+				Scopes:       []string{"relations:read"},
+				RedirectURIs: []string{"https://app.example.com/callback"},
+				GrantTypes:   []string{models.GrantAuthorizationCode},
+			},
+			"public": {
+				ID:           "public",
+				RedirectURIs: []string{"https://app.example.com/callback"},
+				GrantTypes:   []string{models.GrantAuthorizationCode},
+			},
+		},
+		assertions: map[string]bool{},
+	}
+	return New(&logger.Logger{SugaredLogger: zap.NewNop().Sugar()}, store, "secret", time.Hour, testAudience)
+}
+
+func TestClientCredentials(t *testing.T) {
+	tests := []struct {
+		name       string
+		creds      Credentials
+		scopes     []string
+		wantScopes []string
+		wantErr    error
+	}{
+		{
+			name:       "all of the allowed scopes",
+			creds:      Credentials{ClientID: "secret", ClientSecret: "s3cret"},
+			wantScopes: []string{"relations:read", "relations:write"},
+		},
+		{
+			name:       "fewer scopes",
+			creds:      Credentials{ClientID: "secret", ClientSecret: "s3cret"},
+			scopes:     []string{"relations:read"},
+			wantScopes: []string{"relations:read"},
+		},
+		{
+			name:    "scope that is not allowed",
+			creds:   Credentials{ClientID: "secret", ClientSecret: "s3cret"},
+			scopes:  []string{"roles:manage"},
+			wantErr: ErrInvalidScope,
+		},
+		{
+			name:    "application of the code flow",
+			creds:   Credentials{ClientID: "app", ClientSecret: "s3cret"},
+			wantErr: ErrUnauthorizedClient,
+		},
+		{
+			name:    "public client",
+			creds:   Credentials{ClientID: "public"},
+			wantErr: ErrUnauthorizedClient,
+		},
+		{
+			name:    "wrong secret",
+			creds:   Credentials{ClientID: "secret", ClientSecret: "wrong"},
+			wantErr: ErrInvalidClient,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClients("")
+
+			token, err := c.ClientCredentials(context.Background(), tt.creds, tt.scopes)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ClientCredentials error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			claims, err := jwt.DecodeClientToken("secret", token.AccessToken)
+			if err != nil {
+				t.Fatalf("DecodeClientToken: %v", err)
+			}
+			if claims.ClientID != tt.creds.ClientID || claims.Email != "" {
+				t.Errorf("claims of %q for %q, want the client %q alone", claims.ClientID, claims.Email, tt.creds.ClientID)
+			}
+			if !slices.Equal(claims.Permissions, tt.wantScopes) || !slices.Equal(token.Scopes, tt.wantScopes) {
+				t.Errorf("permissions = %v, scopes = %v, want %v", claims.Permissions, token.Scopes, tt.wantScopes)
+			}
+		})
+	}
+}
+
+func TestCreateClientGrantTypes(t *testing.T) {
+	c := newTestClients("")
+	granted := []string{"relations:read"}
+
+	service, _, err := c.CreateClient(context.Background(), "service", granted, 0, "", nil, false, granted)
+	if err != nil {
+		t.Fatalf("CreateClient: %v", err)
+	}
+	if !service.Allows(models.GrantClientCredentials) || service.Allows(models.GrantAuthorizationCode) {
+		t.Errorf("service account grants = %v, want [%s]", service.GrantTypes, models.GrantClientCredentials)
+	}
+
+	app, _, err := c.CreateClient(context.Background(), "app", granted, 0, "", []string{"https://app.example.com/callback"}, false, granted)
+	if err != nil {
+		t.Fatalf("CreateClient: %v", err)
+	}
+	if !app.Allows(models.GrantAuthorizationCode) || app.Allows(models.GrantClientCredentials) {
+		t.Errorf("application grants = %v, want [%s]", app.GrantTypes, models.GrantAuthorizationCode)
+	}
+}
+
+func TestValidRedirectURI(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want bool
+	}{
+		{"https://app.example.com/callback", true},
+		{"https://app.example.com/callback?state=1", true},
+		{"http://localhost:8080/callback", true},
+		{"http://127.0.0.1/callback", true},
+		{"http://[::1]:8080/callback", true},
+		{"com.example.app:/callback", true},
+		{"http://app.example.com/callback", false},
+		{"http://localhost.example.com/callback", false},
+		{"https://app.example.com/callback#fragment", false},
+		{"/callback", false},
+		{"app.example.com/callback", false},
+		{"javascript:alert(1)", false},
+		{"data:text/html,hi", false},
+		{"", false},
+		{"https://app.example.com/%zz", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			if got := validRedirectURI(tt.uri); got != tt.want {
+				t.Errorf("validRedirectURI(%q) = %v, want %v", tt.uri, got, tt.want)
+			}
+		})
+	}
+}
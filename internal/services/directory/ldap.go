@@ -0,0 +1,313 @@
+// Package directory checks logins against an LDAP directory, it is a credential backend of auth
+package directory
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/services/auth"
+
+	"github.com/go-ldap/ldap/v3"
+	"go.uber.org/zap"
+)
+
+var ErrAmbiguousUser = errors.New("more than one directory entry matches the user")
+
+// Config of the directory. Domains are the email domains the directory owns: their users sign in
+// through it only, other emails never reach it. The user is either found by UserFilter under BaseDN,
+// searching as BindDN, or bound to directly by UserDNTemplates. The placeholders {email} and
+// {username}, the part of the email before @, are replaced in filters and templates
+type Config struct {
+	Domains []string
+	// URL is ldap:// or ldaps://, StartTLS upgrades an ldap:// connection
+	URL      string
+	StartTLS bool
+	// BindDN and BindPassword are the service account that searches, anonymous when empty
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	UserFilter   string
+	// UserDNTemplates are tried in order when there is no UserFilter. A template bind cannot tell
+	// an unknown user from a wrong password, a failed one is answered as a wrong password
+	UserDNTemplates []string
+	// GroupFilter finds the groups of the user under GroupBaseDN, {dn} is replaced by the DN
+	// of the user. Without it the memberOf attribute of the user is read
+	GroupBaseDN string
+	GroupFilter string
+	// GroupRoles maps a group, by its DN or its common name, to the role it grants
+	GroupRoles map[string]string
+	Timeout    time.Duration
+}
+
+type LDAP struct {
+	log        *logger.Logger
+	cfg        Config
+	domains    map[string]bool
+	groupRoles map[string]string
+	managed    []string
+}
+
+func New(log *logger.Logger, cfg Config) *LDAP {
+	groupRoles := make(map[string]string, len(cfg.GroupRoles))
+	var managed []string
+	seen := make(map[string]bool)
+	for group, role := range cfg.GroupRoles {
+		groupRoles[strings.ToLower(group)] = role
+		if !seen[role] {
+			seen[role] = true
+			managed = append(managed, role)
+		}
+	}
+	domains := make(map[string]bool, len(cfg.Domains))
+	for _, domain := range cfg.Domains {
+		domains[strings.ToLower(domain)] = true
+	}
+	return &LDAP{
+		log:        log,
+		cfg:        cfg,
+		domains:    domains,
+		groupRoles: groupRoles,
+		managed:    managed,
+	}
+}
+
+// Owns reports whether the domain of the email is one of the directory
+func (l *LDAP) Owns(email string) bool {
+	_, domain, ok := strings.Cut(email, "@")
+	return ok && l.domains[strings.ToLower(domain)]
+}
+
+// Authenticate binds as the user with the password and maps the groups of the user to roles
+func (l *LDAP) Authenticate(
+	ctx context.Context,
+	email string,
+	password string,
+) (auth.Principal, error) {
+	const op = "directory.LDAP.Authenticate"
+	log := l.log.With(zap.String("op", op))
+
+	// an empty password makes an unauthenticated bind, which servers accept for any DN
+	if password == "" {
+		return auth.Principal{}, auth.ErrWrongPassword
+	}
+	conn, err := l.dial(ctx)
+	if err != nil {
+		log.Error("failed to connect to directory", zap.Error(err))
+		return auth.Principal{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer conn.Close()
+
+	var (
+		dn       string
+		memberOf []string
+	)
+	if l.cfg.UserFilter != "" {
+		dn, memberOf, err = l.searchBind(conn, email, password)
+	} else {
+		dn, memberOf, err = l.templateBind(conn, email, password)
+	}
+	if err != nil {
+		if errors.Is(err, auth.ErrUnknownUser) || errors.Is(err, auth.ErrWrongPassword) {
+			return auth.Principal{}, err
+		}
+		log.Error("failed to bind", zap.Error(err))
+		return auth.Principal{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	groups := memberOf
+	if l.cfg.GroupFilter != "" {
+		if groups, err = l.groups(conn, dn); err != nil {
+			log.Error("failed to search groups", zap.Error(err))
+			return auth.Principal{}, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	return auth.Principal{
+		External: true,
+		Roles:    l.roles(groups),
+		Managed:  l.managed,
+	}, nil
+}
+
+func (l *LDAP) dial(ctx context.Context) (*ldap.Conn, error) {
+	timeout := l.cfg.Timeout
+	if deadline, ok := ctx.Deadline(); ok && (timeout <= 0 || time.Until(deadline) < timeout) {
+		timeout = time.Until(deadline)
+	}
+	conn, err := ldap.DialURL(l.cfg.URL, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetTimeout(timeout)
+	}
+	if l.cfg.StartTLS {
+		u, err := url.Parse(l.cfg.URL)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// searchBind finds the user as the service account, then binds as the user
+func (l *LDAP) searchBind(conn *ldap.Conn, email string, password string) (string, []string, error) {
+	if err := l.bindService(conn); err != nil {
+		return "", nil, err
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		l.cfg.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2,
+		0,
+		false,
+		replace(l.cfg.UserFilter, ldap.EscapeFilter, email),
+		[]string{"memberOf"},
+		nil,
+	))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return "", nil, ErrAmbiguousUser
+		}
+		return "", nil, err
+	}
+	switch len(result.Entries) {
+	case 0:
+		return "", nil, auth.ErrUnknownUser
+	case 1:
+	default:
+		return "", nil, ErrAmbiguousUser
+	}
+	entry := result.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return "", nil, auth.ErrWrongPassword
+		}
+		return "", nil, err
+	}
+
+	return entry.DN, entry.GetAttributeValues("memberOf"), nil
+}
+
+// templateBind binds as the DNs of the templates until one accepts the password, the email is
+// one of the directory so none accepting it is a wrong password
+func (l *LDAP) templateBind(conn *ldap.Conn, email string, password string) (string, []string, error) {
+	for _, template := range l.cfg.UserDNTemplates {
+		dn := replace(template, ldap.EscapeDN, email)
+		if err := conn.Bind(dn, password); err != nil {
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+				continue
+			}
+			return "", nil, err
+		}
+		if l.cfg.GroupFilter != "" {
+			return dn, nil, nil
+		}
+		result, err := conn.Search(ldap.NewSearchRequest(
+			dn,
+			ldap.ScopeBaseObject,
+			ldap.NeverDerefAliases,
+			1,
+			0,
+			false,
+			"(objectClass=*)",
+			[]string{"memberOf"},
+			nil,
+		))
+		if err != nil {
+			return "", nil, err
+		}
+		if len(result.Entries) == 0 {
+			return dn, nil, nil
+		}
+		return dn, result.Entries[0].GetAttributeValues("memberOf"), nil
+	}
+
+	return "", nil, auth.ErrWrongPassword
+}
+
+// groups returns the DNs of the groups of the user, searching as the service account if there is one
+func (l *LDAP) groups(conn *ldap.Conn, dn string) ([]string, error) {
+	if l.cfg.BindDN != "" {
+		if err := l.bindService(conn); err != nil {
+			return nil, err
+		}
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		l.cfg.GroupBaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		strings.ReplaceAll(l.cfg.GroupFilter, "{dn}", ldap.EscapeFilter(dn)),
+		// 1.1 asks for no attributes, the DN is all that is needed
+		[]string{"1.1"},
+		nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		groups = append(groups, entry.DN)
+	}
+	return groups, nil
+}
+
+func (l *LDAP) bindService(conn *ldap.Conn) error {
+	if l.cfg.BindDN == "" {
+		return conn.UnauthenticatedBind("")
+	}
+	return conn.Bind(l.cfg.BindDN, l.cfg.BindPassword)
+}
+
+// roles maps the groups to roles by the DN of a group or its common name
+func (l *LDAP) roles(groups []string) []string {
+	var roles []string
+	for _, group := range groups {
+		role, ok := l.groupRoles[strings.ToLower(group)]
+		if cn := commonName(group); !ok && cn != "" {
+			role, ok = l.groupRoles[strings.ToLower(cn)]
+		}
+		if ok && !slices.Contains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+func commonName(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return ""
+	}
+	for _, attr := range parsed.RDNs[0].Attributes {
+		if strings.EqualFold(attr.Type, "cn") {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// replace fills the placeholders of a filter or a DN template, escaped for where they go
+func replace(template string, escape func(string) string, email string) string {
+	username, _, _ := strings.Cut(email, "@")
+	return strings.NewReplacer(
+		"{email}", escape(email),
+		"{username}", escape(username),
+	).Replace(template)
+}
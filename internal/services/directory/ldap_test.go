@@ -0,0 +1,150 @@
+package directory
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/services/auth"
+
+	"github.com/go-ldap/ldap/v3"
+	"go.uber.org/zap"
+)
+
+func newTestLDAP(cfg Config) *LDAP {
+	return New(&logger.Logger{SugaredLogger: zap.NewNop().Sugar()}, cfg)
+}
+
+func TestOwns(t *testing.T) {
+	l := newTestLDAP(Config{Domains: []string{"corp.example.com", "Staff.Example.com"}})
+
+	tests := []struct {
+		email string
+		want  bool
+	}{
+		{"alice@corp.example.com", true},
+		{"alice@CORP.example.com", true},
+		{"bob@staff.example.com", true},
+		{"carol@example.com", false},
+		{"carol@sub.corp.example.com", false},
+		{"carol@corp.example.com.evil.com", false},
+		{"corp.example.com", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.email, func(t *testing.T) {
+			if got := l.Owns(tt.email); got != tt.want {
+				t.Errorf("Owns(%q) = %v, want %v", tt.email, got, tt.want)
+			}
+		})
+	}
+
+	if newTestLDAP(Config{}).Owns("alice@corp.example.com") {
+		t.Errorf("a directory without domains owns an email")
+	}
+}
+
+func TestAuthenticateFailures(t *testing.T) {
+	// a port nothing listens on: the directory is down
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	l := newTestLDAP(Config{
+		Domains:         []string{"corp.example.com"},
+		URL:             "ldap://" + addr,
+		UserDNTemplates: []string{"uid={username},ou=people,dc=corp"},
+		Timeout:         time.Second,
+	})
+
+	t.Run("empty password", func(t *testing.T) {
+		if _, err := l.Authenticate(context.Background(), "alice@corp.example.com", ""); !errors.Is(err, auth.ErrWrongPassword) {
+			t.Errorf("Authenticate error = %v, want %v", err, auth.ErrWrongPassword)
+		}
+	})
+	t.Run("directory down", func(t *testing.T) {
+		_, err := l.Authenticate(context.Background(), "alice@corp.example.com", "password")
+		if err == nil || errors.Is(err, auth.ErrUnknownUser) || errors.Is(err, auth.ErrWrongPassword) {
+			t.Errorf("Authenticate error = %v, want the dial error", err)
+		}
+	})
+}
+
+func TestRoles(t *testing.T) {
+	l := newTestLDAP(Config{GroupRoles: map[string]string{
+		"cn=Admins,ou=groups,dc=corp": "admin",
+		"support":                     "support",
+		"helpdesk":                    "support",
+	}})
+
+	tests := []struct {
+		name   string
+		groups []string
+		want   []string
+	}{
+		{"by dn", []string{"CN=admins,OU=groups,DC=corp"}, []string{"admin"}},
+		{"by common name", []string{"cn=Support,ou=teams,dc=corp"}, []string{"support"}},
+		{"two groups of one role", []string{"cn=support,dc=corp", "cn=helpdesk,dc=corp"}, []string{"support"}},
+		{"unmapped group", []string{"cn=sales,dc=corp"}, nil},
+		{"common name of another rdn", []string{"ou=support,dc=corp"}, nil},
+		{"not a dn", []string{"sales"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := l.roles(tt.groups); !slices.Equal(got, tt.want) {
+				t.Errorf("roles(%v) = %v, want %v", tt.groups, got, tt.want)
+			}
+		})
+	}
+
+	managed := slices.Clone(l.managed)
+	slices.Sort(managed)
+	if !slices.Equal(managed, []string{"admin", "support"}) {
+		t.Errorf("managed = %v, want [admin support]", managed)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		escape   func(string) string
+		email    string
+		want     string
+	}{
+		{
+			name:     "filter",
+			template: "(|(mail={email})(uid={username}))",
+			escape:   ldap.EscapeFilter,
+			email:    "alice@corp.example.com",
+			want:     "(|(mail=alice@corp.example.com)(uid=alice))",
+		},
+		{
+			name:     "filter injection",
+			template: "(mail={email})",
+			escape:   ldap.EscapeFilter,
+			email:    "*)(uid=*@corp.example.com",
+			want:     `(mail=\2a\29\28uid=\2a@corp.example.com)`,
+		},
+		{
+			name:     "dn injection",
+			template: "uid={username},ou=people,dc=corp",
+			escape:   ldap.EscapeDN,
+			email:    "alice,ou=admins@corp.example.com",
+			want:     `uid=alice\,ou=admins,ou=people,dc=corp`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replace(tt.template, tt.escape, tt.email); got != tt.want {
+				t.Errorf("replace = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package entitlements
+
+import (
+	"context"
+	"sync"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/tenant"
+
+	"go.uber.org/zap"
+)
+
+// Provider returns the entitlements of the account, typically from the billing service
+type Provider interface {
+	Entitlements(
+		ctx context.Context,
+		email string,
+	) (models.Entitlements, error)
+}
+
+// Cached keeps the entitlements of the provider for ttl, so logins and refreshes do not reach
+// the billing service every time. When the provider fails the last known entitlements are served,
+// the cache lives in memory of the replica
+type Cached struct {
+	log      *logger.Logger
+	provider Provider
+	ttl      time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]entry
+	lastSweep time.Time
+}
+
+type entry struct {
+	entitlements models.Entitlements
+	expiresAt    time.Time
+}
+
+// staleFor is how long an expired entry is still served while the provider fails
+const staleFor = time.Hour
+
+func NewCached(log *logger.Logger, provider Provider, ttl time.Duration) *Cached {
+	return &Cached{
+		log:       log,
+		provider:  provider,
+		ttl:       ttl,
+		entries:   make(map[string]entry),
+		lastSweep: time.Now(),
+	}
+}
+
+func (c *Cached) Entitlements(ctx context.Context, email string) (models.Entitlements, error) {
+	const op = "entitlements.Cached"
+
+	key := tenant.ID(ctx) + "/" + email
+	now := time.Now()
+
+	c.mu.Lock()
+	cached, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached.entitlements, nil
+	}
+
+	e, err := c.provider.Entitlements(ctx, email)
+	if err != nil {
+		if ok && now.Before(cached.expiresAt.Add(staleFor)) {
+			c.log.Warn("entitlement provider failed, serving cached", zap.String("op", op), zap.Error(err))
+			return cached.entitlements, nil
+		}
+		return models.Entitlements{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweep(now)
+	c.entries[key] = entry{entitlements: e, expiresAt: now.Add(c.ttl)}
+
+	return e, nil
+}
+
+// Invalidate drops the cached entitlements of the account, the next token asks the provider
+func (c *Cached) Invalidate(ctx context.Context, email string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, tenant.ID(ctx)+"/"+email)
+}
+
+// sweep drops the entries too old to be served even as stale, at most once per ttl
+func (c *Cached) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+	c.lastSweep = now
+	for key, e := range c.entries {
+		if now.After(e.expiresAt.Add(staleFor)) {
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package entitlements
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/tenant"
+
+	"go.uber.org/zap"
+)
+
+var errBilling = errors.New("billing unavailable")
+
+// countingProvider answers the premium plan, or err, and counts the calls
+type countingProvider struct {
+	calls int
+	err   error
+}
+
+func (p *countingProvider) Entitlements(context.Context, string) (models.Entitlements, error) {
+	p.calls++
+	if p.err != nil {
+		return models.Entitlements{}, p.err
+	}
+	return models.Entitlements{Plan: "premium", MaxStreams: 4}, nil
+}
+
+func newCached(provider Provider) *Cached {
+	return NewCached(&logger.Logger{SugaredLogger: zap.NewNop().Sugar()}, provider, time.Minute)
+}
+
+// expire makes the cached entitlements of the account expired for age
+func expire(c *Cached, ctx context.Context, email string, age time.Duration) {
+	key := tenant.ID(ctx) + "/" + email
+	e := c.entries[key]
+	e.expiresAt = time.Now().Add(-age)
+	c.entries[key] = e
+}
+
+func TestCachedServesWithinTTL(t *testing.T) {
+	provider := &countingProvider{}
+	c := newCached(provider)
+	ctx := context.Background()
+
+	for range 3 {
+		e, err := c.Entitlements(ctx, "alice@example.com")
+		if err != nil || e.Plan != "premium" {
+			t.Fatalf("Entitlements = %+v, %v, want the premium plan", e, err)
+		}
+	}
+	if provider.calls != 1 {
+		t.Errorf("provider called %d times, want once", provider.calls)
+	}
+
+	// the same email in another tenant is another account
+	other := tenant.NewContext(ctx, tenant.Tenant{ID: "other"})
+	if _, err := c.Entitlements(other, "alice@example.com"); err != nil {
+		t.Fatalf("Entitlements: %v", err)
+	}
+	if provider.calls != 2 {
+		t.Errorf("provider called %d times, want once per tenant", provider.calls)
+	}
+
+	c.Invalidate(ctx, "alice@example.com")
+	if _, err := c.Entitlements(ctx, "alice@example.com"); err != nil {
+		t.Fatalf("Entitlements: %v", err)
+	}
+	if provider.calls != 3 {
+		t.Errorf("provider called %d times, want again after Invalidate", provider.calls)
+	}
+}
+
+func TestCachedRefreshesExpired(t *testing.T) {
+	provider := &countingProvider{}
+	c := newCached(provider)
+	ctx := context.Background()
+
+	if _, err := c.Entitlements(ctx, "alice@example.com"); err != nil {
+		t.Fatalf("Entitlements: %v", err)
+	}
+	expire(c, ctx, "alice@example.com", time.Second)
+	if _, err := c.Entitlements(ctx, "alice@example.com"); err != nil {
+		t.Fatalf("Entitlements: %v", err)
+	}
+	if provider.calls != 2 {
+		t.Errorf("provider called %d times, want again once expired", provider.calls)
+	}
+}
+
+func TestCachedServesStaleWhileTheProviderFails(t *testing.T) {
+	tests := []struct {
+		name    string
+		age     time.Duration
+		wantErr error
+	}{
+		{name: "recently expired", age: time.Minute},
+		{name: "too old", age: staleFor + time.Minute, wantErr: errBilling},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &countingProvider{}
+			c := newCached(provider)
+			ctx := context.Background()
+			if _, err := c.Entitlements(ctx, "alice@example.com"); err != nil {
+				t.Fatalf("Entitlements: %v", err)
+			}
+			expire(c, ctx, "alice@example.com", tt.age)
+			provider.err = errBilling
+
+			e, err := c.Entitlements(ctx, "alice@example.com")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Entitlements error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && e.Plan != "premium" {
+				t.Errorf("plan = %q, want the cached premium", e.Plan)
+			}
+		})
+	}
+}
+
+func TestCachedWithoutEntryFails(t *testing.T) {
+	c := newCached(&countingProvider{err: errBilling})
+
+	if _, err := c.Entitlements(context.Background(), "alice@example.com"); !errors.Is(err, errBilling) {
+		t.Errorf("Entitlements error = %v, want %v", err, errBilling)
+	}
+}
+
+func TestLoadStatic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "entitlements.json")
+	src := `{
+		"default": {"plan": "free", "max_streams": 1},
+		"accounts": {"Alice@Example.com": {"plan": "premium", "features": ["4k"], "max_streams": 4}}
+	}`
+	if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	s, err := LoadStatic(path)
+	if err != nil {
+		t.Fatalf("LoadStatic: %v", err)
+	}
+	e, _ := s.Entitlements(context.Background(), "alice@example.com")
+	if e.Plan != "premium" || !slices.Equal(e.Features, []string{"4k"}) || e.MaxStreams != 4 {
+		t.Errorf("entitlements of alice = %+v, want premium", e)
+	}
+	if e, _ := s.Entitlements(context.Background(), "bob@example.com"); e.Plan != "free" || e.MaxStreams != 1 {
+		t.Errorf("entitlements of bob = %+v, want the default", e)
+	}
+
+	if _, err := LoadStatic(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("LoadStatic of a missing file succeeded")
+	}
+}
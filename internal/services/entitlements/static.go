@@ -0,0 +1,64 @@
+package entitlements
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"vieo/auth/internal/domain/models"
+)
+
+// Static serves entitlements from a file instead of the billing service, for local development and tests
+type Static struct {
+	fallback models.Entitlements
+	accounts map[string]models.Entitlements
+}
+
+// staticFile is the format of the file:
+//
+//	{
+//	  "default": {"plan": "free", "max_streams": 1},
+//	  "accounts": {
+//	    "alice@example.com": {"plan": "premium", "features": ["4k", "downloads"], "max_streams": 4}
+//	  }
+//	}
+type staticFile struct {
+	Default  models.Entitlements            `json:"default"`
+	Accounts map[string]models.Entitlements `json:"accounts"`
+}
+
+// NewStatic serves the entitlements of the accounts, any other account gets fallback
+func NewStatic(fallback models.Entitlements, accounts map[string]models.Entitlements) *Static {
+	normalized := make(map[string]models.Entitlements, len(accounts))
+	for email, e := range accounts {
+		normalized[strings.ToLower(email)] = e
+	}
+	return &Static{
+		fallback: fallback,
+		accounts: normalized,
+	}
+}
+
+// LoadStatic reads the entitlements from a JSON file
+func LoadStatic(path string) (*Static, error) {
+	const op = "entitlements.LoadStatic"
+
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	var file staticFile
+	if err := json.Unmarshal(src, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return NewStatic(file.Default, file.Accounts), nil
+}
+
+func (s *Static) Entitlements(_ context.Context, email string) (models.Entitlements, error) {
+	if e, ok := s.accounts[strings.ToLower(email)]; ok {
+		return e, nil
+	}
+	return s.fallback, nil
+}
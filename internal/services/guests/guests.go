@@ -0,0 +1,193 @@
+package guests
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/jwt"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+const (
+	queryTime = 3 * time.Second
+	// maxMetadata bounds what a guest may attach over all of its logins, the keys and the values
+	maxMetadata      = 32
+	maxMetadataValue = 1024
+)
+
+var ErrInvalidMetadata = errors.New("too much guest metadata")
+
+// Policy of the guest tokens: they grant Scopes only, live for TokenTTL and a guest
+// not seen for RetainFor is forgotten
+type Policy struct {
+	Scopes    []string
+	TokenTTL  time.Duration
+	RetainFor time.Duration
+}
+
+// Guests lets visitors browse before signing up and carries what they did into the account
+type Guests struct {
+	log       *logger.Logger
+	guests    GuestStore
+	devices   DeviceNotifier
+	secretKey string
+	policy    Policy
+}
+
+type GuestStore interface {
+	SaveGuest(
+		ctx context.Context,
+		guest models.Guest,
+		retain time.Duration,
+		maxKeys int,
+	) (models.Guest, error)
+	MergeGuest(
+		ctx context.Context,
+		email string,
+		guestID string,
+	) (guest models.Guest, created bool, err error)
+}
+
+// DeviceNotifier records the device of the guest added to the account and alerts the owner
+type DeviceNotifier interface {
+	DeviceAdded(
+		ctx context.Context,
+		email string,
+		deviceAddress string,
+	)
+}
+
+func New(
+	log *logger.Logger,
+	guests GuestStore,
+	devices DeviceNotifier,
+	secretKey string,
+	policy Policy,
+) *Guests {
+	return &Guests{
+		log:       log,
+		guests:    guests,
+		devices:   devices,
+		secretKey: secretKey,
+		policy:    policy,
+	}
+}
+
+// Login issues a guest token for the device. With the guestID of a token of the same device the guest
+// is kept and the metadata added to it, otherwise a new guest is created
+func (g *Guests) Login(
+	ctx context.Context,
+	guestID string,
+	deviceAddress string,
+	metadata map[string]string,
+) (string, models.Guest, error) {
+	const op = "Guests.Login"
+	log := g.log.With(zap.String("op", op), zap.String("device", deviceAddress))
+
+	if !validMetadata(metadata) {
+		return "", models.Guest{}, fmt.Errorf("%s: %w", op, ErrInvalidMetadata)
+	}
+	if guestID == "" {
+		id, err := randomID()
+		if err != nil {
+			log.Error("failed to generate guest id", zap.Error(err))
+			return "", models.Guest{}, fmt.Errorf("%s: %w", op, err)
+		}
+		guestID = id
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	guest, err := g.guests.SaveGuest(ctx, models.Guest{
+		ID:            guestID,
+		DeviceAddress: deviceAddress,
+		Metadata:      metadata,
+	}, g.policy.RetainFor, maxMetadata)
+	if err != nil {
+		if errors.Is(err, storage.ErrGuestNotFound) {
+			log.Warn("guest token of another device")
+			return "", models.Guest{}, fmt.Errorf("%s: %w", op, err)
+		}
+		// every login may add keys, the bound is on what the guest holds in total
+		if errors.Is(err, storage.ErrGuestMetadataFull) {
+			log.Warn("guest metadata full")
+			return "", models.Guest{}, fmt.Errorf("%s: %w", op, ErrInvalidMetadata)
+		}
+		log.Error("failed to save guest", zap.Error(err))
+		return "", models.Guest{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	token, err := jwt.NewToken(jwt.Claims{
+		DeviceAddress: deviceAddress,
+		Tenant:        tenant.ID(ctx),
+		Scopes:        g.policy.Scopes,
+		GuestID:       guest.ID,
+	}, g.policy.TokenTTL, tenant.SecretKey(ctx, g.secretKey))
+	if err != nil {
+		log.Error("failed to generate token", zap.Error(err))
+		return "", models.Guest{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return token, guest, nil
+}
+
+// Merge moves the guest into the account after it registered or logged in: the metadata
+// is merged and the device of the guest becomes a device of the account
+func (g *Guests) Merge(
+	ctx context.Context,
+	email string,
+	guestID string,
+) error {
+	const op = "Guests.Merge"
+	log := g.log.With(zap.String("op", op))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	guest, created, err := g.guests.MergeGuest(ctx, email, guestID)
+	if err != nil {
+		if errors.Is(err, storage.ErrGuestNotFound) {
+			log.Warn("guest already merged or forgotten")
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		if errors.Is(err, storage.ErrDeviceLimitExceeded) || errors.Is(err, storage.ErrHouseholdDeviceLimitExceeded) {
+			log.Warn("guest device over the limit", zap.Error(err))
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("failed to merge guest", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if created {
+		g.devices.DeviceAdded(ctx, email, guest.DeviceAddress)
+	}
+	log.Info("guest merged into account", zap.String("device", guest.DeviceAddress))
+
+	return nil
+}
+
+func validMetadata(metadata map[string]string) bool {
+	if len(metadata) > maxMetadata {
+		return false
+	}
+	for k, v := range metadata {
+		if k == "" || len(k) > maxMetadataValue || len(v) > maxMetadataValue {
+			return false
+		}
+	}
+	return true
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
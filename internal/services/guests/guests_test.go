@@ -0,0 +1,204 @@
+package guests
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/jwt"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+const testSecret = "secret"
+
+// memoryGuests keeps the guests by id, a guest belongs to its device and holds maxKeys keys at most
+// like in the database
+type memoryGuests struct {
+	guests map[string]models.Guest
+	// devices are the devices already known to the account of the merge
+	devices  []string
+	mergeErr error
+}
+
+func (m *memoryGuests) SaveGuest(_ context.Context, guest models.Guest, _ time.Duration, maxKeys int) (models.Guest, error) {
+	saved, ok := m.guests[guest.ID]
+	if !ok {
+		saved = models.Guest{ID: guest.ID, DeviceAddress: guest.DeviceAddress, Metadata: map[string]string{}}
+	}
+	if saved.DeviceAddress != guest.DeviceAddress {
+		return models.Guest{}, storage.ErrGuestNotFound
+	}
+	merged := maps.Clone(saved.Metadata)
+	maps.Copy(merged, guest.Metadata)
+	if len(merged) > maxKeys {
+		return models.Guest{}, storage.ErrGuestMetadataFull
+	}
+	saved.Metadata = merged
+	m.guests[guest.ID] = saved
+	return saved, nil
+}
+
+func (m *memoryGuests) MergeGuest(_ context.Context, _ string, guestID string) (models.Guest, bool, error) {
+	if m.mergeErr != nil {
+		return models.Guest{}, false, m.mergeErr
+	}
+	guest, ok := m.guests[guestID]
+	if !ok {
+		return models.Guest{}, false, storage.ErrGuestNotFound
+	}
+	delete(m.guests, guestID)
+	created := !slices.Contains(m.devices, guest.DeviceAddress)
+	m.devices = append(m.devices, guest.DeviceAddress)
+	return guest, created, nil
+}
+
+type deviceAlerts struct {
+	added []string
+}
+
+func (d *deviceAlerts) DeviceAdded(_ context.Context, _ string, deviceAddress string) {
+	d.added = append(d.added, deviceAddress)
+}
+
+var policy = Policy{Scopes: []string{"catalog:read"}, TokenTTL: time.Hour, RetainFor: 24 * time.Hour}
+
+func newGuests() (*Guests, *memoryGuests, *deviceAlerts) {
+	store := &memoryGuests{guests: map[string]models.Guest{}}
+	alerts := &deviceAlerts{}
+	g := New(&logger.Logger{SugaredLogger: zap.NewNop().Sugar()}, store, alerts, testSecret, policy)
+	return g, store, alerts
+}
+
+func TestLogin(t *testing.T) {
+	g, _, _ := newGuests()
+
+	token, guest, err := g.Login(context.Background(), "", "tv", map[string]string{"lang": "en"})
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if guest.ID == "" || guest.Metadata["lang"] != "en" {
+		t.Errorf("guest = %+v, want a new guest with its metadata", guest)
+	}
+	claims, err := jwt.DecodeToken(testSecret, token)
+	if err != nil {
+		t.Fatalf("DecodeToken: %v", err)
+	}
+	// the token is the guest's only, no account and nothing beyond the guest scopes
+	if claims.GuestID != guest.ID || claims.Email != "" || claims.DeviceAddress != "tv" || !slices.Equal(claims.Scopes, policy.Scopes) {
+		t.Errorf("claims = %+v, want the guest of the tv with the guest scopes", claims)
+	}
+
+	_, again, err := g.Login(context.Background(), guest.ID, "tv", map[string]string{"watchlist": "42"})
+	if err != nil {
+		t.Fatalf("Login of the same guest: %v", err)
+	}
+	if again.ID != guest.ID || again.Metadata["lang"] != "en" || again.Metadata["watchlist"] != "42" {
+		t.Errorf("guest = %+v, want the same guest with both logins' metadata", again)
+	}
+
+	if _, _, err := g.Login(context.Background(), guest.ID, "phone", nil); !errors.Is(err, storage.ErrGuestNotFound) {
+		t.Errorf("Login with the guest of another device error = %v, want %v", err, storage.ErrGuestNotFound)
+	}
+}
+
+func TestLoginMetadataBounds(t *testing.T) {
+	full := make(map[string]string, maxMetadata)
+	for i := range maxMetadata {
+		full["key"+strconv.Itoa(i)] = "value"
+	}
+	tooMany := maps.Clone(full)
+	tooMany["one more"] = "value"
+
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		wantErr  error
+	}{
+		{name: "none"},
+		{name: "at the limit", metadata: full},
+		{name: "too many keys", metadata: tooMany, wantErr: ErrInvalidMetadata},
+		{name: "empty key", metadata: map[string]string{"": "value"}, wantErr: ErrInvalidMetadata},
+		{name: "long value", metadata: map[string]string{"lang": strings.Repeat("x", maxMetadataValue+1)}, wantErr: ErrInvalidMetadata},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, store, _ := newGuests()
+
+			_, _, err := g.Login(context.Background(), "", "tv", tt.metadata)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Login error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil && len(store.guests) != 0 {
+				t.Errorf("refused metadata saved a guest")
+			}
+		})
+	}
+}
+
+func TestLoginMetadataBoundOverLogins(t *testing.T) {
+	g, _, _ := newGuests()
+	half := func(prefix string) map[string]string {
+		m := map[string]string{}
+		for i := range maxMetadata/2 + 1 {
+			m[prefix+strconv.Itoa(i)] = "value"
+		}
+		return m
+	}
+
+	_, guest, err := g.Login(context.Background(), "", "tv", half("a"))
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	// each login is within the bound, together they are not
+	if _, _, err := g.Login(context.Background(), guest.ID, "tv", half("b")); !errors.Is(err, ErrInvalidMetadata) {
+		t.Errorf("Login over the total bound error = %v, want %v", err, ErrInvalidMetadata)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	g, store, alerts := newGuests()
+	_, onTV, err := g.Login(context.Background(), "", "tv", nil)
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	_, onPhone, err := g.Login(context.Background(), "", "phone", nil)
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	store.devices = []string{"phone"}
+
+	for _, id := range []string{onTV.ID, onPhone.ID} {
+		if err := g.Merge(context.Background(), "alice@example.com", id); err != nil {
+			t.Fatalf("Merge: %v", err)
+		}
+	}
+	// only the device new to the account is announced
+	if !slices.Equal(alerts.added, []string{"tv"}) {
+		t.Errorf("devices announced = %v, want the tv", alerts.added)
+	}
+	if err := g.Merge(context.Background(), "alice@example.com", onTV.ID); !errors.Is(err, storage.ErrGuestNotFound) {
+		t.Errorf("second Merge error = %v, want %v", err, storage.ErrGuestNotFound)
+	}
+}
+
+func TestMergeOverTheDeviceLimit(t *testing.T) {
+	for _, limitErr := range []error{storage.ErrDeviceLimitExceeded, storage.ErrHouseholdDeviceLimitExceeded} {
+		g, store, alerts := newGuests()
+		store.mergeErr = limitErr
+
+		if err := g.Merge(context.Background(), "alice@example.com", "guest"); !errors.Is(err, limitErr) {
+			t.Errorf("Merge error = %v, want %v", err, limitErr)
+		}
+		if len(alerts.added) != 0 {
+			t.Errorf("devices announced = %v, want none", alerts.added)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package households
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+const queryTime = 3 * time.Second
+
+var (
+	// ErrNotOwner is returned when a member manages the household only its owner may
+	ErrNotOwner = errors.New("only the owner manages the household")
+	// ErrOwnerCannotLeave is returned when the owner removes itself, the household stays with its owner
+	ErrOwnerCannotLeave = errors.New("owner cannot leave the household")
+)
+
+// Households lets an owner share the account entitlements with other accounts of the family
+type Households struct {
+	log        *logger.Logger
+	households HouseholdStore
+	maxMembers int
+	maxDevices int
+}
+
+type HouseholdStore interface {
+	CreateHousehold(
+		ctx context.Context,
+		ownerEmail string,
+		maxMembers int,
+		maxDevices int,
+	) (models.Household, error)
+	HouseholdOf(
+		ctx context.Context,
+		email string,
+	) (models.Household, error)
+	HouseholdMembers(
+		ctx context.Context,
+		householdID int64,
+	) ([]models.HouseholdMember, error)
+	SaveHouseholdInvitation(
+		ctx context.Context,
+		householdID int64,
+		email string,
+	) error
+	ActivateHouseholdMember(
+		ctx context.Context,
+		householdID int64,
+		email string,
+	) error
+	DeleteHouseholdMember(
+		ctx context.Context,
+		householdID int64,
+		email string,
+	) error
+}
+
+// New creates the household service, a household has at most maxMembers members besides the owner
+// and maxDevices devices among all of them, 0 is unlimited
+func New(
+	log *logger.Logger,
+	households HouseholdStore,
+	maxMembers int,
+	maxDevices int,
+) *Households {
+	return &Households{
+		log:        log,
+		households: households,
+		maxMembers: maxMembers,
+		maxDevices: maxDevices,
+	}
+}
+
+// Create makes the user the owner of a new household, a user belongs to one household at most
+func (h *Households) Create(
+	ctx context.Context,
+	email string,
+) (models.Household, error) {
+	const op = "Households.Create"
+	log := h.log.With(zap.String("op", op))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	household, err := h.households.CreateHousehold(ctx, email, h.maxMembers, h.maxDevices)
+	if err != nil {
+		if errors.Is(err, storage.ErrHouseholdAlreadyExists) || errors.Is(err, storage.ErrUserNotFound) {
+			log.Warn("household not created", zap.Error(err))
+			return models.Household{}, fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("failed to create household", zap.Error(err))
+		return models.Household{}, fmt.Errorf("%s: %w", op, err)
+	}
+	log.Info("household created", zap.Int64("household_id", household.ID))
+
+	return household, nil
+}
+
+// Get returns the household of the user with its members and pending invitations
+func (h *Households) Get(
+	ctx context.Context,
+	email string,
+) (models.Household, []models.HouseholdMember, error) {
+	const op = "Households.Get"
+	log := h.log.With(zap.String("op", op))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	household, err := h.households.HouseholdOf(ctx, email)
+	if err != nil {
+		if !errors.Is(err, storage.ErrHouseholdNotFound) {
+			log.Error("failed to get household", zap.Error(err))
+		}
+		return models.Household{}, nil, fmt.Errorf("%s: %w", op, err)
+	}
+	members, err := h.households.HouseholdMembers(ctx, household.ID)
+	if err != nil {
+		log.Error("failed to list household members", zap.Error(err))
+		return models.Household{}, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return household, members, nil
+}
+
+// Invite invites the account into the household of the owner, it joins once it accepts
+func (h *Households) Invite(
+	ctx context.Context,
+	ownerEmail string,
+	email string,
+) error {
+	const op = "Households.Invite"
+	log := h.log.With(zap.String("op", op))
+
+	household, err := h.owned(ctx, ownerEmail)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	if err := h.households.SaveHouseholdInvitation(ctx, household.ID, email); err != nil {
+		if errors.Is(err, storage.ErrHouseholdFull) ||
+			errors.Is(err, storage.ErrHouseholdMemberAlreadyExists) ||
+			errors.Is(err, storage.ErrUserNotFound) {
+			log.Warn("member not invited", zap.Error(err))
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("failed to save household invitation", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	log.Info("household member invited", zap.Int64("household_id", household.ID))
+
+	return nil
+}
+
+// Accept joins the household the user was invited to, the user must not be in another one
+func (h *Households) Accept(
+	ctx context.Context,
+	email string,
+	householdID int64,
+) error {
+	const op = "Households.Accept"
+	log := h.log.With(zap.String("op", op), zap.Int64("household_id", householdID))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	if err := h.households.ActivateHouseholdMember(ctx, householdID, email); err != nil {
+		if errors.Is(err, storage.ErrHouseholdMemberNotFound) || errors.Is(err, storage.ErrHouseholdAlreadyExists) {
+			log.Warn("invitation not accepted", zap.Error(err))
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("failed to accept invitation", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	log.Info("household invitation accepted")
+
+	return nil
+}
+
+// Remove takes the member out of the household of the user. The owner removes anyone but itself,
+// a member may only leave
+func (h *Households) Remove(
+	ctx context.Context,
+	email string,
+	memberEmail string,
+) error {
+	const op = "Households.Remove"
+	log := h.log.With(zap.String("op", op))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	household, err := h.households.HouseholdOf(ctx, email)
+	if err != nil {
+		if !errors.Is(err, storage.ErrHouseholdNotFound) {
+			log.Error("failed to get household", zap.Error(err))
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	switch {
+	case memberEmail == household.OwnerEmail:
+		return fmt.Errorf("%s: %w", op, ErrOwnerCannotLeave)
+	case email != household.OwnerEmail && email != memberEmail:
+		log.Warn("member removing another member")
+		return fmt.Errorf("%s: %w", op, ErrNotOwner)
+	}
+
+	if err := h.households.DeleteHouseholdMember(ctx, household.ID, memberEmail); err != nil {
+		if !errors.Is(err, storage.ErrHouseholdMemberNotFound) {
+			log.Error("failed to delete household member", zap.Error(err))
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	log.Info("household member removed", zap.Int64("household_id", household.ID))
+
+	return nil
+}
+
+// owned returns the household of the user if the user owns it
+func (h *Households) owned(ctx context.Context, email string) (models.Household, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	household, err := h.households.HouseholdOf(ctx, email)
+	if err != nil {
+		if !errors.Is(err, storage.ErrHouseholdNotFound) {
+			h.log.Error("failed to get household", zap.Error(err))
+		}
+		return models.Household{}, err
+	}
+	if household.OwnerEmail != email {
+		return models.Household{}, ErrNotOwner
+	}
+
+	return household, nil
+}
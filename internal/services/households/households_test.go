@@ -0,0 +1,168 @@
+package households
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+// memoryHouseholds keeps one household with its members by email, the member limit is checked
+// like the database does
+type memoryHouseholds struct {
+	household models.Household
+	members   map[string]models.HouseholdMember
+}
+
+func (m *memoryHouseholds) CreateHousehold(_ context.Context, ownerEmail string, maxMembers int, maxDevices int) (models.Household, error) {
+	if m.household.ID != 0 {
+		return models.Household{}, storage.ErrHouseholdAlreadyExists
+	}
+	m.household = models.Household{ID: 1, OwnerEmail: ownerEmail, MaxMembers: maxMembers, MaxDevices: maxDevices}
+	m.members = map[string]models.HouseholdMember{
+		ownerEmail: {HouseholdID: 1, Email: ownerEmail, Role: models.HouseholdRoleOwner, Status: models.MembershipActive},
+	}
+	return m.household, nil
+}
+
+func (m *memoryHouseholds) HouseholdOf(_ context.Context, email string) (models.Household, error) {
+	if member, ok := m.members[email]; !ok || member.Status != models.MembershipActive {
+		return models.Household{}, storage.ErrHouseholdNotFound
+	}
+	return m.household, nil
+}
+
+func (m *memoryHouseholds) HouseholdMembers(context.Context, int64) ([]models.HouseholdMember, error) {
+	var members []models.HouseholdMember
+	for _, member := range m.members {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (m *memoryHouseholds) SaveHouseholdInvitation(_ context.Context, _ int64, email string) error {
+	if _, ok := m.members[email]; ok {
+		return storage.ErrHouseholdMemberAlreadyExists
+	}
+	if m.household.MaxMembers > 0 && len(m.members)-1 >= m.household.MaxMembers {
+		return storage.ErrHouseholdFull
+	}
+	m.members[email] = models.HouseholdMember{HouseholdID: 1, Email: email, Role: models.HouseholdRoleMember, Status: models.MembershipInvited}
+	return nil
+}
+
+func (m *memoryHouseholds) ActivateHouseholdMember(_ context.Context, householdID int64, email string) error {
+	member, ok := m.members[email]
+	if !ok || householdID != m.household.ID || member.Status != models.MembershipInvited {
+		return storage.ErrHouseholdMemberNotFound
+	}
+	member.Status = models.MembershipActive
+	m.members[email] = member
+	return nil
+}
+
+func (m *memoryHouseholds) DeleteHouseholdMember(_ context.Context, _ int64, email string) error {
+	if member, ok := m.members[email]; !ok || member.Role != models.HouseholdRoleMember {
+		return storage.ErrHouseholdMemberNotFound
+	}
+	delete(m.members, email)
+	return nil
+}
+
+// newHousehold creates the household of owner@example.com with the active member@example.com
+// and the invited guest@example.com, for at most 2 members
+func newHousehold(t *testing.T) (*Households, *memoryHouseholds) {
+	t.Helper()
+
+	store := &memoryHouseholds{}
+	h := New(&logger.Logger{SugaredLogger: zap.NewNop().Sugar()}, store, 2, 6)
+	household, err := h.Create(context.Background(), "owner@example.com")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if household.MaxMembers != 2 || household.MaxDevices != 6 {
+		t.Fatalf("household = %+v, want the limits of the service", household)
+	}
+	for _, email := range []string{"member@example.com", "guest@example.com"} {
+		if err := h.Invite(context.Background(), "owner@example.com", email); err != nil {
+			t.Fatalf("Invite %s: %v", email, err)
+		}
+	}
+	if err := h.Accept(context.Background(), "member@example.com", household.ID); err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	return h, store
+}
+
+func TestInvite(t *testing.T) {
+	tests := []struct {
+		name    string
+		owner   string
+		email   string
+		wantErr error
+	}{
+		{name: "member invites", owner: "member@example.com", email: "new@example.com", wantErr: ErrNotOwner},
+		{name: "stranger invites", owner: "stranger@example.com", email: "new@example.com", wantErr: storage.ErrHouseholdNotFound},
+		{name: "invitation pending", owner: "owner@example.com", email: "guest@example.com", wantErr: storage.ErrHouseholdMemberAlreadyExists},
+		{name: "household full", owner: "owner@example.com", email: "new@example.com", wantErr: storage.ErrHouseholdFull},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newHousehold(t)
+
+			if err := h.Invite(context.Background(), tt.owner, tt.email); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Invite error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGet(t *testing.T) {
+	h, _ := newHousehold(t)
+
+	household, members, err := h.Get(context.Background(), "member@example.com")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if household.OwnerEmail != "owner@example.com" || len(members) != 3 {
+		t.Errorf("Get = %+v, %d members, want the household of the owner with 3 members", household, len(members))
+	}
+	// an invitation does not make the user a member yet
+	if _, _, err := h.Get(context.Background(), "guest@example.com"); !errors.Is(err, storage.ErrHouseholdNotFound) {
+		t.Errorf("Get of an invited user error = %v, want %v", err, storage.ErrHouseholdNotFound)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	tests := []struct {
+		name    string
+		email   string
+		member  string
+		wantErr error
+	}{
+		{name: "owner removes member", email: "owner@example.com", member: "member@example.com"},
+		{name: "owner withdraws invitation", email: "owner@example.com", member: "guest@example.com"},
+		{name: "member leaves", email: "member@example.com", member: "member@example.com"},
+		{name: "owner leaves", email: "owner@example.com", member: "owner@example.com", wantErr: ErrOwnerCannotLeave},
+		{name: "member removes owner", email: "member@example.com", member: "owner@example.com", wantErr: ErrOwnerCannotLeave},
+		{name: "member removes invitation", email: "member@example.com", member: "guest@example.com", wantErr: ErrNotOwner},
+		{name: "stranger removes member", email: "stranger@example.com", member: "member@example.com", wantErr: storage.ErrHouseholdNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, store := newHousehold(t)
+
+			err := h.Remove(context.Background(), tt.email, tt.member)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Remove error = %v, want %v", err, tt.wantErr)
+			}
+			if _, stays := store.members[tt.member]; stays != (err != nil) {
+				t.Errorf("member still in the household = %v", stays)
+			}
+		})
+	}
+}
@@ -0,0 +1,373 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/services/clients"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// DeviceCodeGrantType is the grant_type of the device authorization grant, RFC 8628 section 3.4
+	DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+	// user codes are read from a TV screen and typed on a phone: consonants only,
+	// so that no word is spelled and no letter is mistaken for a digit, RFC 8628 section 6.1
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+	// slowDownStep is how much the polling interval grows on slow_down, RFC 8628 section 3.5
+	slowDownStep = 5 * time.Second
+	// userCodeAttempts bounds the retries when a generated user code is already taken
+	userCodeAttempts = 5
+)
+
+var (
+	ErrAuthorizationPending = errors.New("authorization pending")
+	ErrSlowDown             = errors.New("slow down")
+	ErrExpiredToken         = errors.New("device code expired")
+	// ErrInvalidUserCode is returned for a user code that is unknown, expired or already answered
+	ErrInvalidUserCode = errors.New("invalid user code")
+	ErrInvalidDecision = errors.New("invalid decision")
+)
+
+// decisions of the user on a device authorization, none only shows what the device asks for
+const (
+	DeviceDecisionNone    = ""
+	DeviceDecisionApprove = "approve"
+	DeviceDecisionDeny    = "deny"
+)
+
+// DeviceFlow configures the device authorization grant. VerificationURI is where the user
+// enters the code, Interval is the minimum time between two polls of the device
+type DeviceFlow struct {
+	VerificationURI string
+	CodeTTL         time.Duration
+	Interval        time.Duration
+}
+
+// DeviceCode is the response of the device authorization endpoint, RFC 8628 section 3.2
+type DeviceCode struct {
+	DeviceCode              string
+	UserCode                string
+	VerificationURI         string
+	VerificationURIComplete string
+	ExpiresIn               time.Duration
+	Interval                time.Duration
+}
+
+// DevicePrompt is what the user is asked to approve for the device
+type DevicePrompt struct {
+	Client models.Client
+	Scopes []string
+}
+
+type DeviceAuthorizationStore interface {
+	SaveDeviceAuthorization(
+		ctx context.Context,
+		deviceCodeHash string,
+		auth models.DeviceAuthorization,
+		ttl time.Duration,
+	) error
+	DeviceAuthorization(
+		ctx context.Context,
+		userCode string,
+	) (models.DeviceAuthorization, error)
+	DecideDeviceAuthorization(
+		ctx context.Context,
+		userCode string,
+		email string,
+		approved bool,
+	) error
+	PollDeviceAuthorization(
+		ctx context.Context,
+		clientID string,
+		deviceCodeHash string,
+		step time.Duration,
+	) (auth models.DeviceAuthorization, slowDown bool, err error)
+	DeleteDeviceAuthorization(
+		ctx context.Context,
+		deviceCodeHash string,
+	) (bool, error)
+}
+
+// DeviceRegistrar adds the device signed in from another one to the devices of the user
+type DeviceRegistrar interface {
+	RegisterDevice(
+		ctx context.Context,
+		email string,
+		deviceAddress string,
+	) error
+}
+
+// DeviceAuthorization starts the device authorization grant for a device that cannot take
+// a password, a TV or a console. The device shows the user code and polls the token endpoint
+// with the device code while the user approves on another device
+func (o *OAuth) DeviceAuthorization(
+	ctx context.Context,
+	creds clients.Credentials,
+	scopes []string,
+	deviceAddress string,
+) (DeviceCode, error) {
+	const op = "OAuth.DeviceAuthorization"
+
+	client, err := o.auth.Authenticate(ctx, creds)
+	if err != nil {
+		return DeviceCode{}, fmt.Errorf("%s: %w", op, err)
+	}
+	log := o.log.With(zap.String("op", op), zap.String("client_id", client.ID))
+
+	if deviceAddress == "" {
+		return DeviceCode{}, fmt.Errorf("%s: %w", op, ErrInvalidRequest)
+	}
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	if !covers(client.Scopes, scopes) {
+		log.Warn("scope not allowed")
+		return DeviceCode{}, fmt.Errorf("%s: %w", op, ErrInvalidScope)
+	}
+
+	deviceCode, err := randomString(32)
+	if err != nil {
+		log.Error("failed to generate device code", zap.Error(err))
+		return DeviceCode{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	var userCode string
+	for attempt := 0; ; attempt++ {
+		userCode, err = newUserCode()
+		if err != nil {
+			log.Error("failed to generate user code", zap.Error(err))
+			return DeviceCode{}, fmt.Errorf("%s: %w", op, err)
+		}
+		err = o.devices.SaveDeviceAuthorization(ctx, hash(deviceCode), models.DeviceAuthorization{
+			ClientID:      client.ID,
+			DeviceAddress: deviceAddress,
+			UserCode:      userCode,
+			Scopes:        scopes,
+			Interval:      o.device.Interval,
+		}, o.device.CodeTTL)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, storage.ErrUserCodeAlreadyExists) || attempt+1 == userCodeAttempts {
+			log.Error("failed to save device authorization", zap.Error(err))
+			return DeviceCode{}, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	display := formatUserCode(userCode)
+	return DeviceCode{
+		DeviceCode:              deviceCode,
+		UserCode:                display,
+		VerificationURI:         o.device.VerificationURI,
+		VerificationURIComplete: o.device.VerificationURI + "?user_code=" + url.QueryEscape(display),
+		ExpiresIn:               o.device.CodeTTL,
+		Interval:                o.device.Interval,
+	}, nil
+}
+
+// VerifyDeviceCode is how the signed in user answers a device authorization: without a decision
+// it returns what the device asks for, approving records the consent of the user to the scopes
+func (o *OAuth) VerifyDeviceCode(
+	ctx context.Context,
+	email string,
+	userCode string,
+	decision string,
+) (DevicePrompt, error) {
+	const op = "OAuth.VerifyDeviceCode"
+	log := o.log.With(zap.String("op", op))
+
+	if decision != DeviceDecisionNone && decision != DeviceDecisionApprove && decision != DeviceDecisionDeny {
+		return DevicePrompt{}, fmt.Errorf("%s: %w", op, ErrInvalidDecision)
+	}
+	userCode = normalizeUserCode(userCode)
+	if len(userCode) != userCodeLength {
+		return DevicePrompt{}, fmt.Errorf("%s: %w", op, ErrInvalidUserCode)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	auth, err := o.devices.DeviceAuthorization(ctx, userCode)
+	if err != nil {
+		if errors.Is(err, storage.ErrDeviceCodeNotFound) {
+			log.Warn("user code not found")
+			return DevicePrompt{}, fmt.Errorf("%s: %w", op, ErrInvalidUserCode)
+		}
+		log.Error("failed to get device authorization", zap.Error(err))
+		return DevicePrompt{}, fmt.Errorf("%s: %w", op, err)
+	}
+	log = log.With(zap.String("client_id", auth.ClientID))
+	client, err := o.clients.Client(ctx, auth.ClientID)
+	if err != nil {
+		log.Error("failed to get client", zap.Error(err))
+		return DevicePrompt{}, fmt.Errorf("%s: %w", op, err)
+	}
+	prompt := DevicePrompt{Client: client, Scopes: auth.Scopes}
+	if decision == DeviceDecisionNone {
+		return prompt, nil
+	}
+
+	approved := decision == DeviceDecisionApprove
+	if approved {
+		if err := o.consents.SaveConsent(ctx, email, auth.ClientID, auth.Scopes); err != nil {
+			log.Error("failed to save consent", zap.Error(err))
+			return DevicePrompt{}, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	if err := o.devices.DecideDeviceAuthorization(ctx, userCode, email, approved); err != nil {
+		if errors.Is(err, storage.ErrDeviceCodeNotFound) {
+			log.Warn("device authorization already answered or expired")
+			return DevicePrompt{}, fmt.Errorf("%s: %w", op, ErrInvalidUserCode)
+		}
+		log.Error("failed to decide device authorization", zap.Error(err))
+		return DevicePrompt{}, fmt.Errorf("%s: %w", op, err)
+	}
+	log.Info("device authorization answered", zap.Bool("approved", approved))
+
+	return prompt, nil
+}
+
+// ExchangeDeviceCode is the device_code grant polled by the device. Once the user approved
+// the device becomes one of the user devices, the device limit applies, and the tokens are bound to it
+func (o *OAuth) ExchangeDeviceCode(
+	ctx context.Context,
+	creds clients.Credentials,
+	deviceCode string,
+) (TokenSet, error) {
+	const op = "OAuth.ExchangeDeviceCode"
+
+	client, err := o.auth.Authenticate(ctx, creds)
+	if err != nil {
+		return TokenSet{}, fmt.Errorf("%s: %w", op, err)
+	}
+	log := o.log.With(zap.String("op", op), zap.String("client_id", client.ID))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	auth, slowDown, err := o.devices.PollDeviceAuthorization(ctx, client.ID, hash(deviceCode), slowDownStep)
+	if err != nil {
+		if errors.Is(err, storage.ErrDeviceCodeNotFound) {
+			log.Warn("device code not found")
+			return TokenSet{}, fmt.Errorf("%s: %w", op, ErrInvalidGrant)
+		}
+		log.Error("failed to poll device authorization", zap.Error(err))
+		return TokenSet{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	switch {
+	case time.Now().After(auth.ExpiresAt):
+		o.deleteDeviceAuthorization(ctx, log, deviceCode)
+		return TokenSet{}, fmt.Errorf("%s: %w", op, ErrExpiredToken)
+	case auth.Status == models.DeviceAuthorizationDenied:
+		o.deleteDeviceAuthorization(ctx, log, deviceCode)
+		return TokenSet{}, fmt.Errorf("%s: %w", op, ErrAccessDenied)
+	case auth.Status == models.DeviceAuthorizationPending && slowDown:
+		return TokenSet{}, fmt.Errorf("%s: %w", op, ErrSlowDown)
+	case auth.Status == models.DeviceAuthorizationPending:
+		return TokenSet{}, fmt.Errorf("%s: %w", op, ErrAuthorizationPending)
+	}
+
+	// only one poll gets the tokens
+	if !o.deleteDeviceAuthorization(ctx, log, deviceCode) {
+		return TokenSet{}, fmt.Errorf("%s: %w", op, ErrInvalidGrant)
+	}
+	if err := o.registrar.RegisterDevice(ctx, auth.Email, auth.DeviceAddress); err != nil {
+		log.Warn("failed to register device", zap.Error(err))
+		return TokenSet{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	refreshToken, err := randomString(32)
+	if err != nil {
+		log.Error("failed to generate refresh token", zap.Error(err))
+		return TokenSet{}, fmt.Errorf("%s: %w", op, err)
+	}
+	_, err = o.refresh.SaveRefreshToken(ctx, hash(refreshToken), models.RefreshToken{
+		Email:         auth.Email,
+		ClientID:      client.ID,
+		Scopes:        auth.Scopes,
+		AuthTime:      time.Now(),
+		DeviceAddress: auth.DeviceAddress,
+	}, o.lifetimes.Refresh)
+	if err != nil {
+		log.Error("failed to save refresh token", zap.Error(err))
+		return TokenSet{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	tokens, err := o.accessToken(ctx, auth.Email, client.ID, auth.DeviceAddress, auth.Scopes)
+	if err != nil {
+		log.Error("failed to generate access token", zap.Error(err))
+		return TokenSet{}, fmt.Errorf("%s: %w", op, err)
+	}
+	tokens.RefreshToken = refreshToken
+	if contains(auth.Scopes, models.ScopeOpenID) {
+		// the user authenticated on the other device, when is not known
+		tokens.IDToken, err = o.idToken(ctx, auth.Email, client.ID, auth.Scopes, "", time.Time{}, nil)
+		if err != nil {
+			log.Error("failed to generate id token", zap.Error(err))
+			return TokenSet{}, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	log.Info("device signed in", zap.String("device", auth.DeviceAddress))
+
+	return tokens, nil
+}
+
+// deleteDeviceAuthorization drops an answered authorization, false when another poll took it first
+func (o *OAuth) deleteDeviceAuthorization(ctx context.Context, log *zap.SugaredLogger, deviceCode string) bool {
+	deleted, err := o.devices.DeleteDeviceAuthorization(ctx, hash(deviceCode))
+	if err != nil {
+		log.Error("failed to delete device authorization", zap.Error(err))
+		return false
+	}
+	return deleted
+}
+
+func newUserCode() (string, error) {
+	b := make([]byte, userCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	// 256 is not a multiple of the alphabet, drop the biased top of the range
+	code := make([]byte, 0, userCodeLength)
+	for len(code) < userCodeLength {
+		for _, c := range b {
+			if int(c) >= 256-256%len(userCodeAlphabet) {
+				continue
+			}
+			code = append(code, userCodeAlphabet[int(c)%len(userCodeAlphabet)])
+			if len(code) == userCodeLength {
+				break
+			}
+		}
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+	}
+	return string(code), nil
+}
+
+// formatUserCode splits the code in two halves for reading, XXXX-XXXX
+func formatUserCode(code string) string {
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+// normalizeUserCode accepts the code as typed by the user: any case, with or without the dash
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
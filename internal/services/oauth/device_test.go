@@ -0,0 +1,266 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/jwt"
+	"vieo/auth/internal/services/clients"
+	"vieo/auth/internal/storage"
+)
+
+type deviceAuthorization struct {
+	auth       models.DeviceAuthorization
+	lastPolled time.Time
+}
+
+func (m *memoryGrants) SaveDeviceAuthorization(_ context.Context, deviceCodeHash string, auth models.DeviceAuthorization, ttl time.Duration) error {
+	for _, d := range m.deviceAuths {
+		if d.auth.UserCode == auth.UserCode {
+			return storage.ErrUserCodeAlreadyExists
+		}
+	}
+	auth.Status = models.DeviceAuthorizationPending
+	auth.ExpiresAt = time.Now().Add(ttl)
+	m.deviceAuths[deviceCodeHash] = &deviceAuthorization{auth: auth}
+	return nil
+}
+
+func (m *memoryGrants) DeviceAuthorization(_ context.Context, userCode string) (models.DeviceAuthorization, error) {
+	for _, d := range m.deviceAuths {
+		if d.auth.UserCode == userCode && d.auth.Status == models.DeviceAuthorizationPending && time.Now().Before(d.auth.ExpiresAt) {
+			return d.auth, nil
+		}
+	}
+	return models.DeviceAuthorization{}, storage.ErrDeviceCodeNotFound
+}
+
+func (m *memoryGrants) DecideDeviceAuthorization(_ context.Context, userCode string, email string, approved bool) error {
+	for _, d := range m.deviceAuths {
+		if d.auth.UserCode == userCode && d.auth.Status == models.DeviceAuthorizationPending && time.Now().Before(d.auth.ExpiresAt) {
+			d.auth.Status = models.DeviceAuthorizationDenied
+			if approved {
+				d.auth.Status = models.DeviceAuthorizationApproved
+			}
+			d.auth.Email = email
+			return nil
+		}
+	}
+	return storage.ErrDeviceCodeNotFound
+}
+
+func (m *memoryGrants) PollDeviceAuthorization(_ context.Context, clientID string, deviceCodeHash string, step time.Duration) (models.DeviceAuthorization, bool, error) {
+	d, ok := m.deviceAuths[deviceCodeHash]
+	if !ok || d.auth.ClientID != clientID {
+		return models.DeviceAuthorization{}, false, storage.ErrDeviceCodeNotFound
+	}
+	now := time.Now()
+	slowDown := !d.lastPolled.IsZero() && now.Before(d.lastPolled.Add(d.auth.Interval))
+	if slowDown {
+		d.auth.Interval += step
+	}
+	d.lastPolled = now
+	return d.auth, slowDown, nil
+}
+
+func (m *memoryGrants) DeleteDeviceAuthorization(_ context.Context, deviceCodeHash string) (bool, error) {
+	_, ok := m.deviceAuths[deviceCodeHash]
+	delete(m.deviceAuths, deviceCodeHash)
+	return ok, nil
+}
+
+func (m *memoryGrants) RegisterDevice(_ context.Context, _ string, deviceAddress string) error {
+	m.registered = append(m.registered, deviceAddress)
+	return nil
+}
+
+// pollLater lets the next poll of the device come after the interval
+func pollLater(grants *memoryGrants, deviceCode string) {
+	if d, ok := grants.deviceAuths[hash(deviceCode)]; ok {
+		d.lastPolled = time.Time{}
+	}
+}
+
+func TestDeviceAuthorization(t *testing.T) {
+	o, grants, _ := newOAuth(t)
+
+	code, err := o.DeviceAuthorization(context.Background(), tvCreds, []string{models.ScopeOpenID}, "living-room-tv")
+	if err != nil {
+		t.Fatalf("DeviceAuthorization: %v", err)
+	}
+	if len(code.UserCode) != userCodeLength+1 || code.UserCode[userCodeLength/2] != '-' {
+		t.Errorf("user code = %q, want XXXX-XXXX", code.UserCode)
+	}
+	if strings.ContainsAny(strings.ReplaceAll(code.UserCode, "-", ""), "AEIOU0123456789") {
+		t.Errorf("user code %q has vowels or digits", code.UserCode)
+	}
+	if code.VerificationURIComplete != "https://vieo.example.com/activate?user_code="+code.UserCode {
+		t.Errorf("verification uri = %q", code.VerificationURIComplete)
+	}
+	if _, ok := grants.deviceAuths[code.DeviceCode]; ok {
+		t.Error("device code saved in clear")
+	}
+
+	if _, err := o.DeviceAuthorization(context.Background(), tvCreds, []string{"admin"}, "tv"); !errors.Is(err, ErrInvalidScope) {
+		t.Errorf("DeviceAuthorization of a scope of another client error = %v, want %v", err, ErrInvalidScope)
+	}
+	if _, err := o.DeviceAuthorization(context.Background(), tvCreds, nil, ""); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("DeviceAuthorization without a device error = %v, want %v", err, ErrInvalidRequest)
+	}
+	wrong := clients.Credentials{ClientID: tvApp.ID, ClientSecret: "guess"}
+	if _, err := o.DeviceAuthorization(context.Background(), wrong, nil, "tv"); !errors.Is(err, clients.ErrInvalidClient) {
+		t.Errorf("DeviceAuthorization with a wrong secret error = %v, want %v", err, clients.ErrInvalidClient)
+	}
+}
+
+func TestExchangeDeviceCode(t *testing.T) {
+	o, grants, _ := newOAuth(t)
+	code, err := o.DeviceAuthorization(context.Background(), tvCreds, []string{models.ScopeOpenID, "catalog:read"}, "living-room-tv")
+	if err != nil {
+		t.Fatalf("DeviceAuthorization: %v", err)
+	}
+
+	if _, err := o.ExchangeDeviceCode(context.Background(), tvCreds, code.DeviceCode); !errors.Is(err, ErrAuthorizationPending) {
+		t.Fatalf("first poll error = %v, want %v", err, ErrAuthorizationPending)
+	}
+	// polling within the interval is told to slow down, and the interval grows
+	if _, err := o.ExchangeDeviceCode(context.Background(), tvCreds, code.DeviceCode); !errors.Is(err, ErrSlowDown) {
+		t.Fatalf("second poll error = %v, want %v", err, ErrSlowDown)
+	}
+	if got := grants.deviceAuths[hash(code.DeviceCode)].auth.Interval; got != time.Hour+slowDownStep {
+		t.Errorf("interval = %s, want %s", got, time.Hour+slowDownStep)
+	}
+
+	// the user types the code as read from the screen
+	prompt, err := o.VerifyDeviceCode(context.Background(), alice.Email, strings.ToLower(code.UserCode), DeviceDecisionApprove)
+	if err != nil {
+		t.Fatalf("VerifyDeviceCode: %v", err)
+	}
+	if prompt.Client.ID != tvApp.ID {
+		t.Errorf("prompt = %+v, want tv-app", prompt)
+	}
+	pollLater(grants, code.DeviceCode)
+	tokens, err := o.ExchangeDeviceCode(context.Background(), tvCreds, code.DeviceCode)
+	if err != nil {
+		t.Fatalf("poll after the approval: %v", err)
+	}
+	claims, err := jwt.DecodeClientToken(testSecret, tokens.AccessToken)
+	if err != nil {
+		t.Fatalf("DecodeClientToken: %v", err)
+	}
+	// the TV becomes a device of the user and the tokens are bound to it
+	if claims.Email != alice.Email || claims.DeviceAddress != "living-room-tv" {
+		t.Errorf("claims = %+v, want alice on the tv", claims)
+	}
+	if len(grants.registered) != 1 || grants.registered[0] != "living-room-tv" {
+		t.Errorf("registered = %v, want the tv", grants.registered)
+	}
+	if tokens.RefreshToken == "" || tokens.IDToken == "" {
+		t.Errorf("tokens = %+v, want refresh and ID tokens", tokens)
+	}
+
+	// the tokens are handed out once
+	pollLater(grants, code.DeviceCode)
+	if _, err := o.ExchangeDeviceCode(context.Background(), tvCreds, code.DeviceCode); !errors.Is(err, ErrInvalidGrant) {
+		t.Errorf("poll after the exchange error = %v, want %v", err, ErrInvalidGrant)
+	}
+}
+
+func TestExchangeDeviceCodeDenied(t *testing.T) {
+	o, grants, _ := newOAuth(t)
+	code, err := o.DeviceAuthorization(context.Background(), tvCreds, nil, "tv")
+	if err != nil {
+		t.Fatalf("DeviceAuthorization: %v", err)
+	}
+
+	if _, err := o.VerifyDeviceCode(context.Background(), alice.Email, code.UserCode, DeviceDecisionDeny); err != nil {
+		t.Fatalf("VerifyDeviceCode: %v", err)
+	}
+	if _, err := o.ExchangeDeviceCode(context.Background(), tvCreds, code.DeviceCode); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("poll after the denial error = %v, want %v", err, ErrAccessDenied)
+	}
+	if len(grants.deviceAuths) != 0 || len(grants.registered) != 0 {
+		t.Errorf("denied authorization kept %d, registered %v", len(grants.deviceAuths), grants.registered)
+	}
+}
+
+func TestExchangeDeviceCodeExpired(t *testing.T) {
+	o, grants, _ := newOAuth(t)
+	code, err := o.DeviceAuthorization(context.Background(), tvCreds, nil, "tv")
+	if err != nil {
+		t.Fatalf("DeviceAuthorization: %v", err)
+	}
+	if _, err := o.VerifyDeviceCode(context.Background(), alice.Email, code.UserCode, DeviceDecisionApprove); err != nil {
+		t.Fatalf("VerifyDeviceCode: %v", err)
+	}
+	grants.deviceAuths[hash(code.DeviceCode)].auth.ExpiresAt = time.Now().Add(-time.Second)
+
+	// even an approved code is worthless once expired
+	if _, err := o.ExchangeDeviceCode(context.Background(), tvCreds, code.DeviceCode); !errors.Is(err, ErrExpiredToken) {
+		t.Errorf("poll of an expired code error = %v, want %v", err, ErrExpiredToken)
+	}
+	if len(grants.deviceAuths) != 0 || len(grants.registered) != 0 {
+		t.Errorf("expired authorization kept %d, registered %v", len(grants.deviceAuths), grants.registered)
+	}
+}
+
+func TestExchangeDeviceCodeOfAnotherClient(t *testing.T) {
+	o, _, _ := newOAuth(t)
+	code, err := o.DeviceAuthorization(context.Background(), tvCreds, nil, "tv")
+	if err != nil {
+		t.Fatalf("DeviceAuthorization: %v", err)
+	}
+
+	if _, err := o.ExchangeDeviceCode(context.Background(), tvCreds, code.DeviceCode+"x"); !errors.Is(err, ErrInvalidGrant) {
+		t.Errorf("poll of an unknown code error = %v, want %v", err, ErrInvalidGrant)
+	}
+}
+
+func TestVerifyDeviceCode(t *testing.T) {
+	o, grants, _ := newOAuth(t)
+	code, err := o.DeviceAuthorization(context.Background(), tvCreds, []string{models.ScopeOpenID}, "tv")
+	if err != nil {
+		t.Fatalf("DeviceAuthorization: %v", err)
+	}
+
+	// looking at the prompt decides nothing
+	prompt, err := o.VerifyDeviceCode(context.Background(), alice.Email, strings.ReplaceAll(code.UserCode, "-", " "), DeviceDecisionNone)
+	if err != nil || len(prompt.Scopes) != 1 || prompt.Scopes[0] != models.ScopeOpenID {
+		t.Fatalf("VerifyDeviceCode = %+v, %v, want the scopes of the device", prompt, err)
+	}
+	if status := grants.deviceAuths[hash(code.DeviceCode)].auth.Status; status != models.DeviceAuthorizationPending {
+		t.Errorf("status after the prompt = %s, want pending", status)
+	}
+
+	tests := []struct {
+		name     string
+		userCode string
+		decision string
+		wantErr  error
+	}{
+		{name: "unknown decision", userCode: code.UserCode, decision: "maybe", wantErr: ErrInvalidDecision},
+		{name: "short code", userCode: "BCDF", decision: DeviceDecisionApprove, wantErr: ErrInvalidUserCode},
+		{name: "unknown code", userCode: "BCDF-GHJK", decision: DeviceDecisionApprove, wantErr: ErrInvalidUserCode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := o.VerifyDeviceCode(context.Background(), alice.Email, tt.userCode, tt.decision); !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyDeviceCode error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := o.VerifyDeviceCode(context.Background(), alice.Email, code.UserCode, DeviceDecisionApprove); err != nil {
+		t.Fatalf("VerifyDeviceCode: %v", err)
+	}
+	if scopes := grants.consents[alice.Email+"/"+tvApp.ID]; len(scopes) != 1 || scopes[0] != models.ScopeOpenID {
+		t.Errorf("consent = %v, want the scopes of the device", scopes)
+	}
+	// a code is answered once
+	if _, err := o.VerifyDeviceCode(context.Background(), alice.Email, code.UserCode, DeviceDecisionDeny); !errors.Is(err, ErrInvalidUserCode) {
+		t.Errorf("second answer error = %v, want %v", err, ErrInvalidUserCode)
+	}
+}
@@ -0,0 +1,780 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/jwt"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/services/clients"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+const (
+	queryTime = 3 * time.Second
+	// DevicePrefix marks the device of the sessions an application opened for the user,
+	// the rest of the address is the client id
+	DevicePrefix   = "oauth:"
+	consentPurpose = "oauth_consent"
+	// PKCE verifiers are 43 to 128 characters, RFC 7636 section 4.1
+	minVerifierLength = 43
+	maxVerifierLength = 128
+	// amrPassword is the authentication method reference of the password login, RFC 8176
+	amrPassword = "pwd"
+)
+
+var (
+	// ErrInvalidRedirectURI is returned when the redirect URI is not registered for the client,
+	// the error must not be sent to that URI
+	ErrInvalidRedirectURI       = errors.New("redirect uri is not registered for the client")
+	ErrInvalidRequest           = errors.New("invalid authorization request")
+	ErrUnsupportedResponseType  = errors.New("unsupported response type")
+	ErrInvalidScope             = errors.New("invalid scope")
+	ErrInvalidGrant             = errors.New("invalid grant")
+	ErrAccessDenied             = errors.New("access denied")
+	ErrInvalidCredentials       = errors.New("invalid credentials")
+	ErrInvalidConsentTicket     = errors.New("invalid consent ticket")
+	ErrUnsupportedChallengeType = errors.New("only the S256 code challenge method is supported")
+	ErrInvalidToken             = errors.New("invalid access token")
+	// ErrInsufficientScope is returned by UserInfo for a token without the openid scope
+	ErrInsufficientScope = errors.New("insufficient scope")
+)
+
+// AuthorizationRequest is the query of the authorization endpoint
+type AuthorizationRequest struct {
+	ClientID            string
+	RedirectURI         string
+	ResponseType        string
+	Scopes              []string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	// Nonce is the OpenID Connect nonce, returned in the ID token
+	Nonce string
+}
+
+// Decision is the outcome of the user authentication: a code when the user already consented,
+// otherwise a ticket to show the consent page with
+type Decision struct {
+	Code          string
+	ConsentTicket string
+	Email         string
+}
+
+// TokenSet is the response of the token endpoint, IDToken is set when the openid scope was granted
+type TokenSet struct {
+	AccessToken  string
+	RefreshToken string
+	IDToken      string
+	ExpiresIn    time.Duration
+	Scopes       []string
+}
+
+// OIDC makes the authorization server an OpenID Connect provider: ID tokens are signed by Signer
+// and name Issuer, the public base URL of the service
+type OIDC struct {
+	Issuer string
+	Signer *jwt.Signer
+}
+
+// Lifetimes of what the authorization server issues, the access tokens live as long as the tenant ones
+type Lifetimes struct {
+	Code    time.Duration
+	Refresh time.Duration
+	Consent time.Duration
+}
+
+// OAuth is the authorization server of the authorization code flow with PKCE
+type OAuth struct {
+	log       *logger.Logger
+	clients   ClientProvider
+	auth      ClientAuthenticator
+	users     UserAuthenticator
+	grants    GrantProvider
+	consents  ConsentStore
+	codes     CodeStore
+	refresh   RefreshTokenStore
+	accounts  UserProvider
+	devices   DeviceAuthorizationStore
+	registrar DeviceRegistrar
+	oidc      OIDC
+	secretKey string
+	tokenTTL  time.Duration
+	lifetimes Lifetimes
+	device    DeviceFlow
+}
+
+type ClientProvider interface {
+	Client(
+		ctx context.Context,
+		clientID string,
+	) (models.Client, error)
+}
+
+type ClientAuthenticator interface {
+	Authenticate(
+		ctx context.Context,
+		creds clients.Credentials,
+	) (models.Client, error)
+}
+
+// UserAuthenticator is the first-party login, the user authenticates to the authorization server with it.
+// The password check keeps the lockout, but the application does not become a device of the user
+type UserAuthenticator interface {
+	VerifyPassword(
+		ctx context.Context,
+		email string,
+		password string,
+		deviceAddress string,
+	) (models.User, error)
+	VerifyToken(
+		ctx context.Context,
+		accessToken string,
+	) (jwt.Claims, error)
+}
+
+type GrantProvider interface {
+	UserAccess(
+		ctx context.Context,
+		email string,
+	) (roles []string, permissions []string, err error)
+}
+
+type UserProvider interface {
+	User(
+		ctx context.Context,
+		email string,
+	) (models.User, error)
+}
+
+type ConsentStore interface {
+	Consent(
+		ctx context.Context,
+		email string,
+		clientID string,
+	) ([]string, error)
+	SaveConsent(
+		ctx context.Context,
+		email string,
+		clientID string,
+		scopes []string,
+	) error
+}
+
+type CodeStore interface {
+	SaveAuthorizationCode(
+		ctx context.Context,
+		codeHash string,
+		code models.AuthorizationCode,
+		ttl time.Duration,
+	) error
+	ConsumeAuthorizationCode(
+		ctx context.Context,
+		codeHash string,
+	) (models.AuthorizationCode, error)
+}
+
+type RefreshTokenStore interface {
+	SaveRefreshToken(
+		ctx context.Context,
+		tokenHash string,
+		token models.RefreshToken,
+		ttl time.Duration,
+	) (models.RefreshToken, error)
+	RotateRefreshToken(
+		ctx context.Context,
+		clientID string,
+		tokenHash string,
+		newTokenHash string,
+		ttl time.Duration,
+	) (models.RefreshToken, error)
+}
+
+func New(
+	log *logger.Logger,
+	clientProvider ClientProvider,
+	clientAuth ClientAuthenticator,
+	users UserAuthenticator,
+	grants GrantProvider,
+	consents ConsentStore,
+	codes CodeStore,
+	refresh RefreshTokenStore,
+	accounts UserProvider,
+	devices DeviceAuthorizationStore,
+	registrar DeviceRegistrar,
+	oidc OIDC,
+	secretKey string,
+	tokenTTL time.Duration,
+	lifetimes Lifetimes,
+	device DeviceFlow,
+) *OAuth {
+	return &OAuth{
+		log:       log,
+		clients:   clientProvider,
+		auth:      clientAuth,
+		users:     users,
+		grants:    grants,
+		consents:  consents,
+		codes:     codes,
+		refresh:   refresh,
+		accounts:  accounts,
+		devices:   devices,
+		registrar: registrar,
+		oidc:      oidc,
+		secretKey: secretKey,
+		tokenTTL:  tokenTTL,
+		lifetimes: lifetimes,
+		device:    device,
+	}
+}
+
+// Validate checks the authorization request and fills in the defaults: the only registered
+// redirect URI and all of the client scopes. Until the redirect URI is validated errors are
+// ErrInvalidRedirectURI or clients.ErrInvalidClient, the others may be sent to the client
+func (o *OAuth) Validate(
+	ctx context.Context,
+	req AuthorizationRequest,
+) (AuthorizationRequest, models.Client, error) {
+	const op = "OAuth.Validate"
+	log := o.log.With(zap.String("op", op), zap.String("client_id", req.ClientID))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	client, err := o.clients.Client(ctx, req.ClientID)
+	if err != nil {
+		if errors.Is(err, storage.ErrClientNotFound) {
+			log.Warn("client not found")
+			return req, models.Client{}, fmt.Errorf("%s: %w", op, clients.ErrInvalidClient)
+		}
+		log.Error("failed to get client", zap.Error(err))
+		return req, models.Client{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if req.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+	}
+	if !contains(client.RedirectURIs, req.RedirectURI) {
+		log.Warn("redirect uri not registered", zap.String("redirect_uri", req.RedirectURI))
+		return req, client, fmt.Errorf("%s: %w", op, ErrInvalidRedirectURI)
+	}
+
+	if req.ResponseType != "code" {
+		return req, client, fmt.Errorf("%s: %w", op, ErrUnsupportedResponseType)
+	}
+	if req.CodeChallenge == "" {
+		return req, client, fmt.Errorf("%s: %w", op, ErrInvalidRequest)
+	}
+	if req.CodeChallengeMethod != "S256" {
+		return req, client, fmt.Errorf("%s: %w", op, ErrUnsupportedChallengeType)
+	}
+	if len(req.Scopes) == 0 {
+		req.Scopes = client.Scopes
+	}
+	for _, s := range req.Scopes {
+		if !contains(client.Scopes, s) {
+			log.Warn("scope not allowed", zap.String("scope", s))
+			return req, client, fmt.Errorf("%s: %w", op, ErrInvalidScope)
+		}
+	}
+
+	return req, client, nil
+}
+
+// Login authenticates the user with the first-party login. The application is not saved as a device,
+// so it takes no slot of the device limits. The code is issued right away when the user already consented to the scopes
+func (o *OAuth) Login(
+	ctx context.Context,
+	req AuthorizationRequest,
+	email string,
+	password string,
+) (Decision, error) {
+	const op = "OAuth.Login"
+	log := o.log.With(zap.String("op", op), zap.String("client_id", req.ClientID))
+
+	req, _, err := o.Validate(ctx, req)
+	if err != nil {
+		return Decision{}, fmt.Errorf("%s: %w", op, err)
+	}
+	// Login masks the email by its first characters
+	if len(email) < 5 || !strings.Contains(email, "@") || password == "" {
+		return Decision{}, fmt.Errorf("%s: %w", op, ErrInvalidCredentials)
+	}
+
+	device := DevicePrefix + req.ClientID
+	user, err := o.users.VerifyPassword(ctx, email, password, device)
+	if err != nil {
+		return Decision{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	consented, err := o.consents.Consent(ctx, user.Email, req.ClientID)
+	if err != nil && !errors.Is(err, storage.ErrConsentNotFound) {
+		log.Error("failed to get consent", zap.Error(err))
+		return Decision{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if covers(consented, req.Scopes) {
+		code, err := o.issueCode(ctx, user.Email, req, time.Now())
+		if err != nil {
+			return Decision{}, fmt.Errorf("%s: %w", op, err)
+		}
+		return Decision{Code: code, Email: user.Email}, nil
+	}
+
+	ticket, err := jwt.NewActionToken(
+		tenant.SecretKey(ctx, o.secretKey),
+		consentPurpose,
+		user.Email,
+		device,
+		fingerprint(req),
+		o.lifetimes.Consent,
+	)
+	if err != nil {
+		log.Error("failed to generate consent ticket", zap.Error(err))
+		return Decision{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return Decision{ConsentTicket: ticket, Email: user.Email}, nil
+}
+
+// Consent records the decision of the user shown the consent page and issues the code when approved
+func (o *OAuth) Consent(
+	ctx context.Context,
+	req AuthorizationRequest,
+	ticket string,
+	approved bool,
+) (string, error) {
+	const op = "OAuth.Consent"
+	log := o.log.With(zap.String("op", op), zap.String("client_id", req.ClientID))
+
+	req, _, err := o.Validate(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	// the ticket is bound to the request, so it cannot approve other scopes or another client
+	claims, err := jwt.DecodeActionToken(tenant.SecretKey(ctx, o.secretKey), consentPurpose, ticket)
+	if err != nil || claims.Fingerprint != fingerprint(req) {
+		log.Warn("invalid consent ticket", zap.Error(err))
+		return "", fmt.Errorf("%s: %w", op, ErrInvalidConsentTicket)
+	}
+	if !approved {
+		log.Info("consent denied")
+		return "", fmt.Errorf("%s: %w", op, ErrAccessDenied)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	if err := o.consents.SaveConsent(ctx, claims.User, req.ClientID, req.Scopes); err != nil {
+		log.Error("failed to save consent", zap.Error(err))
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	// the user authenticated when the ticket was issued
+	code, err := o.issueCode(ctx, claims.User, req, claims.IssuedAt)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return code, nil
+}
+
+// ExchangeCode is the authorization_code grant. The code is consumed even when the exchange fails
+func (o *OAuth) ExchangeCode(
+	ctx context.Context,
+	creds clients.Credentials,
+	code string,
+	redirectURI string,
+	codeVerifier string,
+) (TokenSet, error) {
+	const op = "OAuth.ExchangeCode"
+
+	client, err := o.auth.Authenticate(ctx, creds)
+	if err != nil {
+		return TokenSet{}, fmt.Errorf("%s: %w", op, err)
+	}
+	log := o.log.With(zap.String("op", op), zap.String("client_id", client.ID))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	authorized, err := o.codes.ConsumeAuthorizationCode(ctx, hash(code))
+	if err != nil {
+		if errors.Is(err, storage.ErrCodeNotFound) {
+			log.Warn("code not found")
+			return TokenSet{}, fmt.Errorf("%s: %w", op, ErrInvalidGrant)
+		}
+		log.Error("failed to consume code", zap.Error(err))
+		return TokenSet{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if authorized.ClientID != client.ID || authorized.RedirectURI != redirectURI {
+		log.Warn("code issued to another client or redirect uri")
+		return TokenSet{}, fmt.Errorf("%s: %w", op, ErrInvalidGrant)
+	}
+	if !verifyChallenge(authorized.CodeChallenge, codeVerifier) {
+		log.Warn("code verifier mismatch")
+		return TokenSet{}, fmt.Errorf("%s: %w", op, ErrInvalidGrant)
+	}
+
+	refreshToken, err := randomString(32)
+	if err != nil {
+		log.Error("failed to generate refresh token", zap.Error(err))
+		return TokenSet{}, fmt.Errorf("%s: %w", op, err)
+	}
+	_, err = o.refresh.SaveRefreshToken(ctx, hash(refreshToken), models.RefreshToken{
+		Email:    authorized.Email,
+		ClientID: client.ID,
+		Scopes:   authorized.Scopes,
+		AuthTime: authorized.AuthTime,
+		AMR:      authorized.AMR,
+	}, o.lifetimes.Refresh)
+	if err != nil {
+		log.Error("failed to save refresh token", zap.Error(err))
+		return TokenSet{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	tokens, err := o.accessToken(ctx, authorized.Email, client.ID, "", authorized.Scopes)
+	if err != nil {
+		log.Error("failed to generate access token", zap.Error(err))
+		return TokenSet{}, fmt.Errorf("%s: %w", op, err)
+	}
+	tokens.RefreshToken = refreshToken
+	if contains(authorized.Scopes, models.ScopeOpenID) {
+		tokens.IDToken, err = o.idToken(ctx, authorized.Email, client.ID, authorized.Scopes,
+			authorized.Nonce, authorized.AuthTime, authorized.AMR)
+		if err != nil {
+			log.Error("failed to generate id token", zap.Error(err))
+			return TokenSet{}, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	return tokens, nil
+}
+
+// Refresh is the refresh_token grant. The refresh token is rotated, the access token may ask
+// for fewer scopes than the authorization granted
+func (o *OAuth) Refresh(
+	ctx context.Context,
+	creds clients.Credentials,
+	refreshToken string,
+	scopes []string,
+) (TokenSet, error) {
+	const op = "OAuth.Refresh"
+
+	client, err := o.auth.Authenticate(ctx, creds)
+	if err != nil {
+		return TokenSet{}, fmt.Errorf("%s: %w", op, err)
+	}
+	log := o.log.With(zap.String("op", op), zap.String("client_id", client.ID))
+
+	next, err := randomString(32)
+	if err != nil {
+		log.Error("failed to generate refresh token", zap.Error(err))
+		return TokenSet{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	rotated, err := o.refresh.RotateRefreshToken(ctx, client.ID, hash(refreshToken), hash(next), o.lifetimes.Refresh)
+	if err != nil {
+		if errors.Is(err, storage.ErrTokenReused) {
+			log.Warn("refresh token reused, family revoked")
+			return TokenSet{}, fmt.Errorf("%s: %w", op, ErrInvalidGrant)
+		}
+		if errors.Is(err, storage.ErrTokenNotFound) {
+			log.Warn("refresh token not found")
+			return TokenSet{}, fmt.Errorf("%s: %w", op, ErrInvalidGrant)
+		}
+		log.Error("failed to rotate refresh token", zap.Error(err))
+		return TokenSet{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if len(scopes) == 0 {
+		scopes = rotated.Scopes
+	}
+	if !covers(rotated.Scopes, scopes) {
+		log.Warn("scope not granted")
+		return TokenSet{}, fmt.Errorf("%s: %w", op, ErrInvalidScope)
+	}
+
+	tokens, err := o.accessToken(ctx, rotated.Email, client.ID, rotated.DeviceAddress, scopes)
+	if err != nil {
+		log.Error("failed to generate access token", zap.Error(err))
+		return TokenSet{}, fmt.Errorf("%s: %w", op, err)
+	}
+	tokens.RefreshToken = next
+	if contains(scopes, models.ScopeOpenID) {
+		// a refreshed ID token has no nonce, OpenID Connect Core section 12.2
+		tokens.IDToken, err = o.idToken(ctx, rotated.Email, client.ID, scopes, "", rotated.AuthTime, rotated.AMR)
+		if err != nil {
+			log.Error("failed to generate id token", zap.Error(err))
+			return TokenSet{}, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	return tokens, nil
+}
+
+// accessToken issues the access token of the application, it grants the permissions
+// of the user that are among the scopes. Without a device address the token is bound
+// to the application itself
+func (o *OAuth) accessToken(
+	ctx context.Context,
+	email string,
+	clientID string,
+	deviceAddress string,
+	scopes []string,
+) (TokenSet, error) {
+	_, permissions, err := o.grants.UserAccess(ctx, email)
+	if err != nil {
+		return TokenSet{}, err
+	}
+	granted := make([]string, 0, len(scopes))
+	for _, s := range scopes {
+		if contains(permissions, s) {
+			granted = append(granted, s)
+		}
+	}
+
+	if deviceAddress == "" {
+		deviceAddress = DevicePrefix + clientID
+	}
+	ttl := tenant.TokenTTL(ctx, o.tokenTTL)
+	token, err := jwt.NewToken(
+		jwt.Claims{
+			Email:         email,
+			DeviceAddress: deviceAddress,
+			Permissions:   granted,
+			ClientID:      clientID,
+			Scopes:        scopes,
+			Tenant:        tenant.ID(ctx),
+		},
+		ttl,
+		tenant.SecretKey(ctx, o.secretKey),
+	)
+	if err != nil {
+		return TokenSet{}, err
+	}
+
+	return TokenSet{
+		AccessToken: token,
+		ExpiresIn:   ttl,
+		Scopes:      scopes,
+	}, nil
+}
+
+// UserInfo returns the claims of the user the access token was issued for, selected by its scopes
+func (o *OAuth) UserInfo(
+	ctx context.Context,
+	accessToken string,
+) (map[string]any, error) {
+	const op = "OAuth.UserInfo"
+
+	claims, err := o.users.VerifyToken(ctx, accessToken)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, ErrInvalidToken)
+	}
+	if claims.Email == "" || !contains(claims.Scopes, models.ScopeOpenID) {
+		return nil, fmt.Errorf("%s: %w", op, ErrInsufficientScope)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	user, err := o.accounts.User(ctx, claims.Email)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return nil, fmt.Errorf("%s: %w", op, ErrInvalidToken)
+		}
+		o.log.Error("failed to get user", zap.String("op", op), zap.Error(err))
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return userClaims(user, claims.Scopes), nil
+}
+
+// Metadata is the OpenID Connect discovery document of the provider
+type Metadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// Discovery describes the endpoints and what they support
+func (o *OAuth) Discovery() Metadata {
+	issuer := strings.TrimSuffix(o.oidc.Issuer, "/")
+	return Metadata{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/authorize",
+		TokenEndpoint:                     issuer + "/token",
+		UserInfoEndpoint:                  issuer + "/userinfo",
+		DeviceAuthorizationEndpoint:       issuer + "/device_authorization",
+		JWKSURI:                           issuer + "/.well-known/jwks.json",
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token", "client_credentials", DeviceCodeGrantType},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{"RS256"},
+		ScopesSupported:                   []string{models.ScopeOpenID, models.ScopeEmail, models.ScopeProfile},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "private_key_jwt", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported: []string{
+			"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "amr",
+			"email", "email_verified", "preferred_username",
+		},
+	}
+}
+
+// JWKS returns the keys the ID tokens are verified with
+func (o *OAuth) JWKS() []jwt.JWK {
+	return o.oidc.Signer.JWKS()
+}
+
+// idToken issues the ID token of the user for the client, it carries the claims of the scopes too
+func (o *OAuth) idToken(
+	ctx context.Context,
+	email string,
+	clientID string,
+	scopes []string,
+	nonce string,
+	authTime time.Time,
+	amr []string,
+) (string, error) {
+	user, err := o.accounts.User(ctx, email)
+	if err != nil {
+		return "", err
+	}
+
+	claims := userClaims(user, scopes)
+	claims["iss"] = strings.TrimSuffix(o.oidc.Issuer, "/")
+	claims["aud"] = clientID
+	claims["azp"] = clientID
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	if !authTime.IsZero() {
+		claims["auth_time"] = authTime.Unix()
+	}
+	if len(amr) > 0 {
+		claims["amr"] = amr
+	}
+
+	return o.oidc.Signer.Sign(claims, tenant.TokenTTL(ctx, o.tokenTTL))
+}
+
+// userClaims maps the account to the standard claims of the scopes. The account has no name,
+// the profile scope only brings preferred_username. Emails are not verified at registration
+func userClaims(user models.User, scopes []string) map[string]any {
+	claims := map[string]any{
+		"sub": strconv.FormatUint(user.ID, 10),
+	}
+	if contains(scopes, models.ScopeEmail) {
+		claims["email"] = user.Email
+		claims["email_verified"] = false
+	}
+	if contains(scopes, models.ScopeProfile) {
+		claims["preferred_username"] = user.Email
+	}
+	return claims
+}
+
+func (o *OAuth) issueCode(
+	ctx context.Context,
+	email string,
+	req AuthorizationRequest,
+	authTime time.Time,
+) (string, error) {
+	code, err := randomString(32)
+	if err != nil {
+		o.log.Error("failed to generate code", zap.Error(err))
+		return "", err
+	}
+	err = o.codes.SaveAuthorizationCode(ctx, hash(code), models.AuthorizationCode{
+		Email:         email,
+		ClientID:      req.ClientID,
+		RedirectURI:   req.RedirectURI,
+		Scopes:        req.Scopes,
+		CodeChallenge: req.CodeChallenge,
+		Nonce:         req.Nonce,
+		AuthTime:      authTime,
+		AMR:           []string{amrPassword},
+	}, o.lifetimes.Code)
+	if err != nil {
+		o.log.Error("failed to save code", zap.Error(err))
+		return "", err
+	}
+
+	return code, nil
+}
+
+// verifyChallenge checks the PKCE verifier against the S256 challenge, RFC 7636 section 4.6
+func verifyChallenge(challenge string, verifier string) bool {
+	if len(verifier) < minVerifierLength || len(verifier) > maxVerifierLength {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// fingerprint binds a consent ticket to the request it was issued for
+func fingerprint(req AuthorizationRequest) string {
+	return hash(strings.Join([]string{
+		req.ClientID,
+		req.RedirectURI,
+		strings.Join(req.Scopes, " "),
+		req.CodeChallenge,
+		req.Nonce,
+	}, "\n"))
+}
+
+// covers reports whether every scope of the request is among the granted ones
+func covers(granted []string, requested []string) bool {
+	for _, s := range requested {
+		if !contains(granted, s) {
+			return false
+		}
+	}
+	return true
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,531 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/jwt"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/services/clients"
+	"vieo/auth/internal/storage"
+
+	jwtv5 "github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+func TestVerifyChallenge(t *testing.T) {
+	// the example of RFC 7636 appendix B
+	const (
+		rfcVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+		rfcChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	)
+	s256 := func(verifier string) string {
+		sum := sha256.Sum256([]byte(verifier))
+		return base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	shortest := strings.Repeat("a", minVerifierLength)
+	longest := strings.Repeat("a", maxVerifierLength)
+
+	tests := []struct {
+		name      string
+		challenge string
+		verifier  string
+		want      bool
+	}{
+		{"rfc example", rfcChallenge, rfcVerifier, true},
+		{"shortest verifier", s256(shortest), shortest, true},
+		{"longest verifier", s256(longest), longest, true},
+		{"another verifier", rfcChallenge, strings.Repeat("b", minVerifierLength), false},
+		{"plain challenge", rfcVerifier, rfcVerifier, false},
+		{"padded challenge", rfcChallenge + "=", rfcVerifier, false},
+		{"too short", s256(shortest[1:]), shortest[1:], false},
+		{"too long", s256(longest + "a"), longest + "a", false},
+		{"no verifier", rfcChallenge, "", false},
+		{"no challenge", "", rfcVerifier, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyChallenge(tt.challenge, tt.verifier); got != tt.want {
+				t.Errorf("verifyChallenge(%q, %q) = %v, want %v", tt.challenge, tt.verifier, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCovers(t *testing.T) {
+	tests := []struct {
+		name      string
+		granted   []string
+		requested []string
+		want      bool
+	}{
+		{"same scopes", []string{"openid", "profile"}, []string{"openid", "profile"}, true},
+		{"fewer scopes", []string{"openid", "profile"}, []string{"openid"}, true},
+		{"nothing requested", []string{"openid"}, nil, true},
+		{"more scopes", []string{"openid"}, []string{"openid", "email"}, false},
+		{"nothing granted", nil, []string{"openid"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := covers(tt.granted, tt.requested); got != tt.want {
+				t.Errorf("covers(%v, %v) = %v, want %v", tt.granted, tt.requested, got, tt.want)
+			}
+		})
+	}
+}
+
+const (
+	testSecret  = "secret"
+	testIssuer  = "https://auth.vieo.example.com/"
+	redirectURI = "https://app.example.com/callback"
+	// verifier is the PKCE verifier of the tests, challenge its S256 challenge
+	verifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+var alice = models.User{ID: 7, Email: "alice@example.com"}
+
+// testClients knows the tv-app client, its secret is "secret"
+type testClients struct{}
+
+var tvApp = models.Client{
+	ID:           "tv-app",
+	Scopes:       []string{models.ScopeOpenID, models.ScopeEmail, models.ScopeProfile, "catalog:read", "catalog:write"},
+	RedirectURIs: []string{redirectURI},
+}
+
+func (testClients) Client(_ context.Context, clientID string) (models.Client, error) {
+	if clientID != tvApp.ID {
+		return models.Client{}, storage.ErrClientNotFound
+	}
+	return tvApp, nil
+}
+
+func (testClients) Authenticate(_ context.Context, creds clients.Credentials) (models.Client, error) {
+	if creds.ClientID != tvApp.ID || creds.ClientSecret != "secret" {
+		return models.Client{}, clients.ErrInvalidClient
+	}
+	return tvApp, nil
+}
+
+// testUsers signs alice in with the password "password" and verifies the tokens of the service
+type testUsers struct{}
+
+func (testUsers) VerifyPassword(_ context.Context, email, password, _ string) (models.User, error) {
+	if email != alice.Email || password != "password" {
+		return models.User{}, ErrInvalidCredentials
+	}
+	return alice, nil
+}
+
+func (testUsers) VerifyToken(_ context.Context, accessToken string) (jwt.Claims, error) {
+	return jwt.DecodeClientToken(testSecret, accessToken)
+}
+
+func (testUsers) User(_ context.Context, email string) (models.User, error) {
+	if email != alice.Email {
+		return models.User{}, storage.ErrUserNotFound
+	}
+	return alice, nil
+}
+
+// UserAccess grants alice catalog:read only
+func (testUsers) UserAccess(context.Context, string) ([]string, []string, error) {
+	return []string{"viewer"}, []string{"catalog:read"}, nil
+}
+
+// memoryGrants keeps the consents, the codes, the refresh tokens and the device authorizations
+// like the database, and the devices registered for the user
+type memoryGrants struct {
+	consents    map[string][]string
+	codes       map[string]models.AuthorizationCode
+	refresh     map[string]models.RefreshToken
+	rotated     map[string]bool
+	deviceAuths map[string]*deviceAuthorization
+	registered  []string
+}
+
+func newMemoryGrants() *memoryGrants {
+	return &memoryGrants{
+		consents:    map[string][]string{},
+		codes:       map[string]models.AuthorizationCode{},
+		refresh:     map[string]models.RefreshToken{},
+		rotated:     map[string]bool{},
+		deviceAuths: map[string]*deviceAuthorization{},
+	}
+}
+
+func (m *memoryGrants) Consent(_ context.Context, email string, clientID string) ([]string, error) {
+	scopes, ok := m.consents[email+"/"+clientID]
+	if !ok {
+		return nil, storage.ErrConsentNotFound
+	}
+	return scopes, nil
+}
+
+func (m *memoryGrants) SaveConsent(_ context.Context, email string, clientID string, scopes []string) error {
+	m.consents[email+"/"+clientID] = scopes
+	return nil
+}
+
+func (m *memoryGrants) SaveAuthorizationCode(_ context.Context, codeHash string, code models.AuthorizationCode, _ time.Duration) error {
+	m.codes[codeHash] = code
+	return nil
+}
+
+func (m *memoryGrants) ConsumeAuthorizationCode(_ context.Context, codeHash string) (models.AuthorizationCode, error) {
+	code, ok := m.codes[codeHash]
+	if !ok {
+		return models.AuthorizationCode{}, storage.ErrCodeNotFound
+	}
+	delete(m.codes, codeHash)
+	return code, nil
+}
+
+func (m *memoryGrants) SaveRefreshToken(_ context.Context, tokenHash string, token models.RefreshToken, _ time.Duration) (models.RefreshToken, error) {
+	m.refresh[tokenHash] = token
+	return token, nil
+}
+
+func (m *memoryGrants) RotateRefreshToken(_ context.Context, clientID string, tokenHash string, newTokenHash string, _ time.Duration) (models.RefreshToken, error) {
+	if m.rotated[tokenHash] {
+		return models.RefreshToken{}, storage.ErrTokenReused
+	}
+	token, ok := m.refresh[tokenHash]
+	if !ok || token.ClientID != clientID {
+		return models.RefreshToken{}, storage.ErrTokenNotFound
+	}
+	m.rotated[tokenHash] = true
+	m.refresh[newTokenHash] = token
+	return token, nil
+}
+
+// newOAuth creates the authorization server of tv-app with an RSA signer of the ID tokens
+func newOAuth(t *testing.T) (*OAuth, *memoryGrants, *rsa.PublicKey) {
+	t.Helper()
+
+	signer, err := jwt.GenerateSigner()
+	if err != nil {
+		t.Fatalf("GenerateSigner: %v", err)
+	}
+	grants := newMemoryGrants()
+	o := New(
+		&logger.Logger{SugaredLogger: zap.NewNop().Sugar()},
+		testClients{},
+		testClients{},
+		testUsers{},
+		testUsers{},
+		grants,
+		grants,
+		grants,
+		testUsers{},
+		grants,
+		grants,
+		OIDC{Issuer: testIssuer, Signer: signer},
+		testSecret,
+		time.Hour,
+		Lifetimes{Code: time.Minute, Refresh: time.Hour, Consent: time.Minute},
+		DeviceFlow{VerificationURI: "https://vieo.example.com/activate", CodeTTL: time.Minute, Interval: time.Hour},
+	)
+	return o, grants, publicKey(t, o)
+}
+
+// publicKey reads the key of the JWKS, as a relying party does
+func publicKey(t *testing.T, o *OAuth) *rsa.PublicKey {
+	t.Helper()
+
+	keys := o.JWKS()
+	if len(keys) != 1 || keys[0].Kty != "RSA" || keys[0].Alg != "RS256" || keys[0].Kid == "" {
+		t.Fatalf("JWKS = %+v, want one RS256 key", keys)
+	}
+	var key rsa.PublicKey
+	n, errN := base64.RawURLEncoding.DecodeString(keys[0].N)
+	e, errE := base64.RawURLEncoding.DecodeString(keys[0].E)
+	if errN != nil || errE != nil {
+		t.Fatalf("JWKS key encoding: %v, %v", errN, errE)
+	}
+	key.N = new(big.Int).SetBytes(n)
+	key.E = int(new(big.Int).SetBytes(e).Int64())
+	return &key
+}
+
+// idTokenClaims verifies the ID token with the key of the JWKS
+func idTokenClaims(t *testing.T, key *rsa.PublicKey, idToken string) jwtv5.MapClaims {
+	t.Helper()
+
+	claims := jwtv5.MapClaims{}
+	_, err := jwtv5.ParseWithClaims(idToken, claims, func(*jwtv5.Token) (any, error) {
+		return key, nil
+	}, jwtv5.WithValidMethods([]string{"RS256"}))
+	if err != nil {
+		t.Fatalf("ID token not valid: %v", err)
+	}
+	return claims
+}
+
+var tvCreds = clients.Credentials{ClientID: tvApp.ID, ClientSecret: "secret"}
+
+func authorizationRequest(scopes ...string) AuthorizationRequest {
+	return AuthorizationRequest{
+		ClientID:            tvApp.ID,
+		RedirectURI:         redirectURI,
+		ResponseType:        "code",
+		Scopes:              scopes,
+		State:               "state",
+		CodeChallenge:       challenge,
+		CodeChallengeMethod: "S256",
+		Nonce:               "n-0S6_WzA2Mj",
+	}
+}
+
+// code signs alice in and consents when asked to
+func code(t *testing.T, o *OAuth, req AuthorizationRequest) string {
+	t.Helper()
+
+	decision, err := o.Login(context.Background(), req, alice.Email, "password")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if decision.Code != "" {
+		return decision.Code
+	}
+	code, err := o.Consent(context.Background(), req, decision.ConsentTicket, true)
+	if err != nil {
+		t.Fatalf("Consent: %v", err)
+	}
+	return code
+}
+
+// authorize signs alice in, consents and exchanges the code for tokens
+func authorize(t *testing.T, o *OAuth, req AuthorizationRequest) TokenSet {
+	t.Helper()
+
+	tokens, err := o.ExchangeCode(context.Background(), tvCreds, code(t, o, req), redirectURI, verifier)
+	if err != nil {
+		t.Fatalf("ExchangeCode: %v", err)
+	}
+	return tokens
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	o, grants, _ := newOAuth(t)
+	req := authorizationRequest("catalog:read", "catalog:write")
+
+	decision, err := o.Login(context.Background(), req, alice.Email, "password")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if decision.Code != "" || decision.ConsentTicket == "" {
+		t.Fatalf("first Login = %+v, want the consent page", decision)
+	}
+	tokens := authorize(t, o, req)
+
+	claims, err := jwt.DecodeClientToken(testSecret, tokens.AccessToken)
+	if err != nil {
+		t.Fatalf("access token: %v", err)
+	}
+	// the token holds the scopes, but grants only the permissions alice has
+	if claims.Email != alice.Email || claims.ClientID != tvApp.ID ||
+		!slices.Equal(claims.Scopes, req.Scopes) || !slices.Equal(claims.Permissions, []string{"catalog:read"}) {
+		t.Errorf("access token claims = %+v", claims)
+	}
+	if tokens.RefreshToken == "" || len(grants.refresh) != 1 {
+		t.Errorf("refresh token %q, %d saved, want one", tokens.RefreshToken, len(grants.refresh))
+	}
+
+	// the consent is remembered, the next sign in gets the code right away
+	decision, err = o.Login(context.Background(), authorizationRequest("catalog:read"), alice.Email, "password")
+	if err != nil || decision.Code == "" {
+		t.Errorf("second Login = %+v, %v, want a code", decision, err)
+	}
+}
+
+func TestExchangeCodeRejects(t *testing.T) {
+	tests := []struct {
+		name        string
+		creds       clients.Credentials
+		redirectURI string
+		verifier    string
+		want        error
+	}{
+		{"another verifier", tvCreds, redirectURI, strings.Repeat("b", minVerifierLength), ErrInvalidGrant},
+		{"no verifier", tvCreds, redirectURI, "", ErrInvalidGrant},
+		{"another redirect uri", tvCreds, "https://app.example.com/other", verifier, ErrInvalidGrant},
+		{"wrong client secret", clients.Credentials{ClientID: tvApp.ID, ClientSecret: "guess"}, redirectURI, verifier, clients.ErrInvalidClient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, _, _ := newOAuth(t)
+			c := code(t, o, authorizationRequest("catalog:read"))
+
+			if _, err := o.ExchangeCode(context.Background(), tt.creds, c, tt.redirectURI, tt.verifier); !errors.Is(err, tt.want) {
+				t.Errorf("ExchangeCode error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("code used twice", func(t *testing.T) {
+		o, _, _ := newOAuth(t)
+		c := code(t, o, authorizationRequest("catalog:read"))
+
+		if _, err := o.ExchangeCode(context.Background(), tvCreds, c, redirectURI, verifier); err != nil {
+			t.Fatalf("ExchangeCode: %v", err)
+		}
+		if _, err := o.ExchangeCode(context.Background(), tvCreds, c, redirectURI, verifier); !errors.Is(err, ErrInvalidGrant) {
+			t.Errorf("second ExchangeCode error = %v, want %v", err, ErrInvalidGrant)
+		}
+	})
+}
+
+func TestConsent(t *testing.T) {
+	o, grants, _ := newOAuth(t)
+	req := authorizationRequest("catalog:read")
+	decision, err := o.Login(context.Background(), req, alice.Email, "password")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+
+	// the ticket approves the request it was issued for, not more scopes
+	if _, err := o.Consent(context.Background(), authorizationRequest("catalog:read", "catalog:write"), decision.ConsentTicket, true); !errors.Is(err, ErrInvalidConsentTicket) {
+		t.Errorf("Consent to other scopes error = %v, want %v", err, ErrInvalidConsentTicket)
+	}
+	if _, err := o.Consent(context.Background(), req, decision.ConsentTicket, false); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("denied Consent error = %v, want %v", err, ErrAccessDenied)
+	}
+	if len(grants.consents) != 0 || len(grants.codes) != 0 {
+		t.Errorf("rejected consents saved %v, issued %d codes", grants.consents, len(grants.codes))
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	o, _, _ := newOAuth(t)
+	tokens := authorize(t, o, authorizationRequest("catalog:read", "catalog:write"))
+
+	refreshed, err := o.Refresh(context.Background(), tvCreds, tokens.RefreshToken, []string{"catalog:read"})
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if refreshed.RefreshToken == tokens.RefreshToken || !slices.Equal(refreshed.Scopes, []string{"catalog:read"}) {
+		t.Errorf("Refresh = %+v, want a new refresh token and the narrowed scopes", refreshed)
+	}
+
+	if _, err := o.Refresh(context.Background(), tvCreds, refreshed.RefreshToken, []string{"users:write"}); !errors.Is(err, ErrInvalidScope) {
+		t.Errorf("Refresh with a scope never granted error = %v, want %v", err, ErrInvalidScope)
+	}
+	// a rotated token is spent
+	if _, err := o.Refresh(context.Background(), tvCreds, tokens.RefreshToken, nil); !errors.Is(err, ErrInvalidGrant) {
+		t.Errorf("reused Refresh error = %v, want %v", err, ErrInvalidGrant)
+	}
+}
+
+func TestIDToken(t *testing.T) {
+	o, _, key := newOAuth(t)
+
+	before := time.Now().Add(-time.Second).Unix()
+	tokens := authorize(t, o, authorizationRequest(models.ScopeOpenID, models.ScopeEmail))
+	if tokens.IDToken == "" {
+		t.Fatal("no ID token for the openid scope")
+	}
+	claims := idTokenClaims(t, key, tokens.IDToken)
+
+	for name, want := range map[string]any{
+		"iss":            "https://auth.vieo.example.com",
+		"aud":            tvApp.ID,
+		"azp":            tvApp.ID,
+		"sub":            "7",
+		"nonce":          "n-0S6_WzA2Mj",
+		"email":          alice.Email,
+		"email_verified": false,
+	} {
+		if claims[name] != want {
+			t.Errorf("claim %s = %v, want %v", name, claims[name], want)
+		}
+	}
+	if authTime, _ := claims["auth_time"].(float64); int64(authTime) < before {
+		t.Errorf("auth_time = %v, want the time of the login", claims["auth_time"])
+	}
+	if amr, _ := claims["amr"].([]any); len(amr) != 1 || amr[0] != "pwd" {
+		t.Errorf("amr = %v, want [pwd]", claims["amr"])
+	}
+	// the profile scope was not asked for
+	if _, ok := claims["preferred_username"]; ok {
+		t.Errorf("preferred_username without the profile scope")
+	}
+}
+
+func TestNoIDTokenWithoutOpenID(t *testing.T) {
+	o, _, _ := newOAuth(t)
+
+	if tokens := authorize(t, o, authorizationRequest("catalog:read")); tokens.IDToken != "" {
+		t.Errorf("ID token issued without the openid scope")
+	}
+}
+
+func TestRefreshedIDTokenHasNoNonce(t *testing.T) {
+	o, _, key := newOAuth(t)
+	tokens := authorize(t, o, authorizationRequest(models.ScopeOpenID, models.ScopeProfile))
+
+	refreshed, err := o.Refresh(context.Background(), clients.Credentials{ClientID: tvApp.ID, ClientSecret: "secret"}, tokens.RefreshToken, nil)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	claims := idTokenClaims(t, key, refreshed.IDToken)
+	if _, ok := claims["nonce"]; ok {
+		t.Errorf("refreshed ID token has the nonce %v", claims["nonce"])
+	}
+	if claims["sub"] != "7" || claims["preferred_username"] != alice.Email {
+		t.Errorf("claims = %v, want the profile of alice", claims)
+	}
+}
+
+func TestUserInfo(t *testing.T) {
+	o, _, _ := newOAuth(t)
+	withOpenID := authorize(t, o, authorizationRequest(models.ScopeOpenID, models.ScopeEmail))
+	withoutOpenID := authorize(t, o, authorizationRequest("catalog:read"))
+
+	claims, err := o.UserInfo(context.Background(), withOpenID.AccessToken)
+	if err != nil {
+		t.Fatalf("UserInfo: %v", err)
+	}
+	if claims["sub"] != "7" || claims["email"] != alice.Email {
+		t.Errorf("UserInfo = %v, want the email claims of alice", claims)
+	}
+
+	if _, err := o.UserInfo(context.Background(), withoutOpenID.AccessToken); !errors.Is(err, ErrInsufficientScope) {
+		t.Errorf("UserInfo without openid error = %v, want %v", err, ErrInsufficientScope)
+	}
+	if _, err := o.UserInfo(context.Background(), "not a token"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("UserInfo of garbage error = %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	o, _, _ := newOAuth(t)
+
+	metadata := o.Discovery()
+	if metadata.Issuer != "https://auth.vieo.example.com" {
+		t.Errorf("issuer = %q, want it without the trailing slash", metadata.Issuer)
+	}
+	for name, got := range map[string]string{
+		"authorization": metadata.AuthorizationEndpoint,
+		"token":         metadata.TokenEndpoint,
+		"userinfo":      metadata.UserInfoEndpoint,
+		"jwks":          metadata.JWKSURI,
+	} {
+		if !strings.HasPrefix(got, metadata.Issuer+"/") {
+			t.Errorf("%s endpoint %q is not under the issuer", name, got)
+		}
+	}
+	if !slices.Equal(metadata.IDTokenSigningAlgValuesSupported, []string{"RS256"}) ||
+		!slices.Equal(metadata.CodeChallengeMethodsSupported, []string{"S256"}) {
+		t.Errorf("metadata = %+v, want RS256 ID tokens and S256 challenges", metadata)
+	}
+}
@@ -0,0 +1,268 @@
+package orgs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+const (
+	queryTime = 3 * time.Second
+)
+
+var (
+	// ErrNotAllowed is returned when the membership of the caller does not allow the change
+	ErrNotAllowed     = errors.New("not allowed in the organization")
+	ErrInvalidOrgRole = errors.New("invalid organization role")
+)
+
+// Orgs manages organizations and their members
+type Orgs struct {
+	log               *logger.Logger
+	orgs              OrganizationStore
+	events            EventRecorder
+	defaultMaxDevices int
+}
+
+type OrganizationStore interface {
+	CreateOrganization(
+		ctx context.Context,
+		name string,
+		maxDevices int,
+		ownerEmail string,
+	) (models.Organization, error)
+	Membership(
+		ctx context.Context,
+		orgID int64,
+		email string,
+	) (models.Membership, error)
+	Memberships(
+		ctx context.Context,
+		email string,
+	) ([]models.Membership, error)
+	SaveInvitation(
+		ctx context.Context,
+		orgID int64,
+		email string,
+		role string,
+		invitedBy string,
+	) error
+	ActivateMembership(
+		ctx context.Context,
+		orgID int64,
+		email string,
+	) error
+	DeleteMembership(
+		ctx context.Context,
+		orgID int64,
+		email string,
+	) error
+}
+
+type EventRecorder interface {
+	Record(
+		ctx context.Context,
+		event models.SecurityEvent,
+	)
+}
+
+// New creates the service, organizations created without a device limit get defaultMaxDevices
+func New(
+	log *logger.Logger,
+	orgs OrganizationStore,
+	events EventRecorder,
+	defaultMaxDevices int,
+) *Orgs {
+	return &Orgs{
+		log:               log,
+		orgs:              orgs,
+		events:            events,
+		defaultMaxDevices: defaultMaxDevices,
+	}
+}
+
+// CreateOrganization creates an organization owned by the caller
+func (o *Orgs) CreateOrganization(
+	ctx context.Context,
+	ownerEmail string,
+	name string,
+	maxDevices int,
+) (models.Organization, error) {
+	const op = "Orgs.CreateOrganization"
+	log := o.log.With(zap.String("op", op))
+
+	if maxDevices <= 0 {
+		maxDevices = o.defaultMaxDevices
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	org, err := o.orgs.CreateOrganization(ctx, name, maxDevices, ownerEmail)
+	if err != nil {
+		log.Error("failed to create organization", zap.Error(err))
+		return models.Organization{}, fmt.Errorf("%s: %w", op, err)
+	}
+	o.events.Record(ctx, models.SecurityEvent{
+		Email:  ownerEmail,
+		Type:   models.EventOrgJoined,
+		Reason: strconv.FormatInt(org.ID, 10),
+	})
+
+	log.Info("organization created", zap.Int64("org_id", org.ID))
+
+	return org, nil
+}
+
+// InviteMember invites a registered user. Owners and admins invite, only owners invite owners
+func (o *Orgs) InviteMember(
+	ctx context.Context,
+	actorEmail string,
+	orgID int64,
+	email string,
+	role string,
+) error {
+	const op = "Orgs.InviteMember"
+	log := o.log.With(zap.String("op", op), zap.Int64("org_id", orgID))
+
+	if !models.IsOrgRole(role) {
+		return fmt.Errorf("%s: %w", op, ErrInvalidOrgRole)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	actor, err := o.manager(ctx, orgID, actorEmail)
+	if err != nil {
+		log.Warn("invitation refused", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if role == models.OrgRoleOwner && actor.Role != models.OrgRoleOwner {
+		log.Warn("only owners invite owners")
+		return fmt.Errorf("%s: %w", op, ErrNotAllowed)
+	}
+
+	if err := o.orgs.SaveInvitation(ctx, orgID, email, role, actorEmail); err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) || errors.Is(err, storage.ErrMembershipAlreadyExists) {
+			log.Warn("failed to invite", zap.Error(err))
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("failed to invite", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// AcceptInvitation makes the invited user an active member
+func (o *Orgs) AcceptInvitation(
+	ctx context.Context,
+	email string,
+	orgID int64,
+) error {
+	const op = "Orgs.AcceptInvitation"
+	log := o.log.With(zap.String("op", op), zap.Int64("org_id", orgID))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	if err := o.orgs.ActivateMembership(ctx, orgID, email); err != nil {
+		if errors.Is(err, storage.ErrMembershipNotFound) {
+			log.Warn("no invitation", zap.Error(err))
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("failed to accept invitation", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	o.events.Record(ctx, models.SecurityEvent{
+		Email:  email,
+		Type:   models.EventOrgJoined,
+		Reason: strconv.FormatInt(orgID, 10),
+	})
+
+	return nil
+}
+
+// RemoveMember removes a member or declines an invitation. Members may leave on their own,
+// owners and admins remove others, only owners remove owners
+func (o *Orgs) RemoveMember(
+	ctx context.Context,
+	actorEmail string,
+	orgID int64,
+	email string,
+) error {
+	const op = "Orgs.RemoveMember"
+	log := o.log.With(zap.String("op", op), zap.Int64("org_id", orgID))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	if actorEmail != email {
+		actor, err := o.manager(ctx, orgID, actorEmail)
+		if err != nil {
+			log.Warn("removal refused", zap.Error(err))
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		member, err := o.orgs.Membership(ctx, orgID, email)
+		if err != nil {
+			log.Warn("failed to get membership", zap.Error(err))
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		if member.Role == models.OrgRoleOwner && actor.Role != models.OrgRoleOwner {
+			log.Warn("only owners remove owners")
+			return fmt.Errorf("%s: %w", op, ErrNotAllowed)
+		}
+	}
+
+	if err := o.orgs.DeleteMembership(ctx, orgID, email); err != nil {
+		if errors.Is(err, storage.ErrMembershipNotFound) || errors.Is(err, storage.ErrLastOwner) {
+			log.Warn("failed to remove member", zap.Error(err))
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("failed to remove member", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	o.events.Record(ctx, models.SecurityEvent{
+		Email:  email,
+		Type:   models.EventOrgLeft,
+		Reason: strconv.FormatInt(orgID, 10),
+	})
+
+	return nil
+}
+
+// Memberships returns the organizations of the user and the pending invitations
+func (o *Orgs) Memberships(
+	ctx context.Context,
+	email string,
+) ([]models.Membership, error) {
+	const op = "Orgs.Memberships"
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	memberships, err := o.orgs.Memberships(ctx, email)
+	if err != nil {
+		o.log.Error("failed to get memberships", zap.String("op", op), zap.Error(err))
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return memberships, nil
+}
+
+// manager returns the membership of the caller if it may manage members
+func (o *Orgs) manager(ctx context.Context, orgID int64, email string) (models.Membership, error) {
+	m, err := o.orgs.Membership(ctx, orgID, email)
+	if err != nil {
+		if errors.Is(err, storage.ErrMembershipNotFound) {
+			return models.Membership{}, ErrNotAllowed
+		}
+		return models.Membership{}, err
+	}
+	if m.Status != models.MembershipActive || (m.Role != models.OrgRoleOwner && m.Role != models.OrgRoleAdmin) {
+		return models.Membership{}, ErrNotAllowed
+	}
+	return m, nil
+}
@@ -0,0 +1,238 @@
+package orgs
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+const orgID = 1
+
+// memoryOrgs keeps the memberships of one organization by email
+type memoryOrgs struct {
+	maxDevices int
+	members    map[string]models.Membership
+}
+
+func (m *memoryOrgs) CreateOrganization(_ context.Context, name string, maxDevices int, ownerEmail string) (models.Organization, error) {
+	m.maxDevices = maxDevices
+	m.members[ownerEmail] = models.Membership{OrgID: orgID, Email: ownerEmail, Role: models.OrgRoleOwner, Status: models.MembershipActive}
+	return models.Organization{ID: orgID, Name: name, MaxDevices: maxDevices}, nil
+}
+
+func (m *memoryOrgs) Membership(_ context.Context, _ int64, email string) (models.Membership, error) {
+	member, ok := m.members[email]
+	if !ok {
+		return models.Membership{}, storage.ErrMembershipNotFound
+	}
+	return member, nil
+}
+
+func (m *memoryOrgs) Memberships(_ context.Context, email string) ([]models.Membership, error) {
+	if member, ok := m.members[email]; ok {
+		return []models.Membership{member}, nil
+	}
+	return nil, nil
+}
+
+func (m *memoryOrgs) SaveInvitation(_ context.Context, _ int64, email string, role string, invitedBy string) error {
+	if _, ok := m.members[email]; ok {
+		return storage.ErrMembershipAlreadyExists
+	}
+	m.members[email] = models.Membership{OrgID: orgID, Email: email, Role: role, Status: models.MembershipInvited, InvitedBy: invitedBy}
+	return nil
+}
+
+func (m *memoryOrgs) ActivateMembership(_ context.Context, _ int64, email string) error {
+	member, ok := m.members[email]
+	if !ok || member.Status != models.MembershipInvited {
+		return storage.ErrMembershipNotFound
+	}
+	member.Status = models.MembershipActive
+	m.members[email] = member
+	return nil
+}
+
+func (m *memoryOrgs) DeleteMembership(_ context.Context, _ int64, email string) error {
+	member, ok := m.members[email]
+	if !ok {
+		return storage.ErrMembershipNotFound
+	}
+	if member.Role == models.OrgRoleOwner {
+		owners := 0
+		for _, other := range m.members {
+			if other.Role == models.OrgRoleOwner && other.Status == models.MembershipActive {
+				owners++
+			}
+		}
+		if owners == 1 {
+			return storage.ErrLastOwner
+		}
+	}
+	delete(m.members, email)
+	return nil
+}
+
+type eventLog struct {
+	events []models.SecurityEvent
+}
+
+func (l *eventLog) Record(_ context.Context, event models.SecurityEvent) {
+	l.events = append(l.events, event)
+}
+
+// newOrg creates an organization of owner@example.com with an active member of every role
+// and a pending invitation of invited@example.com
+func newOrg(t *testing.T) (*Orgs, *memoryOrgs, *eventLog) {
+	t.Helper()
+
+	store := &memoryOrgs{members: map[string]models.Membership{}}
+	events := &eventLog{}
+	o := New(&logger.Logger{SugaredLogger: zap.NewNop().Sugar()}, store, events, 10)
+	if _, err := o.CreateOrganization(context.Background(), "owner@example.com", "acme", 0); err != nil {
+		t.Fatalf("CreateOrganization: %v", err)
+	}
+	for email, role := range map[string]string{
+		"owner2@example.com": models.OrgRoleOwner,
+		"admin@example.com":  models.OrgRoleAdmin,
+		"member@example.com": models.OrgRoleMember,
+	} {
+		store.members[email] = models.Membership{OrgID: orgID, Email: email, Role: role, Status: models.MembershipActive}
+	}
+	store.members["invited@example.com"] = models.Membership{
+		OrgID: orgID, Email: "invited@example.com", Role: models.OrgRoleAdmin, Status: models.MembershipInvited,
+	}
+	events.events = nil
+	return o, store, events
+}
+
+func TestCreateOrganization(t *testing.T) {
+	store := &memoryOrgs{members: map[string]models.Membership{}}
+	events := &eventLog{}
+	o := New(&logger.Logger{SugaredLogger: zap.NewNop().Sugar()}, store, events, 10)
+
+	org, err := o.CreateOrganization(context.Background(), "owner@example.com", "acme", 0)
+	if err != nil {
+		t.Fatalf("CreateOrganization: %v", err)
+	}
+	if org.MaxDevices != 10 {
+		t.Errorf("MaxDevices = %d, want the default 10", org.MaxDevices)
+	}
+	if len(events.events) != 1 || events.events[0].Type != models.EventOrgJoined || events.events[0].Reason != strconv.Itoa(orgID) {
+		t.Errorf("events = %+v, want the owner joined", events.events)
+	}
+
+	if org, _ := o.CreateOrganization(context.Background(), "owner@example.com", "globex", 3); org.MaxDevices != 3 {
+		t.Errorf("MaxDevices = %d, want the requested 3", org.MaxDevices)
+	}
+}
+
+func TestInviteMember(t *testing.T) {
+	tests := []struct {
+		name    string
+		actor   string
+		email   string
+		role    string
+		wantErr error
+	}{
+		{name: "owner invites owner", actor: "owner@example.com", email: "new@example.com", role: models.OrgRoleOwner},
+		{name: "admin invites member", actor: "admin@example.com", email: "new@example.com", role: models.OrgRoleMember},
+		{name: "admin invites admin", actor: "admin@example.com", email: "new@example.com", role: models.OrgRoleAdmin},
+		{name: "admin invites owner", actor: "admin@example.com", email: "new@example.com", role: models.OrgRoleOwner, wantErr: ErrNotAllowed},
+		{name: "member invites", actor: "member@example.com", email: "new@example.com", role: models.OrgRoleMember, wantErr: ErrNotAllowed},
+		{name: "pending admin invites", actor: "invited@example.com", email: "new@example.com", role: models.OrgRoleMember, wantErr: ErrNotAllowed},
+		{name: "stranger invites", actor: "stranger@example.com", email: "new@example.com", role: models.OrgRoleMember, wantErr: ErrNotAllowed},
+		{name: "unknown role", actor: "owner@example.com", email: "new@example.com", role: "superuser", wantErr: ErrInvalidOrgRole},
+		{name: "already a member", actor: "owner@example.com", email: "member@example.com", role: models.OrgRoleMember, wantErr: storage.ErrMembershipAlreadyExists},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, store, _ := newOrg(t)
+
+			err := o.InviteMember(context.Background(), tt.actor, orgID, tt.email, tt.role)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("InviteMember error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := store.members[tt.email]; got.Status != models.MembershipInvited || got.Role != tt.role || got.InvitedBy != tt.actor {
+				t.Errorf("membership = %+v, want an invitation as %s by %s", got, tt.role, tt.actor)
+			}
+		})
+	}
+}
+
+func TestAcceptInvitation(t *testing.T) {
+	o, store, events := newOrg(t)
+
+	if err := o.AcceptInvitation(context.Background(), "invited@example.com", orgID); err != nil {
+		t.Fatalf("AcceptInvitation: %v", err)
+	}
+	if got := store.members["invited@example.com"]; got.Status != models.MembershipActive {
+		t.Errorf("status = %s, want %s", got.Status, models.MembershipActive)
+	}
+	if len(events.events) != 1 || events.events[0].Type != models.EventOrgJoined {
+		t.Errorf("events = %+v, want the member joined", events.events)
+	}
+
+	if err := o.AcceptInvitation(context.Background(), "stranger@example.com", orgID); !errors.Is(err, storage.ErrMembershipNotFound) {
+		t.Errorf("AcceptInvitation without an invitation error = %v, want %v", err, storage.ErrMembershipNotFound)
+	}
+	// a pending admin does not manage members until the invitation is accepted
+	if err := o.InviteMember(context.Background(), "invited@example.com", orgID, "new@example.com", models.OrgRoleMember); err != nil {
+		t.Errorf("InviteMember by the accepted admin: %v", err)
+	}
+}
+
+func TestRemoveMember(t *testing.T) {
+	tests := []struct {
+		name    string
+		actor   string
+		email   string
+		wantErr error
+	}{
+		{name: "member leaves", actor: "member@example.com", email: "member@example.com"},
+		{name: "invitation declined", actor: "invited@example.com", email: "invited@example.com"},
+		{name: "admin removes member", actor: "admin@example.com", email: "member@example.com"},
+		{name: "owner removes owner", actor: "owner@example.com", email: "owner2@example.com"},
+		{name: "admin removes owner", actor: "admin@example.com", email: "owner@example.com", wantErr: ErrNotAllowed},
+		{name: "member removes member", actor: "member@example.com", email: "admin@example.com", wantErr: ErrNotAllowed},
+		{name: "stranger removes member", actor: "stranger@example.com", email: "member@example.com", wantErr: ErrNotAllowed},
+		{name: "unknown member", actor: "owner@example.com", email: "stranger@example.com", wantErr: storage.ErrMembershipNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, store, events := newOrg(t)
+
+			err := o.RemoveMember(context.Background(), tt.actor, orgID, tt.email)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("RemoveMember error = %v, want %v", err, tt.wantErr)
+			}
+			_, stays := store.members[tt.email]
+			if stays != (err != nil) && tt.wantErr != storage.ErrMembershipNotFound {
+				t.Errorf("member still in the organization = %v", stays)
+			}
+			if err == nil && (len(events.events) != 1 || events.events[0].Type != models.EventOrgLeft) {
+				t.Errorf("events = %+v, want the member left", events.events)
+			}
+		})
+	}
+}
+
+func TestLastOwnerStays(t *testing.T) {
+	o, _, _ := newOrg(t)
+
+	if err := o.RemoveMember(context.Background(), "owner@example.com", orgID, "owner2@example.com"); err != nil {
+		t.Fatalf("RemoveMember: %v", err)
+	}
+	if err := o.RemoveMember(context.Background(), "owner@example.com", orgID, "owner@example.com"); !errors.Is(err, storage.ErrLastOwner) {
+		t.Errorf("last owner leaving error = %v, want %v", err, storage.ErrLastOwner)
+	}
+}
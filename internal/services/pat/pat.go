@@ -0,0 +1,256 @@
+package pat
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/jwt"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+const (
+	queryTime = 3 * time.Second
+	// Prefix marks personal access tokens, so they are told from JWTs and found by secret scanners
+	Prefix = "vpat_"
+	// displayLength is how much of the token is kept in clear to recognize it in the list
+	displayLength = len(Prefix) + 6
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid personal access token")
+	// ErrScopeNotGranted is returned for a scope the caller does not hold itself
+	ErrScopeNotGranted = errors.New("scope is not granted to the caller")
+	ErrInvalidTTL      = errors.New("invalid token lifetime")
+)
+
+// PersonalTokens manages the personal access tokens of the users
+type PersonalTokens struct {
+	log        *logger.Logger
+	tokens     TokenStore
+	grants     GrantProvider
+	events     EventRecorder
+	defaultTTL time.Duration
+	maxTTL     time.Duration
+}
+
+type TokenStore interface {
+	SavePersonalAccessToken(
+		ctx context.Context,
+		email string,
+		name string,
+		tokenHash string,
+		prefix string,
+		scopes []string,
+		ttl time.Duration,
+	) (models.PersonalAccessToken, error)
+	PersonalAccessTokens(
+		ctx context.Context,
+		email string,
+	) ([]models.PersonalAccessToken, error)
+	RevokePersonalAccessToken(
+		ctx context.Context,
+		email string,
+		id int64,
+	) error
+	UsePersonalAccessToken(
+		ctx context.Context,
+		tokenHash string,
+	) (models.PersonalAccessToken, error)
+}
+
+type GrantProvider interface {
+	UserAccess(
+		ctx context.Context,
+		email string,
+	) (roles []string, permissions []string, err error)
+}
+
+type EventRecorder interface {
+	Record(
+		ctx context.Context,
+		event models.SecurityEvent,
+	)
+}
+
+func New(
+	log *logger.Logger,
+	tokens TokenStore,
+	grants GrantProvider,
+	events EventRecorder,
+	defaultTTL time.Duration,
+	maxTTL time.Duration,
+) *PersonalTokens {
+	return &PersonalTokens{
+		log:        log,
+		tokens:     tokens,
+		grants:     grants,
+		events:     events,
+		defaultTTL: defaultTTL,
+		maxTTL:     maxTTL,
+	}
+}
+
+// IsPersonalToken reports whether the bearer token is a personal access token rather than a JWT
+func IsPersonalToken(token string) bool {
+	return strings.HasPrefix(token, Prefix)
+}
+
+// Create issues a token with the scopes, each of them must be among granted, the permissions of the caller.
+// The token is returned only here
+func (p *PersonalTokens) Create(
+	ctx context.Context,
+	email string,
+	name string,
+	scopes []string,
+	ttl time.Duration,
+	granted []string,
+) (string, models.PersonalAccessToken, error) {
+	const op = "PersonalTokens.Create"
+	log := p.log.With(zap.String("op", op))
+
+	if ttl == 0 {
+		ttl = p.defaultTTL
+	}
+	if ttl < 0 || ttl > p.maxTTL {
+		return "", models.PersonalAccessToken{}, fmt.Errorf("%s: %w", op, ErrInvalidTTL)
+	}
+	for _, s := range scopes {
+		if !contains(granted, s) {
+			log.Warn("scope not granted", zap.String("scope", s))
+			return "", models.PersonalAccessToken{}, fmt.Errorf("%s: %w", op, ErrScopeNotGranted)
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Error("failed to generate token", zap.Error(err))
+		return "", models.PersonalAccessToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+	token := Prefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	saved, err := p.tokens.SavePersonalAccessToken(ctx, email, name, hash(token), token[:displayLength], scopes, ttl)
+	if err != nil {
+		log.Error("failed to save token", zap.Error(err))
+		return "", models.PersonalAccessToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+	p.events.Record(ctx, models.SecurityEvent{
+		Email:  email,
+		Type:   models.EventTokenCreated,
+		Reason: saved.Prefix,
+	})
+
+	return token, saved, nil
+}
+
+func (p *PersonalTokens) List(
+	ctx context.Context,
+	email string,
+) ([]models.PersonalAccessToken, error) {
+	const op = "PersonalTokens.List"
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	tokens, err := p.tokens.PersonalAccessTokens(ctx, email)
+	if err != nil {
+		p.log.Error("failed to list tokens", zap.String("op", op), zap.Error(err))
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return tokens, nil
+}
+
+func (p *PersonalTokens) Revoke(
+	ctx context.Context,
+	email string,
+	id int64,
+) error {
+	const op = "PersonalTokens.Revoke"
+	log := p.log.With(zap.String("op", op))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	if err := p.tokens.RevokePersonalAccessToken(ctx, email, id); err != nil {
+		if errors.Is(err, storage.ErrTokenNotFound) {
+			log.Warn("token not found", zap.Error(err))
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("failed to revoke token", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	p.events.Record(ctx, models.SecurityEvent{
+		Email: email,
+		Type:  models.EventTokenRevoked,
+	})
+
+	return nil
+}
+
+// Verify resolves the token to the claims it grants: the scopes the user still holds
+func (p *PersonalTokens) Verify(
+	ctx context.Context,
+	token string,
+) (jwt.Claims, error) {
+	const op = "PersonalTokens.Verify"
+
+	if !IsPersonalToken(token) {
+		return jwt.Claims{}, fmt.Errorf("%s: %w", op, ErrInvalidToken)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	pat, err := p.tokens.UsePersonalAccessToken(ctx, hash(token))
+	if err != nil {
+		if errors.Is(err, storage.ErrTokenNotFound) {
+			return jwt.Claims{}, fmt.Errorf("%s: %w", op, ErrInvalidToken)
+		}
+		p.log.Error("failed to get token", zap.String("op", op), zap.Error(err))
+		return jwt.Claims{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	_, permissions, err := p.grants.UserAccess(ctx, pat.Email)
+	if err != nil {
+		p.log.Error("failed to get user access", zap.String("op", op), zap.Error(err))
+		return jwt.Claims{}, fmt.Errorf("%s: %w", op, err)
+	}
+	granted := make([]string, 0, len(pat.Scopes))
+	for _, s := range pat.Scopes {
+		if contains(permissions, s) {
+			granted = append(granted, s)
+		}
+	}
+
+	return jwt.Claims{
+		Email:           pat.Email,
+		Permissions:     granted,
+		Tenant:          tenant.ID(ctx),
+		PersonalTokenID: pat.ID,
+		ExpiresAt:       pat.ExpiresAt,
+	}, nil
+}
+
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,238 @@
+package pat
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+const testEmail = "user@example.com"
+
+// memoryTokens is a TokenStore in a map by the hash of the token
+type memoryTokens struct {
+	tokens map[string]models.PersonalAccessToken
+	lastID int64
+}
+
+func (m *memoryTokens) SavePersonalAccessToken(
+	_ context.Context,
+	email string,
+	name string,
+	tokenHash string,
+	prefix string,
+	scopes []string,
+	ttl time.Duration,
+) (models.PersonalAccessToken, error) {
+	m.lastID++
+	token := models.PersonalAccessToken{
+		ID:        m.lastID,
+		Email:     email,
+		Name:      name,
+		Prefix:    prefix,
+		Scopes:    scopes,
+		ExpiresAt: time.Now().Add(ttl),
+		CreatedAt: time.Now(),
+	}
+	m.tokens[tokenHash] = token
+	return token, nil
+}
+
+func (m *memoryTokens) PersonalAccessTokens(_ context.Context, email string) ([]models.PersonalAccessToken, error) {
+	var res []models.PersonalAccessToken
+	for _, token := range m.tokens {
+		if token.Email == email {
+			res = append(res, token)
+		}
+	}
+	return res, nil
+}
+
+func (m *memoryTokens) RevokePersonalAccessToken(_ context.Context, email string, id int64) error {
+	for tokenHash, token := range m.tokens {
+		if token.Email == email && token.ID == id {
+			delete(m.tokens, tokenHash)
+			return nil
+		}
+	}
+	return storage.ErrTokenNotFound
+}
+
+func (m *memoryTokens) UsePersonalAccessToken(_ context.Context, tokenHash string) (models.PersonalAccessToken, error) {
+	token, ok := m.tokens[tokenHash]
+	if !ok || !token.ExpiresAt.After(time.Now()) {
+		return models.PersonalAccessToken{}, storage.ErrTokenNotFound
+	}
+	return token, nil
+}
+
+// staticGrants are the permissions the users hold now
+type staticGrants map[string][]string
+
+func (g staticGrants) UserAccess(_ context.Context, email string) ([]string, []string, error) {
+	return nil, g[email], nil
+}
+
+type recordedEvents []models.SecurityEvent
+
+func (r *recordedEvents) Record(_ context.Context, event models.SecurityEvent) {
+	*r = append(*r, event)
+}
+
+func newTestTokens(grants staticGrants) (*PersonalTokens, *memoryTokens, *recordedEvents) {
+	store := &memoryTokens{tokens: map[string]models.PersonalAccessToken{}}
+	events := &recordedEvents{}
+	p := New(&logger.Logger{SugaredLogger: zap.NewNop().Sugar()}, store, grants, events, time.Hour, 24*time.Hour)
+	return p, store, events
+}
+
+func TestCreate(t *testing.T) {
+	granted := []string{"relations:read", "relations:write"}
+
+	tests := []struct {
+		name    string
+		scopes  []string
+		ttl     time.Duration
+		wantTTL time.Duration
+		wantErr error
+	}{
+		{name: "default lifetime", scopes: []string{"relations:read"}, wantTTL: time.Hour},
+		{name: "chosen lifetime", scopes: granted, ttl: 2 * time.Hour, wantTTL: 2 * time.Hour},
+		{name: "longest lifetime", ttl: 24 * time.Hour, wantTTL: 24 * time.Hour},
+		{name: "lifetime over the maximum", ttl: 25 * time.Hour, wantErr: ErrInvalidTTL},
+		{name: "negative lifetime", ttl: -time.Hour, wantErr: ErrInvalidTTL},
+		{name: "scope the caller does not hold", scopes: []string{"relations:read", "roles:manage"}, wantErr: ErrScopeNotGranted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, store, events := newTestTokens(nil)
+
+			token, saved, err := p.Create(context.Background(), testEmail, "ci", tt.scopes, tt.ttl, granted)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Create error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if len(store.tokens) != 0 || len(*events) != 0 {
+					t.Errorf("a refused token was saved or recorded")
+				}
+				return
+			}
+
+			if !IsPersonalToken(token) || !strings.HasPrefix(token, saved.Prefix) || len(saved.Prefix) != displayLength {
+				t.Errorf("token %q with prefix %q is not a personal access token", token, saved.Prefix)
+			}
+			if _, ok := store.tokens[hash(token)]; !ok || len(store.tokens) != 1 {
+				t.Errorf("token is not stored by its hash")
+			}
+			if ttl := time.Until(saved.ExpiresAt); ttl > tt.wantTTL || ttl < tt.wantTTL-time.Minute {
+				t.Errorf("token expires in %s, want %s", ttl, tt.wantTTL)
+			}
+			if len(*events) != 1 || (*events)[0].Type != models.EventTokenCreated {
+				t.Errorf("events = %+v, want one %s", *events, models.EventTokenCreated)
+			}
+		})
+	}
+}
+
+func TestCreateIsRandom(t *testing.T) {
+	p, _, _ := newTestTokens(nil)
+
+	first, _, err := p.Create(context.Background(), testEmail, "ci", nil, 0, nil)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	second, _, err := p.Create(context.Background(), testEmail, "ci", nil, 0, nil)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if first == second {
+		t.Errorf("two tokens are the same: %q", first)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	p, store, _ := newTestTokens(staticGrants{testEmail: {"relations:read", "roles:manage"}})
+	granted := []string{"relations:read", "relations:write"}
+	token, saved, err := p.Create(context.Background(), testEmail, "ci", granted, 0, granted)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	t.Run("scopes the user still holds", func(t *testing.T) {
+		claims, err := p.Verify(context.Background(), token)
+		if err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+		if claims.Email != testEmail {
+			t.Errorf("Email = %q, want %q", claims.Email, testEmail)
+		}
+		// relations:write was taken from the user after the token was created,
+		// roles:manage was never a scope of the token
+		if !slices.Equal(claims.Permissions, []string{"relations:read"}) {
+			t.Errorf("Permissions = %v, want [relations:read]", claims.Permissions)
+		}
+		if claims.PersonalTokenID != saved.ID || claims.PersonalTokenID == 0 {
+			t.Errorf("PersonalTokenID = %d, want %d", claims.PersonalTokenID, saved.ID)
+		}
+		if !claims.ExpiresAt.Equal(saved.ExpiresAt) {
+			t.Errorf("ExpiresAt = %s, want %s", claims.ExpiresAt, saved.ExpiresAt)
+		}
+	})
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"jwt", "eyJhbGciOiJIUzI1NiJ9.e30.sig"},
+		{"unknown token", Prefix + "unknown"},
+		{"changed token", token[:len(token)-1] + "x"},
+		{"empty", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := p.Verify(context.Background(), tt.token); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("Verify error = %v, want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+
+	t.Run("revoked token", func(t *testing.T) {
+		if err := p.Revoke(context.Background(), testEmail, saved.ID); err != nil {
+			t.Fatalf("Revoke: %v", err)
+		}
+		if _, err := p.Verify(context.Background(), token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Verify error = %v, want %v", err, ErrInvalidToken)
+		}
+		if len(store.tokens) != 0 {
+			t.Errorf("revoked token is still stored")
+		}
+	})
+}
+
+func TestRevoke(t *testing.T) {
+	p, _, events := newTestTokens(nil)
+	_, saved, err := p.Create(context.Background(), testEmail, "ci", nil, 0, nil)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	if err := p.Revoke(context.Background(), "other@example.com", saved.ID); !errors.Is(err, storage.ErrTokenNotFound) {
+		t.Errorf("Revoke of another user error = %v, want %v", err, storage.ErrTokenNotFound)
+	}
+	if err := p.Revoke(context.Background(), testEmail, saved.ID); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if last := (*events)[len(*events)-1]; last.Type != models.EventTokenRevoked {
+		t.Errorf("last event = %s, want %s", last.Type, models.EventTokenRevoked)
+	}
+	if err := p.Revoke(context.Background(), testEmail, saved.ID); !errors.Is(err, storage.ErrTokenNotFound) {
+		t.Errorf("second Revoke error = %v, want %v", err, storage.ErrTokenNotFound)
+	}
+}
@@ -0,0 +1,330 @@
+package profiles
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	queryTime     = 3 * time.Second
+	maxNameLength = 64
+	// PINs are 4 to 6 digits, like the ones entered with a remote
+	minPINLength = 4
+	maxPINLength = 6
+)
+
+var (
+	ErrInvalidProfile = errors.New("invalid profile")
+	ErrInvalidPIN     = errors.New("pin must be 4 to 6 digits")
+	ErrWrongPIN       = errors.New("wrong pin")
+)
+
+// PINLockedError is returned while the PIN of the profile is locked after too many wrong ones
+type PINLockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *PINLockedError) Error() string {
+	return fmt.Sprintf("pin locked, retry after %s", e.RetryAfter)
+}
+
+// PINPolicy bounds the PIN guessing: MaxFailures wrong PINs in a row lock it for LockFor
+type PINPolicy struct {
+	MaxFailures int
+	LockFor     time.Duration
+}
+
+// Update is the new state of a profile. The PIN is kept unless PIN is set or ClearPIN is true
+type Update struct {
+	Name           string
+	AvatarKey      string
+	MaturityRating string
+	PIN            string
+	ClearPIN       bool
+}
+
+// Profiles manages the viewer profiles of the accounts
+type Profiles struct {
+	log         *logger.Logger
+	profiles    ProfileStore
+	maxProfiles int
+	pin         PINPolicy
+}
+
+type ProfileStore interface {
+	SaveProfile(
+		ctx context.Context,
+		email string,
+		profile models.Profile,
+		maxProfiles int,
+	) (models.Profile, error)
+	Profiles(
+		ctx context.Context,
+		email string,
+	) ([]models.Profile, error)
+	Profile(
+		ctx context.Context,
+		email string,
+		id int64,
+	) (models.Profile, error)
+	UpdateProfile(
+		ctx context.Context,
+		email string,
+		profile models.Profile,
+	) (models.Profile, error)
+	DeleteProfile(
+		ctx context.Context,
+		email string,
+		id int64,
+	) error
+	FailProfilePIN(
+		ctx context.Context,
+		id int64,
+		maxFailures int,
+		lockFor time.Duration,
+	) error
+	ResetProfilePIN(
+		ctx context.Context,
+		id int64,
+	) error
+}
+
+// New creates the profile service, an account has at most maxProfiles profiles, 0 is unlimited
+func New(
+	log *logger.Logger,
+	profiles ProfileStore,
+	maxProfiles int,
+	pin PINPolicy,
+) *Profiles {
+	return &Profiles{
+		log:         log,
+		profiles:    profiles,
+		maxProfiles: maxProfiles,
+		pin:         pin,
+	}
+}
+
+// Create adds a profile to the account, without a rating it may watch everything
+func (p *Profiles) Create(
+	ctx context.Context,
+	email string,
+	update Update,
+) (models.Profile, error) {
+	const op = "Profiles.Create"
+	log := p.log.With(zap.String("op", op))
+
+	if update.MaturityRating == "" {
+		update.MaturityRating = models.MaturityAdult
+	}
+	profile := models.Profile{}
+	if err := apply(&profile, update); err != nil {
+		return models.Profile{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	created, err := p.profiles.SaveProfile(ctx, email, profile, p.maxProfiles)
+	if err != nil {
+		if errors.Is(err, storage.ErrProfileLimitExceeded) || errors.Is(err, storage.ErrProfileAlreadyExists) {
+			log.Warn("profile not created", zap.Error(err))
+			return models.Profile{}, fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("failed to save profile", zap.Error(err))
+		return models.Profile{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return created, nil
+}
+
+// List returns the profiles of the account
+func (p *Profiles) List(
+	ctx context.Context,
+	email string,
+) ([]models.Profile, error) {
+	const op = "Profiles.List"
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	profiles, err := p.profiles.Profiles(ctx, email)
+	if err != nil {
+		p.log.Error("failed to list profiles", zap.String("op", op), zap.Error(err))
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return profiles, nil
+}
+
+// Profile returns the profile of the account, tokens selected for it are refreshed with it
+func (p *Profiles) Profile(
+	ctx context.Context,
+	email string,
+	id int64,
+) (models.Profile, error) {
+	const op = "Profiles.Profile"
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	profile, err := p.profiles.Profile(ctx, email, id)
+	if err != nil {
+		return models.Profile{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return profile, nil
+}
+
+// Update changes the profile, a profile with a PIN is only changed with it
+func (p *Profiles) Update(
+	ctx context.Context,
+	email string,
+	id int64,
+	update Update,
+	currentPIN string,
+) (models.Profile, error) {
+	const op = "Profiles.Update"
+	log := p.log.With(zap.String("op", op), zap.Int64("profile_id", id))
+
+	profile, err := p.Unlock(ctx, email, id, currentPIN)
+	if err != nil {
+		return models.Profile{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if err := apply(&profile, update); err != nil {
+		return models.Profile{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	updated, err := p.profiles.UpdateProfile(ctx, email, profile)
+	if err != nil {
+		if errors.Is(err, storage.ErrProfileNotFound) || errors.Is(err, storage.ErrProfileAlreadyExists) {
+			log.Warn("profile not updated", zap.Error(err))
+			return models.Profile{}, fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("failed to update profile", zap.Error(err))
+		return models.Profile{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return updated, nil
+}
+
+// Delete removes the profile, a profile with a PIN is only removed with it
+func (p *Profiles) Delete(
+	ctx context.Context,
+	email string,
+	id int64,
+	currentPIN string,
+) error {
+	const op = "Profiles.Delete"
+
+	if _, err := p.Unlock(ctx, email, id, currentPIN); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	if err := p.profiles.DeleteProfile(ctx, email, id); err != nil {
+		if !errors.Is(err, storage.ErrProfileNotFound) {
+			p.log.Error("failed to delete profile", zap.String("op", op), zap.Error(err))
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// Unlock returns the profile of the account once the PIN matches, a profile without a PIN
+// needs none. Wrong PINs are counted and lock the PIN for a while
+func (p *Profiles) Unlock(
+	ctx context.Context,
+	email string,
+	id int64,
+	pin string,
+) (models.Profile, error) {
+	const op = "Profiles.Unlock"
+	log := p.log.With(zap.String("op", op), zap.Int64("profile_id", id))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	profile, err := p.profiles.Profile(ctx, email, id)
+	if err != nil {
+		if errors.Is(err, storage.ErrProfileNotFound) {
+			log.Warn("profile not found")
+			return models.Profile{}, fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("failed to get profile", zap.Error(err))
+		return models.Profile{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if !profile.HasPIN() {
+		return profile, nil
+	}
+
+	if profile.PINLockedUntil != nil && time.Now().Before(*profile.PINLockedUntil) {
+		log.Warn("pin locked")
+		return models.Profile{}, fmt.Errorf("%s: %w", op, &PINLockedError{
+			RetryAfter: time.Until(*profile.PINLockedUntil),
+		})
+	}
+	if bcrypt.CompareHashAndPassword([]byte(profile.PINHash), []byte(pin)) != nil {
+		log.Warn("wrong pin")
+		if err := p.profiles.FailProfilePIN(ctx, id, p.pin.MaxFailures, p.pin.LockFor); err != nil {
+			log.Error("failed to count wrong pin", zap.Error(err))
+		}
+		return models.Profile{}, fmt.Errorf("%s: %w", op, ErrWrongPIN)
+	}
+	if profile.PINFailures > 0 {
+		if err := p.profiles.ResetProfilePIN(ctx, id); err != nil {
+			log.Error("failed to reset pin failures", zap.Error(err))
+		}
+	}
+
+	return profile, nil
+}
+
+// apply validates the update and writes it to the profile, hashing the new PIN
+func apply(profile *models.Profile, update Update) error {
+	if update.Name == "" || utf8.RuneCountInString(update.Name) > maxNameLength {
+		return ErrInvalidProfile
+	}
+	if !models.ValidMaturityRating(update.MaturityRating) {
+		return ErrInvalidProfile
+	}
+	profile.Name = update.Name
+	profile.AvatarKey = update.AvatarKey
+	profile.MaturityRating = update.MaturityRating
+
+	switch {
+	case update.ClearPIN:
+		profile.PINHash = ""
+	case update.PIN != "":
+		if !validPIN(update.PIN) {
+			return ErrInvalidPIN
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(update.PIN), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		profile.PINHash = string(hash)
+	}
+
+	return nil
+}
+
+func validPIN(pin string) bool {
+	if len(pin) < minPINLength || len(pin) > maxPINLength {
+		return false
+	}
+	for _, c := range pin {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,247 @@
+package profiles
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+const email = "alice@example.com"
+
+// memoryProfiles keeps the profiles of one account and counts the wrong PINs like the database does
+type memoryProfiles struct {
+	profiles map[int64]models.Profile
+	nextID   int64
+}
+
+func (m *memoryProfiles) SaveProfile(_ context.Context, _ string, profile models.Profile, maxProfiles int) (models.Profile, error) {
+	if maxProfiles > 0 && len(m.profiles) >= maxProfiles {
+		return models.Profile{}, storage.ErrProfileLimitExceeded
+	}
+	m.nextID++
+	profile.ID = m.nextID
+	m.profiles[profile.ID] = profile
+	return profile, nil
+}
+
+func (m *memoryProfiles) Profiles(context.Context, string) ([]models.Profile, error) {
+	var profiles []models.Profile
+	for _, profile := range m.profiles {
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+func (m *memoryProfiles) Profile(_ context.Context, _ string, id int64) (models.Profile, error) {
+	profile, ok := m.profiles[id]
+	if !ok {
+		return models.Profile{}, storage.ErrProfileNotFound
+	}
+	return profile, nil
+}
+
+func (m *memoryProfiles) UpdateProfile(_ context.Context, _ string, profile models.Profile) (models.Profile, error) {
+	if _, ok := m.profiles[profile.ID]; !ok {
+		return models.Profile{}, storage.ErrProfileNotFound
+	}
+	m.profiles[profile.ID] = profile
+	return profile, nil
+}
+
+func (m *memoryProfiles) DeleteProfile(_ context.Context, _ string, id int64) error {
+	if _, ok := m.profiles[id]; !ok {
+		return storage.ErrProfileNotFound
+	}
+	delete(m.profiles, id)
+	return nil
+}
+
+func (m *memoryProfiles) FailProfilePIN(_ context.Context, id int64, maxFailures int, lockFor time.Duration) error {
+	profile := m.profiles[id]
+	profile.PINFailures++
+	if profile.PINFailures >= maxFailures {
+		profile.PINFailures = 0
+		until := time.Now().Add(lockFor)
+		profile.PINLockedUntil = &until
+	}
+	m.profiles[id] = profile
+	return nil
+}
+
+func (m *memoryProfiles) ResetProfilePIN(_ context.Context, id int64) error {
+	profile := m.profiles[id]
+	profile.PINFailures = 0
+	m.profiles[id] = profile
+	return nil
+}
+
+func newProfiles(maxProfiles int) (*Profiles, *memoryProfiles) {
+	store := &memoryProfiles{profiles: map[int64]models.Profile{}}
+	p := New(
+		&logger.Logger{SugaredLogger: zap.NewNop().Sugar()},
+		store,
+		maxProfiles,
+		PINPolicy{MaxFailures: 3, LockFor: time.Minute},
+	)
+	return p, store
+}
+
+func TestCreate(t *testing.T) {
+	tests := []struct {
+		name       string
+		update     Update
+		wantErr    error
+		wantRating string
+	}{
+		{name: "without a rating", update: Update{Name: "Alice"}, wantRating: models.MaturityAdult},
+		{name: "with a PIN", update: Update{Name: "Alice", PIN: "1234"}, wantRating: models.MaturityAdult},
+		{name: "without a name", update: Update{}, wantErr: ErrInvalidProfile},
+		{name: "unknown rating", update: Update{Name: "Alice", MaturityRating: "x"}, wantErr: ErrInvalidProfile},
+		{name: "short PIN", update: Update{Name: "Alice", PIN: "123"}, wantErr: ErrInvalidPIN},
+		{name: "long PIN", update: Update{Name: "Alice", PIN: "1234567"}, wantErr: ErrInvalidPIN},
+		{name: "PIN with letters", update: Update{Name: "Alice", PIN: "12ab"}, wantErr: ErrInvalidPIN},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newProfiles(0)
+
+			profile, err := p.Create(context.Background(), email, tt.update)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Create error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if profile.MaturityRating != tt.wantRating {
+				t.Errorf("rating = %q, want %q", profile.MaturityRating, tt.wantRating)
+			}
+			if profile.HasPIN() != (tt.update.PIN != "") {
+				t.Errorf("HasPIN = %v, want %v", profile.HasPIN(), tt.update.PIN != "")
+			}
+			if profile.HasPIN() && profile.PINHash == tt.update.PIN {
+				t.Errorf("PIN is stored in clear")
+			}
+		})
+	}
+}
+
+func TestCreateProfileLimit(t *testing.T) {
+	p, _ := newProfiles(1)
+
+	if _, err := p.Create(context.Background(), email, Update{Name: "Alice"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := p.Create(context.Background(), email, Update{Name: "Bob"}); !errors.Is(err, storage.ErrProfileLimitExceeded) {
+		t.Errorf("Create over the limit error = %v, want %v", err, storage.ErrProfileLimitExceeded)
+	}
+}
+
+func TestUnlock(t *testing.T) {
+	p, _ := newProfiles(0)
+	open, err := p.Create(context.Background(), email, Update{Name: "Everyone"})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	locked, err := p.Create(context.Background(), email, Update{Name: "Parents", PIN: "1234"})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	if _, err := p.Unlock(context.Background(), email, open.ID, ""); err != nil {
+		t.Errorf("Unlock without a PIN: %v", err)
+	}
+	if _, err := p.Unlock(context.Background(), email, locked.ID, "1234"); err != nil {
+		t.Errorf("Unlock with the PIN: %v", err)
+	}
+	if _, err := p.Unlock(context.Background(), email, locked.ID, ""); !errors.Is(err, ErrWrongPIN) {
+		t.Errorf("Unlock without the PIN error = %v, want %v", err, ErrWrongPIN)
+	}
+	if _, err := p.Unlock(context.Background(), email, 42, ""); !errors.Is(err, storage.ErrProfileNotFound) {
+		t.Errorf("Unlock of an unknown profile error = %v, want %v", err, storage.ErrProfileNotFound)
+	}
+}
+
+func TestPINLockout(t *testing.T) {
+	p, store := newProfiles(0)
+	profile, err := p.Create(context.Background(), email, Update{Name: "Parents", PIN: "1234"})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// a right PIN clears the wrong ones before it
+	for range 2 {
+		if _, err := p.Unlock(context.Background(), email, profile.ID, "0000"); !errors.Is(err, ErrWrongPIN) {
+			t.Fatalf("Unlock with a wrong PIN error = %v, want %v", err, ErrWrongPIN)
+		}
+	}
+	if _, err := p.Unlock(context.Background(), email, profile.ID, "1234"); err != nil {
+		t.Fatalf("Unlock with the PIN: %v", err)
+	}
+	if failures := store.profiles[profile.ID].PINFailures; failures != 0 {
+		t.Fatalf("failures after the right PIN = %d, want 0", failures)
+	}
+
+	for range 3 {
+		if _, err := p.Unlock(context.Background(), email, profile.ID, "0000"); !errors.Is(err, ErrWrongPIN) {
+			t.Fatalf("Unlock with a wrong PIN error = %v, want %v", err, ErrWrongPIN)
+		}
+	}
+	// the third wrong PIN locks it, even the right one is refused until the lock ends
+	_, err = p.Unlock(context.Background(), email, profile.ID, "1234")
+	var lockedErr *PINLockedError
+	if !errors.As(err, &lockedErr) {
+		t.Fatalf("Unlock of a locked PIN error = %v, want a PINLockedError", err)
+	}
+	if lockedErr.RetryAfter <= 0 || lockedErr.RetryAfter > time.Minute {
+		t.Errorf("RetryAfter = %s, want up to a minute", lockedErr.RetryAfter)
+	}
+	if err := p.Delete(context.Background(), email, profile.ID, "1234"); !errors.As(err, &lockedErr) {
+		t.Errorf("Delete of a locked profile error = %v, want a PINLockedError", err)
+	}
+
+	past := time.Now().Add(-time.Second)
+	expired := store.profiles[profile.ID]
+	expired.PINLockedUntil = &past
+	store.profiles[profile.ID] = expired
+	if _, err := p.Unlock(context.Background(), email, profile.ID, "1234"); err != nil {
+		t.Errorf("Unlock after the lock: %v", err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	p, _ := newProfiles(0)
+	profile, err := p.Create(context.Background(), email, Update{Name: "Parents", PIN: "1234"})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	if _, err := p.Update(context.Background(), email, profile.ID, Update{Name: "Kids"}, "0000"); !errors.Is(err, ErrWrongPIN) {
+		t.Fatalf("Update with a wrong PIN error = %v, want %v", err, ErrWrongPIN)
+	}
+
+	// the PIN is kept unless it is replaced or cleared
+	updated, err := p.Update(context.Background(), email, profile.ID, Update{Name: "Kids", MaturityRating: models.MaturityAdult}, "1234")
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if updated.Name != "Kids" || updated.PINHash != profile.PINHash {
+		t.Errorf("profile = %+v, want renamed with the same PIN", updated)
+	}
+
+	cleared, err := p.Update(context.Background(), email, profile.ID, Update{Name: "Kids", MaturityRating: models.MaturityAdult, ClearPIN: true}, "1234")
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if cleared.HasPIN() {
+		t.Errorf("profile still has a PIN after ClearPIN")
+	}
+	if _, err := p.Unlock(context.Background(), email, profile.ID, ""); err != nil {
+		t.Errorf("Unlock without the cleared PIN: %v", err)
+	}
+}
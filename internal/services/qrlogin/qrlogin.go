@@ -0,0 +1,265 @@
+package qrlogin
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+const queryTime = 3 * time.Second
+
+var (
+	// ErrSessionNotFound is returned for an unknown session and for a wrong secret
+	ErrSessionNotFound = errors.New("qr login session not found")
+	ErrSessionExpired  = errors.New("qr login session expired")
+)
+
+// Session is what the TV gets when it starts a QR login: ID goes into the QR code,
+// Secret stays on the TV to watch the session with
+type Session struct {
+	ID        string
+	Secret    string
+	ExpiresIn time.Duration
+}
+
+// Update is sent to the TV watching the session, Token is set once the phone approved
+type Update struct {
+	Status string
+	Token  string
+}
+
+// QRLogin signs a TV in by a QR code scanned with a phone where the user is already signed in
+type QRLogin struct {
+	log      *logger.Logger
+	logins   LoginStore
+	devices  DeviceAuthenticator
+	ttl      time.Duration
+	interval time.Duration
+}
+
+type LoginStore interface {
+	SaveQRLogin(
+		ctx context.Context,
+		login models.QRLogin,
+		ttl time.Duration,
+	) error
+	QRLogin(
+		ctx context.Context,
+		id string,
+	) (models.QRLogin, error)
+	ApproveQRLogin(
+		ctx context.Context,
+		id string,
+		email string,
+	) error
+	ConsumeQRLogin(
+		ctx context.Context,
+		id string,
+	) (email string, err error)
+}
+
+// DeviceAuthenticator registers the TV among the devices of the user and signs it in
+type DeviceAuthenticator interface {
+	RegisterDevice(
+		ctx context.Context,
+		email string,
+		deviceAddress string,
+	) error
+	LoginDevice(
+		ctx context.Context,
+		email string,
+		deviceAddress string,
+	) (token string, err error)
+}
+
+// New creates the QR login service, sessions live for ttl and watchers check them every interval
+func New(
+	log *logger.Logger,
+	logins LoginStore,
+	devices DeviceAuthenticator,
+	ttl time.Duration,
+	interval time.Duration,
+) *QRLogin {
+	return &QRLogin{
+		log:      log,
+		logins:   logins,
+		devices:  devices,
+		ttl:      ttl,
+		interval: interval,
+	}
+}
+
+// Start opens a session for the device, the TV renders the ID as a QR code
+func (q *QRLogin) Start(
+	ctx context.Context,
+	deviceAddress string,
+) (Session, error) {
+	const op = "QRLogin.Start"
+	log := q.log.With(zap.String("op", op), zap.String("device", deviceAddress))
+
+	id, err := randomString(16)
+	if err != nil {
+		log.Error("failed to generate session id", zap.Error(err))
+		return Session{}, fmt.Errorf("%s: %w", op, err)
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		log.Error("failed to generate session secret", zap.Error(err))
+		return Session{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	err = q.logins.SaveQRLogin(ctx, models.QRLogin{
+		ID:            id,
+		SecretHash:    hash(secret),
+		DeviceAddress: deviceAddress,
+	}, q.ttl)
+	if err != nil {
+		log.Error("failed to save qr login", zap.Error(err))
+		return Session{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return Session{ID: id, Secret: secret, ExpiresIn: q.ttl}, nil
+}
+
+// Approve is called by the phone that scanned the QR code. The TV is registered right away,
+// so the device limit is reported to the user approving it. Returns the address of the TV
+func (q *QRLogin) Approve(
+	ctx context.Context,
+	email string,
+	id string,
+) (string, error) {
+	const op = "QRLogin.Approve"
+	log := q.log.With(zap.String("op", op))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	login, err := q.logins.QRLogin(ctx, id)
+	if err != nil {
+		if errors.Is(err, storage.ErrQRLoginNotFound) {
+			log.Warn("qr login not found")
+			return "", fmt.Errorf("%s: %w", op, ErrSessionNotFound)
+		}
+		log.Error("failed to get qr login", zap.Error(err))
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	if login.Status != models.QRLoginPending || time.Now().After(login.ExpiresAt) {
+		log.Warn("qr login already approved or expired")
+		return "", fmt.Errorf("%s: %w", op, ErrSessionNotFound)
+	}
+
+	if err := q.devices.RegisterDevice(ctx, email, login.DeviceAddress); err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	if err := q.logins.ApproveQRLogin(ctx, id, email); err != nil {
+		if errors.Is(err, storage.ErrQRLoginNotFound) {
+			log.Warn("qr login approved concurrently or expired")
+			return "", fmt.Errorf("%s: %w", op, ErrSessionNotFound)
+		}
+		log.Error("failed to approve qr login", zap.Error(err))
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	log.Info("qr login approved", zap.String("device", login.DeviceAddress))
+
+	return login.DeviceAddress, nil
+}
+
+// Watch reports the state of the session to the TV until the phone approves it, when the token
+// is sent, or the session expires. The session must be proven with the secret Start returned
+func (q *QRLogin) Watch(
+	ctx context.Context,
+	id string,
+	secret string,
+	send func(Update) error,
+) error {
+	const op = "QRLogin.Watch"
+	log := q.log.With(zap.String("op", op))
+
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+	status := ""
+	for {
+		login, err := q.login(ctx, id)
+		if err != nil {
+			if errors.Is(err, storage.ErrQRLoginNotFound) {
+				return fmt.Errorf("%s: %w", op, ErrSessionNotFound)
+			}
+			log.Error("failed to get qr login", zap.Error(err))
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		if subtle.ConstantTimeCompare([]byte(hash(secret)), []byte(login.SecretHash)) != 1 {
+			log.Warn("wrong qr login secret")
+			return fmt.Errorf("%s: %w", op, ErrSessionNotFound)
+		}
+
+		switch {
+		case login.Status == models.QRLoginApproved:
+			token, err := q.complete(ctx, login)
+			if err != nil {
+				return fmt.Errorf("%s: %w", op, err)
+			}
+			return send(Update{Status: models.QRLoginApproved, Token: token})
+		case time.Now().After(login.ExpiresAt):
+			return fmt.Errorf("%s: %w", op, ErrSessionExpired)
+		case login.Status != status:
+			status = login.Status
+			if err := send(Update{Status: status}); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *QRLogin) login(ctx context.Context, id string) (models.QRLogin, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	return q.logins.QRLogin(ctx, id)
+}
+
+// complete consumes the approved session and signs the TV in
+func (q *QRLogin) complete(ctx context.Context, login models.QRLogin) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	email, err := q.logins.ConsumeQRLogin(ctx, login.ID)
+	if err != nil {
+		if errors.Is(err, storage.ErrQRLoginNotFound) {
+			// another watcher with the secret took the token
+			return "", ErrSessionNotFound
+		}
+		q.log.Error("failed to consume qr login", zap.Error(err))
+		return "", err
+	}
+
+	return q.devices.LoginDevice(ctx, email, login.DeviceAddress)
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
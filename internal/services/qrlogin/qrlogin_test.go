@@ -0,0 +1,225 @@
+package qrlogin
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+// memoryLogins keeps the sessions by id, an approved session is consumed once like in the database
+type memoryLogins struct {
+	mu     sync.Mutex
+	logins map[string]models.QRLogin
+}
+
+func (m *memoryLogins) SaveQRLogin(_ context.Context, login models.QRLogin, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	login.Status = models.QRLoginPending
+	login.ExpiresAt = time.Now().Add(ttl)
+	m.logins[login.ID] = login
+	return nil
+}
+
+func (m *memoryLogins) QRLogin(_ context.Context, id string) (models.QRLogin, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	login, ok := m.logins[id]
+	if !ok {
+		return models.QRLogin{}, storage.ErrQRLoginNotFound
+	}
+	return login, nil
+}
+
+func (m *memoryLogins) ApproveQRLogin(_ context.Context, id string, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	login, ok := m.logins[id]
+	if !ok || login.Status != models.QRLoginPending {
+		return storage.ErrQRLoginNotFound
+	}
+	login.Status = models.QRLoginApproved
+	login.Email = email
+	m.logins[id] = login
+	return nil
+}
+
+func (m *memoryLogins) ConsumeQRLogin(_ context.Context, id string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	login, ok := m.logins[id]
+	if !ok || login.Status != models.QRLoginApproved {
+		return "", storage.ErrQRLoginNotFound
+	}
+	delete(m.logins, id)
+	return login.Email, nil
+}
+
+var errDeviceLimit = errors.New("device limit exceeded")
+
+// tvDevices signs the TV in with a token naming the user, or refuses to register it when full
+type tvDevices struct {
+	full       bool
+	registered []string
+}
+
+func (d *tvDevices) RegisterDevice(_ context.Context, _ string, deviceAddress string) error {
+	if d.full {
+		return errDeviceLimit
+	}
+	d.registered = append(d.registered, deviceAddress)
+	return nil
+}
+
+func (d *tvDevices) LoginDevice(_ context.Context, email string, deviceAddress string) (string, error) {
+	return "token of " + email + " on " + deviceAddress, nil
+}
+
+func newQRLogin(ttl time.Duration) (*QRLogin, *memoryLogins, *tvDevices) {
+	logins := &memoryLogins{logins: map[string]models.QRLogin{}}
+	devices := &tvDevices{}
+	q := New(&logger.Logger{SugaredLogger: zap.NewNop().Sugar()}, logins, devices, ttl, 10*time.Millisecond)
+	return q, logins, devices
+}
+
+// watch collects the updates of the session until Watch returns
+func watch(q *QRLogin, id, secret string) ([]Update, error) {
+	var updates []Update
+	err := q.Watch(context.Background(), id, secret, func(u Update) error {
+		updates = append(updates, u)
+		return nil
+	})
+	return updates, err
+}
+
+func TestStartKeepsOnlyTheSecretHash(t *testing.T) {
+	q, logins, _ := newQRLogin(time.Minute)
+
+	session, err := q.Start(context.Background(), "tv")
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	login := logins.logins[session.ID]
+	if session.Secret == "" || login.SecretHash == session.Secret || login.SecretHash != hash(session.Secret) {
+		t.Errorf("stored %q for the secret %q, want only its hash", login.SecretHash, session.Secret)
+	}
+	if session.ExpiresIn != time.Minute || login.DeviceAddress != "tv" {
+		t.Errorf("session = %+v, login = %+v", session, login)
+	}
+}
+
+func TestWatchApproved(t *testing.T) {
+	q, _, devices := newQRLogin(time.Minute)
+	session, err := q.Start(context.Background(), "tv")
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	// the phone approves once the TV shows the pending session
+	pending := make(chan struct{})
+	done := make(chan error)
+	var updates []Update
+	go func() {
+		done <- q.Watch(context.Background(), session.ID, session.Secret, func(u Update) error {
+			updates = append(updates, u)
+			if u.Status == models.QRLoginPending {
+				close(pending)
+			}
+			return nil
+		})
+	}()
+	<-pending
+	device, err := q.Approve(context.Background(), "alice@example.com", session.ID)
+	if err != nil || device != "tv" {
+		t.Fatalf("Approve = %q, %v, want the tv", device, err)
+	}
+	err = <-done
+
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	want := []Update{{Status: models.QRLoginPending}, {Status: models.QRLoginApproved, Token: "token of alice@example.com on tv"}}
+	if len(updates) != len(want) || updates[0] != want[0] || updates[1] != want[1] {
+		t.Errorf("updates = %+v, want %+v", updates, want)
+	}
+	if len(devices.registered) != 1 {
+		t.Errorf("registered %v, want the tv once", devices.registered)
+	}
+
+	// the token is handed out once
+	if _, err := watch(q, session.ID, session.Secret); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("second Watch error = %v, want %v", err, ErrSessionNotFound)
+	}
+}
+
+func TestWatchChecksTheSecret(t *testing.T) {
+	q, _, _ := newQRLogin(time.Minute)
+	session, err := q.Start(context.Background(), "tv")
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if _, err := q.Approve(context.Background(), "alice@example.com", session.ID); err != nil {
+		t.Fatalf("Approve: %v", err)
+	}
+
+	// the id is in the QR code for anyone to see, without the secret of the TV there is no token
+	for _, secret := range []string{"", "guess", session.ID} {
+		updates, err := watch(q, session.ID, secret)
+		if !errors.Is(err, ErrSessionNotFound) || len(updates) != 0 {
+			t.Errorf("Watch with secret %q = %+v, %v, want %v", secret, updates, err, ErrSessionNotFound)
+		}
+	}
+	if updates, err := watch(q, session.ID, session.Secret); err != nil || len(updates) != 1 || updates[0].Token == "" {
+		t.Errorf("Watch with the secret = %+v, %v, want the token", updates, err)
+	}
+}
+
+func TestWatchExpired(t *testing.T) {
+	q, _, _ := newQRLogin(30 * time.Millisecond)
+	session, err := q.Start(context.Background(), "tv")
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	updates, err := watch(q, session.ID, session.Secret)
+	if !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("Watch error = %v, want %v", err, ErrSessionExpired)
+	}
+	if len(updates) != 1 || updates[0].Status != models.QRLoginPending {
+		t.Errorf("updates = %+v, want pending once", updates)
+	}
+	if _, err := q.Approve(context.Background(), "alice@example.com", session.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Approve of an expired session error = %v, want %v", err, ErrSessionNotFound)
+	}
+}
+
+func TestApprove(t *testing.T) {
+	q, _, devices := newQRLogin(time.Minute)
+	session, err := q.Start(context.Background(), "tv")
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	// the user approving learns the TV does not fit, the session stays open for another try
+	devices.full = true
+	if _, err := q.Approve(context.Background(), "alice@example.com", session.ID); !errors.Is(err, errDeviceLimit) {
+		t.Fatalf("Approve over the device limit error = %v, want %v", err, errDeviceLimit)
+	}
+	devices.full = false
+	if _, err := q.Approve(context.Background(), "alice@example.com", session.ID); err != nil {
+		t.Fatalf("Approve: %v", err)
+	}
+	if _, err := q.Approve(context.Background(), "mallory@example.com", session.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("second Approve error = %v, want %v", err, ErrSessionNotFound)
+	}
+	if _, err := q.Approve(context.Background(), "alice@example.com", "unknown"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Approve of an unknown session error = %v, want %v", err, ErrSessionNotFound)
+	}
+}
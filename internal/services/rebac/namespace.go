@@ -0,0 +1,369 @@
+package rebac
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+var ErrInvalidNamespaceConfig = errors.New("invalid namespace config")
+
+// Namespaces is the parsed namespace config, namespace name to its relations
+type Namespaces map[string]*Namespace
+
+type Namespace struct {
+	Name      string
+	Relations map[string]*Relation
+}
+
+// Relation is defined by the union of its rewrites
+type Relation struct {
+	Name     string
+	Rewrites []Rewrite
+}
+
+// rewrite kinds
+const (
+	// RewriteThis is the tuples written for the relation itself
+	RewriteThis = "this"
+	// RewriteComputed is another relation of the same object
+	RewriteComputed = "computed_userset"
+	// RewriteTupleToUserset follows Tupleset to other objects and takes Relation on them
+	RewriteTupleToUserset = "tuple_to_userset"
+)
+
+type Rewrite struct {
+	Kind     string
+	Relation string
+	Tupleset string
+}
+
+func (r Rewrite) String() string {
+	switch r.Kind {
+	case RewriteComputed:
+		return r.Relation
+	case RewriteTupleToUserset:
+		return r.Tupleset + "->" + r.Relation
+	default:
+		return RewriteThis
+	}
+}
+
+// Relation returns the definition of the relation, nil if it is not declared
+func (n Namespaces) Relation(namespace string, relation string) *Relation {
+	ns, ok := n[namespace]
+	if !ok {
+		return nil
+	}
+	return ns.Relations[relation]
+}
+
+// includes reports whether the tuples written for the relation count towards it
+func (n Namespaces) includes(namespace string, relation string) bool {
+	rel := n.Relation(namespace, relation)
+	if rel == nil {
+		return false
+	}
+	for _, rw := range rel.Rewrites {
+		if rw.Kind == RewriteThis {
+			return true
+		}
+	}
+	return false
+}
+
+// computedFrom returns the relations of the namespace that include the relation as a computed userset
+func (n Namespaces) computedFrom(namespace string, relation string) []string {
+	ns, ok := n[namespace]
+	if !ok {
+		return nil
+	}
+	var res []string
+	for _, rel := range ns.Relations {
+		for _, rw := range rel.Rewrites {
+			if rw.Kind == RewriteComputed && rw.Relation == relation {
+				res = append(res, rel.Name)
+			}
+		}
+	}
+	return res
+}
+
+// tupleToUsersetFrom returns the relations of the namespace that take relation on the objects
+// their tupleset points to
+func (n Namespaces) tupleToUsersetFrom(namespace string, tupleset string, relation string) []string {
+	ns, ok := n[namespace]
+	if !ok {
+		return nil
+	}
+	var res []string
+	for _, rel := range ns.Relations {
+		for _, rw := range rel.Rewrites {
+			if rw.Kind == RewriteTupleToUserset && rw.Tupleset == tupleset && rw.Relation == relation {
+				res = append(res, rel.Name)
+			}
+		}
+	}
+	return res
+}
+
+// LoadNamespaces reads the namespace config from a file
+func LoadNamespaces(path string) (Namespaces, error) {
+	const op = "rebac.LoadNamespaces"
+
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	namespaces, err := ParseNamespaces(string(src))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return namespaces, nil
+}
+
+// ParseNamespaces parses the namespace config language:
+//
+//	// comments run to the end of the line
+//	namespace group {
+//	    relation member
+//	}
+//	namespace playlist {
+//	    relation parent
+//	    relation owner
+//	    relation editor = this | owner
+//	    relation viewer = this | editor | parent->viewer
+//	}
+//
+// A relation without "=" only has its own tuples. "this" is the tuples of the relation,
+// a bare name is the computed userset of another relation of the same object and
+// "tupleset->relation" takes relation on every object the tupleset relation points to.
+// The rewrites of a relation are united
+func ParseNamespaces(src string) (Namespaces, error) {
+	p := &parser{tokens: tokenize(src)}
+	namespaces := make(Namespaces)
+
+	for !p.done() {
+		ns, err := p.namespace()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := namespaces[ns.Name]; ok {
+			return nil, p.errorf("namespace %q declared twice", ns.Name)
+		}
+		namespaces[ns.Name] = ns
+	}
+
+	if err := namespaces.validate(); err != nil {
+		return nil, err
+	}
+
+	return namespaces, nil
+}
+
+// validate checks that every rewrite refers to a declared relation
+func (n Namespaces) validate() error {
+	for _, ns := range n {
+		for _, rel := range ns.Relations {
+			for _, rw := range rel.Rewrites {
+				switch rw.Kind {
+				case RewriteComputed:
+					if _, ok := ns.Relations[rw.Relation]; !ok {
+						return fmt.Errorf("%w: %s#%s refers to unknown relation %q", ErrInvalidNamespaceConfig, ns.Name, rel.Name, rw.Relation)
+					}
+				case RewriteTupleToUserset:
+					if _, ok := ns.Relations[rw.Tupleset]; !ok {
+						return fmt.Errorf("%w: %s#%s refers to unknown relation %q", ErrInvalidNamespaceConfig, ns.Name, rel.Name, rw.Tupleset)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+type token struct {
+	text string
+	line int
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *parser) peek() string {
+	if p.done() {
+		return ""
+	}
+	return p.tokens[p.pos].text
+}
+
+func (p *parser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *parser) expect(text string) error {
+	if got := p.next(); got != text {
+		return p.errorf("expected %q, got %q", text, got)
+	}
+	return nil
+}
+
+func (p *parser) ident() (string, error) {
+	t := p.next()
+	if !isIdent(t) || t == "namespace" || t == "relation" || t == "this" {
+		return "", p.errorf("expected a name, got %q", t)
+	}
+	return t, nil
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	line := 0
+	if n := len(p.tokens); n > 0 {
+		line = p.tokens[min(p.pos, n)-1].line
+		if p.pos < n {
+			line = p.tokens[p.pos].line
+		}
+	}
+	return fmt.Errorf("%w: line %d: %s", ErrInvalidNamespaceConfig, line, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) namespace() (*Namespace, error) {
+	if err := p.expect("namespace"); err != nil {
+		return nil, err
+	}
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	ns := &Namespace{Name: name, Relations: make(map[string]*Relation)}
+	for p.peek() != "}" {
+		if p.done() {
+			return nil, p.errorf("namespace %q is not closed", name)
+		}
+		rel, err := p.relation()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := ns.Relations[rel.Name]; ok {
+			return nil, p.errorf("relation %q declared twice in %q", rel.Name, name)
+		}
+		ns.Relations[rel.Name] = rel
+	}
+	p.next()
+
+	return ns, nil
+}
+
+func (p *parser) relation() (*Relation, error) {
+	if err := p.expect("relation"); err != nil {
+		return nil, err
+	}
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+
+	rel := &Relation{Name: name}
+	if p.peek() != "=" {
+		rel.Rewrites = []Rewrite{{Kind: RewriteThis}}
+		return rel, nil
+	}
+	p.next()
+
+	for {
+		rw, err := p.rewrite()
+		if err != nil {
+			return nil, err
+		}
+		rel.Rewrites = append(rel.Rewrites, rw)
+		if p.peek() != "|" {
+			return rel, nil
+		}
+		p.next()
+	}
+}
+
+func (p *parser) rewrite() (Rewrite, error) {
+	if p.peek() == "this" {
+		p.next()
+		return Rewrite{Kind: RewriteThis}, nil
+	}
+
+	name, err := p.ident()
+	if err != nil {
+		return Rewrite{}, err
+	}
+	if p.peek() != "->" {
+		return Rewrite{Kind: RewriteComputed, Relation: name}, nil
+	}
+	p.next()
+
+	target, err := p.ident()
+	if err != nil {
+		return Rewrite{}, err
+	}
+	return Rewrite{Kind: RewriteTupleToUserset, Tupleset: name, Relation: target}, nil
+}
+
+// tokenize splits the source into names and the symbols { } = | ->, dropping comments
+func tokenize(src string) []token {
+	var tokens []token
+	for i, line := range strings.Split(src, "\n") {
+		if c := strings.Index(line, "//"); c >= 0 {
+			line = line[:c]
+		}
+
+		rs := []rune(line)
+		for j := 0; j < len(rs); {
+			switch {
+			case unicode.IsSpace(rs[j]):
+				j++
+			case rs[j] == '-' && j+1 < len(rs) && rs[j+1] == '>':
+				tokens = append(tokens, token{text: "->", line: i + 1})
+				j += 2
+			case isIdentRune(rs[j]):
+				k := j
+				for k < len(rs) && isIdentRune(rs[k]) {
+					k++
+				}
+				tokens = append(tokens, token{text: string(rs[j:k]), line: i + 1})
+				j = k
+			default:
+				tokens = append(tokens, token{text: string(rs[j]), line: i + 1})
+				j++
+			}
+		}
+	}
+	return tokens
+}
+
+func isIdent(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !isIdentRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,495 @@
+package rebac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+
+	"go.uber.org/zap"
+)
+
+const (
+	queryTime = 3 * time.Second
+	// maxDepth bounds the nesting of usersets a check follows
+	maxDepth = 25
+)
+
+var (
+	ErrUnknownRelation          = errors.New("relation is not declared in the namespace config")
+	ErrInvalidConsistencyToken  = errors.New("invalid consistency token")
+	ErrMaxDepthExceeded         = errors.New("userset nesting is too deep")
+	errConsistencyTokenTooFresh = fmt.Errorf("%w: revision is ahead of the store", ErrInvalidConsistencyToken)
+)
+
+// Rebac answers whether a subject has a relation to an object, following the rewrites of the
+// namespace config over the stored relation tuples
+type Rebac struct {
+	log        *logger.Logger
+	writer     TupleWriter
+	reader     TupleReader
+	namespaces Namespaces
+}
+
+type TupleWriter interface {
+	WriteRelationTuples(
+		ctx context.Context,
+		writes []models.RelationTuple,
+		deletes []models.RelationTuple,
+	) (rev int64, err error)
+}
+
+type TupleReader interface {
+	HeadRevision(ctx context.Context) (int64, error)
+	RelationTuples(
+		ctx context.Context,
+		object models.Object,
+		relation string,
+		rev int64,
+	) ([]models.RelationTuple, error)
+	SubjectTuples(
+		ctx context.Context,
+		subject models.Object,
+		rev int64,
+	) ([]models.RelationTuple, error)
+}
+
+func New(
+	log *logger.Logger,
+	writer TupleWriter,
+	reader TupleReader,
+	namespaces Namespaces,
+) *Rebac {
+	return &Rebac{
+		log:        log,
+		writer:     writer,
+		reader:     reader,
+		namespaces: namespaces,
+	}
+}
+
+// Write creates and deletes the tuples atomically and returns the consistency token of the write.
+// A check with this token is guaranteed to see it
+func (r *Rebac) Write(
+	ctx context.Context,
+	writes []models.RelationTuple,
+	deletes []models.RelationTuple,
+) (string, error) {
+	const op = "Rebac.Write"
+	log := r.log.With(zap.String("op", op))
+
+	for _, t := range append(append([]models.RelationTuple{}, writes...), deletes...) {
+		if err := r.validate(t); err != nil {
+			log.Warn("rejected tuple", zap.String("tuple", t.String()), zap.Error(err))
+			return "", fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	rev, err := r.writer.WriteRelationTuples(ctx, writes, deletes)
+	if err != nil {
+		log.Error("failed to write tuples", zap.Error(err))
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("tuples written", zap.Int("writes", len(writes)), zap.Int("deletes", len(deletes)), zap.Int64("revision", rev))
+
+	return formatToken(rev), nil
+}
+
+// Check reports whether the subject has the relation to the object. An empty token evaluates
+// at the latest revision, otherwise the check is a snapshot read at the revision of the token.
+// The returned token is the revision the check was evaluated at
+func (r *Rebac) Check(
+	ctx context.Context,
+	object models.Object,
+	relation string,
+	subject models.Subject,
+	token string,
+) (bool, string, error) {
+	const op = "Rebac.Check"
+	log := r.log.With(zap.String("op", op))
+
+	if r.namespaces.Relation(object.Namespace, relation) == nil {
+		return false, "", fmt.Errorf("%s: %w", op, ErrUnknownRelation)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	rev, err := r.revision(ctx, token)
+	if err != nil {
+		log.Warn("bad consistency token", zap.Error(err))
+		return false, "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	c := &checker{ctx: ctx, rebac: r, rev: rev, subject: subject, seen: make(map[string]bool)}
+	allowed, err := c.check(object, relation, 0)
+	if err != nil {
+		log.Error("failed to check", zap.Error(err))
+		return false, "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return allowed, formatToken(rev), nil
+}
+
+// Node is a userset tree returned by Expand. A union node has the rewrites of Userset as
+// children, a leaf holds the subjects written directly for it
+type Node struct {
+	Type     string
+	Userset  models.Subject
+	Subjects []models.Subject
+	Children []*Node
+}
+
+// node types
+const (
+	NodeUnion = "union"
+	NodeLeaf  = "leaf"
+)
+
+// Expand returns the tree of subjects that have the relation to the object, following every
+// userset down to its leaves. A userset is expanded once, where it appears again it is
+// a union node without children
+func (r *Rebac) Expand(
+	ctx context.Context,
+	object models.Object,
+	relation string,
+	token string,
+) (*Node, string, error) {
+	const op = "Rebac.Expand"
+	log := r.log.With(zap.String("op", op))
+
+	if r.namespaces.Relation(object.Namespace, relation) == nil {
+		return nil, "", fmt.Errorf("%s: %w", op, ErrUnknownRelation)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	rev, err := r.revision(ctx, token)
+	if err != nil {
+		log.Warn("bad consistency token", zap.Error(err))
+		return nil, "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	tree, err := r.expand(ctx, object, relation, rev, 0, make(map[string]bool))
+	if err != nil {
+		log.Error("failed to expand", zap.Error(err))
+		return nil, "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return tree, formatToken(rev), nil
+}
+
+// ListObjects returns the ids of the objects of the namespace the subject has the relation to.
+// The rewrites are followed backwards from the tuples of the subject, so only the usersets
+// the subject is a member of are read, not every object of the namespace
+func (r *Rebac) ListObjects(
+	ctx context.Context,
+	namespace string,
+	relation string,
+	subject models.Subject,
+	token string,
+) ([]string, string, error) {
+	const op = "Rebac.ListObjects"
+	log := r.log.With(zap.String("op", op))
+
+	if r.namespaces.Relation(namespace, relation) == nil {
+		return nil, "", fmt.Errorf("%s: %w", op, ErrUnknownRelation)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	rev, err := r.revision(ctx, token)
+	if err != nil {
+		log.Warn("bad consistency token", zap.Error(err))
+		return nil, "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	l := &lister{ctx: ctx, rebac: r, rev: rev, reached: make(map[string]bool), tuples: make(map[string][]models.RelationTuple)}
+	if err := l.walk(subject); err != nil {
+		log.Error("failed to list objects", zap.Error(err))
+		return nil, "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	ids := []string{}
+	for _, s := range l.usersets {
+		if s.Namespace == namespace && s.Relation == relation {
+			ids = append(ids, s.ID)
+		}
+	}
+	slices.Sort(ids)
+
+	return ids, formatToken(rev), nil
+}
+
+// validate checks the tuple against the namespace config
+func (r *Rebac) validate(t models.RelationTuple) error {
+	if t.Object.Namespace == "" || t.Object.ID == "" || t.Subject.Namespace == "" || t.Subject.ID == "" {
+		return models.ErrInvalidRelationTuple
+	}
+	if r.namespaces.Relation(t.Object.Namespace, t.Relation) == nil {
+		return fmt.Errorf("%w: %s#%s", ErrUnknownRelation, t.Object.Namespace, t.Relation)
+	}
+	if _, ok := r.namespaces[t.Subject.Namespace]; !ok {
+		return fmt.Errorf("%w: unknown namespace %q", models.ErrInvalidRelationTuple, t.Subject.Namespace)
+	}
+	if t.Subject.Relation != "" && r.namespaces.Relation(t.Subject.Namespace, t.Subject.Relation) == nil {
+		return fmt.Errorf("%w: %s#%s", ErrUnknownRelation, t.Subject.Namespace, t.Subject.Relation)
+	}
+	return nil
+}
+
+// revision returns the revision to evaluate at, a token ahead of the store is rejected
+// since the write it came from is not visible here
+func (r *Rebac) revision(ctx context.Context, token string) (int64, error) {
+	head, err := r.reader.HeadRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if token == "" {
+		return head, nil
+	}
+
+	rev, err := strconv.ParseInt(token, 10, 64)
+	if err != nil || rev < 0 {
+		return 0, ErrInvalidConsistencyToken
+	}
+	if rev > head {
+		return 0, errConsistencyTokenTooFresh
+	}
+
+	return rev, nil
+}
+
+func (r *Rebac) expand(
+	ctx context.Context,
+	object models.Object,
+	relation string,
+	rev int64,
+	depth int,
+	seen map[string]bool,
+) (*Node, error) {
+	if depth > maxDepth {
+		return nil, ErrMaxDepthExceeded
+	}
+
+	userset := models.Subject{Object: object, Relation: relation}
+	node := &Node{Type: NodeUnion, Userset: userset}
+	// a cycle, or a userset already expanded elsewhere in the tree
+	if seen[userset.String()] {
+		return node, nil
+	}
+	seen[userset.String()] = true
+	rel := r.namespaces.Relation(object.Namespace, relation)
+	if rel == nil {
+		// a userset of a relation the config does not declare has no members
+		return node, nil
+	}
+
+	for _, rw := range rel.Rewrites {
+		switch rw.Kind {
+		case RewriteThis:
+			tuples, err := r.reader.RelationTuples(ctx, object, relation, rev)
+			if err != nil {
+				return nil, err
+			}
+			leaf := &Node{Type: NodeLeaf, Userset: userset, Subjects: []models.Subject{}}
+			for _, t := range tuples {
+				if t.Subject.Relation == "" {
+					leaf.Subjects = append(leaf.Subjects, t.Subject)
+					continue
+				}
+				child, err := r.expand(ctx, t.Subject.Object, t.Subject.Relation, rev, depth+1, seen)
+				if err != nil {
+					return nil, err
+				}
+				node.Children = append(node.Children, child)
+			}
+			node.Children = append(node.Children, leaf)
+		case RewriteComputed:
+			child, err := r.expand(ctx, object, rw.Relation, rev, depth+1, seen)
+			if err != nil {
+				return nil, err
+			}
+			node.Children = append(node.Children, child)
+		case RewriteTupleToUserset:
+			tuples, err := r.reader.RelationTuples(ctx, object, rw.Tupleset, rev)
+			if err != nil {
+				return nil, err
+			}
+			for _, t := range tuples {
+				child, err := r.expand(ctx, t.Subject.Object, rw.Relation, rev, depth+1, seen)
+				if err != nil {
+					return nil, err
+				}
+				node.Children = append(node.Children, child)
+			}
+		}
+	}
+
+	return node, nil
+}
+
+// checker evaluates the rewrites for one subject at one revision
+type checker struct {
+	ctx     context.Context
+	rebac   *Rebac
+	rev     int64
+	subject models.Subject
+	// seen are the usersets already visited: rewrites are unions only, so a userset that was
+	// visited either already answered true or cannot add anything
+	seen map[string]bool
+}
+
+func (c *checker) check(object models.Object, relation string, depth int) (bool, error) {
+	if depth > maxDepth {
+		return false, ErrMaxDepthExceeded
+	}
+
+	userset := models.Subject{Object: object, Relation: relation}
+	if userset == c.subject {
+		return true, nil
+	}
+	if c.seen[userset.String()] {
+		return false, nil
+	}
+	c.seen[userset.String()] = true
+
+	rel := c.rebac.namespaces.Relation(object.Namespace, relation)
+	if rel == nil {
+		return false, nil
+	}
+
+	for _, rw := range rel.Rewrites {
+		var (
+			allowed bool
+			err     error
+		)
+		switch rw.Kind {
+		case RewriteThis:
+			allowed, err = c.this(object, relation, depth)
+		case RewriteComputed:
+			allowed, err = c.check(object, rw.Relation, depth+1)
+		case RewriteTupleToUserset:
+			allowed, err = c.tupleToUserset(object, rw, depth)
+		}
+		if err != nil || allowed {
+			return allowed, err
+		}
+	}
+
+	return false, nil
+}
+
+func (c *checker) this(object models.Object, relation string, depth int) (bool, error) {
+	tuples, err := c.rebac.reader.RelationTuples(c.ctx, object, relation, c.rev)
+	if err != nil {
+		return false, err
+	}
+
+	for _, t := range tuples {
+		if t.Subject == c.subject {
+			return true, nil
+		}
+	}
+	for _, t := range tuples {
+		if t.Subject.Relation == "" {
+			continue
+		}
+		allowed, err := c.check(t.Subject.Object, t.Subject.Relation, depth+1)
+		if err != nil || allowed {
+			return allowed, err
+		}
+	}
+
+	return false, nil
+}
+
+func (c *checker) tupleToUserset(object models.Object, rw Rewrite, depth int) (bool, error) {
+	tuples, err := c.rebac.reader.RelationTuples(c.ctx, object, rw.Tupleset, c.rev)
+	if err != nil {
+		return false, err
+	}
+
+	for _, t := range tuples {
+		allowed, err := c.check(t.Subject.Object, rw.Relation, depth+1)
+		if err != nil || allowed {
+			return allowed, err
+		}
+	}
+
+	return false, nil
+}
+
+// lister walks the rewrites backwards from a subject to every userset it is a member of,
+// the reverse of checker
+type lister struct {
+	ctx   context.Context
+	rebac *Rebac
+	rev   int64
+	// reached are the usersets already found, usersets lists them in the order they were found
+	reached  map[string]bool
+	usersets []models.Subject
+	// tuples caches the tuples by their subject object, the usersets of an object share them
+	tuples map[string][]models.RelationTuple
+}
+
+func (l *lister) walk(subject models.Subject) error {
+	l.reach(subject)
+	for i := 0; i < len(l.usersets); i++ {
+		s := l.usersets[i]
+		if s.Relation != "" {
+			for _, rel := range l.rebac.namespaces.computedFrom(s.Namespace, s.Relation) {
+				l.reach(models.Subject{Object: s.Object, Relation: rel})
+			}
+		}
+
+		tuples, err := l.subjectTuples(s.Object)
+		if err != nil {
+			return err
+		}
+		for _, t := range tuples {
+			// written for the relation of the object, directly or as a userset
+			if t.Subject == s && l.rebac.namespaces.includes(t.Object.Namespace, t.Relation) {
+				l.reach(models.Subject{Object: t.Object, Relation: t.Relation})
+			}
+			// the object of the userset is in the tupleset of another object
+			if s.Relation != "" {
+				for _, rel := range l.rebac.namespaces.tupleToUsersetFrom(t.Object.Namespace, t.Relation, s.Relation) {
+					l.reach(models.Subject{Object: t.Object, Relation: rel})
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (l *lister) reach(s models.Subject) {
+	if l.reached[s.String()] {
+		return
+	}
+	l.reached[s.String()] = true
+	l.usersets = append(l.usersets, s)
+}
+
+func (l *lister) subjectTuples(object models.Object) ([]models.RelationTuple, error) {
+	if tuples, ok := l.tuples[object.String()]; ok {
+		return tuples, nil
+	}
+	tuples, err := l.rebac.reader.SubjectTuples(l.ctx, object, l.rev)
+	if err != nil {
+		return nil, err
+	}
+	l.tuples[object.String()] = tuples
+	return tuples, nil
+}
+
+func formatToken(rev int64) string {
+	return strconv.FormatInt(rev, 10)
+}
@@ -0,0 +1,348 @@
+package rebac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+
+	"go.uber.org/zap"
+)
+
+const testNamespaces = `
+namespace user {}
+namespace group {
+    relation member
+}
+namespace folder {
+    relation parent
+    relation owner
+    relation viewer = this | owner | parent->viewer
+}
+namespace doc {
+    relation parent
+    relation owner
+    relation editor = this | owner
+    relation viewer = this | editor | parent->viewer
+}
+`
+
+// memoryTuples is a TupleReader over a fixed set of tuples, all written at revision 1
+type memoryTuples []models.RelationTuple
+
+func (m memoryTuples) HeadRevision(context.Context) (int64, error) {
+	return 1, nil
+}
+
+func (m memoryTuples) RelationTuples(_ context.Context, object models.Object, relation string, _ int64) ([]models.RelationTuple, error) {
+	var res []models.RelationTuple
+	for _, t := range m {
+		if t.Object == object && t.Relation == relation {
+			res = append(res, t)
+		}
+	}
+	return res, nil
+}
+
+func (m memoryTuples) SubjectTuples(_ context.Context, subject models.Object, _ int64) ([]models.RelationTuple, error) {
+	var res []models.RelationTuple
+	for _, t := range m {
+		if t.Subject.Object == subject {
+			res = append(res, t)
+		}
+	}
+	return res, nil
+}
+
+// tuple parses "namespace:id#relation@namespace:id[#relation]"
+func tuple(s string) models.RelationTuple {
+	object, subject, _ := strings.Cut(s, "@")
+	object, relation, _ := strings.Cut(object, "#")
+	return models.RelationTuple{
+		Object:   parseObject(object),
+		Relation: relation,
+		Subject:  parseSubject(subject),
+	}
+}
+
+func parseObject(s string) models.Object {
+	namespace, id, _ := strings.Cut(s, ":")
+	return models.Object{Namespace: namespace, ID: id}
+}
+
+func parseSubject(s string) models.Subject {
+	object, relation, _ := strings.Cut(s, "#")
+	return models.Subject{Object: parseObject(object), Relation: relation}
+}
+
+func newTestRebac(t *testing.T, tuples ...string) *Rebac {
+	t.Helper()
+
+	namespaces, err := ParseNamespaces(testNamespaces)
+	if err != nil {
+		t.Fatalf("ParseNamespaces: %v", err)
+	}
+	store := make(memoryTuples, 0, len(tuples))
+	for _, s := range tuples {
+		store = append(store, tuple(s))
+	}
+	return New(&logger.Logger{SugaredLogger: zap.NewNop().Sugar()}, nil, store, namespaces)
+}
+
+var testTuples = []string{
+	"group:eng#member@user:alice",
+	"group:eng#member@group:leads#member",
+	"group:leads#member@user:bob",
+	"folder:root#owner@user:carol",
+	"folder:root#viewer@group:eng#member",
+	"folder:sub#parent@folder:root",
+	"doc:plan#parent@folder:sub",
+	"doc:plan#owner@user:dave",
+	"doc:memo#editor@user:erin",
+	"doc:draft#viewer@user:frank",
+	// a cycle of usersets
+	"group:a#member@group:b#member",
+	"group:b#member@group:a#member",
+	"group:a#member@user:gina",
+}
+
+func TestCheck(t *testing.T) {
+	r := newTestRebac(t, testTuples...)
+
+	tests := []struct {
+		name     string
+		object   string
+		relation string
+		subject  string
+		want     bool
+	}{
+		{"direct tuple", "doc:draft", "viewer", "user:frank", true},
+		{"computed userset", "doc:memo", "viewer", "user:erin", true},
+		{"owner is editor", "doc:plan", "editor", "user:dave", true},
+		{"tuple to userset", "doc:plan", "viewer", "user:carol", true},
+		{"nested groups through parents", "doc:plan", "viewer", "user:bob", true},
+		{"group member through parents", "doc:plan", "viewer", "user:alice", true},
+		{"userset subject", "doc:plan", "viewer", "group:eng#member", true},
+		{"viewer is not editor", "doc:plan", "editor", "user:alice", false},
+		{"unrelated user", "doc:memo", "viewer", "user:frank", false},
+		{"cycle member", "group:b", "member", "user:gina", true},
+		{"cycle terminates", "group:b", "member", "user:alice", false},
+		{"unknown object", "doc:none", "viewer", "user:alice", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, token, err := r.Check(context.Background(), parseObject(tt.object), tt.relation, parseSubject(tt.subject), "")
+			if err != nil {
+				t.Fatalf("Check: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Check(%s#%s@%s) = %v, want %v", tt.object, tt.relation, tt.subject, got, tt.want)
+			}
+			if token != "1" {
+				t.Errorf("token = %q, want %q", token, "1")
+			}
+		})
+	}
+}
+
+func TestCheckErrors(t *testing.T) {
+	r := newTestRebac(t, testTuples...)
+
+	tests := []struct {
+		name     string
+		relation string
+		token    string
+		want     error
+	}{
+		{"unknown relation", "admin", "", ErrUnknownRelation},
+		{"malformed token", "viewer", "abc", ErrInvalidConsistencyToken},
+		{"negative token", "viewer", "-1", ErrInvalidConsistencyToken},
+		{"token ahead of the store", "viewer", "2", ErrInvalidConsistencyToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := r.Check(context.Background(), parseObject("doc:plan"), tt.relation, parseSubject("user:alice"), tt.token)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Check error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckMaxDepth(t *testing.T) {
+	tuples := make([]string, 0, maxDepth+2)
+	for i := 0; i <= maxDepth+1; i++ {
+		tuples = append(tuples, fmt.Sprintf("group:g%d#member@group:g%d#member", i, i+1))
+	}
+	tuples = append(tuples, fmt.Sprintf("group:g%d#member@user:alice", maxDepth+2))
+	r := newTestRebac(t, tuples...)
+
+	_, _, err := r.Check(context.Background(), parseObject("group:g0"), "member", parseSubject("user:alice"), "")
+	if !errors.Is(err, ErrMaxDepthExceeded) {
+		t.Errorf("Check error = %v, want %v", err, ErrMaxDepthExceeded)
+	}
+}
+
+func TestListObjects(t *testing.T) {
+	r := newTestRebac(t, testTuples...)
+
+	tests := []struct {
+		namespace string
+		relation  string
+		subject   string
+		want      []string
+	}{
+		{"doc", "viewer", "user:alice", []string{"plan"}},
+		{"doc", "viewer", "user:dave", []string{"plan"}},
+		{"doc", "viewer", "user:erin", []string{"memo"}},
+		{"doc", "editor", "user:erin", []string{"memo"}},
+		{"doc", "editor", "user:alice", []string{}},
+		{"folder", "viewer", "user:bob", []string{"root", "sub"}},
+		{"folder", "viewer", "group:eng#member", []string{"root", "sub"}},
+		{"group", "member", "user:bob", []string{"eng", "leads"}},
+		{"group", "member", "user:gina", []string{"a", "b"}},
+		{"doc", "viewer", "user:nobody", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace+"#"+tt.relation+"@"+tt.subject, func(t *testing.T) {
+			got, _, err := r.ListObjects(context.Background(), tt.namespace, tt.relation, parseSubject(tt.subject), "")
+			if err != nil {
+				t.Fatalf("ListObjects: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ListObjects = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestListObjectsMatchesCheck lists every object Check allows, for every subject of the tuples
+func TestListObjectsMatchesCheck(t *testing.T) {
+	r := newTestRebac(t, testTuples...)
+
+	objects := map[string][]string{}
+	var subjects []string
+	for _, s := range testTuples {
+		tt := tuple(s)
+		if !slices.Contains(objects[tt.Object.Namespace], tt.Object.ID) {
+			objects[tt.Object.Namespace] = append(objects[tt.Object.Namespace], tt.Object.ID)
+		}
+		if !slices.Contains(subjects, tt.Subject.String()) {
+			subjects = append(subjects, tt.Subject.String())
+		}
+	}
+
+	for namespace, ns := range r.namespaces {
+		for relation := range ns.Relations {
+			for _, subject := range subjects {
+				want := []string{}
+				for _, id := range objects[namespace] {
+					allowed, _, err := r.Check(context.Background(), models.Object{Namespace: namespace, ID: id}, relation, parseSubject(subject), "")
+					if err != nil {
+						t.Fatalf("Check: %v", err)
+					}
+					if allowed {
+						want = append(want, id)
+					}
+				}
+				slices.Sort(want)
+
+				got, _, err := r.ListObjects(context.Background(), namespace, relation, parseSubject(subject), "")
+				if err != nil {
+					t.Fatalf("ListObjects: %v", err)
+				}
+				if !slices.Equal(got, want) {
+					t.Errorf("ListObjects(%s#%s@%s) = %v, Check allows %v", namespace, relation, subject, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	r := newTestRebac(t, testTuples...)
+
+	tests := []struct {
+		name     string
+		object   string
+		relation string
+		want     []string
+	}{
+		{"direct subjects", "group:leads", "member", []string{"user:bob"}},
+		{"nested userset", "group:eng", "member", []string{"user:alice", "user:bob"}},
+		{"rewrites", "doc:plan", "viewer", []string{"user:alice", "user:bob", "user:carol", "user:dave"}},
+		{"cycle", "group:a", "member", []string{"user:gina"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree, _, err := r.Expand(context.Background(), parseObject(tt.object), tt.relation, "")
+			if err != nil {
+				t.Fatalf("Expand: %v", err)
+			}
+			got := leaves(tree, nil)
+			slices.Sort(got)
+			got = slices.Compact(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Expand subjects = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestExpandVisitsUsersetOnce expands a userset reachable on two paths only once
+func TestExpandVisitsUsersetOnce(t *testing.T) {
+	r := newTestRebac(t,
+		"group:top#member@group:left#member",
+		"group:top#member@group:right#member",
+		"group:left#member@group:shared#member",
+		"group:right#member@group:shared#member",
+		"group:shared#member@user:alice",
+	)
+
+	tree, _, err := r.Expand(context.Background(), parseObject("group:top"), "member", "")
+	if err != nil {
+		t.Fatalf("Expand: %v", err)
+	}
+	if n := count(tree, "group:shared#member"); n != 2 {
+		t.Fatalf("group:shared#member appears %d times, want 2", n)
+	}
+	if n := expanded(tree, "group:shared#member"); n != 1 {
+		t.Errorf("group:shared#member expanded %d times, want 1", n)
+	}
+}
+
+func leaves(n *Node, acc []string) []string {
+	for _, s := range n.Subjects {
+		acc = append(acc, s.String())
+	}
+	for _, c := range n.Children {
+		acc = leaves(c, acc)
+	}
+	return acc
+}
+
+func count(n *Node, userset string) int {
+	c := 0
+	if n.Type == NodeUnion && n.Userset.String() == userset {
+		c++
+	}
+	for _, child := range n.Children {
+		c += count(child, userset)
+	}
+	return c
+}
+
+func expanded(n *Node, userset string) int {
+	c := 0
+	if n.Type == NodeUnion && n.Userset.String() == userset && len(n.Children) > 0 {
+		c++
+	}
+	for _, child := range n.Children {
+		c += expanded(child, userset)
+	}
+	return c
+}
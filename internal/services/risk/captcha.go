@@ -0,0 +1,105 @@
+package risk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"vieo/auth/internal/lib/clientinfo"
+	"vieo/auth/internal/lib/logger"
+
+	"go.uber.org/zap"
+)
+
+const verifyTime = 5 * time.Second
+
+// Captcha verifies responses with a siteverify endpoint. reCAPTCHA, hCaptcha and Turnstile
+// share the same protocol: a form with secret, response and remoteip answered by {"success": bool}
+type Captcha struct {
+	log       *logger.Logger
+	client    *http.Client
+	verifyURL string
+	secret    string
+	siteKey   string
+}
+
+func NewCaptcha(
+	log *logger.Logger,
+	verifyURL string,
+	secret string,
+	siteKey string,
+) *Captcha {
+	return &Captcha{
+		log:       log,
+		client:    &http.Client{Timeout: verifyTime},
+		verifyURL: verifyURL,
+		secret:    secret,
+		siteKey:   siteKey,
+	}
+}
+
+func (c *Captcha) Verify(
+	ctx context.Context,
+	_ string,
+	_ string,
+	response string,
+) error {
+	const op = "Captcha.Verify"
+
+	required := &ChallengeRequiredError{
+		Type:   ChallengeCaptcha,
+		Params: map[string]string{"site_key": c.siteKey},
+	}
+	if response == "" {
+		return fmt.Errorf("%s: %w", op, required)
+	}
+
+	ok, err := c.verify(ctx, response)
+	if err != nil {
+		c.log.Error("failed to verify captcha", zap.String("op", op), zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if !ok {
+		return fmt.Errorf("%s: %w", op, required)
+	}
+
+	return nil
+}
+
+func (c *Captcha) verify(ctx context.Context, response string) (bool, error) {
+	form := url.Values{
+		"secret":   {c.secret},
+		"response": {response},
+	}
+	if ip := clientinfo.FromContext(ctx).IP; ip != "" {
+		form.Set("remoteip", ip)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+
+	return result.Success, nil
+}
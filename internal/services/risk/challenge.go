@@ -0,0 +1,52 @@
+package risk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// challenge types returned to the client
+const (
+	ChallengeCaptcha     = "captcha"
+	ChallengeEmailOTP    = "email_otp"
+	ChallengeProofOfWork = "proof_of_work"
+)
+
+// actions a challenge is bound to
+const (
+	ActionLogin    = "login"
+	ActionRegister = "register"
+)
+
+var (
+	ErrChallengeRequired = errors.New("challenge required")
+	ErrChallengeFailed   = errors.New("challenge failed")
+)
+
+// ChallengeRequiredError tells the client which challenge to solve before retrying the request.
+// Params depend on the type, e.g. the site key of the CAPTCHA
+type ChallengeRequiredError struct {
+	Type   string
+	Params map[string]string
+}
+
+func (e *ChallengeRequiredError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrChallengeRequired, e.Type)
+}
+
+func (e *ChallengeRequiredError) Is(target error) bool {
+	return target == ErrChallengeRequired
+}
+
+// ChallengeVerifier asks a risky client to prove it is a human or the owner of the email.
+// Verify checks the response sent with the request for the action on the email: it returns nil
+// if the response is valid, otherwise it issues a new challenge and returns a *ChallengeRequiredError
+type ChallengeVerifier interface {
+	Verify(
+		ctx context.Context,
+		action string,
+		email string,
+		response string,
+	) error
+}
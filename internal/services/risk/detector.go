@@ -0,0 +1,196 @@
+package risk
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Thresholds of the detector. A source is flagged when within Window it produces more failures
+// than IPFailures/SubnetFailures, fails for more distinct accounts than IPAccounts/SubnetAccounts
+// or registers more accounts than IPRegistrations/SubnetRegistrations.
+// A flagged source stays flagged for FlagFor
+type Thresholds struct {
+	Window              time.Duration
+	IPFailures          int
+	SubnetFailures      int
+	IPAccounts          int
+	SubnetAccounts      int
+	IPRegistrations     int
+	SubnetRegistrations int
+	FlagFor             time.Duration
+}
+
+// Detector keeps sliding-window statistics of failed logins and registrations per client ip and
+// per subnet (/24 for IPv4, /48 for IPv6) to catch credential stuffing, password spraying and bot signups,
+// which per-account lockout does not see. The statistics live in memory of the replica
+type Detector struct {
+	mu         sync.Mutex
+	thresholds Thresholds
+	sources    map[string]*source
+	lastSweep  time.Time
+}
+
+// source is the history of an ip or a subnet
+type source struct {
+	failures      []time.Time
+	accounts      map[string]time.Time
+	registrations []time.Time
+	flaggedUntil  time.Time
+}
+
+func NewDetector(thresholds Thresholds) *Detector {
+	return &Detector{
+		thresholds: thresholds,
+		sources:    make(map[string]*source),
+		lastSweep:  time.Now(),
+	}
+}
+
+// RecordFailure registers a failed login for the account from the ip
+// and flags the ip and its subnet when a threshold is crossed
+func (d *Detector) RecordFailure(ip string, email string) {
+	if ip == "" {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	d.sweep(now)
+
+	d.record("ip:"+ip, email, now, d.thresholds.IPFailures, d.thresholds.IPAccounts)
+	if subnet := subnetOf(ip); subnet != "" {
+		d.record("subnet:"+subnet, email, now, d.thresholds.SubnetFailures, d.thresholds.SubnetAccounts)
+	}
+}
+
+// RecordRegistration registers a new account created from the ip
+// and flags the ip and its subnet when a threshold is crossed
+func (d *Detector) RecordRegistration(ip string) {
+	if ip == "" {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	d.sweep(now)
+
+	d.register("ip:"+ip, now, d.thresholds.IPRegistrations)
+	if subnet := subnetOf(ip); subnet != "" {
+		d.register("subnet:"+subnet, now, d.thresholds.SubnetRegistrations)
+	}
+}
+
+// Risky reports whether logins from the ip must pass a challenge
+func (d *Detector) Risky(ip string) bool {
+	if ip == "" {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if s, ok := d.sources["ip:"+ip]; ok && now.Before(s.flaggedUntil) {
+		return true
+	}
+	if subnet := subnetOf(ip); subnet != "" {
+		if s, ok := d.sources["subnet:"+subnet]; ok && now.Before(s.flaggedUntil) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *Detector) source(key string, now time.Time) *source {
+	s, ok := d.sources[key]
+	if !ok {
+		s = &source{accounts: make(map[string]time.Time)}
+		d.sources[key] = s
+	}
+	s.trim(now.Add(-d.thresholds.Window))
+
+	return s
+}
+
+func (d *Detector) register(key string, now time.Time, maxRegistrations int) {
+	s := d.source(key, now)
+
+	s.registrations = append(s.registrations, now)
+	if maxRegistrations > 0 && len(s.registrations) > maxRegistrations {
+		s.flaggedUntil = now.Add(d.thresholds.FlagFor)
+		s.registrations = s.registrations[len(s.registrations)-maxRegistrations-1:]
+	}
+}
+
+func (d *Detector) record(key string, email string, now time.Time, maxFailures int, maxAccounts int) {
+	s := d.source(key, now)
+
+	s.failures = append(s.failures, now)
+	// one account over the threshold is enough to keep the source flagged
+	if _, seen := s.accounts[email]; seen || (maxAccounts > 0 && len(s.accounts) <= maxAccounts) {
+		s.accounts[email] = now
+	}
+
+	if (maxFailures > 0 && len(s.failures) > maxFailures) || (maxAccounts > 0 && len(s.accounts) > maxAccounts) {
+		s.flaggedUntil = now.Add(d.thresholds.FlagFor)
+	}
+	// the history never needs to be longer than the threshold it is compared with
+	if maxFailures > 0 && len(s.failures) > maxFailures+1 {
+		s.failures = s.failures[len(s.failures)-maxFailures-1:]
+	}
+}
+
+// trim forgets everything that left the window
+func (s *source) trim(since time.Time) {
+	s.failures = trimTimes(s.failures, since)
+	s.registrations = trimTimes(s.registrations, since)
+
+	for email, at := range s.accounts {
+		if at.Before(since) {
+			delete(s.accounts, email)
+		}
+	}
+}
+
+// sweep drops sources with nothing in the window that are not flagged, once per window
+func (d *Detector) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < d.thresholds.Window {
+		return
+	}
+	d.lastSweep = now
+
+	since := now.Add(-d.thresholds.Window)
+	for key, s := range d.sources {
+		s.trim(since)
+		if len(s.failures) == 0 && len(s.registrations) == 0 && now.After(s.flaggedUntil) {
+			delete(d.sources, key)
+		}
+	}
+}
+
+// trimTimes drops the leading times before since, times are in ascending order
+func trimTimes(times []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(since) {
+		i++
+	}
+	return times[i:]
+}
+
+// subnetOf returns the /24 network of an IPv4 address or the /48 network of an IPv6 address
+func subnetOf(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
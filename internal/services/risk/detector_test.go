@@ -0,0 +1,159 @@
+package risk
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDetectorThresholds(t *testing.T) {
+	thresholds := Thresholds{
+		Window:              time.Hour,
+		IPFailures:          3,
+		SubnetFailures:      5,
+		IPAccounts:          2,
+		SubnetAccounts:      4,
+		IPRegistrations:     2,
+		SubnetRegistrations: 3,
+		FlagFor:             time.Hour,
+	}
+
+	type event struct {
+		ip    string
+		email string
+		kind  string
+	}
+	failures := func(ip string, emails ...string) []event {
+		events := make([]event, 0, len(emails))
+		for _, email := range emails {
+			events = append(events, event{ip: ip, email: email, kind: "failure"})
+		}
+		return events
+	}
+	registrations := func(ip string, n int) []event {
+		events := make([]event, 0, n)
+		for range n {
+			events = append(events, event{ip: ip, kind: "registration"})
+		}
+		return events
+	}
+	concat := func(lists ...[]event) []event {
+		var events []event
+		for _, l := range lists {
+			events = append(events, l...)
+		}
+		return events
+	}
+
+	tests := []struct {
+		name   string
+		events []event
+		risky  map[string]bool
+	}{
+		{
+			name:   "failures at the ip threshold",
+			events: failures("10.0.0.1", "a", "a", "a"),
+			risky:  map[string]bool{"10.0.0.1": false},
+		},
+		{
+			name:   "failures over the ip threshold",
+			events: failures("10.0.0.1", "a", "a", "a", "a"),
+			risky:  map[string]bool{"10.0.0.1": true, "10.0.0.2": false},
+		},
+		{
+			name:   "password spraying over the ip accounts",
+			events: failures("10.0.0.1", "a", "b", "c"),
+			risky:  map[string]bool{"10.0.0.1": true},
+		},
+		{
+			name:   "failures spread over the subnet",
+			events: concat(failures("10.0.0.1", "a", "a"), failures("10.0.0.2", "a", "a"), failures("10.0.0.3", "a", "a")),
+			risky:  map[string]bool{"10.0.0.1": true, "10.0.0.200": true, "10.0.1.1": false},
+		},
+		{
+			name: "accounts spread over the subnet",
+			events: concat(
+				failures("10.0.0.1", "a", "b"), failures("10.0.0.2", "c", "d"), failures("10.0.0.3", "e"),
+			),
+			risky: map[string]bool{"10.0.0.9": true},
+		},
+		{
+			name:   "registrations over the ip threshold",
+			events: registrations("10.0.0.1", 3),
+			risky:  map[string]bool{"10.0.0.1": true, "10.0.0.2": false},
+		},
+		{
+			name:   "registrations spread over the subnet",
+			events: concat(registrations("10.0.0.1", 2), registrations("10.0.0.2", 2)),
+			risky:  map[string]bool{"10.0.0.1": true, "10.0.0.3": true},
+		},
+		{
+			name:   "ipv6 subnet is a /48",
+			events: concat(failures("2001:db8:1:1::1", "a", "a"), failures("2001:db8:1:2::1", "a", "a"), failures("2001:db8:1:3::1", "a", "a")),
+			risky:  map[string]bool{"2001:db8:1:ffff::1": true, "2001:db8:2::1": false},
+		},
+		{
+			name:   "no ip",
+			events: failures("", "a", "b", "c", "d", "e", "f"),
+			risky:  map[string]bool{"": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDetector(thresholds)
+			for _, e := range tt.events {
+				if e.kind == "registration" {
+					d.RecordRegistration(e.ip)
+				} else {
+					d.RecordFailure(e.ip, e.email)
+				}
+			}
+			for ip, want := range tt.risky {
+				if got := d.Risky(ip); got != want {
+					t.Errorf("Risky(%q) = %v, want %v", ip, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDetectorWindow(t *testing.T) {
+	d := NewDetector(Thresholds{Window: 20 * time.Millisecond, IPFailures: 2, FlagFor: 20 * time.Millisecond})
+
+	d.RecordFailure("10.0.0.1", "a")
+	d.RecordFailure("10.0.0.1", "a")
+	time.Sleep(30 * time.Millisecond)
+	// the first two failures left the window
+	d.RecordFailure("10.0.0.1", "a")
+	if d.Risky("10.0.0.1") {
+		t.Fatalf("failures outside of the window flagged the ip")
+	}
+
+	d.RecordFailure("10.0.0.1", "a")
+	d.RecordFailure("10.0.0.1", "a")
+	if !d.Risky("10.0.0.1") {
+		t.Fatalf("failures within the window did not flag the ip")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if d.Risky("10.0.0.1") {
+		t.Errorf("ip is still flagged after FlagFor")
+	}
+}
+
+func TestSubnetOf(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"10.1.2.3", "10.1.2.0/24"},
+		{"::ffff:10.1.2.3", "10.1.2.0/24"},
+		{"2001:db8:abcd:12::1", "2001:db8:abcd::/48"},
+		{"not an ip", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := subnetOf(tt.ip); got != tt.want {
+				t.Errorf("subnetOf(%q) = %q, want %q", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package risk
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/notifier"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+const (
+	queryTime  = 3 * time.Second
+	notifyTime = 30 * time.Second
+
+	otpDigits      = 6
+	otpMaxAttempts = 5
+)
+
+// OTPStore keeps the hashed one-time codes, a code is removed once it is used
+// or after too many wrong attempts
+type OTPStore interface {
+	// SaveLoginOTP keeps an active code untouched and reports whether a new one was saved
+	SaveLoginOTP(
+		ctx context.Context,
+		email string,
+		codeHash string,
+		ttl time.Duration,
+	) (saved bool, err error)
+	// TakeLoginOTP counts an attempt and returns the hash of the active code
+	TakeLoginOTP(
+		ctx context.Context,
+		email string,
+		maxAttempts int,
+	) (codeHash string, err error)
+	DeleteLoginOTP(
+		ctx context.Context,
+		email string,
+	) error
+}
+
+type UserProvider interface {
+	User(
+		ctx context.Context,
+		email string,
+	) (models.User, error)
+}
+
+// EmailOTP challenges the client with a one-time code sent to the email.
+// Only the owner of the mailbox can pass it, so it also stops stuffing with leaked passwords.
+// On login the code is mailed to registered accounts only, on registration to the new address
+type EmailOTP struct {
+	log         *logger.Logger
+	store       OTPStore
+	usrProvider UserProvider
+	notifier    notifier.Notifier
+	ttl         time.Duration
+}
+
+func NewEmailOTP(
+	log *logger.Logger,
+	store OTPStore,
+	userProvider UserProvider,
+	notifier notifier.Notifier,
+	ttl time.Duration,
+) *EmailOTP {
+	return &EmailOTP{
+		log:         log,
+		store:       store,
+		usrProvider: userProvider,
+		notifier:    notifier,
+		ttl:         ttl,
+	}
+}
+
+func (o *EmailOTP) Verify(
+	ctx context.Context,
+	action string,
+	email string,
+	response string,
+) error {
+	const op = "EmailOTP.Verify"
+	log := o.log.With(zap.String("op", op))
+
+	required := &ChallengeRequiredError{
+		Type:   ChallengeEmailOTP,
+		Params: map[string]string{"digits": fmt.Sprint(otpDigits)},
+	}
+
+	if response != "" {
+		ok, err := o.verify(ctx, email, response)
+		if err != nil {
+			log.Error("failed to verify code", zap.Error(err))
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		if ok {
+			return nil
+		}
+	}
+
+	mail, err := o.shouldMail(ctx, action, email)
+	if err != nil {
+		log.Error("failed to get user", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	// unknown accounts get the same answer on login, but nobody is mailed
+	if mail {
+		if err := o.issue(ctx, email); err != nil {
+			log.Error("failed to issue code", zap.Error(err))
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	return fmt.Errorf("%s: %w", op, required)
+}
+
+func (o *EmailOTP) shouldMail(ctx context.Context, action string, email string) (bool, error) {
+	if action != ActionLogin {
+		return true, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	if _, err := o.usrProvider.User(ctx, email); err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (o *EmailOTP) verify(ctx context.Context, email string, code string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+
+	codeHash, err := o.store.TakeLoginOTP(ctx, email, otpMaxAttempts)
+	if err != nil {
+		if errors.Is(err, storage.ErrOTPNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	if subtle.ConstantTimeCompare([]byte(codeHash), []byte(hashCode(code))) != 1 {
+		return false, nil
+	}
+
+	return true, o.store.DeleteLoginOTP(ctx, email)
+}
+
+func (o *EmailOTP) issue(ctx context.Context, email string) error {
+	code, err := newCode()
+	if err != nil {
+		return err
+	}
+
+	saveCtx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	saved, err := o.store.SaveLoginOTP(saveCtx, email, hashCode(code), o.ttl)
+	if err != nil {
+		return err
+	}
+	// the code sent earlier is still valid, mailing on every attempt would flood the owner
+	if !saved {
+		return nil
+	}
+
+	msg := notifier.Message{
+		To:      email,
+		Subject: "Your sign-in code",
+		Body: fmt.Sprintf(
+			"We noticed unusual sign-in activity, so we need to confirm it is you.\n\n"+
+				"Your code: %s\nIt expires in %s. If you did not try to sign in, ignore this message.\n",
+			code,
+			o.ttl,
+		),
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), notifyTime)
+		defer cancel()
+		if err := o.notifier.Notify(ctx, msg); err != nil {
+			o.log.Error("failed to send code", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+func newCode() (string, error) {
+	limit := big.NewInt(1)
+	for i := 0; i < otpDigits; i++ {
+		limit.Mul(limit, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", otpDigits, n), nil
+}
+
+func hashCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,167 @@
+package risk
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+	"vieo/auth/internal/storage"
+)
+
+const powVersion = "1"
+
+// ProofOfWork is a hashcash-style challenge that needs no third party.
+// The server hands out a signed stamp "1:bits:expires:resource:nonce:mac", the client appends
+// ":counter" and searches for a counter whose SHA-256 of the whole string starts with bits zero bits.
+// Stamps are stateless until solved, solved stamps are stored until they expire so they can not be
+// replayed on any replica
+type ProofOfWork struct {
+	stamps StampStore
+	secret []byte
+	bits   int
+	ttl    time.Duration
+}
+
+// StampStore remembers the nonces of the solved stamps
+type StampStore interface {
+	// SaveStamp returns storage.ErrStampReplayed for a nonce saved before
+	SaveStamp(
+		ctx context.Context,
+		nonce string,
+		expiresAt time.Time,
+	) error
+}
+
+func NewProofOfWork(
+	stamps StampStore,
+	secretKey string,
+	bits int,
+	ttl time.Duration,
+) *ProofOfWork {
+	return &ProofOfWork{
+		stamps: stamps,
+		secret: []byte(secretKey),
+		bits:   bits,
+		ttl:    ttl,
+	}
+}
+
+func (p *ProofOfWork) Verify(
+	ctx context.Context,
+	action string,
+	email string,
+	response string,
+) error {
+	const op = "ProofOfWork.Verify"
+
+	if response != "" {
+		if nonce, expires, ok := p.check(resource(action, email), response); ok {
+			ctx, cancel := context.WithTimeout(ctx, queryTime)
+			defer cancel()
+			err := p.stamps.SaveStamp(ctx, nonce, expires)
+			if err == nil {
+				return nil
+			}
+			if !errors.Is(err, storage.ErrStampReplayed) {
+				return fmt.Errorf("%s: %w", op, err)
+			}
+		}
+	}
+
+	stamp, expires, err := p.issue(resource(action, email))
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return fmt.Errorf("%s: %w", op, &ChallengeRequiredError{
+		Type: ChallengeProofOfWork,
+		Params: map[string]string{
+			"algorithm":  "sha256",
+			"stamp":      stamp,
+			"bits":       strconv.Itoa(p.bits),
+			"expires_at": strconv.FormatInt(expires.Unix(), 10),
+		},
+	})
+}
+
+func (p *ProofOfWork) issue(res string) (string, time.Time, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", time.Time{}, err
+	}
+
+	expires := time.Now().Add(p.ttl)
+	head := strings.Join([]string{
+		powVersion,
+		strconv.Itoa(p.bits),
+		strconv.FormatInt(expires.Unix(), 10),
+		res,
+		hex.EncodeToString(nonce),
+	}, ":")
+
+	return head + ":" + p.mac(head), expires, nil
+}
+
+// check validates a solved stamp "1:bits:expires:resource:nonce:mac:counter" and returns
+// its nonce and expiry, the caller makes sure the stamp is not used twice
+func (p *ProofOfWork) check(res string, solution string) (string, time.Time, bool) {
+	parts := strings.Split(solution, ":")
+	if len(parts) != 7 || parts[0] != powVersion || parts[3] != res {
+		return "", time.Time{}, false
+	}
+
+	head := strings.Join(parts[:5], ":")
+	if !hmac.Equal([]byte(parts[5]), []byte(p.mac(head))) {
+		return "", time.Time{}, false
+	}
+
+	stampBits, err := strconv.Atoi(parts[1])
+	if err != nil || stampBits < p.bits {
+		return "", time.Time{}, false
+	}
+	expiresUnix, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	expires := time.Unix(expiresUnix, 0)
+	if time.Now().After(expires) {
+		return "", time.Time{}, false
+	}
+
+	sum := sha256.Sum256([]byte(solution))
+	if leadingZeroBits(sum[:]) < stampBits {
+		return "", time.Time{}, false
+	}
+
+	return parts[4], expires, true
+}
+
+func (p *ProofOfWork) mac(head string) string {
+	m := hmac.New(sha256.New, p.secret)
+	m.Write([]byte(head))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// resource binds a stamp to the action and the email, so one solution can not be spent elsewhere
+func resource(action string, email string) string {
+	sum := sha256.Sum256([]byte(action + "\x00" + email))
+	return hex.EncodeToString(sum[:8])
+}
+
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, x := range b {
+		if x != 0 {
+			return n + bits.LeadingZeros8(x)
+		}
+		n += 8
+	}
+	return n
+}
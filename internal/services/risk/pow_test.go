@@ -0,0 +1,222 @@
+package risk
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"vieo/auth/internal/storage"
+)
+
+// memoryStamps is a StampStore in a map
+type memoryStamps map[string]time.Time
+
+func (m memoryStamps) SaveStamp(_ context.Context, nonce string, expiresAt time.Time) error {
+	if _, ok := m[nonce]; ok {
+		return storage.ErrStampReplayed
+	}
+	m[nonce] = expiresAt
+	return nil
+}
+
+// solve searches the counter of a stamp, like a client does
+func solve(t *testing.T, stamp string, bits int) string {
+	t.Helper()
+
+	for counter := 0; counter < 1<<24; counter++ {
+		solution := stamp + ":" + strconv.Itoa(counter)
+		sum := sha256.Sum256([]byte(solution))
+		if leadingZeroBits(sum[:]) >= bits {
+			return solution
+		}
+	}
+	t.Fatalf("no solution for %s", stamp)
+	return ""
+}
+
+// challenge returns the stamp of the challenge Verify answered with
+func challenge(t *testing.T, err error) string {
+	t.Helper()
+
+	var required *ChallengeRequiredError
+	if !errors.As(err, &required) {
+		t.Fatalf("Verify error = %v, want a challenge", err)
+	}
+	if required.Type != ChallengeProofOfWork {
+		t.Fatalf("challenge type = %q, want %q", required.Type, ChallengeProofOfWork)
+	}
+	return required.Params["stamp"]
+}
+
+func TestProofOfWorkVerify(t *testing.T) {
+	const bits = 8
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// respond builds the response from a stamp issued for login of user@example.com
+		respond func(t *testing.T, p *ProofOfWork, stamp string) (action, email, response string)
+		ok      bool
+	}{
+		{
+			name: "solved",
+			respond: func(t *testing.T, _ *ProofOfWork, stamp string) (string, string, string) {
+				return ActionLogin, "user@example.com", solve(t, stamp, bits)
+			},
+			ok: true,
+		},
+		{
+			name: "no response",
+			respond: func(*testing.T, *ProofOfWork, string) (string, string, string) {
+				return ActionLogin, "user@example.com", ""
+			},
+		},
+		{
+			name: "not solved",
+			respond: func(t *testing.T, _ *ProofOfWork, stamp string) (string, string, string) {
+				for counter := 0; ; counter++ {
+					solution := stamp + ":" + strconv.Itoa(counter)
+					sum := sha256.Sum256([]byte(solution))
+					if leadingZeroBits(sum[:]) < bits {
+						return ActionLogin, "user@example.com", solution
+					}
+				}
+			},
+		},
+		{
+			name: "another email",
+			respond: func(t *testing.T, _ *ProofOfWork, stamp string) (string, string, string) {
+				return ActionLogin, "other@example.com", solve(t, stamp, bits)
+			},
+		},
+		{
+			name: "another action",
+			respond: func(t *testing.T, _ *ProofOfWork, stamp string) (string, string, string) {
+				return ActionRegister, "user@example.com", solve(t, stamp, bits)
+			},
+		},
+		{
+			name: "forged mac",
+			respond: func(t *testing.T, _ *ProofOfWork, stamp string) (string, string, string) {
+				parts := strings.Split(stamp, ":")
+				parts[5] = strings.Repeat("0", len(parts[5]))
+				return ActionLogin, "user@example.com", solve(t, strings.Join(parts, ":"), bits)
+			},
+		},
+		{
+			name: "fewer bits",
+			respond: func(t *testing.T, p *ProofOfWork, stamp string) (string, string, string) {
+				parts := strings.Split(stamp, ":")
+				parts[1] = "1"
+				head := strings.Join(parts[:5], ":")
+				return ActionLogin, "user@example.com", solve(t, head+":"+p.mac(head), 1)
+			},
+		},
+		{
+			name: "expired",
+			respond: func(t *testing.T, p *ProofOfWork, stamp string) (string, string, string) {
+				parts := strings.Split(stamp, ":")
+				parts[2] = strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+				head := strings.Join(parts[:5], ":")
+				return ActionLogin, "user@example.com", solve(t, head+":"+p.mac(head), bits)
+			},
+		},
+		{
+			name: "another version",
+			respond: func(t *testing.T, p *ProofOfWork, stamp string) (string, string, string) {
+				parts := strings.Split(stamp, ":")
+				parts[0] = "2"
+				head := strings.Join(parts[:5], ":")
+				return ActionLogin, "user@example.com", solve(t, head+":"+p.mac(head), bits)
+			},
+		},
+		{
+			name: "malformed",
+			respond: func(*testing.T, *ProofOfWork, string) (string, string, string) {
+				return ActionLogin, "user@example.com", "1:8:x"
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProofOfWork(memoryStamps{}, "secret", bits, time.Minute)
+			stamp := challenge(t, p.Verify(ctx, ActionLogin, "user@example.com", ""))
+
+			action, email, response := tt.respond(t, p, stamp)
+			err := p.Verify(ctx, action, email, response)
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("Verify error = %v, want nil", err)
+				}
+				return
+			}
+			challenge(t, err)
+		})
+	}
+}
+
+func TestProofOfWorkReplay(t *testing.T) {
+	const bits = 8
+	ctx := context.Background()
+	stamps := memoryStamps{}
+
+	// replicas share the store, a stamp solved at one is spent at all of them
+	first := NewProofOfWork(stamps, "secret", bits, time.Minute)
+	second := NewProofOfWork(stamps, "secret", bits, time.Minute)
+
+	stamp := challenge(t, first.Verify(ctx, ActionLogin, "user@example.com", ""))
+	solution := solve(t, stamp, bits)
+	if err := first.Verify(ctx, ActionLogin, "user@example.com", solution); err != nil {
+		t.Fatalf("Verify error = %v, want nil", err)
+	}
+	for i, p := range []*ProofOfWork{first, second} {
+		next := challenge(t, p.Verify(ctx, ActionLogin, "user@example.com", solution))
+		if next == stamp {
+			t.Errorf("replica %d issued the replayed stamp again", i)
+		}
+	}
+}
+
+func TestProofOfWorkStoreError(t *testing.T) {
+	const bits = 8
+	ctx := context.Background()
+	failing := errors.New("store down")
+
+	p := NewProofOfWork(stampStoreFunc(func(context.Context, string, time.Time) error { return failing }), "secret", bits, time.Minute)
+	stamp := challenge(t, p.Verify(ctx, ActionLogin, "user@example.com", ""))
+
+	err := p.Verify(ctx, ActionLogin, "user@example.com", solve(t, stamp, bits))
+	if !errors.Is(err, failing) {
+		t.Errorf("Verify error = %v, want %v", err, failing)
+	}
+}
+
+type stampStoreFunc func(ctx context.Context, nonce string, expiresAt time.Time) error
+
+func (f stampStoreFunc) SaveStamp(ctx context.Context, nonce string, expiresAt time.Time) error {
+	return f(ctx, nonce, expiresAt)
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+	tests := []struct {
+		b    []byte
+		want int
+	}{
+		{[]byte{0xff}, 0},
+		{[]byte{0x01}, 7},
+		{[]byte{0x00, 0x80}, 8},
+		{[]byte{0x00, 0x00, 0x10}, 19},
+		{[]byte{0x00, 0x00}, 16},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%x", tt.b), func(t *testing.T) {
+			if got := leadingZeroBits(tt.b); got != tt.want {
+				t.Errorf("leadingZeroBits(%x) = %d, want %d", tt.b, got, tt.want)
+			}
+		})
+	}
+}
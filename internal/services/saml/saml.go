@@ -0,0 +1,368 @@
+package saml
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/samlsp"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const queryTime = 3 * time.Second
+
+// FieldEmail is the user field the account is found and created by
+const FieldEmail = "email"
+
+var (
+	ErrUnknownConnection = errors.New("unknown saml connection")
+	// ErrInvalidState is returned for an unknown, expired or already used relay state
+	ErrInvalidState = errors.New("invalid or expired relay state")
+	// ErrInvalidAssertion is returned for a response that fails the signature, audience or conditions checks
+	ErrInvalidAssertion = errors.New("invalid saml assertion")
+	// ErrReplayed is returned for an assertion that was already used to sign in
+	ErrReplayed = errors.New("saml assertion replayed")
+	// ErrNoEmail is returned for an assertion without an email, or with one outside the domains of the connection
+	ErrNoEmail = errors.New("saml assertion has no acceptable email")
+	// ErrAccountExists is returned when the email already has an account and the connection
+	// is not trusted to link it
+	ErrAccountExists = errors.New("account with this email exists and the connection does not link accounts")
+)
+
+// Authorization is where the user is sent to sign in at the identity provider, RelayState
+// comes back with the response and completes the sign in
+type Authorization struct {
+	URL        string
+	RelayState string
+}
+
+// ServiceProvider is the service provider registered at one identity provider, samlsp.Client
+type ServiceProvider interface {
+	Metadata() ([]byte, error)
+	AuthnRequest(relayState string) (url string, requestID string, err error)
+	Verify(samlResponse string, requestID string) (samlsp.Assertion, error)
+}
+
+// Connection is an identity provider of an enterprise customer
+type Connection struct {
+	SP ServiceProvider
+	// Attributes maps user fields to the attributes of the assertion. The email is the NameID
+	// unless mapped, the other fields are written to the metadata of the user on every sign in
+	Attributes map[string]string
+	// Domains restricts the emails the identity provider may assert, any when empty
+	Domains []string
+	// LinkExisting attaches a new identity to the account of the same email. Only for identity
+	// providers trusted with the emails of their domains
+	LinkExisting bool
+}
+
+// SAML signs users in with the SAML identity providers of enterprise customers
+type SAML struct {
+	log         *logger.Logger
+	connections map[string]Connection
+	logins      LoginStore
+	identities  IdentityStore
+	devices     DeviceAuthenticator
+	requestTTL  time.Duration
+}
+
+type LoginStore interface {
+	SaveSAMLLogin(
+		ctx context.Context,
+		login models.SAMLLogin,
+		ttl time.Duration,
+	) error
+	ConsumeSAMLLogin(
+		ctx context.Context,
+		relayStateHash string,
+	) (models.SAMLLogin, error)
+	SaveAssertion(
+		ctx context.Context,
+		connection string,
+		assertionID string,
+		expiresAt time.Time,
+	) error
+}
+
+type IdentityStore interface {
+	IdentityUser(
+		ctx context.Context,
+		provider string,
+		subject string,
+	) (string, error)
+	SaveIdentity(
+		ctx context.Context,
+		email string,
+		identity models.Identity,
+	) (models.Identity, error)
+	SaveUserWithIdentity(
+		ctx context.Context,
+		email string,
+		passHash []byte,
+		identity models.Identity,
+	) (models.Identity, error)
+	UpdateUserMetadata(
+		ctx context.Context,
+		email string,
+		metadata map[string]string,
+	) error
+}
+
+// DeviceAuthenticator signs the user in on the device without a password once the identity provider vouched for it
+type DeviceAuthenticator interface {
+	LoginDevice(
+		ctx context.Context,
+		email string,
+		deviceAddress string,
+	) (token string, err error)
+}
+
+// New creates the SAML login service over the connections by name, a sign in must complete within requestTTL
+func New(
+	log *logger.Logger,
+	connections map[string]Connection,
+	logins LoginStore,
+	identities IdentityStore,
+	devices DeviceAuthenticator,
+	requestTTL time.Duration,
+) *SAML {
+	return &SAML{
+		log:         log,
+		connections: connections,
+		logins:      logins,
+		identities:  identities,
+		devices:     devices,
+		requestTTL:  requestTTL,
+	}
+}
+
+// Metadata returns the service provider metadata the identity provider of the connection is configured with
+func (s *SAML) Metadata(connection string) ([]byte, error) {
+	const op = "SAML.Metadata"
+
+	conn, ok := s.connections[connection]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", op, ErrUnknownConnection)
+	}
+	metadata, err := conn.SP.Metadata()
+	if err != nil {
+		s.log.Error("failed to build metadata", zap.String("op", op), zap.Error(err))
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return metadata, nil
+}
+
+// Start creates the AuthnRequest of a sign in with the identity provider of the connection for the device
+func (s *SAML) Start(
+	ctx context.Context,
+	connection string,
+	deviceAddress string,
+) (Authorization, error) {
+	const op = "SAML.Start"
+	log := s.log.With(zap.String("op", op), zap.String("connection", connection))
+
+	conn, ok := s.connections[connection]
+	if !ok {
+		return Authorization{}, fmt.Errorf("%s: %w", op, ErrUnknownConnection)
+	}
+	relayState, err := randomString()
+	if err != nil {
+		return Authorization{}, fmt.Errorf("%s: %w", op, err)
+	}
+	url, requestID, err := conn.SP.AuthnRequest(relayState)
+	if err != nil {
+		log.Error("failed to create authn request", zap.Error(err))
+		return Authorization{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	err = s.logins.SaveSAMLLogin(ctx, models.SAMLLogin{
+		RelayStateHash: hash(relayState),
+		Connection:     connection,
+		RequestID:      requestID,
+		DeviceAddress:  deviceAddress,
+	}, s.requestTTL)
+	if err != nil {
+		log.Error("failed to save saml login", zap.Error(err))
+		return Authorization{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return Authorization{URL: url, RelayState: relayState}, nil
+}
+
+// Complete validates the response the identity provider posted to the ACS of the app and signs
+// the user in on the device of the request, like Login does. An unknown identity gets a new
+// account, created reports it
+func (s *SAML) Complete(
+	ctx context.Context,
+	samlResponse string,
+	relayState string,
+) (token string, created bool, err error) {
+	const op = "SAML.Complete"
+	log := s.log.With(zap.String("op", op))
+
+	dbCtx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	login, err := s.logins.ConsumeSAMLLogin(dbCtx, hash(relayState))
+	if err != nil {
+		if errors.Is(err, storage.ErrSAMLLoginNotFound) {
+			log.Warn("saml login not found")
+			return "", false, fmt.Errorf("%s: %w", op, ErrInvalidState)
+		}
+		log.Error("failed to consume saml login", zap.Error(err))
+		return "", false, fmt.Errorf("%s: %w", op, err)
+	}
+	conn, ok := s.connections[login.Connection]
+	if !ok {
+		return "", false, fmt.Errorf("%s: %w", op, ErrUnknownConnection)
+	}
+	log = log.With(zap.String("connection", login.Connection))
+
+	assertion, err := conn.SP.Verify(samlResponse, login.RequestID)
+	if err != nil {
+		log.Warn("assertion not valid", zap.Error(err))
+		return "", false, fmt.Errorf("%s: %w: %w", op, ErrInvalidAssertion, err)
+	}
+	if err := s.logins.SaveAssertion(dbCtx, login.Connection, assertion.ID, assertion.NotOnOrAfter); err != nil {
+		if errors.Is(err, storage.ErrAssertionReplayed) {
+			log.Warn("assertion replayed", zap.String("assertion", assertion.ID))
+			return "", false, fmt.Errorf("%s: %w", op, ErrReplayed)
+		}
+		log.Error("failed to save assertion", zap.Error(err))
+		return "", false, fmt.Errorf("%s: %w", op, err)
+	}
+	fields := conn.fields(assertion)
+	if !conn.acceptsEmail(fields[FieldEmail]) {
+		log.Warn("assertion email not accepted")
+		return "", false, fmt.Errorf("%s: %w", op, ErrNoEmail)
+	}
+
+	provider := "saml:" + login.Connection
+	email, err := s.identities.IdentityUser(dbCtx, provider, assertion.NameID)
+	switch {
+	case errors.Is(err, storage.ErrIdentityNotFound):
+		email, created, err = s.signUp(dbCtx, conn, provider, assertion.NameID, fields[FieldEmail])
+		if err != nil {
+			return "", false, fmt.Errorf("%s: %w", op, err)
+		}
+		log.Info("identity saved", zap.Bool("created", created))
+	case err != nil:
+		log.Error("failed to get identity", zap.Error(err))
+		return "", false, fmt.Errorf("%s: %w", op, err)
+	}
+	delete(fields, FieldEmail)
+	if len(fields) > 0 {
+		if err := s.identities.UpdateUserMetadata(dbCtx, email, fields); err != nil {
+			log.Error("failed to update user metadata", zap.Error(err))
+			return "", false, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	token, err = s.devices.LoginDevice(ctx, email, login.DeviceAddress)
+	if err != nil {
+		return "", false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return token, created, nil
+}
+
+// signUp saves the identity with a new account, or with the account of the email when the connection links existing ones
+func (s *SAML) signUp(
+	ctx context.Context,
+	conn Connection,
+	provider string,
+	subject string,
+	email string,
+) (string, bool, error) {
+	identity := models.Identity{
+		Provider: provider,
+		Subject:  subject,
+		Email:    email,
+	}
+	// nobody knows the password, the account signs in with the identity provider or sets one by the reset
+	password, err := randomString()
+	if err != nil {
+		return "", false, err
+	}
+	passHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", false, err
+	}
+
+	_, err = s.identities.SaveUserWithIdentity(ctx, email, passHash, identity)
+	switch {
+	case err == nil:
+		return email, true, nil
+	case errors.Is(err, storage.ErrUserAlreadyExists):
+		if !conn.LinkExisting {
+			return "", false, ErrAccountExists
+		}
+		_, err = s.identities.SaveIdentity(ctx, email, identity)
+		if err == nil {
+			return email, false, nil
+		}
+	}
+	// signed up concurrently by the same identity
+	if errors.Is(err, storage.ErrIdentityAlreadyLinked) {
+		email, err := s.identities.IdentityUser(ctx, provider, subject)
+		return email, false, err
+	}
+	s.log.Error("failed to save identity", zap.Error(err))
+	return "", false, err
+}
+
+// fields maps the attributes of the assertion to user fields, the first value of an attribute wins
+func (c Connection) fields(assertion samlsp.Assertion) map[string]string {
+	fields := make(map[string]string, len(c.Attributes)+1)
+	for field, attr := range c.Attributes {
+		if values := assertion.Attributes[attr]; len(values) > 0 && values[0] != "" {
+			fields[field] = values[0]
+		}
+	}
+	if _, ok := c.Attributes[FieldEmail]; !ok {
+		fields[FieldEmail] = assertion.NameID
+	}
+	fields[FieldEmail] = strings.TrimSpace(fields[FieldEmail])
+	return fields
+}
+
+func (c Connection) acceptsEmail(email string) bool {
+	_, domain, ok := strings.Cut(email, "@")
+	if !ok || domain == "" {
+		return false
+	}
+	if len(c.Domains) == 0 {
+		return true
+	}
+	for _, d := range c.Domains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,300 @@
+package saml
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/samlsp"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+var errBadSignature = errors.New("bad signature")
+
+// fakeSP answers every response with its assertion when it is for the request it last created
+type fakeSP struct {
+	requests  int
+	assertion samlsp.Assertion
+}
+
+func (sp *fakeSP) Metadata() ([]byte, error) {
+	return []byte("<EntityDescriptor/>"), nil
+}
+
+func (sp *fakeSP) AuthnRequest(relayState string) (string, string, error) {
+	sp.requests++
+	return "https://idp.example.com/sso?RelayState=" + relayState, requestID(sp.requests), nil
+}
+
+func (sp *fakeSP) Verify(samlResponse string, id string) (samlsp.Assertion, error) {
+	if samlResponse != "signed" || id != requestID(sp.requests) {
+		return samlsp.Assertion{}, errBadSignature
+	}
+	return sp.assertion, nil
+}
+
+func requestID(n int) string {
+	return "request-" + strconv.Itoa(n)
+}
+
+// memoryStore keeps the logins, the assertions seen and the accounts with their identities
+type memoryStore struct {
+	logins     map[string]models.SAMLLogin
+	assertions map[string]bool
+	// users maps the email of an account to its metadata, identities the provider and subject to the email
+	users      map[string]map[string]string
+	identities map[string]string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		logins:     map[string]models.SAMLLogin{},
+		assertions: map[string]bool{},
+		users:      map[string]map[string]string{},
+		identities: map[string]string{},
+	}
+}
+
+func (m *memoryStore) SaveSAMLLogin(_ context.Context, login models.SAMLLogin, ttl time.Duration) error {
+	login.ExpiresAt = time.Now().Add(ttl)
+	m.logins[login.RelayStateHash] = login
+	return nil
+}
+
+func (m *memoryStore) ConsumeSAMLLogin(_ context.Context, relayStateHash string) (models.SAMLLogin, error) {
+	login, ok := m.logins[relayStateHash]
+	if !ok || time.Now().After(login.ExpiresAt) {
+		return models.SAMLLogin{}, storage.ErrSAMLLoginNotFound
+	}
+	delete(m.logins, relayStateHash)
+	return login, nil
+}
+
+func (m *memoryStore) SaveAssertion(_ context.Context, connection string, assertionID string, _ time.Time) error {
+	if m.assertions[connection+"/"+assertionID] {
+		return storage.ErrAssertionReplayed
+	}
+	m.assertions[connection+"/"+assertionID] = true
+	return nil
+}
+
+func (m *memoryStore) IdentityUser(_ context.Context, provider string, subject string) (string, error) {
+	email, ok := m.identities[provider+"/"+subject]
+	if !ok {
+		return "", storage.ErrIdentityNotFound
+	}
+	return email, nil
+}
+
+func (m *memoryStore) SaveIdentity(_ context.Context, email string, identity models.Identity) (models.Identity, error) {
+	if _, ok := m.identities[identity.Provider+"/"+identity.Subject]; ok {
+		return models.Identity{}, storage.ErrIdentityAlreadyLinked
+	}
+	m.identities[identity.Provider+"/"+identity.Subject] = email
+	return identity, nil
+}
+
+func (m *memoryStore) SaveUserWithIdentity(ctx context.Context, email string, _ []byte, identity models.Identity) (models.Identity, error) {
+	if _, ok := m.users[email]; ok {
+		return models.Identity{}, storage.ErrUserAlreadyExists
+	}
+	m.users[email] = map[string]string{}
+	return m.SaveIdentity(ctx, email, identity)
+}
+
+func (m *memoryStore) UpdateUserMetadata(_ context.Context, email string, metadata map[string]string) error {
+	for k, v := range metadata {
+		m.users[email][k] = v
+	}
+	return nil
+}
+
+type tokenDevices struct{}
+
+func (tokenDevices) LoginDevice(_ context.Context, email string, deviceAddress string) (string, error) {
+	return "token of " + email + " on " + deviceAddress, nil
+}
+
+// newSAML creates the service with the acme connection, the identity provider of acme.com
+func newSAML(assertion samlsp.Assertion, linkExisting bool) (*SAML, *fakeSP, *memoryStore) {
+	sp := &fakeSP{assertion: assertion}
+	store := newMemoryStore()
+	s := New(
+		&logger.Logger{SugaredLogger: zap.NewNop().Sugar()},
+		map[string]Connection{"acme": {
+			SP:           sp,
+			Attributes:   map[string]string{"department": "dept"},
+			Domains:      []string{"acme.com"},
+			LinkExisting: linkExisting,
+		}},
+		store,
+		store,
+		tokenDevices{},
+		time.Minute,
+	)
+	return s, sp, store
+}
+
+func aliceAssertion(id string) samlsp.Assertion {
+	return samlsp.Assertion{
+		ID:           id,
+		NameID:       "alice@acme.com",
+		Attributes:   map[string][]string{"dept": {"sales"}},
+		NotOnOrAfter: time.Now().Add(time.Minute),
+	}
+}
+
+// signIn starts a sign in on the tv and completes it with the response of the identity provider
+func signIn(t *testing.T, s *SAML) (string, bool, error) {
+	t.Helper()
+
+	auth, err := s.Start(context.Background(), "acme", "tv")
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	return s.Complete(context.Background(), "signed", auth.RelayState)
+}
+
+func TestStart(t *testing.T) {
+	s, _, store := newSAML(aliceAssertion("a1"), false)
+
+	auth, err := s.Start(context.Background(), "acme", "tv")
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	login, ok := store.logins[hash(auth.RelayState)]
+	if !ok || login.Connection != "acme" || login.RequestID != requestID(1) || login.DeviceAddress != "tv" {
+		t.Errorf("saved login = %+v, want the request of the tv under the relay state hash", login)
+	}
+	if _, ok := store.logins[auth.RelayState]; ok {
+		t.Error("relay state saved in clear")
+	}
+
+	if _, err := s.Start(context.Background(), "globex", "tv"); !errors.Is(err, ErrUnknownConnection) {
+		t.Errorf("Start of an unknown connection error = %v, want %v", err, ErrUnknownConnection)
+	}
+	if _, err := s.Metadata("globex"); !errors.Is(err, ErrUnknownConnection) {
+		t.Errorf("Metadata of an unknown connection error = %v, want %v", err, ErrUnknownConnection)
+	}
+}
+
+func TestCompleteSignsUp(t *testing.T) {
+	s, _, store := newSAML(aliceAssertion("a1"), false)
+
+	token, created, err := signIn(t, s)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if token != "token of alice@acme.com on tv" || !created {
+		t.Errorf("Complete = %q, %v, want a new account signed in on the tv", token, created)
+	}
+	if got := store.users["alice@acme.com"]; got["department"] != "sales" || got[FieldEmail] != "" {
+		t.Errorf("metadata = %v, want the mapped department only", got)
+	}
+
+	// the identity signs in to the same account next time
+	s.connections["acme"].SP.(*fakeSP).assertion = aliceAssertion("a2")
+	if token, created, err := signIn(t, s); err != nil || created || token != "token of alice@acme.com on tv" {
+		t.Errorf("second sign in = %q, %v, %v, want the existing account", token, created, err)
+	}
+}
+
+func TestCompleteRejects(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		mutate   func(*samlsp.Assertion)
+		wantErr  error
+	}{
+		{name: "bad signature", response: "forged", wantErr: ErrInvalidAssertion},
+		{name: "email of another domain", mutate: func(a *samlsp.Assertion) { a.NameID = "alice@globex.com" }, wantErr: ErrNoEmail},
+		{name: "no email", mutate: func(a *samlsp.Assertion) { a.NameID = "alice" }, wantErr: ErrNoEmail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertion := aliceAssertion("a1")
+			if tt.mutate != nil {
+				tt.mutate(&assertion)
+			}
+			s, _, store := newSAML(assertion, false)
+			response := "signed"
+			if tt.response != "" {
+				response = tt.response
+			}
+
+			auth, err := s.Start(context.Background(), "acme", "tv")
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			if _, _, err := s.Complete(context.Background(), response, auth.RelayState); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Complete error = %v, want %v", err, tt.wantErr)
+			}
+			if len(store.users) != 0 {
+				t.Errorf("accounts created: %v", store.users)
+			}
+		})
+	}
+}
+
+func TestCompleteRelayStateIsUsedOnce(t *testing.T) {
+	s, _, _ := newSAML(aliceAssertion("a1"), false)
+	auth, err := s.Start(context.Background(), "acme", "tv")
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	if _, _, err := s.Complete(context.Background(), "signed", auth.RelayState); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if _, _, err := s.Complete(context.Background(), "signed", auth.RelayState); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("second Complete error = %v, want %v", err, ErrInvalidState)
+	}
+	if _, _, err := s.Complete(context.Background(), "signed", "guess"); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("Complete with an unknown relay state error = %v, want %v", err, ErrInvalidState)
+	}
+}
+
+func TestCompleteRejectsReplayedAssertions(t *testing.T) {
+	s, _, _ := newSAML(aliceAssertion("a1"), false)
+
+	if _, _, err := signIn(t, s); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	// a captured response posted again with a fresh relay state
+	if _, _, err := signIn(t, s); !errors.Is(err, ErrReplayed) {
+		t.Errorf("Complete with a used assertion error = %v, want %v", err, ErrReplayed)
+	}
+}
+
+func TestCompleteExistingAccount(t *testing.T) {
+	tests := []struct {
+		name         string
+		linkExisting bool
+		wantErr      error
+	}{
+		{name: "linked", linkExisting: true},
+		{name: "not linked", wantErr: ErrAccountExists},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _, store := newSAML(aliceAssertion("a1"), tt.linkExisting)
+			store.users["alice@acme.com"] = map[string]string{}
+
+			token, created, err := signIn(t, s)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Complete error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (created || token != "token of alice@acme.com on tv") {
+				t.Errorf("Complete = %q, %v, want the existing account", token, created)
+			}
+			if _, linked := store.identities["saml:acme/alice@acme.com"]; linked != tt.linkExisting {
+				t.Errorf("identity linked = %v, want %v", linked, tt.linkExisting)
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/jwt"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/notifier"
+	"vieo/auth/internal/lib/tenant"
+
+	"go.uber.org/zap"
+)
+
+var (
+	ErrAccountLocked = errors.New("account temporarily locked")
+)
+
+// LockedError is returned while an account is locked, RetryAfter tells when the next attempt is allowed
+type LockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrAccountLocked, e.RetryAfter)
+}
+
+func (e *LockedError) Is(target error) bool {
+	return target == ErrAccountLocked
+}
+
+// LockoutPolicy describes how failed logins slow an account down.
+// Starting from BackoffAfter consecutive failures every failure locks the account for
+// BaseDelay doubled on each further failure and capped by MaxDelay.
+// After LockAfter failures the account is locked for LockDuration and the owner gets an unlock link.
+// Failures older than ResetAfter are forgotten
+type LockoutPolicy struct {
+	BackoffAfter int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	LockAfter    int
+	LockDuration time.Duration
+	ResetAfter   time.Duration
+}
+
+// LockoutStore keeps the failure counters. All time arithmetic is done by the store,
+// so replicas with skewed clocks see the same lock
+type LockoutStore interface {
+	RegisterLoginFailure(
+		ctx context.Context,
+		email string,
+		resetAfter time.Duration,
+	) (failures int, err error)
+	LockAccount(
+		ctx context.Context,
+		email string,
+		duration time.Duration,
+	) (lockedUntil time.Time, err error)
+	LockRemaining(
+		ctx context.Context,
+		email string,
+	) (time.Duration, error)
+	// LockedUntil returns the end of the last lock, zero if the account has no failures
+	LockedUntil(
+		ctx context.Context,
+		email string,
+	) (time.Time, error)
+	ResetLoginFailures(
+		ctx context.Context,
+		email string,
+	) error
+}
+
+// Lockout protects accounts from online password guessing
+type Lockout struct {
+	log       *logger.Logger
+	store     LockoutStore
+	events    EventRecorder
+	notifier  notifier.Notifier
+	policy    LockoutPolicy
+	secretKey string
+	linkTTL   time.Duration
+	unlockURL string
+}
+
+func NewLockout(
+	log *logger.Logger,
+	store LockoutStore,
+	events EventRecorder,
+	notifier notifier.Notifier,
+	policy LockoutPolicy,
+	secretKey string,
+	linkTTL time.Duration,
+	unlockURL string,
+) *Lockout {
+	return &Lockout{
+		log:       log,
+		store:     store,
+		events:    events,
+		notifier:  notifier,
+		policy:    policy,
+		secretKey: secretKey,
+		linkTTL:   linkTTL,
+		unlockURL: unlockURL,
+	}
+}
+
+// Check returns a *LockedError if the account may not try to log in right now
+func (l *Lockout) Check(
+	ctx context.Context,
+	email string,
+) error {
+	const op = "Lockout.Check"
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	remaining, err := l.store.LockRemaining(ctx, email)
+	if err != nil {
+		l.log.Error("failed to check lock", zap.String("op", op), zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if remaining > 0 {
+		return fmt.Errorf("%s: %w", op, &LockedError{RetryAfter: remaining})
+	}
+
+	return nil
+}
+
+// Fail counts a failed login and locks the account according to the policy.
+// The unlock link is only sent to registered accounts
+func (l *Lockout) Fail(
+	ctx context.Context,
+	email string,
+	registered bool,
+) {
+	const op = "Lockout.Fail"
+	log := l.log.With(zap.String("op", op))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	failures, err := l.store.RegisterLoginFailure(ctx, email, l.policy.ResetAfter)
+	if err != nil {
+		log.Error("failed to register login failure", zap.Error(err))
+		return
+	}
+
+	delay := l.delay(failures)
+	if delay <= 0 {
+		return
+	}
+	lockedUntil, err := l.store.LockAccount(ctx, email, delay)
+	if err != nil {
+		log.Error("failed to lock account", zap.Error(err))
+		return
+	}
+	log.Warn("account locked", zap.Int("failures", failures), zap.Duration("duration", delay))
+
+	if failures == l.policy.LockAfter {
+		l.events.Record(ctx, models.SecurityEvent{
+			Email:  email,
+			Type:   models.EventAccountLocked,
+			Reason: fmt.Sprintf("%d failed attempts", failures),
+		})
+		if registered {
+			l.sendUnlockLink(ctx, email, lockedUntil)
+		}
+	}
+}
+
+// Succeed forgets the failures after a successful login
+func (l *Lockout) Succeed(
+	ctx context.Context,
+	email string,
+) {
+	const op = "Lockout.Succeed"
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	if err := l.store.ResetLoginFailures(ctx, email); err != nil {
+		l.log.Error("failed to reset login failures", zap.String("op", op), zap.Error(err))
+	}
+}
+
+// Unlock lifts the lock on behalf of an administrator
+func (l *Lockout) Unlock(
+	ctx context.Context,
+	email string,
+) error {
+	const op = "Lockout.Unlock"
+
+	if err := l.unlock(ctx, email, "unlocked by administrator"); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// UnlockByLink lifts the lock using the link from the lockout email. The link is bound to
+// the lock it was sent for, it stops working once the account is unlocked or locked again
+func (l *Lockout) UnlockByLink(
+	ctx context.Context,
+	unlockToken string,
+) error {
+	const op = "Lockout.UnlockByLink"
+	log := l.log.With(zap.String("op", op))
+
+	claims, err := jwt.DecodeActionToken(tenant.SecretKey(ctx, l.secretKey), purposeUnlockAccount, unlockToken)
+	if err != nil {
+		log.Warn("rejected unlock link", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, ErrInvalidLink)
+	}
+	dbCtx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	lockedUntil, err := l.store.LockedUntil(dbCtx, claims.User)
+	if err != nil {
+		log.Error("failed to get lock", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if lockedUntil.IsZero() || claims.Fingerprint != lockFingerprint(lockedUntil) {
+		log.Warn("rejected unlock link of another lock")
+		return fmt.Errorf("%s: %w", op, ErrInvalidLink)
+	}
+	if err := l.unlock(ctx, claims.User, "unlocked by email link"); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (l *Lockout) unlock(ctx context.Context, email string, reason string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	if err := l.store.ResetLoginFailures(ctx, email); err != nil {
+		l.log.Error("failed to unlock account", zap.Error(err))
+		return err
+	}
+	l.events.Record(ctx, models.SecurityEvent{
+		Email:  email,
+		Type:   models.EventAccountUnlocked,
+		Reason: reason,
+	})
+
+	return nil
+}
+
+// delay returns how long the account is locked after the given number of consecutive failures
+func (l *Lockout) delay(failures int) time.Duration {
+	p := l.policy
+	if p.LockAfter > 0 && failures >= p.LockAfter {
+		return p.LockDuration
+	}
+	if p.BackoffAfter <= 0 || failures < p.BackoffAfter {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := p.BackoffAfter; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	return delay
+}
+
+func (l *Lockout) sendUnlockLink(ctx context.Context, email string, lockedUntil time.Time) {
+	const op = "Lockout.sendUnlockLink"
+
+	token, err := jwt.NewActionToken(tenant.SecretKey(ctx, l.secretKey), purposeUnlockAccount, email, "", lockFingerprint(lockedUntil), l.linkTTL)
+	if err != nil {
+		l.log.Error("failed to generate unlock token", zap.String("op", op), zap.Error(err))
+		return
+	}
+	sendAsync(ctx, l.log, l.notifier, notifier.Message{
+		To:      email,
+		Subject: "Your account was locked",
+		Body: fmt.Sprintf(
+			"We locked your account for %s after too many failed sign-in attempts.\n\n"+
+				"If it was you, unlock the account now: %s\n"+
+				"If it wasn't you, your password is still safe, but consider changing it.\n",
+			l.policy.LockDuration,
+			link(ctx, l.unlockURL, token),
+		),
+	})
+}
+
+// lockFingerprint identifies the lock an unlock link was sent for
+func lockFingerprint(lockedUntil time.Time) string {
+	return fingerprint([]byte(strconv.FormatInt(lockedUntil.UnixMicro(), 10)))
+}
@@ -0,0 +1,223 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/jwt"
+	"vieo/auth/internal/lib/logger"
+
+	"go.uber.org/zap"
+)
+
+func TestLockoutDelay(t *testing.T) {
+	policy := LockoutPolicy{
+		BackoffAfter: 3,
+		BaseDelay:    time.Second,
+		MaxDelay:     10 * time.Second,
+		LockAfter:    10,
+		LockDuration: time.Hour,
+	}
+
+	tests := []struct {
+		name     string
+		policy   LockoutPolicy
+		failures int
+		want     time.Duration
+	}{
+		{"no failures", policy, 0, 0},
+		{"below backoff", policy, 2, 0},
+		{"first backoff", policy, 3, time.Second},
+		{"doubles", policy, 4, 2 * time.Second},
+		{"doubles again", policy, 5, 4 * time.Second},
+		{"capped", policy, 7, 10 * time.Second},
+		{"capped until lock", policy, 9, 10 * time.Second},
+		{"locked", policy, 10, time.Hour},
+		{"stays locked", policy, 15, time.Hour},
+		{"backoff disabled", LockoutPolicy{LockAfter: 5, LockDuration: time.Hour}, 4, 0},
+		{"lock disabled", LockoutPolicy{BackoffAfter: 1, BaseDelay: time.Second, MaxDelay: time.Minute}, 100, time.Minute},
+		{"no max delay", LockoutPolicy{BackoffAfter: 1, BaseDelay: time.Second}, 5, time.Second},
+		{"disabled", LockoutPolicy{}, 100, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &Lockout{policy: tt.policy}
+			if got := l.delay(tt.failures); got != tt.want {
+				t.Errorf("delay(%d) = %s, want %s", tt.failures, got, tt.want)
+			}
+		})
+	}
+}
+
+// memoryLockout is a LockoutStore of one account
+type memoryLockout struct {
+	failures    int
+	lockedUntil time.Time
+	resets      int
+}
+
+func (m *memoryLockout) RegisterLoginFailure(context.Context, string, time.Duration) (int, error) {
+	m.failures++
+	return m.failures, nil
+}
+
+func (m *memoryLockout) LockAccount(_ context.Context, _ string, duration time.Duration) (time.Time, error) {
+	m.lockedUntil = time.Now().Add(duration).Truncate(time.Microsecond)
+	return m.lockedUntil, nil
+}
+
+func (m *memoryLockout) LockRemaining(context.Context, string) (time.Duration, error) {
+	return time.Until(m.lockedUntil), nil
+}
+
+func (m *memoryLockout) LockedUntil(context.Context, string) (time.Time, error) {
+	return m.lockedUntil, nil
+}
+
+func (m *memoryLockout) ResetLoginFailures(context.Context, string) error {
+	m.failures = 0
+	m.lockedUntil = time.Time{}
+	m.resets++
+	return nil
+}
+
+func newLockout(store *memoryLockout, out outbox, events *eventLog) *Lockout {
+	return NewLockout(
+		&logger.Logger{SugaredLogger: zap.NewNop().Sugar()},
+		store,
+		events,
+		out,
+		LockoutPolicy{BackoffAfter: 2, BaseDelay: time.Minute, MaxDelay: time.Minute, LockAfter: 3, LockDuration: time.Hour},
+		testSecret,
+		time.Hour,
+		"https://vieo.example.com/unlock",
+	)
+}
+
+func TestLockoutFail(t *testing.T) {
+	const email = "user@example.com"
+	for _, registered := range []bool{true, false} {
+		store, out, events := &memoryLockout{}, make(outbox, 1), &eventLog{}
+		l := newLockout(store, out, events)
+
+		l.Fail(context.Background(), email, registered)
+		if err := l.Check(context.Background(), email); err != nil {
+			t.Fatalf("Check after one failure: %v", err)
+		}
+		l.Fail(context.Background(), email, registered)
+		var locked *LockedError
+		if err := l.Check(context.Background(), email); !errors.As(err, &locked) || locked.RetryAfter > time.Minute {
+			t.Fatalf("Check in the backoff = %v, want locked for a minute", err)
+		}
+		l.Fail(context.Background(), email, registered)
+		if err := l.Check(context.Background(), email); !errors.As(err, &locked) || locked.RetryAfter <= time.Minute {
+			t.Fatalf("Check after the lock = %v, want locked for an hour", err)
+		}
+		if len(events.events) != 1 || events.events[0].Type != models.EventAccountLocked {
+			t.Errorf("events = %+v, want the account locked", events.events)
+		}
+
+		// an unregistered email has nobody to send the link to
+		if !registered {
+			select {
+			case msg := <-out:
+				t.Errorf("unlock link sent for an unregistered email: %+v", msg)
+			case <-time.After(50 * time.Millisecond):
+			}
+			continue
+		}
+		if err := l.UnlockByLink(context.Background(), linkToken(t, out.next(t).Body, "https://vieo.example.com/unlock")); err != nil {
+			t.Fatalf("UnlockByLink: %v", err)
+		}
+		if err := l.Check(context.Background(), email); err != nil {
+			t.Errorf("Check after the unlock: %v", err)
+		}
+	}
+}
+
+func TestUnlockByLink(t *testing.T) {
+	const email = "user@example.com"
+
+	tests := []struct {
+		name string
+		// prepare locks the account and returns the link token
+		prepare func(t *testing.T, store *memoryLockout) string
+		want    error
+	}{
+		{
+			name: "link of the current lock",
+			prepare: func(t *testing.T, store *memoryLockout) string {
+				lockedUntil, _ := store.LockAccount(context.Background(), email, time.Hour)
+				return unlockToken(t, testSecret, email, lockedUntil)
+			},
+		},
+		{
+			name: "link of a previous lock",
+			prepare: func(t *testing.T, store *memoryLockout) string {
+				lockedUntil, _ := store.LockAccount(context.Background(), email, time.Hour)
+				token := unlockToken(t, testSecret, email, lockedUntil)
+				_, _ = store.LockAccount(context.Background(), email, 2*time.Hour)
+				return token
+			},
+			want: ErrInvalidLink,
+		},
+		{
+			name: "account already unlocked",
+			prepare: func(t *testing.T, store *memoryLockout) string {
+				lockedUntil, _ := store.LockAccount(context.Background(), email, time.Hour)
+				token := unlockToken(t, testSecret, email, lockedUntil)
+				_ = store.ResetLoginFailures(context.Background(), email)
+				return token
+			},
+			want: ErrInvalidLink,
+		},
+		{
+			name: "another secret",
+			prepare: func(t *testing.T, store *memoryLockout) string {
+				lockedUntil, _ := store.LockAccount(context.Background(), email, time.Hour)
+				return unlockToken(t, "other", email, lockedUntil)
+			},
+			want: ErrInvalidLink,
+		},
+		{
+			name: "another purpose",
+			prepare: func(t *testing.T, store *memoryLockout) string {
+				lockedUntil, _ := store.LockAccount(context.Background(), email, time.Hour)
+				token, err := jwt.NewActionToken(testSecret, purposeResetPassword, email, "", lockFingerprint(lockedUntil), time.Hour)
+				if err != nil {
+					t.Fatalf("NewActionToken: %v", err)
+				}
+				return token
+			},
+			want: ErrInvalidLink,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &memoryLockout{}
+			l := newLockout(store, make(outbox, 1), &eventLog{})
+			token := tt.prepare(t, store)
+			resets := store.resets
+
+			err := l.UnlockByLink(context.Background(), token)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("UnlockByLink error = %v, want %v", err, tt.want)
+			}
+			if unlocked := store.resets > resets; unlocked != (tt.want == nil) {
+				t.Errorf("unlocked = %v, want %v", unlocked, tt.want == nil)
+			}
+		})
+	}
+}
+
+func unlockToken(t *testing.T, secretKey, email string, lockedUntil time.Time) string {
+	t.Helper()
+
+	token, err := jwt.NewActionToken(secretKey, purposeUnlockAccount, email, "", lockFingerprint(lockedUntil), time.Hour)
+	if err != nil {
+		t.Fatalf("NewActionToken: %v", err)
+	}
+	return token
+}
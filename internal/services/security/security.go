@@ -0,0 +1,335 @@
+package security
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/clientinfo"
+	"vieo/auth/internal/lib/jwt"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/notifier"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Security handles account protection flows: new device alerts,
+// reports of unrecognized logins and password resets
+type Security struct {
+	log           *logger.Logger
+	usrProvider   UserProvider
+	deviceRemover DeviceRemover
+	passwords     PasswordManager
+	events        EventRecorder
+	notifier      notifier.Notifier
+	secretKey     string
+	linkTTL       time.Duration
+	reportURL     string
+	resetURL      string
+}
+
+const (
+	queryTime  = 3 * time.Second
+	notifyTime = 30 * time.Second
+
+	purposeReportDevice  = "report_device"
+	purposeResetPassword = "reset_password"
+	purposeUnlockAccount = "unlock_account"
+)
+
+var (
+	ErrInvalidLink = errors.New("invalid or expired link")
+)
+
+type UserProvider interface {
+	User(
+		ctx context.Context,
+		email string,
+	) (models.User, error)
+}
+
+type DeviceRemover interface {
+	DeleteDevice(
+		ctx context.Context,
+		email string,
+		device string,
+	) error
+	DeleteDevices(
+		ctx context.Context,
+		email string,
+	) error
+}
+
+type PasswordManager interface {
+	SetPasswordResetRequired(
+		ctx context.Context,
+		email string,
+	) error
+	UpdatePassword(
+		ctx context.Context,
+		email string,
+		passHash []byte,
+	) error
+}
+
+type EventRecorder interface {
+	Record(
+		ctx context.Context,
+		event models.SecurityEvent,
+	)
+}
+
+func New(
+	log *logger.Logger,
+	userProvider UserProvider,
+	deviceRemover DeviceRemover,
+	passwords PasswordManager,
+	events EventRecorder,
+	notifier notifier.Notifier,
+	secretKey string,
+	linkTTL time.Duration,
+	reportURL string,
+	resetURL string,
+) *Security {
+	return &Security{
+		log:           log,
+		usrProvider:   userProvider,
+		deviceRemover: deviceRemover,
+		passwords:     passwords,
+		events:        events,
+		notifier:      notifier,
+		secretKey:     secretKey,
+		linkTTL:       linkTTL,
+		reportURL:     reportURL,
+		resetURL:      resetURL,
+	}
+}
+
+// NewDevice tells the user that their account was used from a device it has not seen before.
+// The notice carries a "this wasn't me" link, delivery happens in the background
+func (s *Security) NewDevice(
+	ctx context.Context,
+	user models.User,
+	deviceAddress string,
+) {
+	const op = "Security.NewDevice"
+	log := s.log.With(zap.String("op", op))
+
+	token, err := jwt.NewActionToken(tenant.SecretKey(ctx, s.secretKey), purposeReportDevice, user.Email, deviceAddress, fingerprint(user.PassHash), s.linkTTL)
+	if err != nil {
+		log.Error("failed to generate report token", zap.Error(err))
+		return
+	}
+
+	info := clientinfo.FromContext(ctx)
+	var body strings.Builder
+	body.WriteString("Your account was just used to sign in from a new device.\n\n")
+	fmt.Fprintf(&body, "Device: %s\n", deviceAddress)
+	if info.IP != "" {
+		fmt.Fprintf(&body, "IP address: %s\n", info.IP)
+	}
+	if info.UserAgent != "" {
+		fmt.Fprintf(&body, "Client: %s\n", info.UserAgent)
+	}
+	fmt.Fprintf(&body, "Time: %s\n\n", time.Now().UTC().Format(time.RFC1123))
+	body.WriteString("If this was you, you can ignore this message.\n")
+	fmt.Fprintf(&body, "If this wasn't you, sign the device out and reset your password: %s\n", link(ctx, s.reportURL, token))
+
+	s.send(ctx, notifier.Message{
+		To:      user.Email,
+		Subject: "New sign-in to your account",
+		Body:    body.String(),
+	})
+}
+
+// RegistrationAttempt tells the owner that someone tried to register their email again,
+// the caller of Register does not learn that the account exists
+func (s *Security) RegistrationAttempt(
+	ctx context.Context,
+	user models.User,
+) {
+	const op = "Security.RegistrationAttempt"
+
+	token, err := jwt.NewActionToken(tenant.SecretKey(ctx, s.secretKey), purposeResetPassword, user.Email, "", fingerprint(user.PassHash), s.linkTTL)
+	if err != nil {
+		s.log.Error("failed to generate reset token", zap.String("op", op), zap.Error(err))
+		return
+	}
+
+	s.send(ctx, notifier.Message{
+		To:      user.Email,
+		Subject: "Someone tried to create an account with your email",
+		Body: "Somebody tried to register a new account with this email address, but you already have one.\n\n" +
+			"If it was you and you forgot your password, reset it here: " + link(ctx, s.resetURL, token) + "\n" +
+			"Otherwise you can ignore this message, your account has not been changed.\n",
+	})
+}
+
+// ReportUnrecognizedLogin handles the "this wasn't me" link: the reported device is signed out,
+// login is blocked until the password is reset and a reset link is sent to the owner
+func (s *Security) ReportUnrecognizedLogin(
+	ctx context.Context,
+	reportToken string,
+) error {
+	const op = "Security.ReportUnrecognizedLogin"
+	log := s.log.With(zap.String("op", op))
+
+	user, claims, err := s.userByActionToken(ctx, purposeReportDevice, reportToken)
+	if err != nil {
+		log.Warn("rejected report link", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	err = s.deviceRemover.DeleteDevice(ctx, user.Email, claims.DeviceAddress)
+	if err != nil && !errors.Is(err, storage.ErrDeviceNotFound) {
+		log.Error("failed to delete device", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err == nil {
+		s.events.Record(ctx, models.SecurityEvent{
+			Email:  user.Email,
+			Type:   models.EventDeviceRemoved,
+			Device: claims.DeviceAddress,
+			Reason: "reported by owner",
+		})
+	}
+
+	if err := s.passwords.SetPasswordResetRequired(ctx, user.Email); err != nil {
+		log.Error("failed to require password reset", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	token, err := jwt.NewActionToken(tenant.SecretKey(ctx, s.secretKey), purposeResetPassword, user.Email, "", fingerprint(user.PassHash), s.linkTTL)
+	if err != nil {
+		log.Error("failed to generate reset token", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	s.send(ctx, notifier.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: "We signed out the device you reported. Sign-in is blocked until you choose a new password.\n\n" +
+			"Reset your password: " + link(ctx, s.resetURL, token) + "\n",
+	})
+
+	return nil
+}
+
+// ResetPassword sets a new password using the link from the reset email and signs out every device
+func (s *Security) ResetPassword(
+	ctx context.Context,
+	resetToken string,
+	newPassword string,
+) error {
+	const op = "Security.ResetPassword"
+	log := s.log.With(zap.String("op", op))
+
+	user, _, err := s.userByActionToken(ctx, purposeResetPassword, resetToken)
+	if err != nil {
+		log.Warn("rejected reset link", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	passHash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		log.Error("failed to hash password", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	if err := s.passwords.UpdatePassword(ctx, user.Email, passHash); err != nil {
+		log.Error("failed to update password", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := s.deviceRemover.DeleteDevices(ctx, user.Email); err != nil {
+		log.Error("failed to delete devices", zap.Error(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	s.events.Record(ctx, models.SecurityEvent{
+		Email:  user.Email,
+		Type:   models.EventPasswordReset,
+		Reason: "all devices signed out",
+	})
+
+	return nil
+}
+
+// userByActionToken checks the link token and that the password has not changed since it was issued,
+// which makes every link unusable after a successful reset
+func (s *Security) userByActionToken(
+	ctx context.Context,
+	purpose string,
+	token string,
+) (models.User, jwt.ActionClaims, error) {
+	claims, err := jwt.DecodeActionToken(tenant.SecretKey(ctx, s.secretKey), purpose, token)
+	if err != nil {
+		return models.User{}, jwt.ActionClaims{}, ErrInvalidLink
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	user, err := s.usrProvider.User(ctx, claims.User)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return models.User{}, jwt.ActionClaims{}, ErrInvalidLink
+		}
+		return models.User{}, jwt.ActionClaims{}, err
+	}
+	if claims.Fingerprint != fingerprint(user.PassHash) {
+		return models.User{}, jwt.ActionClaims{}, ErrInvalidLink
+	}
+
+	return user, claims, nil
+}
+
+func (s *Security) send(ctx context.Context, msg notifier.Message) {
+	sendAsync(ctx, s.log, s.notifier, msg)
+}
+
+// sendAsync delivers the message in the background, the request must not wait for the mail server
+func sendAsync(ctx context.Context, log *logger.Logger, n notifier.Notifier, msg notifier.Message) {
+	const op = "security.sendAsync"
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), notifyTime)
+		defer cancel()
+		if err := n.Notify(ctx, msg); err != nil {
+			log.Error("failed to send notification", zap.String("op", op), zap.String("subject", msg.Subject), zap.Error(err))
+		}
+	}()
+}
+
+// fingerprint identifies the current password without revealing its hash
+func fingerprint(passHash []byte) string {
+	sum := sha256.Sum256(passHash)
+	return hex.EncodeToString(sum[:8])
+}
+
+// link adds the token to the page URL. The token is signed with the key of the tenant,
+// the page sends the tenant named in the link back in the x-tenant-id metadata
+func link(ctx context.Context, base string, token string) string {
+	params := url.Values{"token": {token}}
+	if t, ok := tenant.FromContext(ctx); ok {
+		params.Set("tenant", t.ID)
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return base + "?" + params.Encode()
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
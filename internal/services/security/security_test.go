@@ -0,0 +1,266 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/clientinfo"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/notifier"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testSecret = "secret"
+	reportURL  = "https://vieo.example.com/report"
+	resetURL   = "https://vieo.example.com/reset?lang=en"
+)
+
+// outbox collects the messages sent in the background
+type outbox chan notifier.Message
+
+func (o outbox) Notify(_ context.Context, msg notifier.Message) error {
+	o <- msg
+	return nil
+}
+
+func (o outbox) next(t *testing.T) notifier.Message {
+	t.Helper()
+
+	select {
+	case msg := <-o:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("no message sent")
+		return notifier.Message{}
+	}
+}
+
+// account is the store of one user and their devices
+type account struct {
+	user          models.User
+	devices       map[string]bool
+	resetRequired bool
+}
+
+func (a *account) User(_ context.Context, email string) (models.User, error) {
+	if email != a.user.Email {
+		return models.User{}, storage.ErrUserNotFound
+	}
+	return a.user, nil
+}
+
+func (a *account) DeleteDevice(_ context.Context, _ string, device string) error {
+	if !a.devices[device] {
+		return storage.ErrDeviceNotFound
+	}
+	delete(a.devices, device)
+	return nil
+}
+
+func (a *account) DeleteDevices(context.Context, string) error {
+	a.devices = map[string]bool{}
+	return nil
+}
+
+func (a *account) SetPasswordResetRequired(context.Context, string) error {
+	a.resetRequired = true
+	return nil
+}
+
+func (a *account) UpdatePassword(_ context.Context, _ string, passHash []byte) error {
+	a.user.PassHash = passHash
+	a.resetRequired = false
+	return nil
+}
+
+type eventLog struct {
+	events []models.SecurityEvent
+}
+
+func (l *eventLog) Record(_ context.Context, event models.SecurityEvent) {
+	l.events = append(l.events, event)
+}
+
+func newSecurity(t *testing.T) (*Security, *account, outbox, *eventLog) {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %v", err)
+	}
+	acc := &account{
+		user:    models.User{Email: "user@example.com", PassHash: hash},
+		devices: map[string]bool{"phone": true, "tv": true},
+	}
+	out := make(outbox, 4)
+	events := &eventLog{}
+	log := &logger.Logger{SugaredLogger: zap.NewNop().Sugar()}
+	s := New(log, acc, acc, acc, events, out, testSecret, time.Hour, reportURL, resetURL)
+	return s, acc, out, events
+}
+
+var linkPattern = regexp.MustCompile(`https://\S+`)
+
+// linkToken returns the token of the link to base found in the body
+func linkToken(t *testing.T, body string, base string) string {
+	t.Helper()
+
+	for _, raw := range linkPattern.FindAllString(body, -1) {
+		u, err := url.Parse(raw)
+		if err != nil {
+			continue
+		}
+		if u.Scheme+"://"+u.Host+u.Path == strings.SplitN(base, "?", 2)[0] {
+			return u.Query().Get("token")
+		}
+	}
+	t.Fatalf("no link to %s in %q", base, body)
+	return ""
+}
+
+func TestNewDeviceNotice(t *testing.T) {
+	s, acc, out, _ := newSecurity(t)
+	ctx := clientinfo.NewContext(context.Background(), clientinfo.Info{IP: "10.0.0.1", UserAgent: "tv-app"})
+
+	s.NewDevice(ctx, acc.user, "tv")
+
+	msg := out.next(t)
+	if msg.To != acc.user.Email {
+		t.Errorf("sent to %q, want %q", msg.To, acc.user.Email)
+	}
+	for _, want := range []string{"Device: tv", "IP address: 10.0.0.1", "Client: tv-app"} {
+		if !strings.Contains(msg.Body, want) {
+			t.Errorf("body does not mention %q: %q", want, msg.Body)
+		}
+	}
+	if linkToken(t, msg.Body, reportURL) == "" {
+		t.Errorf("report link has no token")
+	}
+}
+
+func TestReportUnrecognizedLogin(t *testing.T) {
+	s, acc, out, events := newSecurity(t)
+	s.NewDevice(context.Background(), acc.user, "tv")
+	report := linkToken(t, out.next(t).Body, reportURL)
+
+	if err := s.ReportUnrecognizedLogin(context.Background(), report); err != nil {
+		t.Fatalf("ReportUnrecognizedLogin: %v", err)
+	}
+
+	if acc.devices["tv"] || !acc.devices["phone"] {
+		t.Errorf("devices = %v, want only the reported one signed out", acc.devices)
+	}
+	if !acc.resetRequired {
+		t.Errorf("password reset not required")
+	}
+	if len(events.events) != 1 || events.events[0].Type != models.EventDeviceRemoved || events.events[0].Device != "tv" {
+		t.Errorf("events = %+v, want the reported device removed", events.events)
+	}
+	if linkToken(t, out.next(t).Body, resetURL) == "" {
+		t.Errorf("reset link has no token")
+	}
+
+	// the device is already gone, reporting it again still blocks the account
+	if err := s.ReportUnrecognizedLogin(context.Background(), report); err != nil {
+		t.Errorf("second report: %v", err)
+	}
+	if len(events.events) != 1 {
+		t.Errorf("second report recorded %d events, want none", len(events.events)-1)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	s, acc, out, events := newSecurity(t)
+	s.NewDevice(context.Background(), acc.user, "tv")
+	report := linkToken(t, out.next(t).Body, reportURL)
+	if err := s.ReportUnrecognizedLogin(context.Background(), report); err != nil {
+		t.Fatalf("ReportUnrecognizedLogin: %v", err)
+	}
+	reset := linkToken(t, out.next(t).Body, resetURL)
+
+	if err := s.ResetPassword(context.Background(), reset, "newpassword"); err != nil {
+		t.Fatalf("ResetPassword: %v", err)
+	}
+
+	if bcrypt.CompareHashAndPassword(acc.user.PassHash, []byte("newpassword")) != nil {
+		t.Errorf("password not changed")
+	}
+	if acc.resetRequired || len(acc.devices) != 0 {
+		t.Errorf("reset required = %v, devices = %v, want cleared", acc.resetRequired, acc.devices)
+	}
+	if last := events.events[len(events.events)-1]; last.Type != models.EventPasswordReset {
+		t.Errorf("last event = %s, want %s", last.Type, models.EventPasswordReset)
+	}
+
+	// every link issued for the old password is dead
+	if err := s.ResetPassword(context.Background(), reset, "another1"); !errors.Is(err, ErrInvalidLink) {
+		t.Errorf("reused reset link error = %v, want %v", err, ErrInvalidLink)
+	}
+	if err := s.ReportUnrecognizedLogin(context.Background(), report); !errors.Is(err, ErrInvalidLink) {
+		t.Errorf("old report link error = %v, want %v", err, ErrInvalidLink)
+	}
+}
+
+func TestLinksAreBoundToTheirPurpose(t *testing.T) {
+	s, acc, out, _ := newSecurity(t)
+	s.NewDevice(context.Background(), acc.user, "tv")
+	report := linkToken(t, out.next(t).Body, reportURL)
+
+	if err := s.ResetPassword(context.Background(), report, "newpassword"); !errors.Is(err, ErrInvalidLink) {
+		t.Errorf("reset with a report link error = %v, want %v", err, ErrInvalidLink)
+	}
+	if err := s.ReportUnrecognizedLogin(context.Background(), "not-a-token"); !errors.Is(err, ErrInvalidLink) {
+		t.Errorf("malformed report link error = %v, want %v", err, ErrInvalidLink)
+	}
+	if len(acc.devices) != 2 || acc.resetRequired {
+		t.Errorf("rejected links changed the account")
+	}
+}
+
+func TestLinkKeepsThePageQuery(t *testing.T) {
+	got, err := url.Parse(link(context.Background(), resetURL, "abc"))
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+	if q := got.Query(); q.Get("lang") != "en" || q.Get("token") != "abc" || q.Has("tenant") {
+		t.Errorf("link query = %v, want lang and token", q)
+	}
+}
+
+func TestLinkNamesTheTenant(t *testing.T) {
+	ctx := tenant.NewContext(context.Background(), tenant.Tenant{ID: "acme"})
+
+	got, err := url.Parse(link(ctx, resetURL, "abc"))
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+	if q := got.Query(); q.Get("tenant") != "acme" || q.Get("token") != "abc" {
+		t.Errorf("link query = %v, want the tenant and the token", q)
+	}
+}
+
+func TestRegistrationAttempt(t *testing.T) {
+	s, acc, out, _ := newSecurity(t)
+
+	s.RegistrationAttempt(context.Background(), acc.user)
+
+	msg := out.next(t)
+	if msg.To != acc.user.Email {
+		t.Errorf("sent to %q, want %q", msg.To, acc.user.Email)
+	}
+	// the owner can reset the password from the notice
+	reset := linkToken(t, msg.Body, resetURL)
+	if err := s.ResetPassword(context.Background(), reset, "newpassword"); err != nil {
+		t.Errorf("ResetPassword with the link of the notice: %v", err)
+	}
+}
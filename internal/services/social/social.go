@@ -0,0 +1,405 @@
+package social
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/oidc"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	queryTime = 3 * time.Second
+	// providerTime bounds the calls to the provider, discovery and the code exchange
+	providerTime = 10 * time.Second
+)
+
+var (
+	ErrUnknownProvider = errors.New("unknown identity provider")
+	// ErrInvalidState is returned for an unknown, expired or already used state, or a state
+	// of a link used to sign in and the other way round
+	ErrInvalidState = errors.New("invalid or expired state")
+	// ErrAccountExists is returned when the email of a new identity already has an account.
+	// It is never linked on its own, the owner signs in and links it
+	ErrAccountExists = errors.New("account with this email exists, sign in and link the identity")
+	// ErrEmailNotVerified is returned for a new identity without a verified email, there is
+	// nothing to create the account with
+	ErrEmailNotVerified = errors.New("identity has no verified email")
+	ErrProviderFailed   = errors.New("identity provider failed")
+)
+
+// Authorization is where the user is sent to sign in at the provider, State comes back
+// with the code and completes the sign in
+type Authorization struct {
+	URL   string
+	State string
+}
+
+// Social signs users in with external OpenID Connect providers and links their identities
+type Social struct {
+	log        *logger.Logger
+	providers  map[string]Provider
+	logins     LoginStore
+	identities IdentityStore
+	devices    DeviceAuthenticator
+	stateTTL   time.Duration
+}
+
+// Provider is the relying party of an identity provider, oidc.Client
+type Provider interface {
+	AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error)
+	Exchange(ctx context.Context, code, verifier, nonce string) (oidc.Identity, error)
+}
+
+type LoginStore interface {
+	SaveSocialLogin(
+		ctx context.Context,
+		login models.SocialLogin,
+		ttl time.Duration,
+	) error
+	ConsumeSocialLogin(
+		ctx context.Context,
+		stateHash string,
+	) (models.SocialLogin, error)
+}
+
+type IdentityStore interface {
+	IdentityUser(
+		ctx context.Context,
+		provider string,
+		subject string,
+	) (string, error)
+	SaveIdentity(
+		ctx context.Context,
+		email string,
+		identity models.Identity,
+	) (models.Identity, error)
+	SaveUserWithIdentity(
+		ctx context.Context,
+		email string,
+		passHash []byte,
+		identity models.Identity,
+	) (models.Identity, error)
+	Identities(
+		ctx context.Context,
+		email string,
+	) ([]models.Identity, error)
+	DeleteIdentity(
+		ctx context.Context,
+		email string,
+		provider string,
+	) error
+}
+
+// DeviceAuthenticator signs the user in on the device without a password once the provider vouched for it
+type DeviceAuthenticator interface {
+	LoginDevice(
+		ctx context.Context,
+		email string,
+		deviceAddress string,
+	) (token string, err error)
+}
+
+// New creates the social login service over the providers by name, a sign in must complete within stateTTL
+func New(
+	log *logger.Logger,
+	providers map[string]Provider,
+	logins LoginStore,
+	identities IdentityStore,
+	devices DeviceAuthenticator,
+	stateTTL time.Duration,
+) *Social {
+	return &Social{
+		log:        log,
+		providers:  providers,
+		logins:     logins,
+		identities: identities,
+		devices:    devices,
+		stateTTL:   stateTTL,
+	}
+}
+
+// Start begins a sign in with the provider for the device
+func (s *Social) Start(
+	ctx context.Context,
+	provider string,
+	deviceAddress string,
+) (Authorization, error) {
+	const op = "Social.Start"
+
+	auth, err := s.start(ctx, provider, deviceAddress, "")
+	if err != nil {
+		return Authorization{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return auth, nil
+}
+
+// StartLink begins linking an identity of the provider to the signed in user
+func (s *Social) StartLink(
+	ctx context.Context,
+	email string,
+	provider string,
+) (Authorization, error) {
+	const op = "Social.StartLink"
+
+	auth, err := s.start(ctx, provider, "", email)
+	if err != nil {
+		return Authorization{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return auth, nil
+}
+
+// Complete finishes the sign in with the code the provider redirected back with. An unknown identity
+// with a verified email gets a new account, created reports it
+func (s *Social) Complete(
+	ctx context.Context,
+	state string,
+	code string,
+) (token string, created bool, err error) {
+	const op = "Social.Complete"
+	log := s.log.With(zap.String("op", op))
+
+	login, identity, err := s.exchange(ctx, state, code)
+	if err != nil {
+		return "", false, fmt.Errorf("%s: %w", op, err)
+	}
+	if login.LinkEmail != "" {
+		log.Warn("link state used to sign in")
+		return "", false, fmt.Errorf("%s: %w", op, ErrInvalidState)
+	}
+	log = log.With(zap.String("provider", login.Provider))
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	email, err := s.identities.IdentityUser(ctx, login.Provider, identity.Subject)
+	switch {
+	case errors.Is(err, storage.ErrIdentityNotFound):
+		email, err = s.signUp(ctx, login.Provider, identity)
+		if err != nil {
+			return "", false, fmt.Errorf("%s: %w", op, err)
+		}
+		created = true
+		log.Info("account created with identity")
+	case err != nil:
+		log.Error("failed to get identity", zap.Error(err))
+		return "", false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	token, err = s.devices.LoginDevice(ctx, email, login.DeviceAddress)
+	if err != nil {
+		return "", false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return token, created, nil
+}
+
+// CompleteLink finishes linking the identity to the user who started the link
+func (s *Social) CompleteLink(
+	ctx context.Context,
+	email string,
+	state string,
+	code string,
+) (models.Identity, error) {
+	const op = "Social.CompleteLink"
+	log := s.log.With(zap.String("op", op))
+
+	login, identity, err := s.exchange(ctx, state, code)
+	if err != nil {
+		return models.Identity{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if login.LinkEmail != email {
+		log.Warn("link completed by another user or sign in state used")
+		return models.Identity{}, fmt.Errorf("%s: %w", op, ErrInvalidState)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	linked, err := s.identities.SaveIdentity(ctx, email, models.Identity{
+		Provider: login.Provider,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrIdentityAlreadyLinked) {
+			log.Warn("identity already linked", zap.String("provider", login.Provider))
+			return models.Identity{}, fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("failed to save identity", zap.Error(err))
+		return models.Identity{}, fmt.Errorf("%s: %w", op, err)
+	}
+	log.Info("identity linked", zap.String("provider", login.Provider))
+
+	return linked, nil
+}
+
+// Identities returns the identities linked to the user
+func (s *Social) Identities(
+	ctx context.Context,
+	email string,
+) ([]models.Identity, error) {
+	const op = "Social.Identities"
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	identities, err := s.identities.Identities(ctx, email)
+	if err != nil {
+		s.log.Error("failed to list identities", zap.String("op", op), zap.Error(err))
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return identities, nil
+}
+
+// Unlink removes the identity of the provider from the user. An account created by a provider
+// keeps the password reset to sign in without it
+func (s *Social) Unlink(
+	ctx context.Context,
+	email string,
+	provider string,
+) error {
+	const op = "Social.Unlink"
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	if err := s.identities.DeleteIdentity(ctx, email, provider); err != nil {
+		if !errors.Is(err, storage.ErrIdentityNotFound) {
+			s.log.Error("failed to delete identity", zap.String("op", op), zap.Error(err))
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	s.log.Info("identity unlinked", zap.String("op", op), zap.String("provider", provider))
+
+	return nil
+}
+
+func (s *Social) start(ctx context.Context, provider, deviceAddress, linkEmail string) (Authorization, error) {
+	p, ok := s.providers[provider]
+	if !ok {
+		return Authorization{}, ErrUnknownProvider
+	}
+	state, err := randomString()
+	if err != nil {
+		return Authorization{}, err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return Authorization{}, err
+	}
+	verifier, err := randomString()
+	if err != nil {
+		return Authorization{}, err
+	}
+
+	providerCtx, cancel := context.WithTimeout(ctx, providerTime)
+	defer cancel()
+	url, err := p.AuthCodeURL(providerCtx, state, nonce, verifier)
+	if err != nil {
+		s.log.Error("failed to discover provider", zap.String("provider", provider), zap.Error(err))
+		return Authorization{}, fmt.Errorf("%w: %w", ErrProviderFailed, err)
+	}
+
+	ctx, cancel = context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	err = s.logins.SaveSocialLogin(ctx, models.SocialLogin{
+		StateHash:     hash(state),
+		Provider:      provider,
+		Nonce:         nonce,
+		CodeVerifier:  verifier,
+		DeviceAddress: deviceAddress,
+		LinkEmail:     linkEmail,
+	}, s.stateTTL)
+	if err != nil {
+		s.log.Error("failed to save social login", zap.Error(err))
+		return Authorization{}, err
+	}
+
+	return Authorization{URL: url, State: state}, nil
+}
+
+// exchange consumes the state and verifies the identity the provider returns for the code
+func (s *Social) exchange(ctx context.Context, state, code string) (models.SocialLogin, oidc.Identity, error) {
+	dbCtx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	login, err := s.logins.ConsumeSocialLogin(dbCtx, hash(state))
+	if err != nil {
+		if errors.Is(err, storage.ErrSocialLoginNotFound) {
+			return models.SocialLogin{}, oidc.Identity{}, ErrInvalidState
+		}
+		s.log.Error("failed to consume social login", zap.Error(err))
+		return models.SocialLogin{}, oidc.Identity{}, err
+	}
+	p, ok := s.providers[login.Provider]
+	if !ok {
+		return models.SocialLogin{}, oidc.Identity{}, ErrUnknownProvider
+	}
+
+	providerCtx, cancel := context.WithTimeout(ctx, providerTime)
+	defer cancel()
+	identity, err := p.Exchange(providerCtx, code, login.CodeVerifier, login.Nonce)
+	if err != nil {
+		s.log.Warn("identity not verified", zap.String("provider", login.Provider), zap.Error(err))
+		return models.SocialLogin{}, oidc.Identity{}, fmt.Errorf("%w: %w", ErrProviderFailed, err)
+	}
+
+	return login, identity, nil
+}
+
+// signUp creates the account of a new identity, never attaching it to an existing account
+func (s *Social) signUp(ctx context.Context, provider string, identity oidc.Identity) (string, error) {
+	if identity.Email == "" || !identity.EmailVerified {
+		return "", ErrEmailNotVerified
+	}
+	// nobody knows the password, the account signs in with the provider or sets one by the reset
+	password, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	passHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s.identities.SaveUserWithIdentity(ctx, identity.Email, passHash, models.Identity{
+		Provider: provider,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrUserAlreadyExists) {
+			return "", ErrAccountExists
+		}
+		// signed up concurrently by the same identity
+		if errors.Is(err, storage.ErrIdentityAlreadyLinked) {
+			return s.identities.IdentityUser(ctx, provider, identity.Subject)
+		}
+		s.log.Error("failed to create user with identity", zap.Error(err))
+		return "", err
+	}
+
+	return identity.Email, nil
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
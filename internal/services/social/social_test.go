@@ -0,0 +1,380 @@
+package social
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/lib/oidc"
+	"vieo/auth/internal/lib/oidc/fakeidp"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+const (
+	testProvider    = "fake"
+	testRedirectURL = "https://app.example.com/social/callback"
+)
+
+// memoryLogins is a LoginStore in a map, a state is consumed once
+type memoryLogins map[string]models.SocialLogin
+
+func (m memoryLogins) SaveSocialLogin(_ context.Context, login models.SocialLogin, _ time.Duration) error {
+	m[login.StateHash] = login
+	return nil
+}
+
+func (m memoryLogins) ConsumeSocialLogin(_ context.Context, stateHash string) (models.SocialLogin, error) {
+	login, ok := m[stateHash]
+	if !ok {
+		return models.SocialLogin{}, storage.ErrSocialLoginNotFound
+	}
+	delete(m, stateHash)
+	return login, nil
+}
+
+// memoryIdentities is an IdentityStore of the registered emails and the identities linked to them
+type memoryIdentities struct {
+	users      map[string]bool
+	identities map[string]models.Identity
+	owners     map[string]string
+}
+
+func newMemoryIdentities(emails ...string) *memoryIdentities {
+	m := &memoryIdentities{
+		users:      map[string]bool{},
+		identities: map[string]models.Identity{},
+		owners:     map[string]string{},
+	}
+	for _, email := range emails {
+		m.users[email] = true
+	}
+	return m
+}
+
+func (m *memoryIdentities) IdentityUser(_ context.Context, provider, subject string) (string, error) {
+	email, ok := m.owners[provider+":"+subject]
+	if !ok {
+		return "", storage.ErrIdentityNotFound
+	}
+	return email, nil
+}
+
+func (m *memoryIdentities) SaveIdentity(_ context.Context, email string, identity models.Identity) (models.Identity, error) {
+	if !m.users[email] {
+		return models.Identity{}, storage.ErrUserNotFound
+	}
+	if _, ok := m.owners[identity.Provider+":"+identity.Subject]; ok {
+		return models.Identity{}, storage.ErrIdentityAlreadyLinked
+	}
+	m.owners[identity.Provider+":"+identity.Subject] = email
+	m.identities[email+":"+identity.Provider] = identity
+	return identity, nil
+}
+
+func (m *memoryIdentities) SaveUserWithIdentity(ctx context.Context, email string, _ []byte, identity models.Identity) (models.Identity, error) {
+	if m.users[email] {
+		return models.Identity{}, storage.ErrUserAlreadyExists
+	}
+	m.users[email] = true
+	return m.SaveIdentity(ctx, email, identity)
+}
+
+func (m *memoryIdentities) Identities(_ context.Context, email string) ([]models.Identity, error) {
+	var res []models.Identity
+	for key, identity := range m.identities {
+		if key == email+":"+identity.Provider {
+			res = append(res, identity)
+		}
+	}
+	return res, nil
+}
+
+func (m *memoryIdentities) DeleteIdentity(_ context.Context, email, provider string) error {
+	identity, ok := m.identities[email+":"+provider]
+	if !ok {
+		return storage.ErrIdentityNotFound
+	}
+	delete(m.identities, email+":"+provider)
+	delete(m.owners, provider+":"+identity.Subject)
+	return nil
+}
+
+type tokenDevices struct{}
+
+func (tokenDevices) LoginDevice(_ context.Context, email, deviceAddress string) (string, error) {
+	return email + "@" + deviceAddress, nil
+}
+
+// newTestSocial signs in at a fakeidp with the users
+func newTestSocial(t *testing.T, identities *memoryIdentities, users ...fakeidp.User) *Social {
+	t.Helper()
+
+	// the issuer is the address of the server, known once it listens
+	srv := httptest.NewServer(nil)
+	t.Cleanup(srv.Close)
+	idp, err := fakeidp.New(srv.URL, users...)
+	if err != nil {
+		t.Fatalf("fakeidp.New: %v", err)
+	}
+	srv.Config.Handler = idp
+
+	provider := oidc.NewClient(oidc.Config{
+		Issuer:      srv.URL,
+		ClientID:    "client",
+		RedirectURL: testRedirectURL,
+	}, srv.Client())
+
+	return New(
+		&logger.Logger{SugaredLogger: zap.NewNop().Sugar()},
+		map[string]Provider{testProvider: provider},
+		memoryLogins{},
+		identities,
+		tokenDevices{},
+		time.Minute,
+	)
+}
+
+// signIn sends the user of loginHint to the authorization URL and returns the code and the
+// state the provider redirected back with. rewrite changes the query of the authorization request
+func signIn(t *testing.T, auth Authorization, loginHint string, rewrite func(q url.Values)) (code, state string) {
+	t.Helper()
+
+	u, err := url.Parse(auth.URL)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	q := u.Query()
+	q.Set("login_hint", loginHint)
+	if rewrite != nil {
+		rewrite(q)
+	}
+	u.RawQuery = q.Encode()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize status = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return back.Query().Get("code"), back.Query().Get("state")
+}
+
+func TestComplete(t *testing.T) {
+	verified := fakeidp.User{Subject: "sub-1", Email: "new@example.com", EmailVerified: true}
+	unverified := fakeidp.User{Subject: "sub-2", Email: "unverified@example.com"}
+	existing := fakeidp.User{Subject: "sub-3", Email: "existing@example.com", EmailVerified: true}
+
+	tests := []struct {
+		name        string
+		identities  func() *memoryIdentities
+		user        fakeidp.User
+		rewrite     func(q url.Values)
+		wantErr     error
+		wantToken   string
+		wantCreated bool
+	}{
+		{
+			name:        "new identity creates the account",
+			identities:  func() *memoryIdentities { return newMemoryIdentities() },
+			user:        verified,
+			wantToken:   "new@example.com@device",
+			wantCreated: true,
+		},
+		{
+			name: "linked identity signs in",
+			identities: func() *memoryIdentities {
+				m := newMemoryIdentities("owner@example.com")
+				_, _ = m.SaveIdentity(context.Background(), "owner@example.com", models.Identity{Provider: testProvider, Subject: "sub-1"})
+				return m
+			},
+			user:      verified,
+			wantToken: "owner@example.com@device",
+		},
+		{
+			name:       "unverified email",
+			identities: func() *memoryIdentities { return newMemoryIdentities() },
+			user:       unverified,
+			wantErr:    ErrEmailNotVerified,
+		},
+		{
+			name:       "email of an existing account",
+			identities: func() *memoryIdentities { return newMemoryIdentities("existing@example.com") },
+			user:       existing,
+			wantErr:    ErrAccountExists,
+		},
+		{
+			name:       "nonce of another request",
+			identities: func() *memoryIdentities { return newMemoryIdentities() },
+			user:       verified,
+			rewrite:    func(q url.Values) { q.Set("nonce", "injected") },
+			wantErr:    oidc.ErrNonceMismatch,
+		},
+		{
+			name:       "verifier of another request",
+			identities: func() *memoryIdentities { return newMemoryIdentities() },
+			user:       verified,
+			rewrite:    func(q url.Values) { q.Set("code_challenge", oidc.CodeChallenge("another verifier")) },
+			wantErr:    oidc.ErrExchange,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identities := tt.identities()
+			s := newTestSocial(t, identities, verified, unverified, existing)
+			auth, err := s.Start(context.Background(), testProvider, "device")
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			code, state := signIn(t, auth, tt.user.Email, tt.rewrite)
+
+			token, created, err := s.Complete(context.Background(), state, code)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Complete error = %v, want %v", err, tt.wantErr)
+			}
+			if token != tt.wantToken || created != tt.wantCreated {
+				t.Errorf("Complete = %q, %v, want %q, %v", token, created, tt.wantToken, tt.wantCreated)
+			}
+			if tt.wantErr == nil {
+				return
+			}
+			if _, err := identities.IdentityUser(context.Background(), testProvider, tt.user.Subject); err == nil {
+				t.Errorf("rejected identity was saved")
+			}
+		})
+	}
+}
+
+func TestCompleteState(t *testing.T) {
+	user := fakeidp.User{Subject: "sub-1", Email: "new@example.com", EmailVerified: true}
+
+	t.Run("state used twice", func(t *testing.T) {
+		s := newTestSocial(t, newMemoryIdentities(), user)
+		auth, err := s.Start(context.Background(), testProvider, "device")
+		if err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+		code, state := signIn(t, auth, user.Email, nil)
+		if _, _, err := s.Complete(context.Background(), state, code); err != nil {
+			t.Fatalf("Complete: %v", err)
+		}
+		if _, _, err := s.Complete(context.Background(), state, code); !errors.Is(err, ErrInvalidState) {
+			t.Errorf("second Complete error = %v, want %v", err, ErrInvalidState)
+		}
+	})
+
+	t.Run("unknown state", func(t *testing.T) {
+		s := newTestSocial(t, newMemoryIdentities(), user)
+		if _, _, err := s.Complete(context.Background(), "unknown", "code"); !errors.Is(err, ErrInvalidState) {
+			t.Errorf("Complete error = %v, want %v", err, ErrInvalidState)
+		}
+	})
+
+	t.Run("link state used to sign in", func(t *testing.T) {
+		s := newTestSocial(t, newMemoryIdentities("owner@example.com"), user)
+		auth, err := s.StartLink(context.Background(), "owner@example.com", testProvider)
+		if err != nil {
+			t.Fatalf("StartLink: %v", err)
+		}
+		code, state := signIn(t, auth, user.Email, nil)
+		if _, _, err := s.Complete(context.Background(), state, code); !errors.Is(err, ErrInvalidState) {
+			t.Errorf("Complete error = %v, want %v", err, ErrInvalidState)
+		}
+	})
+
+	t.Run("unknown provider", func(t *testing.T) {
+		s := newTestSocial(t, newMemoryIdentities(), user)
+		if _, err := s.Start(context.Background(), "other", "device"); !errors.Is(err, ErrUnknownProvider) {
+			t.Errorf("Start error = %v, want %v", err, ErrUnknownProvider)
+		}
+	})
+}
+
+func TestCompleteLink(t *testing.T) {
+	user := fakeidp.User{Subject: "sub-1", Email: "someone@example.com", EmailVerified: true}
+
+	tests := []struct {
+		name       string
+		identities func() *memoryIdentities
+		// signIn starts a sign in instead of a link
+		signIn  bool
+		email   string
+		wantErr error
+	}{
+		{
+			name:       "links the identity",
+			identities: func() *memoryIdentities { return newMemoryIdentities("owner@example.com") },
+			email:      "owner@example.com",
+		},
+		{
+			name: "identity of another account",
+			identities: func() *memoryIdentities {
+				m := newMemoryIdentities("owner@example.com", "other@example.com")
+				_, _ = m.SaveIdentity(context.Background(), "other@example.com", models.Identity{Provider: testProvider, Subject: "sub-1"})
+				return m
+			},
+			email:   "owner@example.com",
+			wantErr: storage.ErrIdentityAlreadyLinked,
+		},
+		{
+			name:       "completed by another user",
+			identities: func() *memoryIdentities { return newMemoryIdentities("owner@example.com", "other@example.com") },
+			email:      "other@example.com",
+			wantErr:    ErrInvalidState,
+		},
+		{
+			name:       "sign in state used to link",
+			identities: func() *memoryIdentities { return newMemoryIdentities("owner@example.com") },
+			signIn:     true,
+			email:      "owner@example.com",
+			wantErr:    ErrInvalidState,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identities := tt.identities()
+			s := newTestSocial(t, identities, user)
+
+			var (
+				auth Authorization
+				err  error
+			)
+			if tt.signIn {
+				auth, err = s.Start(context.Background(), testProvider, "device")
+			} else {
+				auth, err = s.StartLink(context.Background(), "owner@example.com", testProvider)
+			}
+			if err != nil {
+				t.Fatalf("start: %v", err)
+			}
+			code, state := signIn(t, auth, user.Email, nil)
+
+			linked, err := s.CompleteLink(context.Background(), tt.email, state, code)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CompleteLink error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if linked.Provider != testProvider || linked.Subject != user.Subject || linked.Email != user.Email {
+				t.Errorf("CompleteLink = %+v", linked)
+			}
+			if email, err := identities.IdentityUser(context.Background(), testProvider, user.Subject); err != nil || email != tt.email {
+				t.Errorf("identity belongs to %q, %v, want %q", email, err, tt.email)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package streams
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+const queryTime = 3 * time.Second
+
+// ErrRevoked is returned for the heartbeat of a revoked session, the reason tells the player why it stopped
+var ErrRevoked = errors.New("stream session revoked")
+
+// Policy bounds the streams playing at once for a user, or a household when the user is in one.
+// MaxStreams applies to accounts without a plan, the plan brings its own, 0 is unlimited.
+// Over the limit a new stream is refused, or the oldest is revoked with KickOldest.
+// A stream without a heartbeat for Timeout stops counting
+type Policy struct {
+	MaxStreams int
+	KickOldest bool
+	Timeout    time.Duration
+}
+
+// Streams counts the active playbacks, unlike the device limit which counts registered devices
+type Streams struct {
+	log     *logger.Logger
+	streams StreamStore
+	policy  Policy
+}
+
+type StreamStore interface {
+	StartStreamSession(
+		ctx context.Context,
+		email string,
+		id string,
+		deviceAddress string,
+		maxStreams int,
+		kickOldest bool,
+		timeout time.Duration,
+	) (models.StreamSession, []models.StreamSession, error)
+	HeartbeatStreamSession(
+		ctx context.Context,
+		email string,
+		id string,
+		timeout time.Duration,
+	) (models.StreamSession, error)
+	DeleteStreamSession(
+		ctx context.Context,
+		email string,
+		id string,
+	) error
+}
+
+func New(
+	log *logger.Logger,
+	streams StreamStore,
+	policy Policy,
+) *Streams {
+	return &Streams{
+		log:     log,
+		streams: streams,
+		policy:  policy,
+	}
+}
+
+// HeartbeatInterval is how often players should send heartbeats to stay well within the timeout
+func (s *Streams) HeartbeatInterval() time.Duration {
+	return s.policy.Timeout / 3
+}
+
+// Start opens a stream session for the device within the limit of the entitlements. The sessions
+// displaced to make room learn it from their next heartbeat
+func (s *Streams) Start(
+	ctx context.Context,
+	email string,
+	deviceAddress string,
+	entitlements models.Entitlements,
+) (models.StreamSession, error) {
+	const op = "Streams.Start"
+	log := s.log.With(zap.String("op", op), zap.String("device", deviceAddress))
+
+	maxStreams := s.policy.MaxStreams
+	if entitlements.Plan != "" {
+		maxStreams = entitlements.MaxStreams
+	}
+	id, err := randomID()
+	if err != nil {
+		log.Error("failed to generate session id", zap.Error(err))
+		return models.StreamSession{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	session, displaced, err := s.streams.StartStreamSession(
+		ctx,
+		email,
+		id,
+		deviceAddress,
+		maxStreams,
+		s.policy.KickOldest,
+		s.policy.Timeout,
+	)
+	if err != nil {
+		if errors.Is(err, storage.ErrStreamLimitExceeded) {
+			log.Warn("concurrent stream limit exceeded", zap.Int("max_streams", maxStreams))
+			return models.StreamSession{}, fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("failed to start stream session", zap.Error(err))
+		return models.StreamSession{}, fmt.Errorf("%s: %w", op, err)
+	}
+	for _, d := range displaced {
+		log.Info("stream session displaced", zap.String("displaced_device", d.DeviceAddress))
+	}
+
+	return session, nil
+}
+
+// Heartbeat keeps the session alive. A revoked session gets ErrRevoked with the session
+// carrying the reason, the player must stop
+func (s *Streams) Heartbeat(
+	ctx context.Context,
+	email string,
+	id string,
+) (models.StreamSession, error) {
+	const op = "Streams.Heartbeat"
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	session, err := s.streams.HeartbeatStreamSession(ctx, email, id, s.policy.Timeout)
+	if err != nil {
+		if !errors.Is(err, storage.ErrStreamNotFound) {
+			s.log.Error("failed to heartbeat stream session", zap.String("op", op), zap.Error(err))
+		}
+		return models.StreamSession{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if session.Revoked() {
+		return session, fmt.Errorf("%s: %w", op, ErrRevoked)
+	}
+
+	return session, nil
+}
+
+// Stop ends the session, its place is free for another stream at once
+func (s *Streams) Stop(
+	ctx context.Context,
+	email string,
+	id string,
+) error {
+	const op = "Streams.Stop"
+
+	ctx, cancel := context.WithTimeout(ctx, queryTime)
+	defer cancel()
+	if err := s.streams.DeleteStreamSession(ctx, email, id); err != nil {
+		if !errors.Is(err, storage.ErrStreamNotFound) {
+			s.log.Error("failed to stop stream session", zap.String("op", op), zap.Error(err))
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,146 @@
+package streams
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/logger"
+	"vieo/auth/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+// recordingStreams records the limits the service asks for and answers with the sessions it is given
+type recordingStreams struct {
+	maxStreams int
+	kickOldest bool
+	timeout    time.Duration
+	err        error
+	heartbeat  models.StreamSession
+}
+
+func (r *recordingStreams) StartStreamSession(_ context.Context, _ string, id string, deviceAddress string, maxStreams int, kickOldest bool, timeout time.Duration) (models.StreamSession, []models.StreamSession, error) {
+	r.maxStreams, r.kickOldest, r.timeout = maxStreams, kickOldest, timeout
+	if r.err != nil {
+		return models.StreamSession{}, nil, r.err
+	}
+	return models.StreamSession{ID: id, DeviceAddress: deviceAddress}, nil, nil
+}
+
+func (r *recordingStreams) HeartbeatStreamSession(_ context.Context, _ string, id string, timeout time.Duration) (models.StreamSession, error) {
+	r.timeout = timeout
+	if r.err != nil {
+		return models.StreamSession{}, r.err
+	}
+	return r.heartbeat, nil
+}
+
+func (r *recordingStreams) DeleteStreamSession(context.Context, string, string) error {
+	return r.err
+}
+
+var policy = Policy{MaxStreams: 1, KickOldest: true, Timeout: 90 * time.Second}
+
+func newStreams(store *recordingStreams) *Streams {
+	return New(&logger.Logger{SugaredLogger: zap.NewNop().Sugar()}, store, policy)
+}
+
+func TestStartLimits(t *testing.T) {
+	tests := []struct {
+		name           string
+		entitlements   models.Entitlements
+		wantMaxStreams int
+	}{
+		{name: "without a plan", wantMaxStreams: 1},
+		{name: "plan limit", entitlements: models.Entitlements{Plan: "family", MaxStreams: 4}, wantMaxStreams: 4},
+		{name: "unlimited plan", entitlements: models.Entitlements{Plan: "premium"}, wantMaxStreams: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &recordingStreams{}
+
+			session, err := newStreams(store).Start(context.Background(), "alice@example.com", "tv", tt.entitlements)
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			if session.ID == "" || session.DeviceAddress != "tv" {
+				t.Errorf("session = %+v, want a new session of the tv", session)
+			}
+			if store.maxStreams != tt.wantMaxStreams || !store.kickOldest || store.timeout != policy.Timeout {
+				t.Errorf("started with %d, %v, %s, want %d streams of the policy", store.maxStreams, store.kickOldest, store.timeout, tt.wantMaxStreams)
+			}
+		})
+	}
+}
+
+func TestStartIDsAreUnique(t *testing.T) {
+	s := newStreams(&recordingStreams{})
+
+	a, errA := s.Start(context.Background(), "alice@example.com", "tv", models.Entitlements{})
+	b, errB := s.Start(context.Background(), "alice@example.com", "tv", models.Entitlements{})
+	if errA != nil || errB != nil {
+		t.Fatalf("Start: %v, %v", errA, errB)
+	}
+	if a.ID == b.ID {
+		t.Errorf("two sessions share the id %q", a.ID)
+	}
+}
+
+func TestStartOverTheLimit(t *testing.T) {
+	store := &recordingStreams{err: storage.ErrStreamLimitExceeded}
+
+	if _, err := newStreams(store).Start(context.Background(), "alice@example.com", "tv", models.Entitlements{}); !errors.Is(err, storage.ErrStreamLimitExceeded) {
+		t.Errorf("Start error = %v, want %v", err, storage.ErrStreamLimitExceeded)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	revokedAt := time.Now()
+	tests := []struct {
+		name       string
+		session    models.StreamSession
+		err        error
+		wantErr    error
+		wantReason string
+	}{
+		{name: "active", session: models.StreamSession{ID: "a"}},
+		{
+			name:       "displaced",
+			session:    models.StreamSession{ID: "a", RevokedAt: &revokedAt, RevokeReason: models.StreamRevokedDisplaced},
+			wantErr:    ErrRevoked,
+			wantReason: models.StreamRevokedDisplaced,
+		},
+		{
+			name:       "timed out",
+			session:    models.StreamSession{ID: "a", RevokedAt: &revokedAt, RevokeReason: models.StreamRevokedTimeout},
+			wantErr:    ErrRevoked,
+			wantReason: models.StreamRevokedTimeout,
+		},
+		{name: "unknown", err: storage.ErrStreamNotFound, wantErr: storage.ErrStreamNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &recordingStreams{heartbeat: tt.session, err: tt.err}
+
+			session, err := newStreams(store).Heartbeat(context.Background(), "alice@example.com", "a")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Heartbeat error = %v, want %v", err, tt.wantErr)
+			}
+			// the player learns why it has to stop
+			if session.RevokeReason != tt.wantReason {
+				t.Errorf("reason = %q, want %q", session.RevokeReason, tt.wantReason)
+			}
+			if store.timeout != policy.Timeout {
+				t.Errorf("timeout = %s, want %s", store.timeout, policy.Timeout)
+			}
+		})
+	}
+}
+
+func TestHeartbeatInterval(t *testing.T) {
+	if got := newStreams(&recordingStreams{}).HeartbeatInterval(); got != 30*time.Second {
+		t.Errorf("HeartbeatInterval = %s, want a third of the timeout", got)
+	}
+}
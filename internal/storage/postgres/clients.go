@@ -0,0 +1,154 @@
+package postgre
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+
+	"github.com/lib/pq"
+)
+
+const clientColumns = "client_id, name, secret_hash, public_key, scopes, redirect_uris, grant_types, token_ttl_ms, created_at"
+
+type clientRow struct {
+	ID           string         `db:"client_id"`
+	Name         string         `db:"name"`
+	SecretHash   sql.NullString `db:"secret_hash"`
+	PublicKey    sql.NullString `db:"public_key"`
+	Scopes       pq.StringArray `db:"scopes"`
+	RedirectURIs pq.StringArray `db:"redirect_uris"`
+	GrantTypes   pq.StringArray `db:"grant_types"`
+	TokenTTL     int64          `db:"token_ttl_ms"`
+	CreatedAt    time.Time      `db:"created_at"`
+}
+
+func (r clientRow) client() models.Client {
+	return models.Client{
+		ID:           r.ID,
+		Name:         r.Name,
+		SecretHash:   r.SecretHash.String,
+		PublicKey:    r.PublicKey.String,
+		Scopes:       []string(r.Scopes),
+		RedirectURIs: []string(r.RedirectURIs),
+		GrantTypes:   []string(r.GrantTypes),
+		TokenTTL:     time.Duration(r.TokenTTL) * time.Millisecond,
+		CreatedAt:    r.CreatedAt,
+	}
+}
+
+func (s *Storage) SaveClient(
+	ctx context.Context,
+	client models.Client,
+) (models.Client, error) {
+	const op = "storage.postgres.SaveClient"
+
+	var row clientRow
+	err := s.db.GetContext(
+		ctx,
+		&row,
+		`INSERT INTO oauth_clients (tenant_id, client_id, name, secret_hash, public_key, scopes, redirect_uris, grant_types, token_ttl_ms)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6, $7, $8, $9)
+		RETURNING `+clientColumns,
+		tenant.ID(ctx),
+		client.ID,
+		client.Name,
+		client.SecretHash,
+		client.PublicKey,
+		pq.StringArray(client.Scopes),
+		pq.StringArray(client.RedirectURIs),
+		pq.StringArray(client.GrantTypes),
+		client.TokenTTL.Milliseconds(),
+	)
+	if err != nil {
+		return models.Client{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return row.client(), nil
+}
+
+func (s *Storage) Client(
+	ctx context.Context,
+	clientID string,
+) (models.Client, error) {
+	const op = "storage.postgres.Client"
+
+	var row clientRow
+	err := s.db.GetContext(
+		ctx,
+		&row,
+		`SELECT `+clientColumns+` FROM oauth_clients WHERE tenant_id = $1 AND client_id = $2`,
+		tenant.ID(ctx),
+		clientID,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Client{}, fmt.Errorf("%s: %w", op, storage.ErrClientNotFound)
+		}
+		return models.Client{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return row.client(), nil
+}
+
+func (s *Storage) DeleteClient(
+	ctx context.Context,
+	clientID string,
+) error {
+	const op = "storage.postgres.DeleteClient"
+
+	res, err := s.db.ExecContext(
+		ctx,
+		`DELETE FROM oauth_clients WHERE tenant_id = $1 AND client_id = $2`,
+		tenant.ID(ctx),
+		clientID,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrClientNotFound)
+	}
+
+	return nil
+}
+
+// SaveClientAssertion records the jti of an assertion the client authenticated with until it expires.
+// A jti seen before is ErrClientAssertionReplayed
+func (s *Storage) SaveClientAssertion(
+	ctx context.Context,
+	clientID string,
+	jti string,
+	expiresAt time.Time,
+) error {
+	const op = "storage.postgres.SaveClientAssertion"
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM client_assertions WHERE expires_at < now()"); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	res, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO client_assertions (tenant_id, client_id, jti, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT DO NOTHING`,
+		tenant.ID(ctx),
+		clientID,
+		jti,
+		expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrClientAssertionReplayed)
+	}
+
+	return nil
+}
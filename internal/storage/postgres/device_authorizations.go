@@ -0,0 +1,215 @@
+package postgre
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+
+	"github.com/lib/pq"
+)
+
+type deviceAuthorizationRow struct {
+	ClientID      string         `db:"client_id"`
+	DeviceAddress string         `db:"device_address"`
+	UserCode      string         `db:"user_code"`
+	Scopes        pq.StringArray `db:"scopes"`
+	Status        string         `db:"status"`
+	Email         sql.NullString `db:"email"`
+	Interval      int64          `db:"interval_ms"`
+	ExpiresAt     time.Time      `db:"expires_at"`
+}
+
+func (r deviceAuthorizationRow) authorization() models.DeviceAuthorization {
+	return models.DeviceAuthorization{
+		ClientID:      r.ClientID,
+		DeviceAddress: r.DeviceAddress,
+		UserCode:      r.UserCode,
+		Scopes:        []string(r.Scopes),
+		Status:        r.Status,
+		Email:         r.Email.String,
+		Interval:      time.Duration(r.Interval) * time.Millisecond,
+		ExpiresAt:     r.ExpiresAt,
+	}
+}
+
+// SaveDeviceAuthorization stores a pending authorization, expired ones are dropped on the way.
+// ErrUserCodeAlreadyExists means the user code collided and another one must be tried
+func (s *Storage) SaveDeviceAuthorization(
+	ctx context.Context,
+	deviceCodeHash string,
+	auth models.DeviceAuthorization,
+	ttl time.Duration,
+) error {
+	const op = "storage.postgres.SaveDeviceAuthorization"
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM device_authorizations WHERE expires_at < now()"); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO device_authorizations
+			(device_code_hash, tenant_id, user_code, client_id, device_address, scopes, interval_ms, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, now() + $8 * INTERVAL '1 millisecond')`,
+		deviceCodeHash,
+		tenant.ID(ctx),
+		auth.UserCode,
+		auth.ClientID,
+		auth.DeviceAddress,
+		pq.StringArray(auth.Scopes),
+		auth.Interval.Milliseconds(),
+		ttl.Milliseconds(),
+	)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return fmt.Errorf("%s: %w", op, storage.ErrUserCodeAlreadyExists)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// DeviceAuthorization returns the pending authorization of the user code
+func (s *Storage) DeviceAuthorization(
+	ctx context.Context,
+	userCode string,
+) (models.DeviceAuthorization, error) {
+	const op = "storage.postgres.DeviceAuthorization"
+
+	var row deviceAuthorizationRow
+	err := s.db.GetContext(
+		ctx,
+		&row,
+		`SELECT d.client_id, d.device_address, d.user_code, d.scopes, d.status, u.email, d.interval_ms, d.expires_at
+		FROM device_authorizations d LEFT JOIN users u ON u.id = d.user_id
+		WHERE d.user_code = $1 AND d.tenant_id = $2 AND d.status = 'pending' AND d.expires_at > now()`,
+		userCode,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.DeviceAuthorization{}, fmt.Errorf("%s: %w", op, storage.ErrDeviceCodeNotFound)
+		}
+		return models.DeviceAuthorization{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return row.authorization(), nil
+}
+
+// DecideDeviceAuthorization records the decision of the user on a pending authorization
+func (s *Storage) DecideDeviceAuthorization(
+	ctx context.Context,
+	userCode string,
+	email string,
+	approved bool,
+) error {
+	const op = "storage.postgres.DecideDeviceAuthorization"
+
+	decision := models.DeviceAuthorizationDenied
+	if approved {
+		decision = models.DeviceAuthorizationApproved
+	}
+	res, err := s.db.ExecContext(
+		ctx,
+		`UPDATE device_authorizations d SET status = $3, user_id = u.id
+		FROM users u
+		WHERE d.user_code = $1 AND d.tenant_id = $2 AND d.status = 'pending' AND d.expires_at > now()
+			AND u.email = $4 AND u.tenant_id = d.tenant_id`,
+		userCode,
+		tenant.ID(ctx),
+		decision,
+		email,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrDeviceCodeNotFound)
+	}
+
+	return nil
+}
+
+// PollDeviceAuthorization returns the authorization of the client's device code and remembers the poll.
+// slowDown is true when the device polled sooner than the interval, the interval then grows by step
+func (s *Storage) PollDeviceAuthorization(
+	ctx context.Context,
+	clientID string,
+	deviceCodeHash string,
+	step time.Duration,
+) (auth models.DeviceAuthorization, slowDown bool, err error) {
+	const op = "storage.postgres.PollDeviceAuthorization"
+
+	var row struct {
+		deviceAuthorizationRow
+		SlowDown bool `db:"slow_down"`
+	}
+	err = s.db.GetContext(
+		ctx,
+		&row,
+		`WITH prev AS (
+			SELECT device_code_hash, last_polled_at, interval_ms FROM device_authorizations
+			WHERE device_code_hash = $1 AND tenant_id = $2 AND client_id = $3
+			FOR UPDATE
+		), too_soon AS (
+			SELECT device_code_hash, interval_ms,
+				COALESCE(last_polled_at > now() - interval_ms * INTERVAL '1 millisecond', FALSE) AS slow_down
+			FROM prev
+		)
+		UPDATE device_authorizations d
+		SET last_polled_at = now(),
+			interval_ms = CASE WHEN t.slow_down THEN t.interval_ms + $4 ELSE t.interval_ms END
+		FROM too_soon t
+		WHERE d.device_code_hash = t.device_code_hash
+		RETURNING d.client_id, d.device_address, d.user_code, d.scopes, d.status,
+			(SELECT email FROM users WHERE id = d.user_id) AS email, d.interval_ms, d.expires_at, t.slow_down`,
+		deviceCodeHash,
+		tenant.ID(ctx),
+		clientID,
+		step.Milliseconds(),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.DeviceAuthorization{}, false, fmt.Errorf("%s: %w", op, storage.ErrDeviceCodeNotFound)
+		}
+		return models.DeviceAuthorization{}, false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return row.authorization(), row.SlowDown, nil
+}
+
+// DeleteDeviceAuthorization removes the authorization once it was answered, false means
+// a concurrent poll already took it
+func (s *Storage) DeleteDeviceAuthorization(
+	ctx context.Context,
+	deviceCodeHash string,
+) (bool, error) {
+	const op = "storage.postgres.DeleteDeviceAuthorization"
+
+	res, err := s.db.ExecContext(
+		ctx,
+		"DELETE FROM device_authorizations WHERE device_code_hash = $1 AND tenant_id = $2",
+		deviceCodeHash,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return n > 0, nil
+}
@@ -0,0 +1,84 @@
+package postgre
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/tenant"
+)
+
+func (s *Storage) SaveSecurityEvent(
+	ctx context.Context,
+	event models.SecurityEvent,
+) error {
+	const op = "storage.postgres.SaveSecurityEvent"
+
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO login_events (email, event_type, ip, device, user_agent, reason, tenant_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		event.Email,
+		event.Type,
+		event.IP,
+		event.Device,
+		event.UserAgent,
+		event.Reason,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// SecurityEvents returns up to limit events of the user, newest first.
+// If beforeID is positive, only events older than it are returned
+func (s *Storage) SecurityEvents(
+	ctx context.Context,
+	email string,
+	beforeID int64,
+	limit int,
+) ([]models.SecurityEvent, error) {
+	const op = "storage.postgres.SecurityEvents"
+
+	events := make([]models.SecurityEvent, 0, limit)
+	err := s.db.SelectContext(
+		ctx,
+		&events,
+		`SELECT id, email, event_type, ip, device, user_agent, reason, created_at FROM login_events
+		WHERE email = $1 AND tenant_id = $4 AND ($2 <= 0 OR id < $2)
+		ORDER BY id DESC
+		LIMIT $3`,
+		email,
+		beforeID,
+		limit,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return events, nil
+}
+
+// DeleteSecurityEvents removes events created before the given time and returns how many were removed
+func (s *Storage) DeleteSecurityEvents(
+	ctx context.Context,
+	before time.Time,
+) (int64, error) {
+	const op = "storage.postgres.DeleteSecurityEvents"
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM login_events WHERE created_at < $1", before)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return n, nil
+}
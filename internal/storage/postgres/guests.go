@@ -0,0 +1,184 @@
+package postgre
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+)
+
+type guestRow struct {
+	ID            string    `db:"id"`
+	DeviceAddress string    `db:"device_address"`
+	Metadata      []byte    `db:"metadata"`
+	CreatedAt     time.Time `db:"created_at"`
+}
+
+func (r guestRow) toModel() (models.Guest, error) {
+	guest := models.Guest{
+		ID:            r.ID,
+		DeviceAddress: r.DeviceAddress,
+		CreatedAt:     r.CreatedAt,
+	}
+	if err := json.Unmarshal(r.Metadata, &guest.Metadata); err != nil {
+		return models.Guest{}, err
+	}
+	return guest, nil
+}
+
+// SaveGuest creates the guest or, for a known one of the same device, merges the metadata into it
+// and keeps it for another retain period. The merged metadata may hold maxKeys keys, a guest
+// already full gets ErrGuestMetadataFull. Guests unseen for retain are removed
+func (s *Storage) SaveGuest(
+	ctx context.Context,
+	guest models.Guest,
+	retain time.Duration,
+	maxKeys int,
+) (models.Guest, error) {
+	const op = "storage.postgres.SaveGuest"
+
+	metadata, err := json.Marshal(nonNilMetadata(guest.Metadata))
+	if err != nil {
+		return models.Guest{}, fmt.Errorf("%s: %w", op, err)
+	}
+	_, err = s.db.ExecContext(
+		ctx,
+		"DELETE FROM guests WHERE last_seen_at < now() - $1 * INTERVAL '1 millisecond'",
+		retain.Milliseconds(),
+	)
+	if err != nil {
+		return models.Guest{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var row guestRow
+	err = s.db.GetContext(
+		ctx,
+		&row,
+		`INSERT INTO guests (id, tenant_id, device_address, metadata) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO UPDATE SET last_seen_at = now(), metadata = guests.metadata || EXCLUDED.metadata
+		WHERE guests.tenant_id = EXCLUDED.tenant_id AND guests.device_address = EXCLUDED.device_address
+			AND (SELECT COUNT(*) FROM jsonb_object_keys(guests.metadata || EXCLUDED.metadata)) <= $5
+		RETURNING id, device_address, metadata, created_at`,
+		guest.ID,
+		tenant.ID(ctx),
+		guest.DeviceAddress,
+		string(metadata),
+		maxKeys,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Guest{}, fmt.Errorf("%s: %w", op, s.guestConflict(ctx, guest))
+		}
+		return models.Guest{}, fmt.Errorf("%s: %w", op, err)
+	}
+	saved, err := row.toModel()
+	if err != nil {
+		return models.Guest{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return saved, nil
+}
+
+// guestConflict tells why the upsert of SaveGuest changed no row: the guest of the device is full,
+// or the id is taken by a guest of another device or tenant
+func (s *Storage) guestConflict(ctx context.Context, guest models.Guest) error {
+	var full bool
+	err := s.db.GetContext(
+		ctx,
+		&full,
+		"SELECT EXISTS (SELECT 1 FROM guests WHERE id = $1 AND tenant_id = $2 AND device_address = $3)",
+		guest.ID,
+		tenant.ID(ctx),
+		guest.DeviceAddress,
+	)
+	if err != nil {
+		return err
+	}
+	if full {
+		return storage.ErrGuestMetadataFull
+	}
+	return storage.ErrGuestNotFound
+}
+
+// MergeGuest moves the metadata and the device of the guest into the account and removes the guest,
+// the values the account already has win. Created reports whether the device is new to the account,
+// a device over the limit keeps the guest
+func (s *Storage) MergeGuest(
+	ctx context.Context,
+	email string,
+	guestID string,
+) (guest models.Guest, created bool, err error) {
+	const op = "storage.postgres.MergeGuest"
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return models.Guest{}, false, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	var row guestRow
+	err = tx.GetContext(
+		ctx,
+		&row,
+		`DELETE FROM guests WHERE id = $1 AND tenant_id = $2
+		RETURNING id, device_address, metadata, created_at`,
+		guestID,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Guest{}, false, fmt.Errorf("%s: %w", op, storage.ErrGuestNotFound)
+		}
+		return models.Guest{}, false, fmt.Errorf("%s: %w", op, err)
+	}
+	res, err := tx.ExecContext(
+		ctx,
+		"UPDATE users SET metadata = $1::JSONB || metadata WHERE email = $2 AND tenant_id = $3",
+		string(row.Metadata),
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return models.Guest{}, false, fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.Guest{}, false, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+	res, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO devices (email, device_name, tenant_id) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		email,
+		row.DeviceAddress,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		if limitErr := deviceLimitError(email, err); limitErr != nil {
+			return models.Guest{}, false, fmt.Errorf("%s: %w", op, limitErr)
+		}
+		return models.Guest{}, false, fmt.Errorf("%s: %w", op, err)
+	}
+	n, _ := res.RowsAffected()
+	created = n > 0
+
+	if err := tx.Commit(); err != nil {
+		return models.Guest{}, false, fmt.Errorf("%s: %w", op, err)
+	}
+	guest, err = row.toModel()
+	if err != nil {
+		return models.Guest{}, false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return guest, created, nil
+}
+
+func nonNilMetadata(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+	return m
+}
@@ -0,0 +1,115 @@
+package postgre
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+)
+
+const guestRetention = time.Hour
+
+func TestMergeGuest(t *testing.T) {
+	s := testStorage(t)
+	ctx := tenantContext("guests")
+	if _, err := s.SaveUser(ctx, "alice@example.com", []byte("hash")); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+	if _, err := s.db.Exec(
+		`UPDATE users SET metadata = '{"lang": "fr"}' WHERE email = $1 AND tenant_id = $2`,
+		"alice@example.com", tenant.ID(ctx),
+	); err != nil {
+		t.Fatalf("set metadata: %v", err)
+	}
+	id := "guest-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	_, err := s.SaveGuest(ctx, models.Guest{
+		ID:            id,
+		DeviceAddress: "tv",
+		Metadata:      map[string]string{"lang": "en", "watchlist": "42"},
+	}, guestRetention, 32)
+	if err != nil {
+		t.Fatalf("SaveGuest: %v", err)
+	}
+
+	guest, created, err := s.MergeGuest(ctx, "alice@example.com", id)
+	if err != nil || !created || guest.DeviceAddress != "tv" {
+		t.Fatalf("MergeGuest = %+v, %v, %v, want the tv created", guest, created, err)
+	}
+	var raw []byte
+	if err := s.db.Get(&raw, "SELECT metadata FROM users WHERE email = $1 AND tenant_id = $2", "alice@example.com", tenant.ID(ctx)); err != nil {
+		t.Fatalf("read metadata: %v", err)
+	}
+	var metadata map[string]string
+	if err := json.Unmarshal(raw, &metadata); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	// the values the account already has win over the guest's
+	if metadata["lang"] != "fr" || metadata["watchlist"] != "42" {
+		t.Errorf("metadata = %v, want the lang of the account and the watchlist of the guest", metadata)
+	}
+	if err := s.Device(ctx, "alice@example.com", "tv"); err != nil {
+		t.Errorf("Device of the merged guest: %v", err)
+	}
+	if _, _, err := s.MergeGuest(ctx, "alice@example.com", id); !errors.Is(err, storage.ErrGuestNotFound) {
+		t.Errorf("second MergeGuest error = %v, want %v", err, storage.ErrGuestNotFound)
+	}
+}
+
+func TestMergeGuestOverTheDeviceLimit(t *testing.T) {
+	s := testStorage(t)
+	ctx := tenantContext("guests")
+	if _, err := s.SaveUser(ctx, "alice@example.com", []byte("hash")); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+	for i := range 5 {
+		if _, err := s.SaveDevice(ctx, "alice@example.com", "device-"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("SaveDevice: %v", err)
+		}
+	}
+	id := "guest-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if _, err := s.SaveGuest(ctx, models.Guest{ID: id, DeviceAddress: "tv"}, guestRetention, 32); err != nil {
+		t.Fatalf("SaveGuest: %v", err)
+	}
+
+	if _, _, err := s.MergeGuest(ctx, "alice@example.com", id); !errors.Is(err, storage.ErrDeviceLimitExceeded) {
+		t.Fatalf("MergeGuest error = %v, want %v", err, storage.ErrDeviceLimitExceeded)
+	}
+	// nothing of the merge is kept, the guest may merge once a device is removed
+	if err := s.DeleteDevice(ctx, "alice@example.com", "device-0"); err != nil {
+		t.Fatalf("DeleteDevice: %v", err)
+	}
+	if _, created, err := s.MergeGuest(ctx, "alice@example.com", id); err != nil || !created {
+		t.Errorf("MergeGuest after a device was removed = %v, %v, want the tv created", created, err)
+	}
+}
+
+func TestSaveGuest(t *testing.T) {
+	s := testStorage(t)
+	ctx := tenantContext("guests")
+	id := "guest-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	save := func(device string, metadata map[string]string) (models.Guest, error) {
+		return s.SaveGuest(ctx, models.Guest{ID: id, DeviceAddress: device, Metadata: metadata}, guestRetention, 2)
+	}
+
+	if _, err := save("tv", map[string]string{"lang": "en"}); err != nil {
+		t.Fatalf("SaveGuest: %v", err)
+	}
+	guest, err := save("tv", map[string]string{"watchlist": "42"})
+	if err != nil || len(guest.Metadata) != 2 {
+		t.Fatalf("SaveGuest = %+v, %v, want both keys", guest, err)
+	}
+	if _, err := save("tv", map[string]string{"theme": "dark"}); !errors.Is(err, storage.ErrGuestMetadataFull) {
+		t.Errorf("SaveGuest over maxKeys error = %v, want %v", err, storage.ErrGuestMetadataFull)
+	}
+	// a key already held is replaced, the guest is not fuller
+	if _, err := save("tv", map[string]string{"lang": "fr"}); err != nil {
+		t.Errorf("SaveGuest of a known key: %v", err)
+	}
+	if _, err := save("phone", nil); !errors.Is(err, storage.ErrGuestNotFound) {
+		t.Errorf("SaveGuest from another device error = %v, want %v", err, storage.ErrGuestNotFound)
+	}
+}
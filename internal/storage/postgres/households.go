@@ -0,0 +1,257 @@
+package postgre
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+
+	"github.com/lib/pq"
+)
+
+const householdColumns = "h.id, o.email AS owner_email, h.max_members, h.max_devices, h.created_at"
+
+// CreateHousehold creates the household with the user as its active owner
+func (s *Storage) CreateHousehold(
+	ctx context.Context,
+	ownerEmail string,
+	maxMembers int,
+	maxDevices int,
+) (models.Household, error) {
+	const op = "storage.postgres.CreateHousehold"
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return models.Household{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	var household models.Household
+	err = tx.GetContext(
+		ctx,
+		&household,
+		`INSERT INTO households (tenant_id, owner_id, max_members, max_devices)
+		SELECT tenant_id, id, $3, $4 FROM users WHERE email = $1 AND tenant_id = $2
+		RETURNING id, $1::TEXT AS owner_email, max_members, max_devices, created_at`,
+		ownerEmail,
+		tenant.ID(ctx),
+		maxMembers,
+		maxDevices,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Household{}, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+		return models.Household{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO household_members (household_id, user_id, role, status)
+		SELECT $1, owner_id, 'owner', 'active' FROM households WHERE id = $1`,
+		household.ID,
+	)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return models.Household{}, fmt.Errorf("%s: %w", op, storage.ErrHouseholdAlreadyExists)
+		}
+		return models.Household{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.Household{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return household, nil
+}
+
+// HouseholdOf returns the household the user is an active member of
+func (s *Storage) HouseholdOf(
+	ctx context.Context,
+	email string,
+) (models.Household, error) {
+	const op = "storage.postgres.HouseholdOf"
+
+	var household models.Household
+	err := s.db.GetContext(
+		ctx,
+		&household,
+		`SELECT `+householdColumns+`
+		FROM households h
+		JOIN users o ON o.id = h.owner_id
+		JOIN household_members m ON m.household_id = h.id AND m.status = 'active'
+		JOIN users u ON u.id = m.user_id
+		WHERE u.email = $1 AND u.tenant_id = $2 AND h.tenant_id = $2`,
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Household{}, fmt.Errorf("%s: %w", op, storage.ErrHouseholdNotFound)
+		}
+		return models.Household{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return household, nil
+}
+
+// HouseholdMembers returns the members and the pending invitations of the household
+func (s *Storage) HouseholdMembers(
+	ctx context.Context,
+	householdID int64,
+) ([]models.HouseholdMember, error) {
+	const op = "storage.postgres.HouseholdMembers"
+
+	var members []models.HouseholdMember
+	err := s.db.SelectContext(
+		ctx,
+		&members,
+		`SELECT m.household_id, u.email, m.role, m.status, m.created_at
+		FROM household_members m
+		JOIN households h ON h.id = m.household_id
+		JOIN users u ON u.id = m.user_id
+		WHERE m.household_id = $1 AND h.tenant_id = $2
+		ORDER BY m.created_at`,
+		householdID,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return members, nil
+}
+
+// SaveHouseholdInvitation invites the user unless the household already has max_members besides the owner,
+// invitations count as members
+func (s *Storage) SaveHouseholdInvitation(
+	ctx context.Context,
+	householdID int64,
+	email string,
+) error {
+	const op = "storage.postgres.SaveHouseholdInvitation"
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	var maxMembers int
+	err = tx.GetContext(
+		ctx,
+		&maxMembers,
+		"SELECT max_members FROM households WHERE id = $1 AND tenant_id = $2 FOR UPDATE",
+		householdID,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%s: %w", op, storage.ErrHouseholdNotFound)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if maxMembers > 0 {
+		var count int
+		err = tx.GetContext(
+			ctx,
+			&count,
+			"SELECT count(*) FROM household_members WHERE household_id = $1 AND role = 'member'",
+			householdID,
+		)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		if count >= maxMembers {
+			return fmt.Errorf("%s: %w", op, storage.ErrHouseholdFull)
+		}
+	}
+
+	res, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO household_members (household_id, user_id, role, status)
+		SELECT $1, id, 'member', 'invited' FROM users WHERE email = $2 AND tenant_id = $3`,
+		householdID,
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return fmt.Errorf("%s: %w", op, storage.ErrHouseholdMemberAlreadyExists)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// ActivateHouseholdMember accepts the invitation, it fails for a user already active in another household
+func (s *Storage) ActivateHouseholdMember(
+	ctx context.Context,
+	householdID int64,
+	email string,
+) error {
+	const op = "storage.postgres.ActivateHouseholdMember"
+
+	res, err := s.db.ExecContext(
+		ctx,
+		`UPDATE household_members m SET status = 'active'
+		FROM users u
+		WHERE m.household_id = $1 AND m.user_id = u.id AND m.status = 'invited'
+			AND u.email = $2 AND u.tenant_id = $3`,
+		householdID,
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return fmt.Errorf("%s: %w", op, storage.ErrHouseholdAlreadyExists)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrHouseholdMemberNotFound)
+	}
+
+	return nil
+}
+
+// DeleteHouseholdMember removes a member or an invitation, never the owner
+func (s *Storage) DeleteHouseholdMember(
+	ctx context.Context,
+	householdID int64,
+	email string,
+) error {
+	const op = "storage.postgres.DeleteHouseholdMember"
+
+	res, err := s.db.ExecContext(
+		ctx,
+		`DELETE FROM household_members m USING users u
+		WHERE m.household_id = $1 AND m.user_id = u.id AND m.role = 'member'
+			AND u.email = $2 AND u.tenant_id = $3`,
+		householdID,
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrHouseholdMemberNotFound)
+	}
+
+	return nil
+}
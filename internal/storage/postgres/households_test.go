@@ -0,0 +1,80 @@
+package postgre
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"vieo/auth/internal/storage"
+)
+
+// household creates the users and a household of owner with member active in it
+func household(t *testing.T, s *Storage, ctx context.Context, owner, member string, maxDevices int) int64 {
+	t.Helper()
+
+	for _, email := range []string{owner, member} {
+		if _, err := s.SaveUser(ctx, email, []byte("hash")); err != nil {
+			t.Fatalf("SaveUser %s: %v", email, err)
+		}
+	}
+	h, err := s.CreateHousehold(ctx, owner, 0, maxDevices)
+	if err != nil {
+		t.Fatalf("CreateHousehold: %v", err)
+	}
+	if err := s.SaveHouseholdInvitation(ctx, h.ID, member); err != nil {
+		t.Fatalf("SaveHouseholdInvitation: %v", err)
+	}
+	if err := s.ActivateHouseholdMember(ctx, h.ID, member); err != nil {
+		t.Fatalf("ActivateHouseholdMember: %v", err)
+	}
+	return h.ID
+}
+
+func TestHouseholdDeviceLimit(t *testing.T) {
+	s := testStorage(t)
+	ctx := tenantContext("households")
+	household(t, s, ctx, "owner@example.com", "member@example.com", 3)
+
+	for _, d := range []struct{ email, device string }{
+		{"owner@example.com", "tv"},
+		{"owner@example.com", "phone"},
+		{"member@example.com", "tablet"},
+	} {
+		if _, err := s.SaveDevice(ctx, d.email, d.device); err != nil {
+			t.Fatalf("SaveDevice %s of %s: %v", d.device, d.email, err)
+		}
+	}
+
+	// the devices of all the members count against the household, each has only a few of its own
+	if _, err := s.SaveDevice(ctx, "member@example.com", "laptop"); !errors.Is(err, storage.ErrHouseholdDeviceLimitExceeded) {
+		t.Errorf("SaveDevice over the household limit error = %v, want %v", err, storage.ErrHouseholdDeviceLimitExceeded)
+	}
+	// a device already known is not a new one
+	if created, err := s.SaveDevice(ctx, "member@example.com", "tablet"); err != nil || created {
+		t.Errorf("SaveDevice of a known device = %v, %v, want not created", created, err)
+	}
+
+	if err := s.DeleteDevice(ctx, "owner@example.com", "phone"); err != nil {
+		t.Fatalf("DeleteDevice: %v", err)
+	}
+	if _, err := s.SaveDevice(ctx, "member@example.com", "laptop"); err != nil {
+		t.Errorf("SaveDevice after a device was removed: %v", err)
+	}
+}
+
+func TestHouseholdDeviceLimitLeavesOthersAlone(t *testing.T) {
+	s := testStorage(t)
+	ctx := tenantContext("households")
+	household(t, s, ctx, "owner@example.com", "member@example.com", 1)
+	if _, err := s.SaveUser(ctx, "single@example.com", []byte("hash")); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+
+	if _, err := s.SaveDevice(ctx, "owner@example.com", "tv"); err != nil {
+		t.Fatalf("SaveDevice: %v", err)
+	}
+	for _, device := range []string{"tv", "phone"} {
+		if _, err := s.SaveDevice(ctx, "single@example.com", device); err != nil {
+			t.Errorf("SaveDevice %s of a user without a household: %v", device, err)
+		}
+	}
+}
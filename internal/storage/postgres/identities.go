@@ -0,0 +1,240 @@
+package postgre
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// SaveSocialLogin stores the sign in started at a provider for ttl, expired ones are removed
+func (s *Storage) SaveSocialLogin(
+	ctx context.Context,
+	login models.SocialLogin,
+	ttl time.Duration,
+) error {
+	const op = "storage.postgres.SaveSocialLogin"
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM social_logins WHERE expires_at < now()"); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO social_logins
+		(state_hash, tenant_id, provider, nonce, code_verifier, device_address, link_email, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, now() + $8 * INTERVAL '1 millisecond')`,
+		login.StateHash,
+		tenant.ID(ctx),
+		login.Provider,
+		login.Nonce,
+		login.CodeVerifier,
+		login.DeviceAddress,
+		login.LinkEmail,
+		ttl.Milliseconds(),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// ConsumeSocialLogin removes and returns the unexpired sign in of the state, a state is used once
+func (s *Storage) ConsumeSocialLogin(
+	ctx context.Context,
+	stateHash string,
+) (models.SocialLogin, error) {
+	const op = "storage.postgres.ConsumeSocialLogin"
+
+	var login models.SocialLogin
+	err := s.db.GetContext(
+		ctx,
+		&login,
+		`DELETE FROM social_logins WHERE state_hash = $1 AND tenant_id = $2 AND expires_at > now()
+		RETURNING state_hash, provider, nonce, code_verifier, device_address, link_email, expires_at`,
+		stateHash,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.SocialLogin{}, fmt.Errorf("%s: %w", op, storage.ErrSocialLoginNotFound)
+		}
+		return models.SocialLogin{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return login, nil
+}
+
+// IdentityUser returns the email of the user the identity is linked to
+func (s *Storage) IdentityUser(
+	ctx context.Context,
+	provider string,
+	subject string,
+) (string, error) {
+	const op = "storage.postgres.IdentityUser"
+
+	var email string
+	err := s.db.GetContext(
+		ctx,
+		&email,
+		`SELECT u.email FROM user_identities i JOIN users u ON u.id = i.user_id
+		WHERE i.tenant_id = $1 AND i.provider = $2 AND i.subject = $3`,
+		tenant.ID(ctx),
+		provider,
+		subject,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("%s: %w", op, storage.ErrIdentityNotFound)
+		}
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return email, nil
+}
+
+// SaveIdentity links the identity to the user, ErrIdentityAlreadyLinked is returned when it is linked
+// to anyone or the user already has one of the provider
+func (s *Storage) SaveIdentity(
+	ctx context.Context,
+	email string,
+	identity models.Identity,
+) (models.Identity, error) {
+	const op = "storage.postgres.SaveIdentity"
+
+	saved, err := saveIdentity(ctx, s.db, email, identity)
+	if err != nil {
+		return models.Identity{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return saved, nil
+}
+
+// SaveUserWithIdentity creates the user signed up with an identity, with a password nobody knows
+func (s *Storage) SaveUserWithIdentity(
+	ctx context.Context,
+	email string,
+	passHash []byte,
+	identity models.Identity,
+) (models.Identity, error) {
+	const op = "storage.postgres.SaveUserWithIdentity"
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return models.Identity{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO users (email, password, tenant_id) VALUES ($1, $2, $3)",
+		email,
+		passHash,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return models.Identity{}, fmt.Errorf("%s: %w", op, storage.ErrUserAlreadyExists)
+		}
+		return models.Identity{}, fmt.Errorf("%s: %w", op, err)
+	}
+	saved, err := saveIdentity(ctx, tx, email, identity)
+	if err != nil {
+		return models.Identity{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.Identity{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return saved, nil
+}
+
+// Identities returns the identities linked to the user
+func (s *Storage) Identities(
+	ctx context.Context,
+	email string,
+) ([]models.Identity, error) {
+	const op = "storage.postgres.Identities"
+
+	var identities []models.Identity
+	err := s.db.SelectContext(
+		ctx,
+		&identities,
+		`SELECT i.id, i.provider, i.subject, i.email, i.created_at
+		FROM user_identities i JOIN users u ON u.id = i.user_id
+		WHERE u.email = $1 AND u.tenant_id = $2
+		ORDER BY i.created_at`,
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return identities, nil
+}
+
+// DeleteIdentity unlinks the identity of the provider from the user
+func (s *Storage) DeleteIdentity(
+	ctx context.Context,
+	email string,
+	provider string,
+) error {
+	const op = "storage.postgres.DeleteIdentity"
+
+	res, err := s.db.ExecContext(
+		ctx,
+		`DELETE FROM user_identities i USING users u
+		WHERE i.user_id = u.id AND u.email = $1 AND u.tenant_id = $2 AND i.provider = $3`,
+		email,
+		tenant.ID(ctx),
+		provider,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrIdentityNotFound)
+	}
+
+	return nil
+}
+
+// saveIdentity links the identity inside or outside of a transaction
+func saveIdentity(ctx context.Context, q sqlx.QueryerContext, email string, identity models.Identity) (models.Identity, error) {
+	var saved models.Identity
+	err := sqlx.GetContext(
+		ctx,
+		q,
+		&saved,
+		`INSERT INTO user_identities (user_id, tenant_id, provider, subject, email)
+		SELECT id, tenant_id, $3, $4, $5 FROM users WHERE email = $1 AND tenant_id = $2
+		RETURNING id, provider, subject, email, created_at`,
+		email,
+		tenant.ID(ctx),
+		identity.Provider,
+		identity.Subject,
+		identity.Email,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Identity{}, storage.ErrUserNotFound
+		}
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return models.Identity{}, storage.ErrIdentityAlreadyLinked
+		}
+		return models.Identity{}, err
+	}
+
+	return saved, nil
+}
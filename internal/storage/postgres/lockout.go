@@ -0,0 +1,123 @@
+package postgre
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+	"vieo/auth/internal/lib/tenant"
+)
+
+// RegisterLoginFailure increments the failure counter of the account, a counter whose last failure
+// is older than resetAfter starts over
+func (s *Storage) RegisterLoginFailure(
+	ctx context.Context,
+	email string,
+	resetAfter time.Duration,
+) (int, error) {
+	const op = "storage.postgres.RegisterLoginFailure"
+
+	var failures int
+	err := s.db.QueryRowContext(
+		ctx,
+		`INSERT INTO login_failures (email, tenant_id, failures, last_failure) VALUES ($1, $3, 1, now())
+		ON CONFLICT (tenant_id, email) DO UPDATE SET
+			failures = CASE
+				WHEN login_failures.last_failure < now() - $2 * INTERVAL '1 millisecond' THEN 1
+				ELSE login_failures.failures + 1
+			END,
+			last_failure = now()
+		RETURNING failures`,
+		email,
+		resetAfter.Milliseconds(),
+		tenant.ID(ctx),
+	).Scan(&failures)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return failures, nil
+}
+
+// LockAccount locks the account for the duration and returns the end of the lock
+func (s *Storage) LockAccount(
+	ctx context.Context,
+	email string,
+	duration time.Duration,
+) (time.Time, error) {
+	const op = "storage.postgres.LockAccount"
+
+	var lockedUntil time.Time
+	err := s.db.QueryRowContext(
+		ctx,
+		`UPDATE login_failures SET locked_until = now() + $2 * INTERVAL '1 millisecond' WHERE email = $1 AND tenant_id = $3
+		RETURNING locked_until`,
+		email,
+		duration.Milliseconds(),
+		tenant.ID(ctx),
+	).Scan(&lockedUntil)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return lockedUntil, nil
+}
+
+// LockedUntil returns the end of the last lock of the account, zero if it has no failures or was never locked
+func (s *Storage) LockedUntil(
+	ctx context.Context,
+	email string,
+) (time.Time, error) {
+	const op = "storage.postgres.LockedUntil"
+
+	var lockedUntil sql.NullTime
+	err := s.db.QueryRowContext(
+		ctx,
+		"SELECT locked_until FROM login_failures WHERE email = $1 AND tenant_id = $2",
+		email,
+		tenant.ID(ctx),
+	).Scan(&lockedUntil)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return lockedUntil.Time, nil
+}
+
+// LockRemaining returns how long the account stays locked, zero if it is not locked
+func (s *Storage) LockRemaining(
+	ctx context.Context,
+	email string,
+) (time.Duration, error) {
+	const op = "storage.postgres.LockRemaining"
+
+	var ms int64
+	err := s.db.QueryRowContext(
+		ctx,
+		`SELECT COALESCE(MAX(CEIL(EXTRACT(EPOCH FROM (locked_until - now())) * 1000)), 0)::BIGINT
+		FROM login_failures
+		WHERE email = $1 AND tenant_id = $2 AND locked_until > now()`,
+		email,
+		tenant.ID(ctx),
+	).Scan(&ms)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+func (s *Storage) ResetLoginFailures(
+	ctx context.Context,
+	email string,
+) error {
+	const op = "storage.postgres.ResetLoginFailures"
+
+	_, err := s.db.ExecContext(ctx, "DELETE FROM login_failures WHERE email = $1 AND tenant_id = $2", email, tenant.ID(ctx))
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,318 @@
+package postgre
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+
+	"github.com/lib/pq"
+)
+
+// Consent returns the scopes the user allowed the client
+func (s *Storage) Consent(
+	ctx context.Context,
+	email string,
+	clientID string,
+) ([]string, error) {
+	const op = "storage.postgres.Consent"
+
+	var scopes pq.StringArray
+	err := s.db.GetContext(
+		ctx,
+		&scopes,
+		`SELECT c.scopes FROM oauth_consents c JOIN users u ON u.id = c.user_id
+		WHERE u.email = $1 AND u.tenant_id = $2 AND c.client_id = $3`,
+		email,
+		tenant.ID(ctx),
+		clientID,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%s: %w", op, storage.ErrConsentNotFound)
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return []string(scopes), nil
+}
+
+// SaveConsent adds the scopes to the ones the user already allowed the client
+func (s *Storage) SaveConsent(
+	ctx context.Context,
+	email string,
+	clientID string,
+	scopes []string,
+) error {
+	const op = "storage.postgres.SaveConsent"
+
+	res, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO oauth_consents (tenant_id, user_id, client_id, scopes)
+		SELECT tenant_id, id, $3, $4 FROM users WHERE email = $1 AND tenant_id = $2
+		ON CONFLICT (user_id, client_id) DO UPDATE
+		SET scopes = ARRAY(SELECT DISTINCT unnest(oauth_consents.scopes || EXCLUDED.scopes)), updated_at = now()`,
+		email,
+		tenant.ID(ctx),
+		clientID,
+		pq.StringArray(scopes),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+
+	return nil
+}
+
+// SaveAuthorizationCode stores the code by its hash, expired codes that were never redeemed are dropped on the way
+func (s *Storage) SaveAuthorizationCode(
+	ctx context.Context,
+	codeHash string,
+	code models.AuthorizationCode,
+	ttl time.Duration,
+) error {
+	const op = "storage.postgres.SaveAuthorizationCode"
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM oauth_codes WHERE expires_at < now()"); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	res, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO oauth_codes
+			(code_hash, tenant_id, user_id, client_id, redirect_uri, scopes, code_challenge, nonce, auth_time, amr, expires_at)
+		SELECT $1, tenant_id, id, $4, $5, $6, $7, $8, $9, $10, now() + $11 * INTERVAL '1 millisecond'
+		FROM users WHERE email = $2 AND tenant_id = $3`,
+		codeHash,
+		code.Email,
+		tenant.ID(ctx),
+		code.ClientID,
+		code.RedirectURI,
+		pq.StringArray(code.Scopes),
+		code.CodeChallenge,
+		code.Nonce,
+		code.AuthTime,
+		pq.StringArray(code.AMR),
+		ttl.Milliseconds(),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+
+	return nil
+}
+
+// ConsumeAuthorizationCode deletes the code and returns it, so a code is redeemed at most once
+func (s *Storage) ConsumeAuthorizationCode(
+	ctx context.Context,
+	codeHash string,
+) (models.AuthorizationCode, error) {
+	const op = "storage.postgres.ConsumeAuthorizationCode"
+
+	var row struct {
+		Email         string         `db:"email"`
+		ClientID      string         `db:"client_id"`
+		RedirectURI   string         `db:"redirect_uri"`
+		Scopes        pq.StringArray `db:"scopes"`
+		CodeChallenge string         `db:"code_challenge"`
+		Nonce         string         `db:"nonce"`
+		AuthTime      time.Time      `db:"auth_time"`
+		AMR           pq.StringArray `db:"amr"`
+		ExpiresAt     time.Time      `db:"expires_at"`
+	}
+	err := s.db.GetContext(
+		ctx,
+		&row,
+		`DELETE FROM oauth_codes c USING users u
+		WHERE c.code_hash = $1 AND c.tenant_id = $2 AND u.id = c.user_id
+		RETURNING u.email, c.client_id, c.redirect_uri, c.scopes, c.code_challenge, c.nonce, c.auth_time, c.amr, c.expires_at`,
+		codeHash,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.AuthorizationCode{}, fmt.Errorf("%s: %w", op, storage.ErrCodeNotFound)
+		}
+		return models.AuthorizationCode{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if time.Now().After(row.ExpiresAt) {
+		return models.AuthorizationCode{}, fmt.Errorf("%s: %w", op, storage.ErrCodeNotFound)
+	}
+
+	return models.AuthorizationCode{
+		Email:         row.Email,
+		ClientID:      row.ClientID,
+		RedirectURI:   row.RedirectURI,
+		Scopes:        []string(row.Scopes),
+		CodeChallenge: row.CodeChallenge,
+		Nonce:         row.Nonce,
+		AuthTime:      row.AuthTime,
+		AMR:           []string(row.AMR),
+		ExpiresAt:     row.ExpiresAt,
+	}, nil
+}
+
+type refreshRow struct {
+	ID        int64          `db:"id"`
+	FamilyID  int64          `db:"family_id"`
+	Email     string         `db:"email"`
+	ClientID  string         `db:"client_id"`
+	Scopes    pq.StringArray `db:"scopes"`
+	AuthTime  time.Time      `db:"auth_time"`
+	AMR       pq.StringArray `db:"amr"`
+	Device    string         `db:"device_address"`
+	ExpiresAt time.Time      `db:"expires_at"`
+	RevokedAt *time.Time     `db:"revoked_at"`
+}
+
+func (r refreshRow) token() models.RefreshToken {
+	return models.RefreshToken{
+		ID:            r.ID,
+		FamilyID:      r.FamilyID,
+		Email:         r.Email,
+		ClientID:      r.ClientID,
+		Scopes:        []string(r.Scopes),
+		AuthTime:      r.AuthTime,
+		AMR:           []string(r.AMR),
+		DeviceAddress: r.Device,
+		ExpiresAt:     r.ExpiresAt,
+	}
+}
+
+// SaveRefreshToken starts a new family of refresh tokens for the user and the client
+func (s *Storage) SaveRefreshToken(
+	ctx context.Context,
+	tokenHash string,
+	token models.RefreshToken,
+	ttl time.Duration,
+) (models.RefreshToken, error) {
+	const op = "storage.postgres.SaveRefreshToken"
+
+	var row refreshRow
+	err := s.db.GetContext(
+		ctx,
+		&row,
+		`WITH next AS (SELECT nextval(pg_get_serial_sequence('oauth_refresh_tokens', 'id')) AS id)
+		INSERT INTO oauth_refresh_tokens
+			(id, family_id, tenant_id, user_id, client_id, token_hash, scopes, auth_time, amr, device_address, expires_at)
+		SELECT next.id, next.id, u.tenant_id, u.id, $3, $4, $5, $6, $7, $8, now() + $9 * INTERVAL '1 millisecond'
+		FROM next, users u WHERE u.email = $1 AND u.tenant_id = $2
+		RETURNING id, family_id, $1::TEXT AS email, client_id, scopes, auth_time, amr, device_address, expires_at, revoked_at`,
+		token.Email,
+		tenant.ID(ctx),
+		token.ClientID,
+		tokenHash,
+		pq.StringArray(token.Scopes),
+		token.AuthTime,
+		pq.StringArray(token.AMR),
+		token.DeviceAddress,
+		ttl.Milliseconds(),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.RefreshToken{}, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+		return models.RefreshToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return row.token(), nil
+}
+
+// RotateRefreshToken revokes the token of the client and issues its successor in the same family.
+// A token that was already rotated is a sign of theft: the whole family is revoked and ErrTokenReused returned
+func (s *Storage) RotateRefreshToken(
+	ctx context.Context,
+	clientID string,
+	tokenHash string,
+	newTokenHash string,
+	ttl time.Duration,
+) (models.RefreshToken, error) {
+	const op = "storage.postgres.RotateRefreshToken"
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return models.RefreshToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	var old refreshRow
+	err = tx.GetContext(
+		ctx,
+		&old,
+		`SELECT t.id, t.family_id, u.email, t.client_id, t.scopes, t.auth_time, t.amr, t.device_address, t.expires_at, t.revoked_at
+		FROM oauth_refresh_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1 AND t.tenant_id = $2 AND t.client_id = $3
+		FOR UPDATE OF t`,
+		tokenHash,
+		tenant.ID(ctx),
+		clientID,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.RefreshToken{}, fmt.Errorf("%s: %w", op, storage.ErrTokenNotFound)
+		}
+		return models.RefreshToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if old.RevokedAt != nil {
+		_, err = tx.ExecContext(
+			ctx,
+			"UPDATE oauth_refresh_tokens SET revoked_at = now() WHERE family_id = $1 AND revoked_at IS NULL",
+			old.FamilyID,
+		)
+		if err != nil {
+			return models.RefreshToken{}, fmt.Errorf("%s: %w", op, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return models.RefreshToken{}, fmt.Errorf("%s: %w", op, err)
+		}
+		return models.RefreshToken{}, fmt.Errorf("%s: %w", op, storage.ErrTokenReused)
+	}
+	if time.Now().After(old.ExpiresAt) {
+		return models.RefreshToken{}, fmt.Errorf("%s: %w", op, storage.ErrTokenNotFound)
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE oauth_refresh_tokens SET revoked_at = now() WHERE id = $1", old.ID); err != nil {
+		return models.RefreshToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+	var row refreshRow
+	err = tx.GetContext(
+		ctx,
+		&row,
+		`INSERT INTO oauth_refresh_tokens
+			(family_id, tenant_id, user_id, client_id, token_hash, scopes, auth_time, amr, device_address, expires_at)
+		SELECT family_id, tenant_id, user_id, client_id, $2, scopes, auth_time, amr, device_address,
+			now() + $3 * INTERVAL '1 millisecond'
+		FROM oauth_refresh_tokens WHERE id = $1
+		RETURNING id, family_id, $4::TEXT AS email, client_id, scopes, auth_time, amr, device_address, expires_at, revoked_at`,
+		old.ID,
+		newTokenHash,
+		ttl.Milliseconds(),
+		old.Email,
+	)
+	if err != nil {
+		return models.RefreshToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return models.RefreshToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return row.token(), nil
+}
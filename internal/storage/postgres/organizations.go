@@ -0,0 +1,358 @@
+package postgre
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+
+	"github.com/lib/pq"
+)
+
+// CreateOrganization creates the organization with the user as its active owner
+func (s *Storage) CreateOrganization(
+	ctx context.Context,
+	name string,
+	maxDevices int,
+	ownerEmail string,
+) (models.Organization, error) {
+	const op = "storage.postgres.CreateOrganization"
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return models.Organization{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	var org models.Organization
+	err = tx.GetContext(
+		ctx,
+		&org,
+		"INSERT INTO organizations (name, max_devices, tenant_id) VALUES ($1, $2, $3) RETURNING id, name, max_devices, created_at",
+		name,
+		maxDevices,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return models.Organization{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	res, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO memberships (org_id, user_id, role, status)
+		SELECT $1, id, 'owner', 'active' FROM users WHERE email = $2 AND tenant_id = $3`,
+		org.ID,
+		ownerEmail,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return models.Organization{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.Organization{}, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.Organization{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return org, nil
+}
+
+func (s *Storage) Membership(
+	ctx context.Context,
+	orgID int64,
+	email string,
+) (models.Membership, error) {
+	const op = "storage.postgres.Membership"
+
+	var m models.Membership
+	err := s.db.GetContext(
+		ctx,
+		&m,
+		`SELECT m.org_id, o.name AS org_name, u.email, m.role, m.status, m.invited_by, m.created_at
+		FROM memberships m
+		JOIN organizations o ON o.id = m.org_id
+		JOIN users u ON u.id = m.user_id
+		WHERE m.org_id = $1 AND u.email = $2 AND u.tenant_id = $3 AND o.tenant_id = $3`,
+		orgID,
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Membership{}, fmt.Errorf("%s: %w", op, storage.ErrMembershipNotFound)
+		}
+		return models.Membership{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return m, nil
+}
+
+// Memberships returns the organizations of the user, invitations included
+func (s *Storage) Memberships(
+	ctx context.Context,
+	email string,
+) ([]models.Membership, error) {
+	const op = "storage.postgres.Memberships"
+
+	memberships := []models.Membership{}
+	err := s.db.SelectContext(
+		ctx,
+		&memberships,
+		`SELECT m.org_id, o.name AS org_name, u.email, m.role, m.status, m.invited_by, m.created_at
+		FROM memberships m
+		JOIN organizations o ON o.id = m.org_id
+		JOIN users u ON u.id = m.user_id
+		WHERE u.email = $1 AND u.tenant_id = $2 AND o.tenant_id = $2
+		ORDER BY m.org_id`,
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return memberships, nil
+}
+
+// SaveInvitation adds the user to the organization as invited
+func (s *Storage) SaveInvitation(
+	ctx context.Context,
+	orgID int64,
+	email string,
+	role string,
+	invitedBy string,
+) error {
+	const op = "storage.postgres.SaveInvitation"
+
+	var exists bool
+	err := s.db.GetContext(
+		ctx,
+		&exists,
+		"SELECT EXISTS (SELECT 1 FROM organizations WHERE id = $1 AND tenant_id = $2)",
+		orgID,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if !exists {
+		return fmt.Errorf("%s: %w", op, storage.ErrOrganizationNotFound)
+	}
+
+	res, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO memberships (org_id, user_id, role, status, invited_by)
+		SELECT $1, id, $3, 'invited', $4 FROM users WHERE email = $2 AND tenant_id = $5`,
+		orgID,
+		email,
+		role,
+		invitedBy,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) {
+			switch pqErr.Code {
+			case "23505":
+				return fmt.Errorf("%s: %w", op, storage.ErrMembershipAlreadyExists)
+			case "23503":
+				return fmt.Errorf("%s: %w", op, storage.ErrOrganizationNotFound)
+			}
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+
+	return nil
+}
+
+// ActivateMembership accepts the invitation of the user
+func (s *Storage) ActivateMembership(
+	ctx context.Context,
+	orgID int64,
+	email string,
+) error {
+	const op = "storage.postgres.ActivateMembership"
+
+	res, err := s.db.ExecContext(
+		ctx,
+		`UPDATE memberships SET status = 'active'
+		WHERE org_id = $1 AND status = 'invited'
+		AND user_id = (SELECT id FROM users WHERE email = $2 AND tenant_id = $3)`,
+		orgID,
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrMembershipNotFound)
+	}
+
+	return nil
+}
+
+// DeleteMembership removes the user from the organization together with the devices used in it.
+// The last active owner cannot be removed
+func (s *Storage) DeleteMembership(
+	ctx context.Context,
+	orgID int64,
+	email string,
+) error {
+	const op = "storage.postgres.DeleteMembership"
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	// the organization row serializes concurrent removals of owners
+	var locked int64
+	err = tx.GetContext(
+		ctx,
+		&locked,
+		"SELECT id FROM organizations WHERE id = $1 AND tenant_id = $2 FOR UPDATE",
+		orgID,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%s: %w", op, storage.ErrOrganizationNotFound)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	var owners int
+	err = tx.GetContext(
+		ctx,
+		&owners,
+		"SELECT count(*) FROM memberships WHERE org_id = $1 AND role = 'owner' AND status = 'active'",
+		orgID,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	var role, status string
+	err = tx.QueryRowContext(
+		ctx,
+		`DELETE FROM memberships
+		WHERE org_id = $1 AND user_id = (SELECT id FROM users WHERE email = $2 AND tenant_id = $3)
+		RETURNING role, status`,
+		orgID,
+		email,
+		tenant.ID(ctx),
+	).Scan(&role, &status)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%s: %w", op, storage.ErrMembershipNotFound)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if role == models.OrgRoleOwner && status == models.MembershipActive && owners <= 1 {
+		return fmt.Errorf("%s: %w", op, storage.ErrLastOwner)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// SaveOrganizationDevice registers the device of the member in the organization,
+// refusing a new device once the organization has max_devices of them
+func (s *Storage) SaveOrganizationDevice(
+	ctx context.Context,
+	orgID int64,
+	email string,
+	device string,
+) error {
+	const op = "storage.postgres.SaveOrganizationDevice"
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	var maxDevices int
+	err = tx.GetContext(
+		ctx,
+		&maxDevices,
+		"SELECT max_devices FROM organizations WHERE id = $1 AND tenant_id = $2 FOR UPDATE",
+		orgID,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%s: %w", op, storage.ErrOrganizationNotFound)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	var userID int64
+	err = tx.GetContext(ctx, &userID, "SELECT id FROM users WHERE email = $1 AND tenant_id = $2", email, tenant.ID(ctx))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	var known bool
+	err = tx.GetContext(
+		ctx,
+		&known,
+		"SELECT EXISTS (SELECT 1 FROM organization_devices WHERE org_id = $1 AND user_id = $2 AND device_name = $3)",
+		orgID,
+		userID,
+		device,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if known {
+		return nil
+	}
+
+	if maxDevices > 0 {
+		var count int
+		err = tx.GetContext(ctx, &count, "SELECT count(*) FROM organization_devices WHERE org_id = $1", orgID)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		if count >= maxDevices {
+			return fmt.Errorf("%s: %w", op, storage.ErrOrganizationDeviceLimitExceeded)
+		}
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO organization_devices (org_id, user_id, device_name) VALUES ($1, $2, $3)",
+		orgID,
+		userID,
+		device,
+	)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			return fmt.Errorf("%s: %w", op, storage.ErrMembershipNotFound)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
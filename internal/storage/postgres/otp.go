@@ -0,0 +1,95 @@
+package postgre
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+)
+
+func (s *Storage) SaveLoginOTP(
+	ctx context.Context,
+	email string,
+	codeHash string,
+	ttl time.Duration,
+) (bool, error) {
+	const op = "storage.postgres.SaveLoginOTP"
+
+	res, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO login_otps (email, tenant_id, code_hash, attempts, expires_at)
+		VALUES ($1, $4, $2, 0, now() + $3 * INTERVAL '1 millisecond')
+		ON CONFLICT (tenant_id, email) DO UPDATE SET
+			code_hash = EXCLUDED.code_hash,
+			attempts = 0,
+			expires_at = EXCLUDED.expires_at
+		WHERE login_otps.expires_at < now()`,
+		email,
+		codeHash,
+		ttl.Milliseconds(),
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return n > 0, nil
+}
+
+// TakeLoginOTP counts an attempt on the active code, a code that ran out of attempts is removed
+func (s *Storage) TakeLoginOTP(
+	ctx context.Context,
+	email string,
+	maxAttempts int,
+) (string, error) {
+	const op = "storage.postgres.TakeLoginOTP"
+
+	var (
+		codeHash string
+		attempts int
+	)
+	err := s.db.QueryRowContext(
+		ctx,
+		`UPDATE login_otps SET attempts = attempts + 1
+		WHERE email = $1 AND tenant_id = $2 AND expires_at > now()
+		RETURNING code_hash, attempts`,
+		email,
+		tenant.ID(ctx),
+	).Scan(&codeHash, &attempts)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("%s: %w", op, storage.ErrOTPNotFound)
+		}
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	if attempts > maxAttempts {
+		if err := s.DeleteLoginOTP(ctx, email); err != nil {
+			return "", fmt.Errorf("%s: %w", op, err)
+		}
+		return "", fmt.Errorf("%s: %w", op, storage.ErrOTPNotFound)
+	}
+
+	return codeHash, nil
+}
+
+func (s *Storage) DeleteLoginOTP(
+	ctx context.Context,
+	email string,
+) error {
+	const op = "storage.postgres.DeleteLoginOTP"
+
+	_, err := s.db.ExecContext(ctx, "DELETE FROM login_otps WHERE email = $1 AND tenant_id = $2", email, tenant.ID(ctx))
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package postgre
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+
+	"github.com/lib/pq"
+)
+
+type patRow struct {
+	ID         int64          `db:"id"`
+	Email      string         `db:"email"`
+	Name       string         `db:"name"`
+	Prefix     string         `db:"token_prefix"`
+	Scopes     pq.StringArray `db:"scopes"`
+	ExpiresAt  time.Time      `db:"expires_at"`
+	CreatedAt  time.Time      `db:"created_at"`
+	LastUsedAt *time.Time     `db:"last_used_at"`
+}
+
+func (r patRow) token() models.PersonalAccessToken {
+	return models.PersonalAccessToken{
+		ID:         r.ID,
+		Email:      r.Email,
+		Name:       r.Name,
+		Prefix:     r.Prefix,
+		Scopes:     []string(r.Scopes),
+		ExpiresAt:  r.ExpiresAt,
+		CreatedAt:  r.CreatedAt,
+		LastUsedAt: r.LastUsedAt,
+	}
+}
+
+func (s *Storage) SavePersonalAccessToken(
+	ctx context.Context,
+	email string,
+	name string,
+	tokenHash string,
+	prefix string,
+	scopes []string,
+	ttl time.Duration,
+) (models.PersonalAccessToken, error) {
+	const op = "storage.postgres.SavePersonalAccessToken"
+
+	var row patRow
+	err := s.db.GetContext(
+		ctx,
+		&row,
+		`INSERT INTO personal_access_tokens (tenant_id, user_id, name, token_hash, token_prefix, scopes, expires_at)
+		SELECT tenant_id, id, $3, $4, $5, $6, now() + $7 * INTERVAL '1 millisecond'
+		FROM users WHERE email = $1 AND tenant_id = $2
+		RETURNING id, $1::TEXT AS email, name, token_prefix, scopes, expires_at, created_at, last_used_at`,
+		email,
+		tenant.ID(ctx),
+		name,
+		tokenHash,
+		prefix,
+		pq.StringArray(scopes),
+		ttl.Milliseconds(),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.PersonalAccessToken{}, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+		return models.PersonalAccessToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return row.token(), nil
+}
+
+// PersonalAccessTokens returns the tokens of the user that were not revoked, expired ones included
+func (s *Storage) PersonalAccessTokens(
+	ctx context.Context,
+	email string,
+) ([]models.PersonalAccessToken, error) {
+	const op = "storage.postgres.PersonalAccessTokens"
+
+	var rows []patRow
+	err := s.db.SelectContext(
+		ctx,
+		&rows,
+		`SELECT p.id, u.email, p.name, p.token_prefix, p.scopes, p.expires_at, p.created_at, p.last_used_at
+		FROM personal_access_tokens p
+		JOIN users u ON u.id = p.user_id
+		WHERE u.email = $1 AND u.tenant_id = $2 AND p.revoked_at IS NULL
+		ORDER BY p.id`,
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	tokens := make([]models.PersonalAccessToken, 0, len(rows))
+	for _, r := range rows {
+		tokens = append(tokens, r.token())
+	}
+
+	return tokens, nil
+}
+
+func (s *Storage) RevokePersonalAccessToken(
+	ctx context.Context,
+	email string,
+	id int64,
+) error {
+	const op = "storage.postgres.RevokePersonalAccessToken"
+
+	res, err := s.db.ExecContext(
+		ctx,
+		`UPDATE personal_access_tokens SET revoked_at = now()
+		WHERE id = $1 AND revoked_at IS NULL
+		AND user_id = (SELECT id FROM users WHERE email = $2 AND tenant_id = $3)`,
+		id,
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrTokenNotFound)
+	}
+
+	return nil
+}
+
+// UsePersonalAccessToken returns the active token with the hash and marks it used
+func (s *Storage) UsePersonalAccessToken(
+	ctx context.Context,
+	tokenHash string,
+) (models.PersonalAccessToken, error) {
+	const op = "storage.postgres.UsePersonalAccessToken"
+
+	var row patRow
+	err := s.db.GetContext(
+		ctx,
+		&row,
+		`UPDATE personal_access_tokens p SET last_used_at = now()
+		FROM users u
+		WHERE u.id = p.user_id AND p.token_hash = $1 AND p.tenant_id = $2
+		AND p.revoked_at IS NULL AND p.expires_at > now()
+		RETURNING p.id, u.email, p.name, p.token_prefix, p.scopes, p.expires_at, p.created_at, p.last_used_at`,
+		tokenHash,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.PersonalAccessToken{}, fmt.Errorf("%s: %w", op, storage.ErrTokenNotFound)
+		}
+		return models.PersonalAccessToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return row.token(), nil
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/tenant"
 	"vieo/auth/internal/storage"
 
 	"github.com/jmoiron/sqlx"
@@ -38,9 +39,10 @@ func (s *Storage) SaveUser(
 
 	err := s.db.QueryRowContext(
 		ctx,
-		"INSERT INTO users (email, password) VALUES ($1, $2) RETURNING id",
+		"INSERT INTO users (email, password, tenant_id) VALUES ($1, $2, $3) RETURNING id",
 		email,
 		passHash,
+		tenant.ID(ctx),
 	).Scan(&lastInsertIndex)
 
 	if err != nil {
@@ -62,7 +64,8 @@ func (s *Storage) User(
 	const op = "storage.postgres.User"
 
 	var user models.User
-	err := s.db.GetContext(ctx, &user, "SELECT * FROM users WHERE email = $1", email)
+	err := s.db.GetContext(ctx, &user, `SELECT id, email, password, registration_time, password_reset_required, tenant_id
+		FROM users WHERE email = $1 AND tenant_id = $2`, email, tenant.ID(ctx))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return models.User{}, fmt.Errorf("%s: user not found: %w", op, storage.ErrUserNotFound)
@@ -75,33 +78,54 @@ func (s *Storage) User(
 
 }
 
+// SaveDevice registers the device for the user, created is false if the device was already known
 func (s *Storage) SaveDevice(
 	ctx context.Context,
 	email string,
 	device string,
-) error {
+) (created bool, err error) {
 	const op = "storage.postgres.SaveDevice"
 
-	_, err := s.db.ExecContext(ctx, "INSERT INTO devices (email, device_name) VALUES ($1, $2)", email, device)
+	_, err = s.db.ExecContext(
+		ctx,
+		"INSERT INTO devices (email, device_name, tenant_id) VALUES ($1, $2, $3)",
+		email,
+		device,
+		tenant.ID(ctx),
+	)
 	if err != nil {
 		var pqErr *pq.Error
 		if errors.As(err, &pqErr) {
 			switch pqErr.Code {
 			case "23505":
 				// the user logged in from another browser, the access token is not there, we just generate a new one for him
-				return nil
+				return false, nil
 			case "23503":
-				return fmt.Errorf("%s: user not found for email: %w", op, storage.ErrUserNotFound)
-			case "P0001":
-				if pqErr.Message == fmt.Sprintf("Exceeded limit of 5 devices for the same email: %s", email) {
-					return fmt.Errorf("%s: %w", op, storage.ErrDeviceLimitExceeded)
-				}
+				return false, fmt.Errorf("%s: user not found for email: %w", op, storage.ErrUserNotFound)
 			}
 		}
+		if limitErr := deviceLimitError(email, err); limitErr != nil {
+			return false, fmt.Errorf("%s: %w", op, limitErr)
+		}
 
-		return fmt.Errorf("%s: %w", op, err)
+		return false, fmt.Errorf("%s: %w", op, err)
 	}
 
+	return true, nil
+}
+
+// deviceLimitError maps the errors the device limit triggers raise, nil for any other error
+func deviceLimitError(email string, err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "P0001" {
+		return nil
+	}
+	if pqErr.Message == fmt.Sprintf("Exceeded limit of 5 devices for the same email: %s", email) {
+		return storage.ErrDeviceLimitExceeded
+	}
+	if pqErr.Message == "Exceeded household device limit" {
+		return storage.ErrHouseholdDeviceLimitExceeded
+	}
 	return nil
 }
 
@@ -114,9 +138,10 @@ func (s *Storage) Device(
 
 	var exists bool
 	err := s.db.QueryRowContext(ctx,
-		"SELECT EXISTS (SELECT 1 FROM devices WHERE email = $1 AND device_name = $2)",
+		"SELECT EXISTS (SELECT 1 FROM devices WHERE email = $1 AND device_name = $2 AND tenant_id = $3)",
 		email,
 		device,
+		tenant.ID(ctx),
 	).Scan(&exists)
 	if err != nil {
 		return fmt.Errorf("%s: failed to execute query: %w", op, err)
@@ -128,3 +153,101 @@ func (s *Storage) Device(
 
 	return nil
 }
+
+func (s *Storage) DeleteDevice(
+	ctx context.Context,
+	email string,
+	device string,
+) error {
+	const op = "storage.postgres.DeleteDevice"
+
+	res, err := s.db.ExecContext(
+		ctx,
+		"DELETE FROM devices WHERE email = $1 AND device_name = $2 AND tenant_id = $3",
+		email,
+		device,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrDeviceNotFound)
+	}
+
+	return nil
+}
+
+// DeleteDevices removes all devices of the user, so none of their tokens can be refreshed
+func (s *Storage) DeleteDevices(
+	ctx context.Context,
+	email string,
+) error {
+	const op = "storage.postgres.DeleteDevices"
+
+	_, err := s.db.ExecContext(ctx, "DELETE FROM devices WHERE email = $1 AND tenant_id = $2", email, tenant.ID(ctx))
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (s *Storage) SetPasswordResetRequired(
+	ctx context.Context,
+	email string,
+) error {
+	const op = "storage.postgres.SetPasswordResetRequired"
+
+	res, err := s.db.ExecContext(
+		ctx,
+		"UPDATE users SET password_reset_required = TRUE WHERE email = $1 AND tenant_id = $2",
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+
+	return nil
+}
+
+// UpdatePassword sets a new password hash and lifts the reset requirement
+func (s *Storage) UpdatePassword(
+	ctx context.Context,
+	email string,
+	passHash []byte,
+) error {
+	const op = "storage.postgres.UpdatePassword"
+
+	res, err := s.db.ExecContext(
+		ctx,
+		"UPDATE users SET password = $2, password_reset_required = FALSE WHERE email = $1 AND tenant_id = $3",
+		email,
+		passHash,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+
+	return nil
+}
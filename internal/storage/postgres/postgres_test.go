@@ -0,0 +1,32 @@
+package postgre
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+	"vieo/auth/internal/lib/tenant"
+)
+
+// testStorage connects to the database of TEST_STORAGE_PATH, the test is skipped without one
+func testStorage(t *testing.T) *Storage {
+	t.Helper()
+
+	path := os.Getenv("TEST_STORAGE_PATH")
+	if path == "" {
+		t.Skip("TEST_STORAGE_PATH is not set")
+	}
+	s, err := New(path)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { _ = s.db.Close() })
+	return s
+}
+
+// tenantContext scopes ctx to a tenant no earlier run has used
+func tenantContext(name string) context.Context {
+	id := fmt.Sprintf("%s-%d", name, time.Now().UnixNano())
+	return tenant.NewContext(context.Background(), tenant.Tenant{ID: id})
+}
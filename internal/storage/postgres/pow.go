@@ -0,0 +1,36 @@
+package postgre
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"vieo/auth/internal/storage"
+)
+
+// SaveStamp records the nonce of a solved proof of work stamp until it expires.
+// A nonce seen before is ErrStampReplayed
+func (s *Storage) SaveStamp(
+	ctx context.Context,
+	nonce string,
+	expiresAt time.Time,
+) error {
+	const op = "storage.postgres.SaveStamp"
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM pow_stamps WHERE expires_at < now()"); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	res, err := s.db.ExecContext(
+		ctx,
+		"INSERT INTO pow_stamps (nonce, expires_at) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		nonce,
+		expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrStampReplayed)
+	}
+
+	return nil
+}
@@ -0,0 +1,281 @@
+package postgre
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+
+	"github.com/lib/pq"
+)
+
+const profileColumns = "p.id, p.name, p.avatar_key, p.maturity_rating, p.pin_hash, p.pin_failures, p.pin_locked_until, p.created_at"
+
+type profileRow struct {
+	ID             int64      `db:"id"`
+	Name           string     `db:"name"`
+	AvatarKey      string     `db:"avatar_key"`
+	MaturityRating string     `db:"maturity_rating"`
+	PINHash        string     `db:"pin_hash"`
+	PINFailures    int        `db:"pin_failures"`
+	PINLockedUntil *time.Time `db:"pin_locked_until"`
+	CreatedAt      time.Time  `db:"created_at"`
+}
+
+func (r profileRow) profile() models.Profile {
+	return models.Profile{
+		ID:             r.ID,
+		Name:           r.Name,
+		AvatarKey:      r.AvatarKey,
+		MaturityRating: r.MaturityRating,
+		PINHash:        r.PINHash,
+		PINFailures:    r.PINFailures,
+		PINLockedUntil: r.PINLockedUntil,
+		CreatedAt:      r.CreatedAt,
+	}
+}
+
+// SaveProfile adds a profile to the account unless it already has maxProfiles of them, 0 is unlimited
+func (s *Storage) SaveProfile(
+	ctx context.Context,
+	email string,
+	profile models.Profile,
+	maxProfiles int,
+) (models.Profile, error) {
+	const op = "storage.postgres.SaveProfile"
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return models.Profile{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	// the user row is locked so that concurrent creations cannot both pass the limit
+	var userID int64
+	err = tx.GetContext(
+		ctx,
+		&userID,
+		"SELECT id FROM users WHERE email = $1 AND tenant_id = $2 FOR UPDATE",
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Profile{}, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+		return models.Profile{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if maxProfiles > 0 {
+		var count int
+		if err := tx.GetContext(ctx, &count, "SELECT count(*) FROM profiles WHERE user_id = $1", userID); err != nil {
+			return models.Profile{}, fmt.Errorf("%s: %w", op, err)
+		}
+		if count >= maxProfiles {
+			return models.Profile{}, fmt.Errorf("%s: %w", op, storage.ErrProfileLimitExceeded)
+		}
+	}
+
+	var row profileRow
+	err = tx.GetContext(
+		ctx,
+		&row,
+		`INSERT INTO profiles AS p (user_id, name, avatar_key, maturity_rating, pin_hash)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+profileColumns,
+		userID,
+		profile.Name,
+		profile.AvatarKey,
+		profile.MaturityRating,
+		profile.PINHash,
+	)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return models.Profile{}, fmt.Errorf("%s: %w", op, storage.ErrProfileAlreadyExists)
+		}
+		return models.Profile{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return models.Profile{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return row.profile(), nil
+}
+
+// Profiles returns the profiles of the account, oldest first
+func (s *Storage) Profiles(
+	ctx context.Context,
+	email string,
+) ([]models.Profile, error) {
+	const op = "storage.postgres.Profiles"
+
+	var rows []profileRow
+	err := s.db.SelectContext(
+		ctx,
+		&rows,
+		`SELECT `+profileColumns+`
+		FROM profiles p JOIN users u ON u.id = p.user_id
+		WHERE u.email = $1 AND u.tenant_id = $2
+		ORDER BY p.created_at, p.id`,
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	profiles := make([]models.Profile, 0, len(rows))
+	for _, r := range rows {
+		profiles = append(profiles, r.profile())
+	}
+	return profiles, nil
+}
+
+// Profile returns the profile if it belongs to the account
+func (s *Storage) Profile(
+	ctx context.Context,
+	email string,
+	id int64,
+) (models.Profile, error) {
+	const op = "storage.postgres.Profile"
+
+	var row profileRow
+	err := s.db.GetContext(
+		ctx,
+		&row,
+		`SELECT `+profileColumns+`
+		FROM profiles p JOIN users u ON u.id = p.user_id
+		WHERE p.id = $1 AND u.email = $2 AND u.tenant_id = $3`,
+		id,
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Profile{}, fmt.Errorf("%s: %w", op, storage.ErrProfileNotFound)
+		}
+		return models.Profile{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return row.profile(), nil
+}
+
+// UpdateProfile replaces the name, avatar, rating and PIN hash of the profile of the account
+func (s *Storage) UpdateProfile(
+	ctx context.Context,
+	email string,
+	profile models.Profile,
+) (models.Profile, error) {
+	const op = "storage.postgres.UpdateProfile"
+
+	var row profileRow
+	err := s.db.GetContext(
+		ctx,
+		&row,
+		`UPDATE profiles p SET name = $3, avatar_key = $4, maturity_rating = $5, pin_hash = $6,
+			pin_failures = CASE WHEN p.pin_hash = $6 THEN p.pin_failures ELSE 0 END,
+			pin_locked_until = CASE WHEN p.pin_hash = $6 THEN p.pin_locked_until END
+		FROM users u
+		WHERE p.id = $1 AND u.id = p.user_id AND u.email = $2 AND u.tenant_id = $7
+		RETURNING `+profileColumns,
+		profile.ID,
+		email,
+		profile.Name,
+		profile.AvatarKey,
+		profile.MaturityRating,
+		profile.PINHash,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Profile{}, fmt.Errorf("%s: %w", op, storage.ErrProfileNotFound)
+		}
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return models.Profile{}, fmt.Errorf("%s: %w", op, storage.ErrProfileAlreadyExists)
+		}
+		return models.Profile{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return row.profile(), nil
+}
+
+// DeleteProfile removes the profile of the account
+func (s *Storage) DeleteProfile(
+	ctx context.Context,
+	email string,
+	id int64,
+) error {
+	const op = "storage.postgres.DeleteProfile"
+
+	res, err := s.db.ExecContext(
+		ctx,
+		`DELETE FROM profiles p USING users u
+		WHERE p.id = $1 AND u.id = p.user_id AND u.email = $2 AND u.tenant_id = $3`,
+		id,
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrProfileNotFound)
+	}
+
+	return nil
+}
+
+// FailProfilePIN counts a wrong PIN, the maxFailures-th in a row locks the PIN for lockFor
+func (s *Storage) FailProfilePIN(
+	ctx context.Context,
+	id int64,
+	maxFailures int,
+	lockFor time.Duration,
+) error {
+	const op = "storage.postgres.FailProfilePIN"
+
+	_, err := s.db.ExecContext(
+		ctx,
+		`UPDATE profiles SET
+			pin_failures = CASE WHEN pin_failures + 1 >= $2 THEN 0 ELSE pin_failures + 1 END,
+			pin_locked_until = CASE WHEN pin_failures + 1 >= $2
+				THEN now() + $3 * INTERVAL '1 millisecond' ELSE pin_locked_until END
+		WHERE id = $1`,
+		id,
+		maxFailures,
+		lockFor.Milliseconds(),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// ResetProfilePIN clears the wrong PIN count after the right PIN
+func (s *Storage) ResetProfilePIN(
+	ctx context.Context,
+	id int64,
+) error {
+	const op = "storage.postgres.ResetProfilePIN"
+
+	_, err := s.db.ExecContext(
+		ctx,
+		"UPDATE profiles SET pin_failures = 0, pin_locked_until = NULL WHERE id = $1 AND pin_failures > 0",
+		id,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
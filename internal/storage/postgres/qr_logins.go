@@ -0,0 +1,148 @@
+package postgre
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+)
+
+type qrLoginRow struct {
+	ID            string         `db:"id"`
+	SecretHash    string         `db:"secret_hash"`
+	DeviceAddress string         `db:"device_address"`
+	Status        string         `db:"status"`
+	Email         sql.NullString `db:"email"`
+	ExpiresAt     time.Time      `db:"expires_at"`
+}
+
+func (r qrLoginRow) login() models.QRLogin {
+	return models.QRLogin{
+		ID:            r.ID,
+		SecretHash:    r.SecretHash,
+		DeviceAddress: r.DeviceAddress,
+		Status:        r.Status,
+		Email:         r.Email.String,
+		ExpiresAt:     r.ExpiresAt,
+	}
+}
+
+// SaveQRLogin stores a pending QR login, expired ones are dropped on the way
+func (s *Storage) SaveQRLogin(
+	ctx context.Context,
+	login models.QRLogin,
+	ttl time.Duration,
+) error {
+	const op = "storage.postgres.SaveQRLogin"
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM qr_logins WHERE expires_at < now()"); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO qr_logins (id, tenant_id, secret_hash, device_address, expires_at)
+		VALUES ($1, $2, $3, $4, now() + $5 * INTERVAL '1 millisecond')`,
+		login.ID,
+		tenant.ID(ctx),
+		login.SecretHash,
+		login.DeviceAddress,
+		ttl.Milliseconds(),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// QRLogin returns the QR login, expired ones too so that the TV learns it expired
+func (s *Storage) QRLogin(
+	ctx context.Context,
+	id string,
+) (models.QRLogin, error) {
+	const op = "storage.postgres.QRLogin"
+
+	var row qrLoginRow
+	err := s.db.GetContext(
+		ctx,
+		&row,
+		`SELECT q.id, q.secret_hash, q.device_address, q.status, u.email, q.expires_at
+		FROM qr_logins q LEFT JOIN users u ON u.id = q.user_id
+		WHERE q.id = $1 AND q.tenant_id = $2`,
+		id,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.QRLogin{}, fmt.Errorf("%s: %w", op, storage.ErrQRLoginNotFound)
+		}
+		return models.QRLogin{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return row.login(), nil
+}
+
+// ApproveQRLogin binds a pending, unexpired QR login to the user
+func (s *Storage) ApproveQRLogin(
+	ctx context.Context,
+	id string,
+	email string,
+) error {
+	const op = "storage.postgres.ApproveQRLogin"
+
+	res, err := s.db.ExecContext(
+		ctx,
+		`UPDATE qr_logins q SET status = 'approved', user_id = u.id
+		FROM users u
+		WHERE q.id = $1 AND q.tenant_id = $2 AND q.status = 'pending' AND q.expires_at > now()
+			AND u.email = $3 AND u.tenant_id = q.tenant_id`,
+		id,
+		tenant.ID(ctx),
+		email,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrQRLoginNotFound)
+	}
+
+	return nil
+}
+
+// ConsumeQRLogin deletes the approved QR login and returns the email of the user who approved it,
+// so that only one watcher gets the token
+func (s *Storage) ConsumeQRLogin(
+	ctx context.Context,
+	id string,
+) (string, error) {
+	const op = "storage.postgres.ConsumeQRLogin"
+
+	var email string
+	err := s.db.GetContext(
+		ctx,
+		&email,
+		`DELETE FROM qr_logins q USING users u
+		WHERE q.id = $1 AND q.tenant_id = $2 AND q.status = 'approved' AND u.id = q.user_id
+		RETURNING u.email`,
+		id,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("%s: %w", op, storage.ErrQRLoginNotFound)
+		}
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return email, nil
+}
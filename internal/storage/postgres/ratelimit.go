@@ -0,0 +1,84 @@
+package postgre
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// UpdateRateLimitBucket locks the bucket row, passes its tokens and the time since the last update
+// to update and saves the result. A missing bucket starts with initial tokens
+func (s *Storage) UpdateRateLimitBucket(
+	ctx context.Context,
+	key string,
+	initial float64,
+	update func(tokens float64, elapsed time.Duration) float64,
+) error {
+	const op = "storage.postgres.UpdateRateLimitBucket"
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO rate_limit_buckets (key, tokens, updated_at) VALUES ($1, $2, now()) ON CONFLICT (key) DO NOTHING",
+		key,
+		initial,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	var (
+		tokens    float64
+		elapsedMs float64
+	)
+	err = tx.QueryRowContext(
+		ctx,
+		`SELECT tokens, GREATEST(EXTRACT(EPOCH FROM (now() - updated_at)) * 1000, 0)
+		FROM rate_limit_buckets WHERE key = $1 FOR UPDATE`,
+		key,
+	).Scan(&tokens, &elapsedMs)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	left := update(tokens, time.Duration(elapsedMs)*time.Millisecond)
+
+	_, err = tx.ExecContext(ctx, "UPDATE rate_limit_buckets SET tokens = $2, updated_at = now() WHERE key = $1", key, left)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (s *Storage) DeleteIdleRateLimitBuckets(
+	ctx context.Context,
+	idle time.Duration,
+) (int64, error) {
+	const op = "storage.postgres.DeleteIdleRateLimitBuckets"
+
+	res, err := s.db.ExecContext(
+		ctx,
+		"DELETE FROM rate_limit_buckets WHERE updated_at < now() - $1 * INTERVAL '1 millisecond'",
+		idle.Milliseconds(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,147 @@
+package postgre
+
+import (
+	"context"
+	"fmt"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/tenant"
+)
+
+const tupleColumns = "namespace, object_id, relation, subject_namespace, subject_object_id, subject_relation"
+
+// WriteRelationTuples creates and deletes tuples in one revision and returns it.
+// Writing a tuple that exists or deleting one that does not is not an error
+func (s *Storage) WriteRelationTuples(
+	ctx context.Context,
+	writes []models.RelationTuple,
+	deletes []models.RelationTuple,
+) (int64, error) {
+	const op = "storage.postgres.WriteRelationTuples"
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	// the head row lock orders the writers, so revisions commit in the order they were taken
+	var rev int64
+	err = tx.GetContext(ctx, &rev, "UPDATE relation_tuple_head SET rev = rev + 1 RETURNING rev")
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	tenantID := tenant.ID(ctx)
+	for _, t := range deletes {
+		_, err = tx.ExecContext(
+			ctx,
+			`UPDATE relation_tuples SET deleted_rev = $7
+			WHERE (`+tupleColumns+`) = ($1, $2, $3, $4, $5, $6) AND tenant_id = $8 AND deleted_rev IS NULL`,
+			t.Object.Namespace, t.Object.ID, t.Relation,
+			t.Subject.Namespace, t.Subject.ID, t.Subject.Relation,
+			rev, tenantID,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	for _, t := range writes {
+		_, err = tx.ExecContext(
+			ctx,
+			`INSERT INTO relation_tuples (`+tupleColumns+`, created_rev, tenant_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (tenant_id, `+tupleColumns+`) WHERE deleted_rev IS NULL DO NOTHING`,
+			t.Object.Namespace, t.Object.ID, t.Relation,
+			t.Subject.Namespace, t.Subject.ID, t.Subject.Relation,
+			rev, tenantID,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return rev, nil
+}
+
+// HeadRevision returns the revision of the latest write
+func (s *Storage) HeadRevision(ctx context.Context) (int64, error) {
+	const op = "storage.postgres.HeadRevision"
+
+	var rev int64
+	if err := s.db.GetContext(ctx, &rev, "SELECT rev FROM relation_tuple_head"); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return rev, nil
+}
+
+// RelationTuples returns the subjects that had the relation to the object at the revision
+func (s *Storage) RelationTuples(
+	ctx context.Context,
+	object models.Object,
+	relation string,
+	rev int64,
+) ([]models.RelationTuple, error) {
+	const op = "storage.postgres.RelationTuples"
+
+	var rows []models.TupleRow
+	err := s.db.SelectContext(
+		ctx,
+		&rows,
+		`SELECT `+tupleColumns+` FROM relation_tuples
+		WHERE namespace = $1 AND object_id = $2 AND relation = $3 AND tenant_id = $5
+		AND created_rev <= $4 AND (deleted_rev IS NULL OR deleted_rev > $4)
+		ORDER BY id`,
+		object.Namespace,
+		object.ID,
+		relation,
+		rev,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return tuples(rows), nil
+}
+
+// SubjectTuples returns the tuples whose subject is the object or a userset of it at the revision,
+// the reverse of RelationTuples
+func (s *Storage) SubjectTuples(
+	ctx context.Context,
+	subject models.Object,
+	rev int64,
+) ([]models.RelationTuple, error) {
+	const op = "storage.postgres.SubjectTuples"
+
+	var rows []models.TupleRow
+	err := s.db.SelectContext(
+		ctx,
+		&rows,
+		`SELECT `+tupleColumns+` FROM relation_tuples
+		WHERE subject_namespace = $1 AND subject_object_id = $2 AND tenant_id = $4
+		AND created_rev <= $3 AND (deleted_rev IS NULL OR deleted_rev > $3)
+		ORDER BY id`,
+		subject.Namespace,
+		subject.ID,
+		rev,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return tuples(rows), nil
+}
+
+func tuples(rows []models.TupleRow) []models.RelationTuple {
+	res := make([]models.RelationTuple, 0, len(rows))
+	for _, r := range rows {
+		res = append(res, r.Tuple())
+	}
+	return res
+}
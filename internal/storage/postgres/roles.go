@@ -0,0 +1,210 @@
+package postgre
+
+import (
+	"context"
+	"fmt"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+
+	"github.com/lib/pq"
+)
+
+// UserAccess returns the role names of the user and the permissions granted by them
+func (s *Storage) UserAccess(
+	ctx context.Context,
+	email string,
+) ([]string, []string, error) {
+	const op = "storage.postgres.UserAccess"
+
+	roles := []string{}
+	err := s.db.SelectContext(
+		ctx,
+		&roles,
+		`SELECT r.name FROM roles r
+		JOIN user_roles ur ON ur.role_id = r.id
+		JOIN users u ON u.id = ur.user_id
+		WHERE u.email = $1 AND u.tenant_id = $2
+		ORDER BY r.name`,
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	permissions := []string{}
+	err = s.db.SelectContext(
+		ctx,
+		&permissions,
+		`SELECT DISTINCT p.name FROM permissions p
+		JOIN role_permissions rp ON rp.permission_id = p.id
+		JOIN user_roles ur ON ur.role_id = rp.role_id
+		JOIN users u ON u.id = ur.user_id
+		WHERE u.email = $1 AND u.tenant_id = $2
+		ORDER BY p.name`,
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return roles, permissions, nil
+}
+
+// AssignRole gives the role to the user, assigning it twice is not an error
+func (s *Storage) AssignRole(
+	ctx context.Context,
+	email string,
+	role string,
+) error {
+	const op = "storage.postgres.AssignRole"
+
+	userID, roleID, err := s.userAndRole(ctx, email, role)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	_, err = s.db.ExecContext(
+		ctx,
+		"INSERT INTO user_roles (user_id, role_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		userID,
+		roleID,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// RevokeRole takes the role from the user, revoking a role the user does not have is not an error
+func (s *Storage) RevokeRole(
+	ctx context.Context,
+	email string,
+	role string,
+) error {
+	const op = "storage.postgres.RevokeRole"
+
+	userID, roleID, err := s.userAndRole(ctx, email, role)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	_, err = s.db.ExecContext(ctx, "DELETE FROM user_roles WHERE user_id = $1 AND role_id = $2", userID, roleID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (s *Storage) userAndRole(ctx context.Context, email string, role string) (int64, int64, error) {
+	var ids struct {
+		UserID *int64 `db:"user_id"`
+		RoleID *int64 `db:"role_id"`
+	}
+	err := s.db.GetContext(
+		ctx,
+		&ids,
+		`SELECT
+			(SELECT id FROM users WHERE email = $1 AND tenant_id = $3) AS user_id,
+			(SELECT id FROM roles WHERE name = $2) AS role_id`,
+		email,
+		role,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+	if ids.UserID == nil {
+		return 0, 0, storage.ErrUserNotFound
+	}
+	if ids.RoleID == nil {
+		return 0, 0, storage.ErrRoleNotFound
+	}
+
+	return *ids.UserID, *ids.RoleID, nil
+}
+
+// BootstrapAdmins gives the admin role to the registered users among emails while the tenant
+// has no admin. The bootstrap is recorded once it granted the role or the tenant has an admin,
+// until then every call tries again, so an admin registering after the first start gets the role
+// on the next one. It returns the emails that got the role, none once the bootstrap is recorded
+func (s *Storage) BootstrapAdmins(
+	ctx context.Context,
+	emails []string,
+) ([]string, error) {
+	const op = "storage.postgres.BootstrapAdmins"
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	var done bool
+	err = tx.GetContext(
+		ctx,
+		&done,
+		"SELECT EXISTS (SELECT 1 FROM admin_bootstraps WHERE tenant_id = $1)",
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if done {
+		return nil, nil
+	}
+
+	granted := []string{}
+	err = tx.SelectContext(
+		ctx,
+		&granted,
+		`WITH granted AS (
+			INSERT INTO user_roles (user_id, role_id)
+			SELECT u.id, r.id FROM users u CROSS JOIN roles r
+			WHERE u.email = ANY($1) AND u.tenant_id = $2 AND r.name = $3
+				AND NOT EXISTS (
+					SELECT 1 FROM user_roles ur JOIN users a ON a.id = ur.user_id
+					WHERE ur.role_id = r.id AND a.tenant_id = $2
+				)
+			ON CONFLICT DO NOTHING
+			RETURNING user_id
+		)
+		SELECT u.email FROM users u JOIN granted g ON g.user_id = u.id ORDER BY u.email`,
+		pq.Array(emails),
+		tenant.ID(ctx),
+		models.RoleAdmin,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// while none of the emails is registered and nobody else is admin, the next start tries again
+	res, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO admin_bootstraps (tenant_id)
+		SELECT $1 WHERE EXISTS (
+			SELECT 1 FROM user_roles ur JOIN users u ON u.id = ur.user_id JOIN roles r ON r.id = ur.role_id
+			WHERE u.tenant_id = $1 AND r.name = $2
+		)
+		ON CONFLICT DO NOTHING`,
+		tenant.ID(ctx),
+		models.RoleAdmin,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	// nothing to record, or another replica recorded the bootstrap meanwhile and its grants win
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return granted, nil
+}
@@ -0,0 +1,109 @@
+package postgre
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/tenant"
+)
+
+func TestRolesAreScopedToTheTenant(t *testing.T) {
+	s := testStorage(t)
+	const email = "alice@example.com"
+	a, b := tenantContext("a"), tenantContext("b")
+	for _, ctx := range []context.Context{a, b} {
+		if _, err := s.SaveUser(ctx, email, []byte("hash")); err != nil {
+			t.Fatalf("SaveUser in %s: %v", tenant.ID(ctx), err)
+		}
+	}
+
+	if err := s.AssignRole(a, email, models.RoleAdmin); err != nil {
+		t.Fatalf("AssignRole: %v", err)
+	}
+
+	roles, permissions, err := s.UserAccess(a, email)
+	if err != nil || !slices.Contains(roles, models.RoleAdmin) || len(permissions) == 0 {
+		t.Errorf("UserAccess in tenant a = %v, %v, %v, want the admin role", roles, permissions, err)
+	}
+	// the same email in tenant b is another user, the role of tenant a grants it nothing
+	roles, permissions, err = s.UserAccess(b, email)
+	if err != nil || len(roles) != 0 || len(permissions) != 0 {
+		t.Errorf("UserAccess in tenant b = %v, %v, %v, want nothing", roles, permissions, err)
+	}
+}
+
+func TestBootstrapAdminsPerTenant(t *testing.T) {
+	s := testStorage(t)
+	const email = "alice@example.com"
+	a, b := tenantContext("a"), tenantContext("b")
+	for _, ctx := range []context.Context{a, b} {
+		if _, err := s.SaveUser(ctx, email, []byte("hash")); err != nil {
+			t.Fatalf("SaveUser in %s: %v", tenant.ID(ctx), err)
+		}
+	}
+
+	granted, err := s.BootstrapAdmins(a, []string{email})
+	if err != nil || !slices.Equal(granted, []string{email}) {
+		t.Fatalf("BootstrapAdmins in tenant a = %v, %v, want %s", granted, err, email)
+	}
+	if granted, err := s.BootstrapAdmins(a, []string{email}); err != nil || len(granted) != 0 {
+		t.Errorf("second BootstrapAdmins in tenant a = %v, %v, want none", granted, err)
+	}
+	// tenant b bootstraps its own admins, the admin of tenant a does not count
+	if roles, _, err := s.UserAccess(b, email); err != nil || len(roles) != 0 {
+		t.Errorf("UserAccess in tenant b before its bootstrap = %v, %v, want nothing", roles, err)
+	}
+	if granted, err := s.BootstrapAdmins(b, []string{email}); err != nil || !slices.Equal(granted, []string{email}) {
+		t.Errorf("BootstrapAdmins in tenant b = %v, %v, want %s", granted, err, email)
+	}
+}
+
+func TestBootstrapAdminsRegisteredAfterTheFirstStart(t *testing.T) {
+	s := testStorage(t)
+	ctx := tenantContext("bootstrap")
+	const email = "alice@example.com"
+
+	// the admin of the config has not registered yet, nothing is granted nor recorded
+	if granted, err := s.BootstrapAdmins(ctx, []string{email}); err != nil || len(granted) != 0 {
+		t.Fatalf("BootstrapAdmins before the registration = %v, %v, want none", granted, err)
+	}
+	if _, err := s.SaveUser(ctx, email, []byte("hash")); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+
+	// the restart grants the role, the one after it does not grant again
+	if granted, err := s.BootstrapAdmins(ctx, []string{email}); err != nil || !slices.Equal(granted, []string{email}) {
+		t.Fatalf("BootstrapAdmins after the registration = %v, %v, want %s", granted, err, email)
+	}
+	if roles, _, err := s.UserAccess(ctx, email); err != nil || !slices.Contains(roles, models.RoleAdmin) {
+		t.Errorf("UserAccess = %v, %v, want the admin role", roles, err)
+	}
+	if granted, err := s.BootstrapAdmins(ctx, []string{email}); err != nil || len(granted) != 0 {
+		t.Errorf("third BootstrapAdmins = %v, %v, want none", granted, err)
+	}
+}
+
+func TestBootstrapAdminsWithAnAdmin(t *testing.T) {
+	s := testStorage(t)
+	ctx := tenantContext("bootstrap")
+	for _, email := range []string{"admin@example.com", "late@example.com"} {
+		if _, err := s.SaveUser(ctx, email, []byte("hash")); err != nil {
+			t.Fatalf("SaveUser %s: %v", email, err)
+		}
+	}
+	if err := s.AssignRole(ctx, "admin@example.com", models.RoleAdmin); err != nil {
+		t.Fatalf("AssignRole: %v", err)
+	}
+
+	// the tenant has an admin, the bootstrap is recorded without granting anything
+	if granted, err := s.BootstrapAdmins(ctx, []string{"nobody@example.com"}); err != nil || len(granted) != 0 {
+		t.Fatalf("BootstrapAdmins = %v, %v, want none", granted, err)
+	}
+	if err := s.RevokeRole(ctx, "admin@example.com", models.RoleAdmin); err != nil {
+		t.Fatalf("RevokeRole: %v", err)
+	}
+	if granted, err := s.BootstrapAdmins(ctx, []string{"late@example.com"}); err != nil || len(granted) != 0 {
+		t.Errorf("BootstrapAdmins after the recorded bootstrap = %v, %v, want none", granted, err)
+	}
+}
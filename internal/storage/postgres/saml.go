@@ -0,0 +1,128 @@
+package postgre
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+)
+
+// SaveSAMLLogin stores the SAML sign in started at an identity provider for ttl, expired ones are removed
+func (s *Storage) SaveSAMLLogin(
+	ctx context.Context,
+	login models.SAMLLogin,
+	ttl time.Duration,
+) error {
+	const op = "storage.postgres.SaveSAMLLogin"
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM saml_logins WHERE expires_at < now()"); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO saml_logins (relay_state_hash, tenant_id, connection, request_id, device_address, expires_at)
+		VALUES ($1, $2, $3, $4, $5, now() + $6 * INTERVAL '1 millisecond')`,
+		login.RelayStateHash,
+		tenant.ID(ctx),
+		login.Connection,
+		login.RequestID,
+		login.DeviceAddress,
+		ttl.Milliseconds(),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// ConsumeSAMLLogin removes and returns the unexpired sign in of the relay state, a relay state is used once
+func (s *Storage) ConsumeSAMLLogin(
+	ctx context.Context,
+	relayStateHash string,
+) (models.SAMLLogin, error) {
+	const op = "storage.postgres.ConsumeSAMLLogin"
+
+	var login models.SAMLLogin
+	err := s.db.GetContext(
+		ctx,
+		&login,
+		`DELETE FROM saml_logins WHERE relay_state_hash = $1 AND tenant_id = $2 AND expires_at > now()
+		RETURNING relay_state_hash, connection, request_id, device_address, expires_at`,
+		relayStateHash,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.SAMLLogin{}, fmt.Errorf("%s: %w", op, storage.ErrSAMLLoginNotFound)
+		}
+		return models.SAMLLogin{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return login, nil
+}
+
+// SaveAssertion records the assertion of the identity provider of the connection until it expires.
+// An assertion seen before is ErrAssertionReplayed
+func (s *Storage) SaveAssertion(
+	ctx context.Context,
+	connection string,
+	assertionID string,
+	expiresAt time.Time,
+) error {
+	const op = "storage.postgres.SaveAssertion"
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM saml_assertions WHERE expires_at < now()"); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	res, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO saml_assertions (connection, assertion_id, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`,
+		connection,
+		assertionID,
+		expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrAssertionReplayed)
+	}
+
+	return nil
+}
+
+// UpdateUserMetadata writes the values into the metadata of the user, replacing the ones it has
+func (s *Storage) UpdateUserMetadata(
+	ctx context.Context,
+	email string,
+	metadata map[string]string,
+) error {
+	const op = "storage.postgres.UpdateUserMetadata"
+
+	values, err := json.Marshal(nonNilMetadata(metadata))
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	res, err := s.db.ExecContext(
+		ctx,
+		"UPDATE users SET metadata = metadata || $1::JSONB WHERE email = $2 AND tenant_id = $3",
+		string(values),
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+
+	return nil
+}
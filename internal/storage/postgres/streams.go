@@ -0,0 +1,209 @@
+package postgre
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/lib/tenant"
+	"vieo/auth/internal/storage"
+
+	"github.com/lib/pq"
+)
+
+const streamColumns = "s.id, s.device_address, s.started_at, s.last_seen_at, s.revoked_at, s.revoke_reason"
+
+// StartStreamSession opens the session unless maxStreams sessions are already active for the user,
+// or for the household when the user is in one, 0 is unlimited. Sessions without a heartbeat for
+// timeout are revoked first. Over the limit the oldest sessions are revoked and returned when
+// kickOldest is set, otherwise ErrStreamLimitExceeded is returned
+func (s *Storage) StartStreamSession(
+	ctx context.Context,
+	email string,
+	id string,
+	deviceAddress string,
+	maxStreams int,
+	kickOldest bool,
+	timeout time.Duration,
+) (models.StreamSession, []models.StreamSession, error) {
+	const op = "storage.postgres.StartStreamSession"
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return models.StreamSession{}, nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	// the user row, and the household row for a member, is locked so that concurrent starts
+	// cannot both pass the limit
+	var owner struct {
+		UserID      int64         `db:"id"`
+		HouseholdID sql.NullInt64 `db:"household_id"`
+	}
+	err = tx.GetContext(
+		ctx,
+		&owner,
+		`SELECT u.id, m.household_id FROM users u
+		LEFT JOIN household_members m ON m.user_id = u.id AND m.status = 'active'
+		WHERE u.email = $1 AND u.tenant_id = $2
+		FOR UPDATE OF u`,
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.StreamSession{}, nil, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+		return models.StreamSession{}, nil, fmt.Errorf("%s: %w", op, err)
+	}
+	scope, scopeID := "s.user_id = $1", owner.UserID
+	if owner.HouseholdID.Valid {
+		scope, scopeID = "s.household_id = $1", owner.HouseholdID.Int64
+		if _, err := tx.ExecContext(ctx, "SELECT 1 FROM households WHERE id = $1 FOR UPDATE", scopeID); err != nil {
+			return models.StreamSession{}, nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`DELETE FROM stream_sessions s WHERE `+scope+` AND s.revoked_at < now() - INTERVAL '1 day'`,
+		scopeID,
+	)
+	if err != nil {
+		return models.StreamSession{}, nil, fmt.Errorf("%s: %w", op, err)
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		`UPDATE stream_sessions s SET revoked_at = now(), revoke_reason = $3
+		WHERE `+scope+` AND s.revoked_at IS NULL AND s.last_seen_at < now() - $2 * INTERVAL '1 millisecond'`,
+		scopeID,
+		timeout.Milliseconds(),
+		models.StreamRevokedTimeout,
+	)
+	if err != nil {
+		return models.StreamSession{}, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var displaced []models.StreamSession
+	if maxStreams > 0 {
+		var active []string
+		err = tx.SelectContext(
+			ctx,
+			&active,
+			`SELECT s.id FROM stream_sessions s WHERE `+scope+` AND s.revoked_at IS NULL ORDER BY s.started_at`,
+			scopeID,
+		)
+		if err != nil {
+			return models.StreamSession{}, nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if len(active) >= maxStreams {
+			if !kickOldest {
+				return models.StreamSession{}, nil, fmt.Errorf("%s: %w", op, storage.ErrStreamLimitExceeded)
+			}
+			err = tx.SelectContext(
+				ctx,
+				&displaced,
+				`UPDATE stream_sessions s SET revoked_at = now(), revoke_reason = $2
+				WHERE s.id = ANY($1)
+				RETURNING `+streamColumns,
+				pq.Array(active[:len(active)-maxStreams+1]),
+				models.StreamRevokedDisplaced,
+			)
+			if err != nil {
+				return models.StreamSession{}, nil, fmt.Errorf("%s: %w", op, err)
+			}
+		}
+	}
+
+	var session models.StreamSession
+	err = tx.GetContext(
+		ctx,
+		&session,
+		`INSERT INTO stream_sessions AS s (id, tenant_id, user_id, household_id, device_address)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+streamColumns,
+		id,
+		tenant.ID(ctx),
+		owner.UserID,
+		owner.HouseholdID,
+		deviceAddress,
+	)
+	if err != nil {
+		return models.StreamSession{}, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.StreamSession{}, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return session, displaced, nil
+}
+
+// HeartbeatStreamSession keeps the session of the user alive and returns it. A session already
+// revoked, or silent for longer than timeout, is returned revoked instead
+func (s *Storage) HeartbeatStreamSession(
+	ctx context.Context,
+	email string,
+	id string,
+	timeout time.Duration,
+) (models.StreamSession, error) {
+	const op = "storage.postgres.HeartbeatStreamSession"
+
+	// SET sees the row as it was, so a silent session is revoked rather than revived
+	var session models.StreamSession
+	err := s.db.GetContext(
+		ctx,
+		&session,
+		`UPDATE stream_sessions s SET
+			last_seen_at = CASE WHEN s.revoked_at IS NULL AND s.last_seen_at >= now() - $4 * INTERVAL '1 millisecond'
+				THEN now() ELSE s.last_seen_at END,
+			revoked_at = CASE WHEN s.revoked_at IS NULL AND s.last_seen_at < now() - $4 * INTERVAL '1 millisecond'
+				THEN now() ELSE s.revoked_at END,
+			revoke_reason = CASE WHEN s.revoked_at IS NULL AND s.last_seen_at < now() - $4 * INTERVAL '1 millisecond'
+				THEN $5 ELSE s.revoke_reason END
+		FROM users u
+		WHERE s.user_id = u.id AND s.id = $1 AND u.email = $2 AND u.tenant_id = $3
+		RETURNING `+streamColumns,
+		id,
+		email,
+		tenant.ID(ctx),
+		timeout.Milliseconds(),
+		models.StreamRevokedTimeout,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.StreamSession{}, fmt.Errorf("%s: %w", op, storage.ErrStreamNotFound)
+		}
+		return models.StreamSession{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return session, nil
+}
+
+// DeleteStreamSession ends the session of the user, freeing its place at once
+func (s *Storage) DeleteStreamSession(
+	ctx context.Context,
+	email string,
+	id string,
+) error {
+	const op = "storage.postgres.DeleteStreamSession"
+
+	res, err := s.db.ExecContext(
+		ctx,
+		`DELETE FROM stream_sessions s USING users u
+		WHERE s.user_id = u.id AND s.id = $1 AND u.email = $2 AND u.tenant_id = $3`,
+		id,
+		email,
+		tenant.ID(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrStreamNotFound)
+	}
+
+	return nil
+}
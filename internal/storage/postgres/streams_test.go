@@ -0,0 +1,136 @@
+package postgre
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"vieo/auth/internal/domain/models"
+	"vieo/auth/internal/storage"
+)
+
+const streamTimeout = time.Minute
+
+// silence makes the session look like its last heartbeat was long ago
+func silence(t *testing.T, s *Storage, id string) {
+	t.Helper()
+
+	if _, err := s.db.Exec("UPDATE stream_sessions SET last_seen_at = now() - INTERVAL '1 hour' WHERE id = $1", id); err != nil {
+		t.Fatalf("silence %s: %v", id, err)
+	}
+}
+
+func startStream(t *testing.T, s *Storage, ctx context.Context, email, id string, maxStreams int, kickOldest bool) []models.StreamSession {
+	t.Helper()
+
+	_, displaced, err := s.StartStreamSession(ctx, email, id, "device-"+id, maxStreams, kickOldest, streamTimeout)
+	if err != nil {
+		t.Fatalf("StartStreamSession %s: %v", id, err)
+	}
+	return displaced
+}
+
+func TestStreamLimit(t *testing.T) {
+	s := testStorage(t)
+	ctx := tenantContext("streams")
+	if _, err := s.SaveUser(ctx, "alice@example.com", []byte("hash")); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+
+	startStream(t, s, ctx, "alice@example.com", "a", 2, false)
+	startStream(t, s, ctx, "alice@example.com", "b", 2, false)
+	_, _, err := s.StartStreamSession(ctx, "alice@example.com", "c", "device-c", 2, false, streamTimeout)
+	if !errors.Is(err, storage.ErrStreamLimitExceeded) {
+		t.Fatalf("StartStreamSession over the limit error = %v, want %v", err, storage.ErrStreamLimitExceeded)
+	}
+
+	// a stopped stream frees its place at once
+	if err := s.DeleteStreamSession(ctx, "alice@example.com", "a"); err != nil {
+		t.Fatalf("DeleteStreamSession: %v", err)
+	}
+	startStream(t, s, ctx, "alice@example.com", "c", 2, false)
+}
+
+func TestStreamLimitKicksTheOldest(t *testing.T) {
+	s := testStorage(t)
+	ctx := tenantContext("streams")
+	if _, err := s.SaveUser(ctx, "alice@example.com", []byte("hash")); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+
+	startStream(t, s, ctx, "alice@example.com", "a", 2, true)
+	startStream(t, s, ctx, "alice@example.com", "b", 2, true)
+	displaced := startStream(t, s, ctx, "alice@example.com", "c", 2, true)
+	if len(displaced) != 1 || displaced[0].ID != "a" || displaced[0].RevokeReason != models.StreamRevokedDisplaced {
+		t.Fatalf("displaced = %+v, want the oldest session a", displaced)
+	}
+
+	session, err := s.HeartbeatStreamSession(ctx, "alice@example.com", "a", streamTimeout)
+	if err != nil || !session.Revoked() || session.RevokeReason != models.StreamRevokedDisplaced {
+		t.Errorf("heartbeat of the displaced session = %+v, %v, want it revoked as displaced", session, err)
+	}
+	for _, id := range []string{"b", "c"} {
+		if session, err := s.HeartbeatStreamSession(ctx, "alice@example.com", id, streamTimeout); err != nil || session.Revoked() {
+			t.Errorf("heartbeat of %s = %+v, %v, want it active", id, session, err)
+		}
+	}
+}
+
+func TestSilentStreamsAreRevoked(t *testing.T) {
+	s := testStorage(t)
+	ctx := tenantContext("streams")
+	if _, err := s.SaveUser(ctx, "alice@example.com", []byte("hash")); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+
+	startStream(t, s, ctx, "alice@example.com", "a", 1, false)
+	silence(t, s, "a")
+	// the silent session does not count, a new one takes its place without kicking anything
+	if displaced := startStream(t, s, ctx, "alice@example.com", "b", 1, false); len(displaced) != 0 {
+		t.Errorf("displaced = %+v, want none", displaced)
+	}
+
+	session, err := s.HeartbeatStreamSession(ctx, "alice@example.com", "a", streamTimeout)
+	if err != nil || !session.Revoked() || session.RevokeReason != models.StreamRevokedTimeout {
+		t.Errorf("heartbeat of the silent session = %+v, %v, want it revoked on timeout", session, err)
+	}
+}
+
+func TestHeartbeatDoesNotReviveSilentStreams(t *testing.T) {
+	s := testStorage(t)
+	ctx := tenantContext("streams")
+	if _, err := s.SaveUser(ctx, "alice@example.com", []byte("hash")); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+
+	startStream(t, s, ctx, "alice@example.com", "a", 0, false)
+	silence(t, s, "a")
+	for range 2 {
+		session, err := s.HeartbeatStreamSession(ctx, "alice@example.com", "a", streamTimeout)
+		if err != nil || !session.Revoked() || session.RevokeReason != models.StreamRevokedTimeout {
+			t.Errorf("heartbeat of the silent session = %+v, %v, want it revoked on timeout", session, err)
+		}
+	}
+
+	if _, err := s.HeartbeatStreamSession(ctx, "bob@example.com", "a", streamTimeout); !errors.Is(err, storage.ErrStreamNotFound) {
+		t.Errorf("heartbeat of another user error = %v, want %v", err, storage.ErrStreamNotFound)
+	}
+}
+
+func TestHouseholdStreamsAreCountedTogether(t *testing.T) {
+	s := testStorage(t)
+	ctx := tenantContext("streams")
+	household(t, s, ctx, "owner@example.com", "member@example.com", 0)
+
+	startStream(t, s, ctx, "owner@example.com", "a", 1, false)
+	_, _, err := s.StartStreamSession(ctx, "member@example.com", "b", "device-b", 1, false, streamTimeout)
+	if !errors.Is(err, storage.ErrStreamLimitExceeded) {
+		t.Fatalf("StartStreamSession of the member error = %v, want %v", err, storage.ErrStreamLimitExceeded)
+	}
+
+	// kicking makes room in the household, the stream of the owner goes
+	displaced := startStream(t, s, ctx, "member@example.com", "b", 1, true)
+	if len(displaced) != 1 || displaced[0].ID != "a" {
+		t.Errorf("displaced = %+v, want the stream of the owner", displaced)
+	}
+}
@@ -8,4 +8,41 @@ var (
 	ErrDeviceLimitExceeded = errors.New("device limit exceeded")
 	ErrDeviceAlreadyExists = errors.New("device already exists")
 	ErrDeviceNotFound      = errors.New("device not found")
+	ErrOTPNotFound         = errors.New("one-time code not found")
+	ErrRoleNotFound        = errors.New("role not found")
+
+	ErrOrganizationNotFound            = errors.New("organization not found")
+	ErrMembershipNotFound              = errors.New("membership not found")
+	ErrLastOwner                       = errors.New("organization must keep an owner")
+	ErrMembershipAlreadyExists         = errors.New("membership already exists")
+	ErrOrganizationDeviceLimitExceeded = errors.New("organization device limit exceeded")
+	ErrTokenNotFound                   = errors.New("token not found")
+	ErrClientNotFound                  = errors.New("client not found")
+	ErrConsentNotFound                 = errors.New("consent not found")
+	ErrCodeNotFound                    = errors.New("authorization code not found")
+	ErrDeviceCodeNotFound              = errors.New("device code not found")
+	ErrUserCodeAlreadyExists           = errors.New("user code already exists")
+	ErrQRLoginNotFound                 = errors.New("qr login not found")
+	ErrProfileNotFound                 = errors.New("profile not found")
+	ErrProfileAlreadyExists            = errors.New("profile already exists")
+	ErrProfileLimitExceeded            = errors.New("profile limit exceeded")
+	ErrHouseholdNotFound               = errors.New("household not found")
+	ErrHouseholdAlreadyExists          = errors.New("already in a household")
+	ErrHouseholdMemberNotFound         = errors.New("household member not found")
+	ErrHouseholdMemberAlreadyExists    = errors.New("household member already exists")
+	ErrHouseholdFull                   = errors.New("household member limit reached")
+	ErrHouseholdDeviceLimitExceeded    = errors.New("household device limit exceeded")
+	ErrStreamNotFound                  = errors.New("stream session not found")
+	ErrStreamLimitExceeded             = errors.New("concurrent stream limit exceeded")
+	ErrGuestNotFound                   = errors.New("guest not found")
+	ErrGuestMetadataFull               = errors.New("guest metadata limit reached")
+	ErrIdentityNotFound                = errors.New("identity not found")
+	ErrIdentityAlreadyLinked           = errors.New("identity already linked")
+	ErrSocialLoginNotFound             = errors.New("social login not found")
+	ErrSAMLLoginNotFound               = errors.New("saml login not found")
+	ErrAssertionReplayed               = errors.New("saml assertion already used")
+	ErrStampReplayed                   = errors.New("proof of work stamp already used")
+	ErrClientAssertionReplayed         = errors.New("client assertion already used")
+	// ErrTokenReused is returned for a refresh token that was already rotated, its family is revoked
+	ErrTokenReused = errors.New("refresh token reused")
 )